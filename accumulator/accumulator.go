@@ -0,0 +1,70 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+// Accumulator is what both Forest and Pollard do, so code that just adds,
+// deletes and proves can work with either.
+//
+// Errors mean the same thing everywhere: if Modify errors because of what
+// it was given (an empty leaf, a delete that's out of range or repeated)
+// nothing has changed.  Errors from further in, like a pollard missing the
+// nodes it needs, can leave the accumulator half modified and it shouldn't
+// be used after.
+type Accumulator interface {
+	// Modify deletes the leaves at dels and then adds adds.  The deletes
+	// need to be proven first (IngestBatchProof for a pollard).  The
+	// UndoBlock is nil if the accumulator can't undo, like a Pollard.
+	Modify(adds []Leaf, dels []uint64) (*UndoBlock, error)
+
+	// ProveBatch proves the given leaves.  Accumulators that don't have all
+	// the leaves, like a Pollard that isn't a full pollard, error.
+	ProveBatch(hs []Hash) (BatchProof, error)
+
+	// VerifyBatchProof checks bp proves hs are all in the accumulator
+	VerifyBatchProof(hs []Hash, bp BatchProof) error
+
+	// GetRoots gives the roots, biggest tree first
+	GetRoots() []Hash
+
+	// NumLeaves is how many leaves are in the accumulator
+	NumLeaves() uint64
+
+	// HashScheme and Hasher are how the accumulator hashes
+	HashScheme() HashScheme
+	Hasher() Hasher
+
+	// Stats and ToString are for printing out
+	Stats() string
+	ToString() string
+}
+
+var (
+	_ Accumulator = (*Forest)(nil)
+	_ Accumulator = (*Pollard)(nil)
+)
+
+// checkModify checks the adds and dels for a Modify on an accumulator with
+// numLeaves leaves, before anything is changed.  dels has to be sorted.
+func checkModify(adds []Leaf, dels []uint64, numLeaves uint64) error {
+	for _, a := range adds {
+		if a.Hash == empty {
+			return fmt.Errorf("Can't add empty (all 0s) leaf to accumulator")
+		}
+	}
+	if uint64(len(dels)) > numLeaves {
+		return fmt.Errorf("can't delete %d leaves, only %d exist",
+			len(dels), numLeaves)
+	}
+	for i, dpos := range dels {
+		if dpos >= numLeaves {
+			return fmt.Errorf(
+				"Trying to delete leaf at %d, beyond max %d", dpos, numLeaves)
+		}
+		if i > 0 && dels[i-1] == dpos {
+			return fmt.Errorf("Trying to delete leaf at %d twice", dpos)
+		}
+	}
+	return nil
+}
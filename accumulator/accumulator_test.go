@@ -0,0 +1,184 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// accImpl makes a fresh Accumulator to put through the conformance tests.
+// canProve is if ProveBatch should work, and scheme and hasher are what the
+// reference forest needs to match it.
+type accImpl struct {
+	name     string
+	canProve bool
+	scheme   HashScheme
+	hasher   Hasher
+	make     func(t *testing.T) Accumulator
+}
+
+func accImpls() []accImpl {
+	return []accImpl{
+		{"ram forest", true, LegacyHash, nil, func(t *testing.T) Accumulator {
+			return NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+		}},
+		{"v1 sha256 ram forest", true, TaggedHashV1, SHA256{},
+			func(t *testing.T) Accumulator {
+				return NewForest(RamForest, nil, "", 0, TaggedHashV1, SHA256{})
+			}},
+		{"cow forest", true, LegacyHash, nil, func(t *testing.T) Accumulator {
+			dir, err := ioutil.TempDir("", "cowforest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			return NewForest(CowForest, nil, dir, 100, LegacyHash, nil)
+		}},
+		{"disk forest", true, LegacyHash, nil, func(t *testing.T) Accumulator {
+			return NewForest(DiskForest, tempForestFile(t), "", 0, LegacyHash, nil)
+		}},
+		{"cache forest", true, LegacyHash, nil, func(t *testing.T) Accumulator {
+			f := NewForest(CacheForest, tempForestFile(t), "", 0, LegacyHash, nil)
+			// few enough pages that they get evicted and read back
+			f.data.(*cacheForestData).cache.capacity = 2
+			return f
+		}},
+		{"mmap forest", true, LegacyHash, nil, func(t *testing.T) Accumulator {
+			// not every OS has it
+			probe, err := newMmapForestData(tempForestFile(t))
+			if err != nil {
+				t.Skip(err)
+			}
+			probe.close()
+			return NewForest(MmapForest, tempForestFile(t), "", 0, LegacyHash, nil)
+		}},
+		{"full pollard", true, LegacyHash, nil, func(t *testing.T) Accumulator {
+			p := NewFullPollard()
+			return &p
+		}},
+		{"pollard", false, LegacyHash, nil, func(t *testing.T) Accumulator {
+			p := NewPollard(LegacyHash, nil)
+			return &p
+		}},
+		{"v1 sha256 pollard", false, TaggedHashV1, SHA256{},
+			func(t *testing.T) Accumulator {
+				p := NewPollard(TaggedHashV1, SHA256{})
+				return &p
+			}},
+	}
+}
+
+// tempForestFile makes a forest file that's removed when t is done
+func tempForestFile(t *testing.T) *os.File {
+	file, err := ioutil.TempFile("", "forestfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		file.Close()
+		os.Remove(file.Name())
+	})
+	return file
+}
+
+// TestAccumulatorConformance runs the same simChain blocks through every
+// Accumulator, checking they all end up with the same roots as a plain ram
+// forest and that bad Modifies error without changing anything.
+func TestAccumulatorConformance(t *testing.T) {
+	for _, impl := range accImpls() {
+		for _, duration := range []uint32{0x03, 0x07, 0x1f} {
+			impl, duration := impl, duration
+			t.Run(fmt.Sprintf("%s/%x", impl.name, duration), func(t *testing.T) {
+				runConformance(t, impl, duration, 60)
+			})
+		}
+	}
+}
+
+// runConformance runs blocks simChain blocks through an impl and a ram
+// forest, failing t if they ever differ
+func runConformance(t *testing.T, impl accImpl, duration uint32, blocks int) {
+	acc := impl.make(t)
+	ref := NewForest(RamForest, nil, "", 0, impl.scheme, impl.hasher)
+	if acc.HashScheme() != impl.scheme {
+		t.Fatalf("scheme %s want %s", acc.HashScheme(), impl.scheme)
+	}
+
+	sc := newSimChainWithSeed(duration, int64(duration))
+	sc.lookahead = 4
+	for b := 0; b < blocks; b++ {
+		adds, _, delHashes := sc.NextBlock(uint32(b % 9))
+
+		bp, err := ref.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// pollards have to take in the proof before they can delete
+		if ing, ok := acc.(interface {
+			IngestBatchProof([]Hash, BatchProof, bool) error
+		}); ok {
+			err = ing.IngestBatchProof(delHashes, bp, false)
+			if err != nil {
+				t.Fatalf("block %d ingest %s", b, err.Error())
+			}
+		}
+		err = acc.VerifyBatchProof(delHashes, bp)
+		if err != nil {
+			t.Fatalf("block %d verify %s", b, err.Error())
+		}
+
+		accBP, err := acc.ProveBatch(delHashes)
+		if impl.canProve {
+			if err != nil {
+				t.Fatalf("block %d prove %s", b, err.Error())
+			}
+			if !reflect.DeepEqual(accBP, bp) {
+				t.Fatalf("block %d proof %s want %s",
+					b, accBP.ToString(), bp.ToString())
+			}
+		} else if err == nil && len(delHashes) > 0 {
+			t.Fatalf("block %d proved without being able to", b)
+		}
+
+		// none of these should do anything
+		roots := acc.GetRoots()
+		numLeaves := acc.NumLeaves()
+		bad := [][]uint64{{numLeaves}}
+		if numLeaves > 0 {
+			bad = append(bad, []uint64{0, 0})
+		}
+		for _, dels := range bad {
+			_, err = acc.Modify(nil, dels)
+			if err == nil {
+				t.Fatalf("block %d deleted %v of %d leaves", b, dels, numLeaves)
+			}
+		}
+		_, err = acc.Modify([]Leaf{{}}, nil)
+		if err == nil {
+			t.Fatalf("block %d added an empty leaf", b)
+		}
+		if acc.NumLeaves() != numLeaves ||
+			!reflect.DeepEqual(acc.GetRoots(), roots) {
+			t.Fatalf("block %d failed Modify changed things", b)
+		}
+
+		_, err = ref.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = acc.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatalf("block %d modify %s", b, err.Error())
+		}
+		if acc.NumLeaves() != ref.NumLeaves() {
+			t.Fatalf("block %d have %d leaves want %d",
+				b, acc.NumLeaves(), ref.NumLeaves())
+		}
+		if !reflect.DeepEqual(acc.GetRoots(), ref.GetRoots()) {
+			t.Fatalf("block %d roots differ", b)
+		}
+	}
+}
@@ -246,7 +246,8 @@ type targPos struct {
 
 // verifyBatchProof verifies a batchproof by checking against the set of known
 // correct roots.
-// Takes a BatchProof, the accumulator roots, and the number of leaves in the forest.
+// Takes a BatchProof, the accumulator roots, the number of leaves in the forest
+// and the scheme and hasher the forest hashes with.
 // Returns wether or not the proof verified correctly, the partial proof tree,
 // and the subset of roots that was computed.
 //
@@ -256,7 +257,8 @@ type targPos struct {
 //
 // TODO OH WAIT -- this is not how to to it!  Don't hash all the way up to the
 // roots to verify -- just hash up to any populated node!  Saves a ton of CPU!
-func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeaves uint64,
+func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash,
+	numLeaves uint64, scheme HashScheme, hasher Hasher,
 	// cached should be a function that fetches nodes from the pollard and
 	// indicates whether they exist or not, this is only useful for the pollard
 	// and nil should be passed for the forest.
@@ -329,9 +331,10 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 		// this is the case if its the last leaf (pos==numLeaves-1)
 		// AND the tree has a root at row 0 (numLeaves&1==1)
 		if targets[0] == numLeaves-1 && numLeaves&1 == 1 {
-			// target is the row 0 root, append it to the root candidates.
+			// target is the row 0 root, append it to the root candidates
+			// so it gets checked against the actual root.
 			rootCandidates = append(rootCandidates,
-				node{Val: roots[len(roots)-1], Pos: targets[0]})
+				node{Val: targetHashes[0], Pos: targets[0]})
 			break
 		}
 
@@ -404,6 +407,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 
 		// check if the parent is cached
 		parentPos := parent(target.Pos, rows)
+		row := detectRow(parentPos, rows)
 		isParentCached, cachedParent := cached(parentPos)
 
 		var hash Hash
@@ -427,7 +431,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 					return nil, nil, err
 				}
 			} else {
-				hash = parentHash(left.Val, right.Val)
+				hash = scheme.parentHash(hasher, left.Val, right.Val, row)
 				if hash != cachedParent {
 					// The calculated hash did not match the cached parent.
 					err := fmt.Errorf("verifyBatchProof: calculated parent hash of %x doesn't"+
@@ -437,7 +441,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 				}
 			}
 		} else {
-			hash = parentHash(left.Val, right.Val)
+			hash = scheme.parentHash(hasher, left.Val, right.Val, row)
 		}
 
 		// sort the miniTrees by which tree they are in
@@ -450,7 +454,6 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 			rightChild: right,
 		})
 
-		row := detectRow(parentPos, rows)
 		if numLeaves&(1<<row) > 0 && parentPos == rootPosition(numLeaves, row, rows) {
 			// the parent is a root -> store as candidate, to check against
 			// actual roots later.
@@ -489,9 +492,13 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 }
 
 // Reconstruct takes a number of leaves and rows, and turns a block proof back
-// into a partial proof tree. Should leave bp intact
-func (bp *BatchProof) Reconstruct(
-	numleaves uint64, forestRows uint8) (map[uint64]Hash, error) {
+// into a partial proof tree. Should leave bp intact.
+// If targetHashes are given (in the same order as bp.Targets), the targets
+// go in the tree too, along with every parent that can be hashed from there
+// up to the roots, using scheme and hasher.  With nil targetHashes it's just
+// the proof.
+func (bp *BatchProof) Reconstruct(numleaves uint64, forestRows uint8,
+	targetHashes []Hash, scheme HashScheme, hasher Hasher) (map[uint64]Hash, error) {
 
 	if verbose {
 		fmt.Printf("reconstruct blockproof %d tgts %d hashes nl %d fr %d\n",
@@ -523,5 +530,146 @@ func (bp *BatchProof) Reconstruct(
 		proofTree[pos] = bp.Proof[i]
 	}
 
+	if targetHashes == nil {
+		return proofTree, nil
+	}
+	if len(targetHashes) != len(bp.Targets) {
+		return nil, fmt.Errorf("Reconstruct has %d targets but %d hashes",
+			len(bp.Targets), len(targetHashes))
+	}
+	for i, pos := range bp.Targets {
+		proofTree[pos] = targetHashes[i]
+	}
+
+	// hash up a row at a time.  Everything in row is sorted, and so are
+	// the parents made from it.
+	row := targets
+	for r := uint8(0); r < forestRows && len(row) > 0; r++ {
+		var next []uint64
+		for _, pos := range row {
+			if numleaves&(1<<r) != 0 && pos == rootPosition(numleaves, r, forestRows) {
+				continue // roots have no parent
+			}
+			par := parent(pos, forestRows)
+			if len(next) > 0 && next[len(next)-1] == par {
+				continue // already hashed from the sibling
+			}
+			l, lok := proofTree[pos&^1]
+			rt, rok := proofTree[pos|1]
+			if !lok || !rok {
+				return nil, fmt.Errorf("Reconstruct: no sibling for %d", pos)
+			}
+			proofTree[par] = scheme.parentHash(hasher, l, rt, r+1)
+			next = append(next, par)
+		}
+		row = next
+	}
+
 	return proofTree, nil
 }
+
+// Subset pulls the proof for just the targets in subset out of bp, without
+// needing the forest.  subset has to be some of bp.Targets, and targetHashes
+// are the hashes for all of bp.Targets, in the same order.  Proof positions
+// that aren't in bp.Proof get hashed up from the targets with scheme and
+// hasher.  The new proof's targets are in the order subset gives them.
+func (bp *BatchProof) Subset(subset []uint64, numLeaves uint64,
+	targetHashes []Hash, scheme HashScheme, hasher Hasher) (BatchProof, error) {
+
+	if len(subset) == 0 {
+		return BatchProof{}, nil
+	}
+	inProof := make(map[uint64]bool, len(bp.Targets))
+	for _, t := range bp.Targets {
+		inProof[t] = true
+	}
+	for _, t := range subset {
+		if !inProof[t] {
+			return BatchProof{}, fmt.Errorf("Subset: %d isn't a target", t)
+		}
+	}
+
+	rows := treeRows(numLeaves)
+	proofTree, err := bp.Reconstruct(numLeaves, rows, targetHashes, scheme, hasher)
+	if err != nil {
+		return BatchProof{}, err
+	}
+
+	sub := BatchProof{Targets: make([]uint64, len(subset))}
+	copy(sub.Targets, subset)
+	sub.Proof, err = proofFromTree(proofTree, sub.Targets, numLeaves, rows)
+	if err != nil {
+		return BatchProof{}, fmt.Errorf("Subset: %s", err.Error())
+	}
+	return sub, nil
+}
+
+// MergeBatchProofs puts proofs made at the same numLeaves together into one
+// proof, with each target and proof hash in it once.  The targets stay in
+// the order they first show up in proofs, so target hashes for the merged
+// proof go in that order too.  No hashing is needed, as every position the
+// merged proof wants is already in one of the proofs.
+func MergeBatchProofs(proofs []BatchProof, numLeaves uint64) (BatchProof, error) {
+	var merged BatchProof
+	rows := treeRows(numLeaves)
+	known := make(map[uint64]Hash)
+	seen := make(map[uint64]bool)
+
+	for i, bp := range proofs {
+		proofTree, err := bp.Reconstruct(numLeaves, rows, nil, LegacyHash, nil)
+		if err != nil {
+			return BatchProof{}, fmt.Errorf("MergeBatchProofs proof %d: %s",
+				i, err.Error())
+		}
+		for pos, h := range proofTree {
+			old, ok := known[pos]
+			if ok && old != h {
+				return BatchProof{}, fmt.Errorf(
+					"MergeBatchProofs proof %d: position %d is %x, was %x",
+					i, pos, h[:4], old[:4])
+			}
+			known[pos] = h
+		}
+		for _, t := range bp.Targets {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			merged.Targets = append(merged.Targets, t)
+		}
+	}
+	if len(merged.Targets) == 0 {
+		return merged, nil
+	}
+
+	var err error
+	merged.Proof, err = proofFromTree(known, merged.Targets, numLeaves, rows)
+	if err != nil {
+		return BatchProof{}, fmt.Errorf("MergeBatchProofs: %s", err.Error())
+	}
+	return merged, nil
+}
+
+// proofFromTree gives the proof hashes for targets out of a tree of known
+// positions, in the order verifyBatchProof wants them.
+func proofFromTree(tree map[uint64]Hash, targets []uint64,
+	numLeaves uint64, rows uint8) ([]Hash, error) {
+
+	sorted := make([]uint64, len(targets))
+	copy(sorted, targets)
+	sortUint64s(sorted)
+
+	positionList := NewPositionList()
+	defer positionList.Free()
+	ProofPositions(sorted, numLeaves, rows, &positionList.list)
+
+	proof := make([]Hash, len(positionList.list))
+	for i, pos := range positionList.list {
+		h, ok := tree[pos]
+		if !ok {
+			return nil, fmt.Errorf("no hash for position %d", pos)
+		}
+		proof[i] = h
+	}
+	return proof, nil
+}
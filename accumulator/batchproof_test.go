@@ -8,7 +8,7 @@ import (
 // TestIncompleteBatchProof tests that a incomplete (missing some hashes) batchproof does not pass verification.
 func TestIncompleteBatchProof(t *testing.T) {
 	// Create forest in memory
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	// last index to be deleted. Same as blockDels
 	lastIdx := uint64(7)
@@ -50,7 +50,7 @@ func TestIncompleteBatchProof(t *testing.T) {
 // Utreexo forest.
 func TestVerifyBatchProof(t *testing.T) {
 	// Create forest in memory
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	// last index to be deleted. Same as blockDels
 	lastIdx := uint64(7)
@@ -114,7 +114,7 @@ func TestProofShouldNotValidateAfterNodeDeleted(t *testing.T) {
 	adds[0].Hash = Hash{1} // will be deleted
 	adds[1].Hash = Hash{2} // will be proven
 
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	_, err := f.Modify(adds, nil)
 	if err != nil {
 		t.Fatal(fmt.Errorf("Modify with initial adds: %v", err))
@@ -145,3 +145,93 @@ func TestProofShouldNotValidateAfterNodeDeleted(t *testing.T) {
 			proofIndex))
 	}
 }
+
+// TestMergeAndSubsetBatchProof merges proofs for overlapping sets of leaves,
+// then takes subsets back out of the merged proof, and checks they all
+// verify against the forest
+func TestMergeAndSubsetBatchProof(t *testing.T) {
+	for _, scheme := range []HashScheme{LegacyHash, TaggedHashV1} {
+		f := NewForest(RamForest, nil, "", 0, scheme, nil)
+		sc := newSimChain(0x3f)
+		adds, _, _ := sc.NextBlock(300)
+		_, err := f.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sets := [][]int{{0, 1, 2, 77}, {2, 3, 150, 299}, {151, 40, 77}}
+		var proofs []BatchProof
+		hashes := make(map[uint64]Hash)
+		for _, set := range sets {
+			var hs []Hash
+			for _, i := range set {
+				hs = append(hs, adds[i].Hash)
+			}
+			bp, err := f.ProveBatch(hs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, pos := range bp.Targets {
+				hashes[pos] = hs[i]
+			}
+			proofs = append(proofs, bp)
+		}
+		targetHashes := func(targets []uint64) []Hash {
+			hs := make([]Hash, len(targets))
+			for i, pos := range targets {
+				hs[i] = hashes[pos]
+			}
+			return hs
+		}
+
+		merged, err := MergeBatchProofs(proofs, f.numLeaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(merged.Targets) != 9 {
+			t.Fatalf("merged %d targets, expect 9", len(merged.Targets))
+		}
+		err = f.VerifyBatchProof(targetHashes(merged.Targets), merged)
+		if err != nil {
+			t.Fatalf("merged proof: %s", err.Error())
+		}
+
+		for _, subset := range [][]uint64{
+			merged.Targets[:1], merged.Targets[2:6], merged.Targets} {
+			sub, err := merged.Subset(subset, f.numLeaves,
+				targetHashes(merged.Targets), f.scheme, f.hasher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// should be just what the forest would prove
+			want, err := f.ProveBatch(targetHashes(subset))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(sub) != fmt.Sprint(want) {
+				t.Fatalf("subset proof\n%s forest proof\n%s",
+					sub.ToString(), want.ToString())
+			}
+			err = f.VerifyBatchProof(targetHashes(sub.Targets), sub)
+			if err != nil {
+				t.Fatalf("subset proof: %s", err.Error())
+			}
+		}
+
+		_, err = merged.Subset([]uint64{5}, f.numLeaves,
+			targetHashes(merged.Targets), f.scheme, f.hasher)
+		if err == nil {
+			t.Fatal("subset with a target not in the proof")
+		}
+
+		// proofs that disagree can't be merged
+		bad := BatchProof{Targets: proofs[0].Targets,
+			Proof: make([]Hash, len(proofs[0].Proof))}
+		copy(bad.Proof, proofs[0].Proof)
+		bad.Proof[0][0] ^= 1
+		_, err = MergeBatchProofs(append(proofs, bad), f.numLeaves)
+		if err == nil {
+			t.Fatal("merged proofs that disagree")
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"time"
@@ -62,8 +63,18 @@ type Forest struct {
 	// is clearly better can go back to non-interface.
 	data ForestData
 
-	// map from hashes to positions.
-	positionMap map[MiniHash]uint64
+	// index from hashes to positions.  In ram unless SetPositionIndex
+	// gives it one on disk.
+	positionMap PositionIndex
+
+	// scheme is how leaves and parents are hashed, and hasher is the
+	// hash function it uses
+	scheme HashScheme
+	hasher Hasher
+
+	// hashWorkers is how many goroutines can hash a row at once.
+	// 0 means one per cpu.
+	hashWorkers int
 
 	/*
 	 * below are just for testing / benchmarking
@@ -94,8 +105,8 @@ type Forest struct {
 	timeInVerify time.Duration
 }
 
-// ForestType defines the 4 type of forests:
-// DiskForest, RamForest, CacheForest, CowForest
+// ForestType defines the 5 type of forests:
+// DiskForest, RamForest, CacheForest, CowForest, MmapForest
 type ForestType int
 
 const (
@@ -107,25 +118,48 @@ const (
 	//               can restart as RamForest even if you created a DiskForest. Pass
 	//               nil, as the forestFile to create a RamForest.
 	RamForest
-	// CacheForest - keeps the entire forest on disk but caches recent nodes. It's
-	//               faster than disk. Is compatible with the above two forest types.
-	//               Pass cached = true to create a cacheForest.
+	// CacheForest - keeps the entire forest on disk but caches the pages of it that
+	//               get used. It's faster than disk. Is compatible with the above two
+	//               forest types. Pass maxCache(how much MB to use in ram, 0 for 64)
+	//               to create a CacheForest, or cached = true to restore one.
 	CacheForest
 	// CowForest   - A copy-on-write (really a redirect on write) forest. It strikes
 	//               a balance between ram usage and speed. Not compatible with other
-	//               forest types though (meaning there isn't functionality implemented
-	//               to convert a CowForest to DiskForest and vise-versa). Pass a filepath
-	//               and cowMaxCache(how much MB to use in ram) to create a CowForest.
+	//               forest types as is, but CowToFlat and FlatToCow convert between
+	//               them. Pass a filepath and maxCache(how much MB to use in ram)
+	//               to create a CowForest.
 	CowForest
+	// MmapForest  - maps the DiskForest file into memory.  Close to ram speed while
+	//               the OS has the ram for it, and the same file as DiskForest so
+	//               you can switch between the two.  Pass an os.File as forestFile
+	//               to create a MmapForest.  Only on unix-like systems.
+	MmapForest
 )
 
+// HashScheme is the scheme the forest hashes with
+func (f *Forest) HashScheme() HashScheme {
+	return f.scheme
+}
+
+// Hasher is the hash function the forest hashes with
+func (f *Forest) Hasher() Hasher {
+	return f.hasher
+}
+
 // NewForest initializes a Forest and returns it. The given arguments determine
-// what type of forest it will be.
-func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMaxCache int) *Forest {
+// what type of forest it will be, and how it hashes.  A nil hasher is the
+// DefaultHasher.
+func NewForest(forestType ForestType, forestFile *os.File, cowPath string,
+	maxCache int, scheme HashScheme, hasher Hasher) *Forest {
 
 	f := new(Forest)
 	f.numLeaves = 0
 	f.rows = 0
+	f.scheme = scheme
+	f.hasher = hasher
+	if f.hasher == nil {
+		f.hasher = DefaultHasher
+	}
 
 	switch forestType {
 	case DiskForest:
@@ -135,12 +169,15 @@ func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMa
 	case RamForest:
 		f.data = new(ramForestData)
 	case CacheForest:
-		d := new(cacheForestData)
-		d.file = forestFile
-		d.cache = newDiskForestCache(20)
-		f.data = d
+		f.data = newCacheForestData(forestFile, maxCache)
 	case CowForest:
-		d, err := initialize(cowPath, cowMaxCache)
+		d, err := initialize(cowPath, maxCache)
+		if err != nil {
+			panic(err)
+		}
+		f.data = d
+	case MmapForest:
+		d, err := newMmapForestData(forestFile)
 		if err != nil {
 			panic(err)
 		}
@@ -148,7 +185,7 @@ func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMa
 	}
 
 	f.data.resize((2 << f.rows) - 1)
-	f.positionMap = make(map[MiniHash]uint64)
+	f.positionMap = make(ramPositionIndex)
 	return f
 }
 
@@ -239,8 +276,8 @@ func (f *Forest) swapNodes(s arrow, row uint8) {
 	}
 	if row == 0 {
 		f.data.swapHash(s.from, s.to)
-		f.positionMap[f.data.read(s.to).Mini()] = s.to
-		f.positionMap[f.data.read(s.from).Mini()] = s.from
+		f.positionMap.Put(f.data.read(s.to), s.to)
+		f.positionMap.Put(f.data.read(s.from), s.from)
 		return
 	}
 	a := childMany(s.from, row, f.rows)
@@ -249,8 +286,8 @@ func (f *Forest) swapNodes(s arrow, row uint8) {
 
 	// happens before the actual swap, so swapping a and b
 	for i := uint64(0); i < run; i++ {
-		f.positionMap[f.data.read(a+i).Mini()] = b + i
-		f.positionMap[f.data.read(b+i).Mini()] = a + i
+		f.positionMap.Put(f.data.read(a+i), b+i)
+		f.positionMap.Put(f.data.read(b+i), a+i)
 	}
 
 	// start at the bottom and go to the top
@@ -302,6 +339,8 @@ func (f *Forest) reHash(dirt []uint64) error {
 	// halfway up...
 
 	var currentRow, nextRow []uint64
+	var lefts, rights, pars []Hash
+	var hashPos []uint64
 
 	// floor by floor
 	for r = uint8(0); r < f.rows; r++ {
@@ -339,15 +378,30 @@ func (f *Forest) reHash(dirt []uint64) error {
 			left := right ^ 1
 			parpos := parent(left, f.rows)
 
-			if f.data.read(left) == empty || f.data.read(right) == empty {
+			// the parents in a row don't depend on each other, so gather
+			// them up and hash them all at once below
+			l, r := f.data.read(left), f.data.read(right)
+			if l == empty || r == empty {
 				f.data.write(parpos, empty)
 			} else {
-				par := parentHash(f.data.read(left), f.data.read(right))
-				f.historicHashes++
-				f.data.write(parpos, par)
+				lefts = append(lefts, l)
+				rights = append(rights, r)
+				hashPos = append(hashPos, parpos)
 			}
 			nextRow = append(nextRow, parpos)
 		}
+
+		if cap(pars) < len(hashPos) {
+			pars = make([]Hash, len(hashPos))
+		}
+		pars = pars[:len(hashPos)]
+		hashPairs(lefts, rights, pars, f.scheme, f.hasher, r+1, f.hashWorkers)
+		for i, parpos := range hashPos {
+			f.data.write(parpos, pars[i])
+		}
+		f.historicHashes += uint64(len(hashPos))
+		lefts, rights, hashPos = lefts[:0], rights[:0], hashPos[:0]
+
 		if rootRows[len(rootRows)-1] == r {
 			positionList.list = positionList.list[:len(rootRows)-1]
 			rootRows = rootRows[:len(rootRows)-1]
@@ -364,7 +418,7 @@ func (f *Forest) reHash(dirt []uint64) error {
 func (f *Forest) cleanup(overshoot uint64) {
 	for p := f.numLeaves; p < f.numLeaves+overshoot; p++ {
 		// TODO this probably does nothing. or at least should.
-		delete(f.positionMap, f.data.read(p).Mini()) // clear position map
+		f.positionMap.Delete(f.data.read(p)) // clear position map
 	}
 }
 
@@ -383,7 +437,7 @@ func (f *Forest) addv2(adds []Leaf) {
 		// reset positionList
 		positionList.list = positionList.list[:0]
 
-		f.positionMap[add.Mini()] = f.numLeaves
+		f.positionMap.Put(add.Hash, f.numLeaves)
 		getRootsForwards(f.numLeaves, f.rows, &positionList.list)
 		pos := f.numLeaves
 		n := add.Hash
@@ -394,7 +448,7 @@ func (f *Forest) addv2(adds []Leaf) {
 			rootPos := len(positionList.list) - int(h+1)
 			// grab, pop, swap, hash, new
 			root := f.data.read(positionList.list[rootPos]) // grab
-			n = parentHash(root, n)                         // hash
+			n = f.scheme.parentHash(f.hasher, root, n, h+1) // hash
 			pos = parent(pos, f.rows)                       // rise
 			f.data.write(pos, n)                            // write
 		}
@@ -409,20 +463,15 @@ func (f *Forest) addv2(adds []Leaf) {
 func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 	numdels, numadds := len(delsUn), len(adds)
 	delta := int64(numadds - numdels) // watch 32/64 bit
-	if int64(f.numLeaves)+delta < 0 {
-		return nil, fmt.Errorf("can't delete %d leaves, only %d exist",
-			len(delsUn), f.numLeaves)
-	}
 
 	// TODO for now just sort
 	dels := make([]uint64, len(delsUn))
 	copy(dels, delsUn)
 	sortUint64s(dels)
 
-	for _, a := range adds { // check for empty leaves
-		if a.Hash == empty {
-			return nil, fmt.Errorf("Can't add empty (all 0s) leaf to accumulator")
-		}
+	err := checkModify(adds, dels, f.numLeaves)
+	if err != nil {
+		return nil, err
 	}
 	// remap to expand the forest if needed
 	for int64(f.numLeaves)+delta > int64(1<<f.rows) {
@@ -434,7 +483,7 @@ func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 	}
 
 	// v3 should do the exact same thing as v2 now
-	err := f.removev4(dels)
+	err = f.removev4(dels)
 	if err != nil {
 		return nil, err
 	}
@@ -449,7 +498,12 @@ func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 
 	f.addv2(adds)
 
-	return ub, err
+	err = f.commitPositionIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return ub, nil
 }
 
 // reMap changes the rows in the forest
@@ -526,9 +580,10 @@ func (f *Forest) sanity() error {
 		}
 	}
 
-	if uint64(len(f.positionMap)) > f.numLeaves {
+	if m, ok := f.positionMap.(ramPositionIndex); ok &&
+		uint64(len(m)) > f.numLeaves {
 		return fmt.Errorf("sanity: positionMap %d leaves but forest %d leaves",
-			len(f.positionMap), f.numLeaves)
+			len(m), f.numLeaves)
 	}
 
 	return nil
@@ -537,38 +592,43 @@ func (f *Forest) sanity() error {
 // PosMapSanity is costly / slow: check that everything in posMap is correct
 func (f *Forest) PosMapSanity() error {
 	for i := uint64(0); i < f.numLeaves; i++ {
-		if f.positionMap[f.data.read(i).Mini()] != i {
+		pos, _ := f.positionMap.Get(f.data.read(i))
+		if pos != i {
 			return fmt.Errorf("positionMap error: map says %x @%d but @%d",
-				f.data.read(i).Prefix(), f.positionMap[f.data.read(i).Mini()], i)
+				f.data.read(i).Prefix(), pos, i)
 		}
 	}
 	return nil
 }
 
 // RestoreForest restores the forest on restart. Needed when resuming after exiting.
-// miscForestFile is where numLeaves and rows is stored
+// miscForestFile is where numLeaves and rows is stored.  The hasher isn't
+// saved, so it has to be the same one the forest was made with; nil is the
+// DefaultHasher.
+// mmapped maps forestFile into memory instead of reading it with pread, and
+// is ignored if toRAM is set.  maxCache is how many MB a CowForest or
+// CacheForest keeps in ram.
+// With a nil index the position index is rebuilt in ram from all the leaves.
+// Otherwise index is used, and only rebuilt if it's not for this forest.
 func RestoreForest(
 	miscForestFile *os.File, forestFile *os.File,
-	toRAM, cached bool, cow string, cowMaxCache int) (*Forest, error) {
+	toRAM, cached, mmapped bool, cow string, maxCache int,
+	hasher Hasher, index PositionIndex) (*Forest, error) {
 
 	// start a forest for restore
 	f := new(Forest)
-
-	// Restore the numLeaves
-	err := binary.Read(miscForestFile, binary.BigEndian, &f.numLeaves)
-	if err != nil {
-		return nil, err
+	f.hasher = hasher
+	if f.hasher == nil {
+		f.hasher = DefaultHasher
 	}
-	// Restore number of rows
-	// TODO optimize away "rows" and only save in minimzed form
-	// (this requires code to shrink the forest
-	binary.Read(miscForestFile, binary.BigEndian, &f.rows)
+
+	err := f.readMiscData(miscForestFile)
 	if err != nil {
 		return nil, err
 	}
 
 	if cow != "" {
-		cowData, err := loadCowForest(cow, cowMaxCache)
+		cowData, err := loadCowForest(cow, maxCache)
 		if err != nil {
 			return nil, err
 		}
@@ -596,13 +656,18 @@ func RestoreForest(
 			}
 
 			f.data = ramData
+		} else if mmapped {
+			mmapData, err := newMmapForestData(forestFile)
+			if err != nil {
+				return nil, err
+			}
+			// older disk forests might be smaller than the rows need
+			mmapData.resize((2 << f.rows) - 1)
+			f.data = mmapData
 		} else {
 			if cached {
 				// on disk, with cache
-				cfd := new(cacheForestData)
-				cfd.cache = newDiskForestCache(20)
-				cfd.file = forestFile
-				f.data = cfd
+				f.data = newCacheForestData(forestFile, maxCache)
 			} else {
 				// on disk, no cache
 				f.data = diskData
@@ -611,32 +676,64 @@ func RestoreForest(
 		}
 	}
 
-	// Restore positionMap by rebuilding from all leaves
-	f.positionMap = make(map[MiniHash]uint64)
-	for i := uint64(0); i < f.numLeaves; i++ {
-		f.positionMap[f.data.read(i).Mini()] = i
-	}
-	if f.positionMap == nil {
-		return nil, fmt.Errorf("Generated positionMap is nil")
+	if index != nil {
+		err = f.SetPositionIndex(index)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Restore positionMap by rebuilding from all leaves
+		m := make(ramPositionIndex)
+		for i := uint64(0); i < f.numLeaves; i++ {
+			m.Put(f.data.read(i), i)
+		}
+		f.positionMap = m
 	}
 
-	// for cacheForestData the `hashCount` field gets
-	// set throught the size() call.
-	f.data.size()
-
 	return f, nil
 }
 
 func (f *Forest) PrintPositionMap() string {
 	var s string
 	for pos := uint64(0); pos < f.numLeaves; pos++ {
-		l := f.data.read(pos).Mini()
-		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l, f.positionMap[l])
+		l := f.data.read(pos)
+		mapPos, _ := f.positionMap.Get(l)
+		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l.Mini(), mapPos)
 	}
 
 	return s
 }
 
+// readMiscData reads what WriteMiscData wrote: numLeaves, rows and the
+// hash scheme
+func (f *Forest) readMiscData(miscForestFile io.Reader) error {
+	// Restore the numLeaves
+	err := binary.Read(miscForestFile, binary.BigEndian, &f.numLeaves)
+	if err != nil {
+		return err
+	}
+	// Restore number of rows
+	// TODO optimize away "rows" and only save in minimzed form
+	// (this requires code to shrink the forest
+	err = binary.Read(miscForestFile, binary.BigEndian, &f.rows)
+	if err != nil {
+		return err
+	}
+	// Restore the hash scheme.  Misc files from before there were schemes
+	// end here, and those forests are all LegacyHash.
+	err = binary.Read(miscForestFile, binary.BigEndian, &f.scheme)
+	if err == io.EOF {
+		f.scheme = LegacyHash
+	} else if err != nil {
+		return err
+	}
+	err = checkHashScheme(f.scheme)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 // WriteMiscData writes the numLeaves and rows to miscForestFile
 func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
 	err := binary.Write(miscForestFile, binary.BigEndian, f.numLeaves)
@@ -649,6 +746,11 @@ func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
 		return err
 	}
 
+	err = binary.Write(miscForestFile, binary.BigEndian, f.scheme)
+	if err != nil {
+		return err
+	}
+
 	f.data.close()
 
 	return nil
@@ -656,8 +758,13 @@ func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
 
 // WriteForestToDisk writes the whole forest to disk
 // this only makes sense to do if the forest is in ram.  So it'll return
-// an error if it's not a ramForestData
+// an error if it's not a ramForestData.  A mmapped forest is already in its
+// file, so it's just synced.
 func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
+	if mmapData, ok := f.data.(*mmapForestData); ok {
+		return mmapData.sync()
+	}
+
 	// Only the RamForest needs to be written.
 	if ram {
 		ramForest, ok := f.data.(*ramForestData)
@@ -677,6 +784,11 @@ func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
 	return nil
 }
 
+// NumLeaves returns the number of leaves that the accumulator has.
+func (f *Forest) NumLeaves() uint64 {
+	return f.numLeaves
+}
+
 // GetRoots returns all the roots of all the trees in the accumulator.
 func (f *Forest) GetRoots() []Hash {
 	positionList := NewPositionList()
@@ -696,8 +808,12 @@ func (f *Forest) GetRoots() []Hash {
 // number of total leaves, historic hashes, length of the position map,
 // and the size of the forest
 func (f *Forest) Stats() string {
-	s := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %d forest: %d\n",
-		f.numLeaves, f.historicHashes, len(f.positionMap), f.data.size())
+	posmap := "disk"
+	if m, ok := f.positionMap.(ramPositionIndex); ok {
+		posmap = fmt.Sprintf("%d", len(m))
+	}
+	s := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %s forest: %d\n",
+		f.numLeaves, f.historicHashes, posmap, f.data.size())
 	s += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) proveT: %.2f",
 		f.timeInHash.Seconds(), f.timeRem.Seconds(), f.timeMST.Seconds(),
 		f.timeInProve.Seconds())
@@ -767,7 +883,7 @@ func (f *Forest) ToString() string {
 
 // FindLeaf finds a leave from the positionMap and returns a bool
 func (f *Forest) FindLeaf(leaf Hash) bool {
-	_, found := f.positionMap[leaf.Mini()]
+	_, found := f.leafPosition(leaf)
 	return found
 }
 
@@ -783,26 +899,20 @@ func (f *Forest) AssertEqual(compareForest *Forest) error {
 		return err
 	}
 
-	// Preliminary check of the position map element count before looping
-	// through all the elements in the map.
-	if len(f.positionMap) != len(compareForest.positionMap) {
-		err := fmt.Errorf("position maps sizes aren't equal"+
-			"forest: %d, compared forest : %d\n", len(f.positionMap),
-			len(compareForest.positionMap))
-		return err
-	}
-
-	// Make sure that the two maps are equal.
-	for key, val := range f.positionMap {
-		compVal, ok := compareForest.positionMap[key]
+	// Make sure that the two maps agree on every leaf.  The maps can be
+	// different kinds of index, so it's done by leaf and not by key.
+	for i := uint64(0); i < f.numLeaves; i++ {
+		key := f.data.read(i)
+		val, _ := f.positionMap.Get(key)
+		compVal, ok := compareForest.positionMap.Get(key)
 		if !ok {
-			err := fmt.Errorf("miniHash %s doesn't exist in the the compared forest",
+			err := fmt.Errorf("hash %s doesn't exist in the the compared forest",
 				hex.EncodeToString(key[:]))
 			return err
 		}
 
 		if val != compVal {
-			err := fmt.Errorf("miniHash %s returned position %d for "+
+			err := fmt.Errorf("hash %s returned position %d for "+
 				"forest but %d for the compared forest", hex.EncodeToString(key[:]),
 				val, compVal)
 			return err
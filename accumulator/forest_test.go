@@ -11,7 +11,7 @@ import (
 )
 
 func TestDeleteReverseOrder(t *testing.T) {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	leaf1 := Leaf{Hash: Hash{1}}
 	leaf2 := Leaf{Hash: Hash{2}}
 	_, err := f.Modify([]Leaf{leaf1, leaf2}, nil)
@@ -28,7 +28,7 @@ func TestDeleteReverseOrder(t *testing.T) {
 func TestForestAddDel(t *testing.T) {
 	numAdds := uint32(10)
 
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	sc := newSimChain(0x07)
 
@@ -64,8 +64,8 @@ func TestCowForestAddDelComp(t *testing.T) {
 	tmpDir := os.TempDir()
 	defer os.RemoveAll(tmpDir)
 
-	cowF := NewForest(CowForest, nil, tmpDir, 2500)
-	memF := NewForest(RamForest, nil, "", 0)
+	cowF := NewForest(CowForest, nil, tmpDir, 2500, LegacyHash, nil)
+	memF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	numAdds := uint32(1000)
 
 	sc := newSimChain(0x07)
@@ -111,7 +111,7 @@ func TestCowForestAddDel(t *testing.T) {
 	numAdds := uint32(10)
 
 	tmpDir := os.TempDir()
-	cowF := NewForest(CowForest, nil, tmpDir, 500)
+	cowF := NewForest(CowForest, nil, tmpDir, 500, LegacyHash, nil)
 
 	sc := newSimChain(0x07)
 	sc.lookahead = 400
@@ -134,7 +134,7 @@ func TestCowForestAddDel(t *testing.T) {
 }
 
 func TestForestFixed(t *testing.T) {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	numadds := 5
 	numdels := 3
 	adds := make([]Leaf, numadds)
@@ -165,7 +165,7 @@ func TestForestFixed(t *testing.T) {
 
 // Add 2. delete 1.  Repeat.
 func Test2Fwd1Back(t *testing.T) {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	var absidx uint32
 	adds := make([]Leaf, 2)
 
@@ -244,7 +244,7 @@ func addDelFullBatchProof(nAdds, nDels int) error {
 		return fmt.Errorf("too many deletes")
 	}
 
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	adds := make([]Leaf, nAdds)
 
 	for j, _ := range adds {
@@ -271,7 +271,8 @@ func addDelFullBatchProof(nAdds, nDels int) error {
 		return err
 	}
 	// check block proof.  Note this doesn't delete anything, just proves inclusion
-	_, _, err = verifyBatchProof(leavesToProve, bp, f.GetRoots(), f.numLeaves, nil)
+	_, _, err = verifyBatchProof(leavesToProve, bp, f.GetRoots(), f.numLeaves,
+		f.scheme, f.hasher, nil)
 	if err != nil {
 		return fmt.Errorf("VerifyBatchProof failed. Error: %s", err.Error())
 	}
@@ -280,7 +281,7 @@ func addDelFullBatchProof(nAdds, nDels int) error {
 }
 
 func TestDeleteNonExisting(t *testing.T) {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	deletions := []uint64{0}
 	_, err := f.Modify(nil, deletions)
 	if err == nil {
@@ -294,7 +295,7 @@ func TestSmallRandomForests(t *testing.T) {
 
 	for i := 0; i < 1000; i++ {
 		// The forest instance to test in this iteration of the loop
-		f := NewForest(RamForest, nil, "", 0)
+		f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 		// We use 'quick' to generate testing data:
 		// we interpret the keys as leaf hashes and the values
@@ -348,7 +349,8 @@ func TestSmallRandomForests(t *testing.T) {
 		deletions := make([]int, len(leavesToDeleteSet))
 		i = 0
 		for leafTxo, _ := range leavesToDeleteSet {
-			deletions[i] = int(f.positionMap[leafTxo.Mini()])
+			pos, _ := f.positionMap.Get(leafTxo.Hash)
+			deletions[i] = int(pos)
 			i++
 		}
 		sort.Ints(deletions)
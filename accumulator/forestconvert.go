@@ -0,0 +1,106 @@
+package accumulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A CowForest and a flat forest file (what DiskForest, CacheForest,
+// MmapForest and RamForest save to) hold the same positions, just laid out
+// differently, and share the same misc forest file.  So converting is just
+// reading every position out of one and writing it to the other.
+
+// CowToFlat writes the CowForest at cowPath out to flatFile.  flatFile is
+// overwritten, and the CowForest isn't changed.
+func CowToFlat(cowPath string, cowMaxCache int, flatFile *os.File) error {
+	cow, err := loadCowForest(cowPath, cowMaxCache)
+	if err != nil {
+		return fmt.Errorf("CowToFlat: %s", err.Error())
+	}
+
+	err = flatFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = flatFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(flatFile, 1<<20)
+	size := cow.size()
+	for pos := uint64(0); pos < size; pos++ {
+		h := cow.read(pos)
+		_, err = w.Write(h[:])
+		if err != nil {
+			return fmt.Errorf("CowToFlat write pos %d: %s", pos, err.Error())
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return flatFile.Sync()
+}
+
+// FlatToCow makes a new CowForest at cowPath from flatFile.  The rows come
+// from miscForestFile, since a flat file can be bigger than the forest in it.
+// There can't already be a CowForest at cowPath.
+func FlatToCow(miscForestFile io.Reader, flatFile *os.File,
+	cowPath string, cowMaxCache int) error {
+
+	if _, err := os.Stat(filepath.Join(cowPath, "CURRENT")); err == nil {
+		return fmt.Errorf("FlatToCow: already a cow forest at %s", cowPath)
+	}
+
+	misc := new(Forest)
+	err := misc.readMiscData(miscForestFile)
+	if err != nil {
+		return fmt.Errorf("FlatToCow: %s", err.Error())
+	}
+	size := uint64((2 << misc.rows) - 1)
+
+	s, err := flatFile.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(s.Size()) < size*leafSize {
+		return fmt.Errorf("FlatToCow: forest file has %d hashes, need %d",
+			s.Size()/leafSize, size)
+	}
+	_, err = flatFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	cow, err := initialize(cowPath, cowMaxCache)
+	if err != nil {
+		return err
+	}
+	// a cowForest only grows a row at a time, like when the forest remaps
+	for r := uint8(0); r <= misc.rows; r++ {
+		cow.resize((2 << r) - 1)
+	}
+
+	r := bufio.NewReaderSize(flatFile, 1<<20)
+	var h Hash
+	for pos := uint64(0); pos < size; pos++ {
+		_, err = io.ReadFull(r, h[:])
+		if err != nil {
+			return fmt.Errorf("FlatToCow read pos %d: %s", pos, err.Error())
+		}
+		// new treeBlocks are already empty
+		if h != empty {
+			cow.write(pos, h)
+		}
+	}
+
+	err = cow.commit()
+	if err != nil {
+		return err
+	}
+	return cow.clean()
+}
@@ -0,0 +1,122 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestForestConvert takes a ram forest's file to a CowForest and back to a
+// flat file, changing it along the way, and checks it matches a ram forest
+// the whole time
+func TestForestConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forestconvert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cowDir := filepath.Join(dir, "cow")
+
+	ramF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	sc := newSimChain(0x1f)
+	sc.lookahead = 10
+	// modify runs blocks through ramF, and f if it's something else
+	modify := func(f *Forest, blocks int) {
+		for b := 0; b < blocks; b++ {
+			adds, _, delHashes := sc.NextBlock(100)
+			bp, err := ramF.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f != ramF {
+				_, err = f.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = ramF.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// save writes out f's misc data, and its forest if it's in ram
+	save := func(f *Forest, name string) (*os.File, *os.File) {
+		forestFile, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		miscFile, err := os.Create(filepath.Join(dir, name+"misc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.WriteForestToDisk(forestFile, f == ramF, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.WriteMiscData(miscFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = miscFile.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return forestFile, miscFile
+	}
+
+	// flat to cow
+	modify(ramF, 60)
+	flatFile, miscFile := save(ramF, "flat")
+	err = FlatToCow(miscFile, flatFile, cowDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FlatToCow(miscFile, flatFile, cowDir, 2) == nil {
+		t.Fatal("converted over an existing cow forest")
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cowF, err := RestoreForest(
+		miscFile, nil, false, false, false, cowDir, 2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cowF.AssertEqual(ramF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and back to flat, as a disk forest
+	modify(cowF, 20)
+	_, miscFile = save(cowF, "cowmisc")
+	flatFile, err = os.Create(filepath.Join(dir, "flat2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CowToFlat(cowDir, 2, flatFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diskF, err := RestoreForest(
+		miscFile, flatFile, false, false, false, "", 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = diskF.AssertEqual(ramF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify(diskF, 20)
+	err = diskF.AssertEqual(ramF)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
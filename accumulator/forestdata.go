@@ -142,6 +142,34 @@ var (
 
 func errorCorruptManifest() error { return ErrorCorruptManifest }
 
+// cowCommitStep is a point in a cowForest commit where, if the process died,
+// the files on disk would be half way between two forests
+type cowCommitStep int
+
+const (
+	// a dirty treeTable was written
+	stepTreeTable cowCommitStep = iota
+	// the new manifest was written, but CURRENT wasn't changed
+	stepManifest
+	// CURRENT.tmp was written, but not renamed to CURRENT
+	stepCurrentTmp
+	// CURRENT points to the new manifest, the old one is still there
+	stepCurrent
+	// a stale treeTable was removed
+	stepClean
+)
+
+// cowCrashHook is for testing.  If it's set it's called at every step of a
+// commit, and an error stops the commit right there like a crash would.
+var cowCrashHook func(step cowCommitStep) error
+
+func cowCrashPoint(step cowCommitStep) error {
+	if cowCrashHook == nil {
+		return nil
+	}
+	return cowCrashHook(step)
+}
+
 // metadata holds the temporary data about the CowForest that isn't saved
 // to disk
 type metadata struct {
@@ -192,19 +220,13 @@ type manifest struct {
 
 // commit creates a new manifest version and commits it and removes the old manifest
 // The commit is atomic in that only when the commit was successful, the
-// old manifest is removed.
+// old manifest is removed.  Anything left over from a commit that didn't
+// finish is removed by removeOrphans when the forest is loaded.
 func (m *manifest) commit(basePath string) error {
 	manifestNum := m.currentManifestNum + 1
 	fName := fmt.Sprintf("MANIFEST-%06d", manifestNum)
 	fPath := filepath.Join(basePath, fName)
 
-	// Create new manifest on disk
-	fNewManifest, err := os.OpenFile(fPath, os.O_CREATE|os.O_RDWR, 0666)
-	defer fNewManifest.Close()
-	if err != nil {
-		return err
-	}
-
 	// This is the bytes to be written
 	var buf []byte
 
@@ -275,20 +297,37 @@ func (m *manifest) commit(basePath string) error {
 		fmt.Println(len(buf))
 	}
 
-	_, err = fNewManifest.Write(buf)
+	err := writeFileSync(fPath, buf)
+	if err != nil {
+		return err
+	}
+	err = cowCrashPoint(stepManifest)
 	if err != nil {
 		return err
 	}
 
-	// Overwrite the current manifest number in CURRENT
+	// Point CURRENT at the new manifest.  It's written to a temp file first
+	// and renamed over CURRENT, so CURRENT is always the old manifest or the
+	// new one, never half of each.
 	curFileName := filepath.Join(basePath, "CURRENT")
-	fCurrent, err := os.OpenFile(curFileName, os.O_CREATE|os.O_WRONLY, 0666)
-	defer fCurrent.Close()
+	tmpFileName := curFileName + ".tmp"
+	err = writeFileSync(tmpFileName, []byte(fName))
+	if err != nil {
+		return err
+	}
+	err = cowCrashPoint(stepCurrentTmp)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpFileName, curFileName)
+	if err != nil {
+		return err
+	}
+	err = syncDir(basePath)
 	if err != nil {
 		return err
 	}
-	fNameByteArray := []byte(fName)
-	_, err = fCurrent.WriteAt(fNameByteArray, 0)
+	err = cowCrashPoint(stepCurrent)
 	if err != nil {
 		return err
 	}
@@ -303,10 +342,45 @@ func (m *manifest) commit(basePath string) error {
 			return e
 		}
 	}
+	m.currentManifestNum = manifestNum
 
 	return nil
 }
 
+// writeFileSync writes b to a new file at fName (or over the old one) and
+// fsyncs it, so it's all on disk when this returns
+func writeFileSync(fName string, b []byte) error {
+	f, err := os.OpenFile(fName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir fsyncs a directory so files made or renamed in it stay that way
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
 // load loades the manifest from the disk
 func (m *manifest) load(path string) error {
 	curFileName := filepath.Join(path, "CURRENT")
@@ -322,7 +396,7 @@ func (m *manifest) load(path string) error {
 		return err
 	}
 
-	maniFName := string(manifestBytes[:])
+	maniFName := strings.TrimSpace(string(manifestBytes[:]))
 
 	maniFilePath := filepath.Join(path, maniFName)
 
@@ -345,9 +419,9 @@ func (m *manifest) load(path string) error {
 	// 45 bytes are all that's needed to load except for the locations
 	buf := make([]byte, 45)
 
-	_, err = maniFile.Read(buf)
+	_, err = io.ReadFull(maniFile, buf)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: %s", errorCorruptManifest(), err.Error())
 	}
 
 	// 1. Read forestRows
@@ -382,12 +456,12 @@ func (m *manifest) load(path string) error {
 	for {
 		sizeBuf := make([]byte, 4)
 
-		_, err := maniFile.Read(sizeBuf)
+		_, err := io.ReadFull(maniFile, sizeBuf)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return fmt.Errorf("%s: %s", errorCorruptManifest(), err.Error())
 		}
 		m.location = append(m.location, []uint64{})
 
@@ -398,9 +472,9 @@ func (m *manifest) load(path string) error {
 		}
 		rowBytes := make([]byte, rowSize*binary.MaxVarintLen64)
 
-		_, err = maniFile.Read(rowBytes)
+		_, err = io.ReadFull(maniFile, rowBytes)
 		if err != nil {
-			return err
+			return fmt.Errorf("%s: %s", errorCorruptManifest(), err.Error())
 		}
 
 		for i := uint32(0); i < rowSize; i++ {
@@ -733,8 +807,56 @@ func loadCowForest(path string, maxTreeTableCache int) (*cowForest, error) {
 
 	cow.cachedTreeTables = make(map[uint64]*cachedTreeTable)
 
+	err = cow.removeOrphans()
+	if err != nil {
+		return nil, err
+	}
+
 	return &cow, nil
 }
+
+// removeOrphans removes the files a commit or clean that didn't finish left
+// behind: treeTables and manifests the current manifest doesn't use, and
+// the temp CURRENT.
+func (cow *cowForest) removeOrphans() error {
+	inUse := make(map[uint64]bool)
+	for _, row := range cow.manifest.location {
+		for _, fileNum := range row {
+			inUse[fileNum] = true
+		}
+	}
+	curManifest := fmt.Sprintf("MANIFEST-%06d", cow.manifest.currentManifestNum)
+
+	files, err := ioutil.ReadDir(cow.meta.fBasePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		orphan := false
+		switch {
+		case name == "CURRENT.tmp":
+			orphan = true
+		case strings.HasPrefix(name, "MANIFEST-"):
+			orphan = name != curManifest
+		case strings.HasSuffix(name, extension):
+			fileNum, err := strconv.ParseUint(
+				strings.TrimSuffix(name, extension), 10, 64)
+			orphan = err == nil && !inUse[fileNum]
+		}
+		if !orphan {
+			continue
+		}
+		if verbose {
+			fmt.Printf("removing orphaned cow forest file %s\n", name)
+		}
+		err = os.Remove(filepath.Join(cow.meta.fBasePath, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (cow *cowForest) searchCache(location uint64) (*cachedTreeTable, bool) {
 	// search in the in-memory map
 	table, found := cow.cachedTreeTables[location]
@@ -835,7 +957,7 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 	// check if it exists in memory
 	table, found := cow.searchCache(location)
 
-	// if not found in memory, load then update the fileNum
+	// if not found in memory, load it
 	if !found {
 		// Load the treeTable onto memory. This maps the table to the location
 		table, err = cow.load(location)
@@ -843,7 +965,10 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 			// TODO better to return err
 			panic(err)
 		}
-
+	}
+	// A table that isn't dirty is the one the last manifest points to, so
+	// it gets a new fileNum instead of being written over
+	if !table.dirty {
 		cow.updateTableNum(table,
 			treeBlockRow, treeTableOffset, location)
 	}
@@ -1113,20 +1238,7 @@ func saveTreeTableToDisk(treeTable *treeTable, fName string) error {
 	buf := make([]byte, 0, bytesPerTable)
 	treeTable.serialize(&buf)
 
-	// actual writing to file
-	// calculate the file name
-	f, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		return err
-	}
-	_, err = f.Write(buf)
-	if err != nil {
-		return err
-	}
-
-	f.Close()
-
-	return nil
+	return writeFileSync(fName, buf)
 }
 
 // commit makes writes to the disk and sets the forest to point to the new
@@ -1134,15 +1246,24 @@ func saveTreeTableToDisk(treeTable *treeTable, fName string) error {
 func (cow *cowForest) commit() error {
 	var err error
 	for fileNum, cachedTreeTable := range cow.cachedTreeTables {
-		// only write the files that are dirty
+		// only write the files that are dirty.  They all have fileNums
+		// the last manifest doesn't use, so nothing it needs is changed.
 		if cachedTreeTable.dirty {
 			err = saveTreeTableToDisk(
 				cachedTreeTable.treeTable, cow.getTreeTableFName(fileNum))
 			if err != nil {
 				return err
 			}
+			err = cowCrashPoint(stepTreeTable)
+			if err != nil {
+				return err
+			}
 		}
 	}
+	err = syncDir(cow.meta.fBasePath)
+	if err != nil {
+		return err
+	}
 
 	err = cow.manifest.commit(cow.meta.fBasePath)
 	if err != nil {
@@ -1150,6 +1271,11 @@ func (cow *cowForest) commit() error {
 		return err
 	}
 
+	// the tables are now what the manifest points to
+	for _, cachedTreeTable := range cow.cachedTreeTables {
+		cachedTreeTable.dirty = false
+	}
+
 	return nil
 }
 
@@ -1163,6 +1289,10 @@ func (cow *cowForest) clean() error {
 		if err != nil {
 			return err
 		}
+		err = cowCrashPoint(stepClean)
+		if err != nil {
+			return err
+		}
 	}
 
 	// empty staleFiles
@@ -4,10 +4,14 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"testing/quick"
 )
@@ -133,7 +137,7 @@ func createRandomHash(i int64) [32]byte {
 func TestCowForestWrite(t *testing.T) {
 	// keep only 1 treetable in memory to force flush and
 	// test the flushing/restoring as well
-	f := NewForest(CowForest, nil, os.TempDir(), 1)
+	f := NewForest(CowForest, nil, os.TempDir(), 1, LegacyHash, nil)
 
 	numAdds := uint32(10)   // adds per block
 	sc := newSimChain(0x07) // A chain simulator
@@ -168,3 +172,130 @@ func TestCowForestWrite(t *testing.T) {
 		}
 	}
 }
+
+// TestCowForestCrash stops a cowForest commit at every step, like the
+// process died there, and checks the forest on disk loads as it was before
+// the commit or after it with nothing left over
+func TestCowForestCrash(t *testing.T) {
+	defer func() { cowCrashHook = nil }()
+	steps := []cowCommitStep{stepTreeTable, stepManifest, stepCurrentTmp,
+		stepCurrent, stepClean}
+	for _, step := range steps {
+		// crash the first or the third time the step comes up.  A step
+		// that doesn't come up that often is a commit that finished.
+		for _, nth := range []int{1, 3} {
+			testCowCrash(t, step, nth)
+		}
+	}
+}
+
+// forestSnapshot is all the positions in a ram forest
+type forestSnapshot struct {
+	rows uint8
+	m    []byte
+}
+
+func snapshot(f *Forest) forestSnapshot {
+	m := f.data.(*ramForestData).m
+	return forestSnapshot{f.rows, append([]byte{}, m...)}
+}
+
+func testCowCrash(t *testing.T, step cowCommitStep, nth int) {
+	dir, err := ioutil.TempDir("", "cowcrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cowF := NewForest(CowForest, nil, dir, 100, LegacyHash, nil)
+	ramF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	sc := newSimChain(0x07)
+	modify := func(blocks int) {
+		for b := 0; b < blocks; b++ {
+			adds, _, delHashes := sc.NextBlock(50)
+			bp, err := ramF.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []*Forest{cowF, ramF} {
+				_, err = f.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	cow := cowF.data.(*cowForest)
+
+	modify(30)
+	err = cow.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cow.clean()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := snapshot(ramF)
+	modify(20)
+	after := snapshot(ramF)
+
+	var count int
+	cowCrashHook = func(s cowCommitStep) error {
+		if s == step {
+			count++
+			if count == nth {
+				return errors.New("crash")
+			}
+		}
+		return nil
+	}
+	err = cow.commit()
+	if err == nil {
+		err = cow.clean()
+	}
+	cowCrashHook = nil
+	crashed := err != nil
+
+	want := before
+	if !crashed || step >= stepCurrent {
+		want = after
+	}
+	loaded, err := loadCowForest(dir, 100)
+	if err != nil {
+		t.Fatalf("step %d #%d load %s", step, nth, err.Error())
+	}
+	if loaded.manifest.forestRows != want.rows {
+		t.Fatalf("step %d #%d loaded %d rows, want %d",
+			step, nth, loaded.manifest.forestRows, want.rows)
+	}
+	for pos := uint64(0); pos < loaded.size(); pos++ {
+		var h Hash
+		copy(h[:], want.m[pos*leafSize:])
+		if loaded.read(pos) != h {
+			t.Fatalf("step %d #%d crashed %v pos %d differs",
+				step, nth, crashed, pos)
+		}
+	}
+
+	// only the files the manifest uses are left
+	inUse := make(map[string]bool)
+	for _, row := range loaded.manifest.location {
+		for _, fileNum := range row {
+			inUse[filepath.Base(loaded.getTreeTableFName(fileNum))] = true
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if name == "CURRENT" || inUse[name] || (strings.HasPrefix(name,
+			"MANIFEST-") && name == fmt.Sprintf("MANIFEST-%06d",
+			loaded.manifest.currentManifestNum)) {
+			continue
+		}
+		t.Fatalf("step %d #%d left %s", step, nth, name)
+	}
+}
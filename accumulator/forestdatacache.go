@@ -1,405 +1,495 @@
 package accumulator
 
 import (
+	"container/list"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 )
 
 // ********************************************* forest on disk with cache
-type diskForestCache struct {
-	// The number of leaves contained in the cached part of the forest.
-	size uint64
-	// `valid` stores which positions are set in the cache.
-	valid []bool
-	// The cache stores the forest data which is most frequently changed.
-	// Based on the ttl distribution of bitcoin utxos.
-	// (see figure 2 in the paper)
-	data []byte
+
+// The cache keeps pages of the forest file in ram.  A page is a run of
+// cachePageHashes positions, so loading or writing one is a single read or
+// write.  Which pages stay is decided with ARC (adaptive replacement cache,
+// Megiddo & Modha 2003), which splits the cache between pages used once
+// recently and pages used more than once, and moves the split depending on
+// which of the two would have had the hits.  Changed pages are only written
+// when they're evicted or the cache is flushed, and then in sorted batches
+// so runs of pages go out in one write.
+
+// cachePageHashes is how many hashes are in a page
+const cachePageHashes = 128
+
+// cachePageBytes is how big a page is
+const cachePageBytes = cachePageHashes * leafSize
+
+// cacheWriteBatch is how many evicted dirty pages are held until they're
+// all written at once.  They're on top of the pages the cache holds.
+const cacheWriteBatch = 64
+
+// defaultCacheMB is the cache size for CacheForests made with a maxCache
+// of 0
+const defaultCacheMB = 64
+
+// cachePage is a page of the forest file in ram
+type cachePage struct {
+	num   uint64
+	data  [cachePageBytes]byte
+	dirty bool
+
+	// inT2 is if the page is in t2 (used more than once) instead of t1
+	inT2 bool
+	elem *list.Element
 }
 
-// creates a new cache.
-func newDiskForestCache(trees uint64) *diskForestCache {
-	size := uint64(1 << trees)
-	fmt.Printf("newDiskForestCache: forest data cache size is set to %dMB\n",
-		((size<<1) /*valid*/ +(size<<1)*leafSize /*data*/)>>20)
+// cacheOp is what the forest was doing when it went to the cache, for stats
+type cacheOp int
 
-	return &diskForestCache{
-		size:  size,
-		valid: make([]bool, size<<1),
-		data:  make([]byte, (size<<1)*leafSize),
-	}
-}
+const (
+	cacheRead cacheOp = iota
+	cacheWrite
+	cacheSwap
+)
 
-type cacheRange struct {
-	// the start position of this range in the cache
-	startCache uint64
-	// the start position of this range in the forest
-	start uint64
-	// the amount of hashes in the range
-	count uint64
-}
+// CacheStats counts how a CacheForest's cache is doing, so it can be sized.
+// Swaps are the reads and writes done moving hashes around in swapHash and
+// swapHashRange, which is most of what remove does.
+type CacheStats struct {
+	ReadHits, ReadMisses   uint64
+	WriteHits, WriteMisses uint64
+	SwapHits, SwapMisses   uint64
 
-type cacheForestData struct {
-	file *os.File
-	// stores the size of the forest (the number of hashes stored).
-	// gets updated on every size()/resize() call.
-	hashCount uint64
+	// Evictions is how many pages were dropped to make room
+	Evictions uint64
 
-	cache *diskForestCache
+	// PagesWritten is how many dirty pages were written to disk, and
+	// Writes is how many writes that took
+	PagesWritten, Writes uint64
+
+	// Pages is how many pages are in the cache, and MaxPages how many
+	// fit.  A page is cachePageHashes hashes.
+	Pages, MaxPages int
 }
 
-// Calculates the overlap of a range (start, start+r) with the cache.
-// returns the amount of hashes of that range that are included in the cache.
-func (cache *diskForestCache) rangeOverlap(
-	start, r, hashCount uint64) (uint64, uint64) {
-	row := uint8(0)
-	rowOffset := uint64(0)
+// HitRate gives hits / (hits + misses) over all operations
+func (s CacheStats) HitRate() float64 {
+	hits := s.ReadHits + s.WriteHits + s.SwapHits
+	total := hits + s.ReadMisses + s.WriteMisses + s.SwapMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(hits) / float64(total)
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("cache %d/%d pages hit %.3f read %d/%d write %d/%d "+
+		"swap %d/%d evicted %d wrote %d pages in %d writes",
+		s.Pages, s.MaxPages, s.HitRate(),
+		s.ReadHits, s.ReadHits+s.ReadMisses,
+		s.WriteHits, s.WriteHits+s.WriteMisses,
+		s.SwapHits, s.SwapHits+s.SwapMisses,
+		s.Evictions, s.PagesWritten, s.Writes)
+}
 
-	cacheSize := cache.size
-	if cacheSize > hashCount>>1 {
-		cacheSize = hashCount >> 1
+func (s *CacheStats) count(op cacheOp, hit bool) {
+	switch {
+	case op == cacheRead && hit:
+		s.ReadHits++
+	case op == cacheRead:
+		s.ReadMisses++
+	case op == cacheWrite && hit:
+		s.WriteHits++
+	case op == cacheWrite:
+		s.WriteMisses++
+	case hit:
+		s.SwapHits++
+	default:
+		s.SwapMisses++
 	}
+}
+
+type diskForestCache struct {
+	file *os.File
 
-	hashesNotCached := uint64(0)
-	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
-		totalHashesOnRow := hashCount >> (row + 1)
-		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
+	// fileSize is how big the file is.  Pages hanging off the end aren't
+	// written past it.
+	fileSize int64
 
-		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
-		maxPosition := rowOffset + totalHashesOnRow - 1
+	// capacity is how many pages fit, and p is how many of them ARC wants
+	// t1 to have
+	capacity int
+	p        int
 
-		if start < minPosition &&
-			start+r >= minPosition {
-			return (start + r) - minPosition, (start + r) - hashesNotCached
-		}
+	// t1 has pages used once recently and t2 pages used more than once,
+	// with the most recent at the front.  b1 and b2 are the page numbers
+	// (no data) recently evicted from t1 and t2.
+	t1, t2 *list.List
+	b1, b2 *list.List
 
-		if start >= minPosition && start <= maxPosition {
-			// The whole range lies with in the cache.
-			return r, start - hashesNotCached
-		}
+	pages  map[uint64]*cachePage
+	ghost1 map[uint64]*list.Element
+	ghost2 map[uint64]*list.Element
 
-		row++
-		rowOffset += totalHashesOnRow
-	}
+	// evicted dirty pages that haven't been written yet
+	writeBack map[uint64]*cachePage
 
-	return 0, 0
+	stats CacheStats
 }
 
-// Check if a position should be included in the cache based on `cache.Size`.
-// Goes through each forest row and checks if `pos` is in the cached portion of that row.
-func (cache *diskForestCache) includes(
-	pos uint64, hashCount uint64) (included bool, cachePosition uint64) {
-	row := uint8(0)
-	rowOffset := uint64(0)
+// creates a new cache using maxMB of ram for pages.  0 is defaultCacheMB.
+func newDiskForestCache(file *os.File, maxMB int) *diskForestCache {
+	if maxMB <= 0 {
+		maxMB = defaultCacheMB
+	}
+	capacity := (maxMB << 20) / cachePageBytes
+	if capacity < 1 {
+		capacity = 1
+	}
+	fmt.Printf("newDiskForestCache: forest data cache size is set to %dMB "+
+		"(%d pages)\n", maxMB, capacity)
 
-	cacheSize := cache.size
-	if cacheSize > hashCount>>1 {
-		cacheSize = hashCount >> 1
+	return &diskForestCache{
+		file:      file,
+		capacity:  capacity,
+		t1:        list.New(),
+		t2:        list.New(),
+		b1:        list.New(),
+		b2:        list.New(),
+		pages:     make(map[uint64]*cachePage),
+		ghost1:    make(map[uint64]*list.Element),
+		ghost2:    make(map[uint64]*list.Element),
+		writeBack: make(map[uint64]*cachePage),
 	}
+}
 
-	hashesNotCached := uint64(0)
-	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
-		totalHashesOnRow := hashCount >> (row + 1)
-		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
+// page gives the page with number num, loading it if it's not in the cache
+func (c *diskForestCache) page(num uint64, op cacheOp) *cachePage {
+	if pg, ok := c.pages[num]; ok {
+		// hit, so it's been used more than once
+		c.stats.count(op, true)
+		if pg.inT2 {
+			c.t2.MoveToFront(pg.elem)
+		} else {
+			c.t1.Remove(pg.elem)
+			pg.elem = c.t2.PushFront(pg)
+			pg.inT2 = true
+		}
+		return pg
+	}
+	c.stats.count(op, false)
 
-		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
-		maxPosition := rowOffset + totalHashesOnRow - 1
+	// recently evicted from t1, so t1 should have been bigger
+	if e, ok := c.ghost1[num]; ok {
+		c.p += maxInt(c.b2.Len()/c.b1.Len(), 1)
+		if c.p > c.capacity {
+			c.p = c.capacity
+		}
+		c.replace(false)
+		c.b1.Remove(e)
+		delete(c.ghost1, num)
+		return c.load(num, true)
+	}
 
-		if pos >= minPosition && pos <= maxPosition {
-			included = true
-			cachePosition = pos - hashesNotCached
-			return
+	// recently evicted from t2, so t2 should have been bigger
+	if e, ok := c.ghost2[num]; ok {
+		c.p -= maxInt(c.b1.Len()/c.b2.Len(), 1)
+		if c.p < 0 {
+			c.p = 0
 		}
-		row++
-		rowOffset += totalHashesOnRow
+		c.replace(true)
+		c.b2.Remove(e)
+		delete(c.ghost2, num)
+		return c.load(num, true)
 	}
 
-	included = false
-	cachePosition = 0
-	return
+	// never seen (or long forgotten)
+	l1 := c.t1.Len() + c.b1.Len()
+	if l1 == c.capacity {
+		if c.t1.Len() < c.capacity {
+			c.dropGhost(c.b1, c.ghost1)
+			c.replace(false)
+		} else {
+			// b1 is empty and t1 is everything; forget its oldest
+			c.evict(c.t1.Back().Value.(*cachePage), nil, nil)
+		}
+	} else {
+		total := l1 + c.t2.Len() + c.b2.Len()
+		if total >= c.capacity {
+			if total == 2*c.capacity {
+				c.dropGhost(c.b2, c.ghost2)
+			}
+			c.replace(false)
+		}
+	}
+	return c.load(num, false)
 }
 
-// Get a hash from the cache.
-// Returns the hash found at `pos` and wether or not the cache was populated
-// at that position. If it wasn't populated it should be with the contents
-// from disk.
-// `pos` must be a cache position returned from `includes`.
-func (cache *diskForestCache) get(pos uint64) (Hash, bool) {
-	populated := cache.valid[pos]
-	if !populated {
-		return empty, false
+// replace evicts a page from t1 or t2, whichever is over what ARC wants,
+// if the cache is full
+func (c *diskForestCache) replace(inB2 bool) {
+	if c.t1.Len()+c.t2.Len() < c.capacity {
+		return
+	}
+	t1Len := c.t1.Len()
+	if t1Len > 0 && (t1Len > c.p || (inB2 && t1Len == c.p) || c.t2.Len() == 0) {
+		c.evict(c.t1.Back().Value.(*cachePage), c.b1, c.ghost1)
+	} else {
+		c.evict(c.t2.Back().Value.(*cachePage), c.b2, c.ghost2)
 	}
+}
 
-	var h Hash
-	copy(h[:], cache.data[pos*leafSize:(pos+1)*leafSize])
+// evict takes pg out of the cache, remembering its number in the ghost
+// list if there is one.  Dirty pages wait in writeBack to be written.
+func (c *diskForestCache) evict(pg *cachePage,
+	ghosts *list.List, ghostMap map[uint64]*list.Element) {
 
-	return h, true
-}
+	if pg.inT2 {
+		c.t2.Remove(pg.elem)
+	} else {
+		c.t1.Remove(pg.elem)
+	}
+	pg.elem = nil
+	delete(c.pages, pg.num)
+	c.stats.Evictions++
+	if ghosts != nil {
+		ghostMap[pg.num] = ghosts.PushFront(pg.num)
+	}
 
-// Gets a range of hashes.
-// Returns the hashes as a byte slice and unpopulated cache positions relative to `start`.
-func (cache *diskForestCache) rangeGet(start uint64, r uint64) ([]byte, []uint64) {
-	var misses []uint64
-	for check := uint64(0); check < r; check++ {
-		if !cache.valid[check+start] {
-			misses = append(misses, check)
+	if pg.dirty {
+		c.writeBack[pg.num] = pg
+		if len(c.writeBack) >= cacheWriteBatch {
+			c.writePages(c.takeWriteBack())
 		}
 	}
-
-	set := make([]byte, r*leafSize)
-	copy(set, cache.data[start*leafSize:(start+r)*leafSize])
-
-	return set, misses
 }
 
-// Set a position in the cache.
-// The previous value at that position is overwritten.
-// Will create an entry in the cache wether
-// or not it should actually be included.
-// Check inclusion first with `includes`.
-func (cache *diskForestCache) set(pos uint64, hash []byte) {
-	copy(cache.data[pos*leafSize:(pos+1)*leafSize], hash)
-	cache.valid[pos] = true
-}
+// dropGhost forgets the oldest page number in a ghost list
+func (c *diskForestCache) dropGhost(
+	ghosts *list.List, ghostMap map[uint64]*list.Element) {
 
-func (cache *diskForestCache) rangeSet(start uint64,
-	r uint64, hashes []byte) {
-	if r != uint64(len(hashes)>>5 /*divided by leafSize*/) {
-		panic(
-			fmt.Sprintf(
-				"rangeSet: range was %d but only %d hashes were given",
-				r, len(hashes)/leafSize,
-			),
-		)
+	e := ghosts.Back()
+	if e == nil {
+		return
 	}
+	ghosts.Remove(e)
+	delete(ghostMap, e.Value.(uint64))
+}
 
-	for populate := start; populate < start+r; populate++ {
-		// mark all entries in the range as populated
-		cache.valid[populate] = true
+// load puts page num at the front of t1 or t2, reading it from disk unless
+// it's still waiting to be written
+func (c *diskForestCache) load(num uint64, toT2 bool) *cachePage {
+	pg, ok := c.writeBack[num]
+	if ok {
+		delete(c.writeBack, num)
+	} else {
+		pg = &cachePage{num: num}
+		// past the end of the file is all empty
+		_, err := c.file.ReadAt(pg.data[:], int64(num*cachePageBytes))
+		if err != nil && err != io.EOF {
+			fmt.Printf("\tWARNING!! read page %d %s\n", num, err.Error())
+		}
 	}
 
-	copy(cache.data[start*leafSize:(start+r)*leafSize], hashes[:r*leafSize])
+	pg.inT2 = toT2
+	if toT2 {
+		pg.elem = c.t2.PushFront(pg)
+	} else {
+		pg.elem = c.t1.PushFront(pg)
+	}
+	c.pages[num] = pg
+	return pg
 }
 
-// Resets the cache and returns populated cache ranges.
-// sort of expensive but not needed often.
-func (cache *diskForestCache) flush(hashCount uint64) []cacheRange {
-	cacheLength := cache.size << 1
-	var entries []cacheRange
-
-	row := uint8(0)
-	rowOffset := uint64(0)
-
-	cacheSize := cache.size
-	if cacheSize > hashCount>>1 {
-		cacheSize = hashCount >> 1
+// takeWriteBack empties writeBack, giving what was in it
+func (c *diskForestCache) takeWriteBack() []*cachePage {
+	pages := make([]*cachePage, 0, len(c.writeBack))
+	for num, pg := range c.writeBack {
+		pages = append(pages, pg)
+		delete(c.writeBack, num)
 	}
+	return pages
+}
 
-	hashesNotCached := uint64(0)
-	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
-		totalHashesOnRow := hashCount >> (row + 1)
-		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
-		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
-
-		cachePosition := minPosition - hashesNotCached
-		count := uint64(0)
-		for i := uint64(0); i < hashesCachedOnRow+1; i++ {
-			// if the end of the row is reached
-			if i == hashesCachedOnRow ||
-				// or the cache is not populated at `cachePosition+i`.
-				!cache.valid[cachePosition+i] {
-				// append the range of populated entries.
-				entries = append(entries, cacheRange{
-					start:      minPosition + i - count,
-					startCache: cachePosition + i - count,
-					count:      count,
-				})
-				// reset the count
-				count = 0
-				continue
-			}
-
-			count++
+// writePages writes pages to disk, one write per run of pages next to each
+// other, and marks them clean
+func (c *diskForestCache) writePages(pages []*cachePage) {
+	sort.Slice(pages, func(a, b int) bool { return pages[a].num < pages[b].num })
+
+	var buf []byte
+	for i := 0; i < len(pages); {
+		// find the run of pages starting at i
+		j := i + 1
+		for j < len(pages) && pages[j].num == pages[j-1].num+1 {
+			j++
+		}
+		buf = buf[:0]
+		for _, pg := range pages[i:j] {
+			buf = append(buf, pg.data[:]...)
+			pg.dirty = false
 		}
 
-		row++
-		rowOffset += totalHashesOnRow
+		// don't make the file bigger than the forest asked for
+		offset := int64(pages[i].num * cachePageBytes)
+		if offset+int64(len(buf)) > c.fileSize {
+			buf = buf[:maxInt(int(c.fileSize-offset), 0)]
+		}
+		if len(buf) > 0 {
+			_, err := c.file.WriteAt(buf, offset)
+			if err != nil {
+				fmt.Printf("\tWARNING!! write page %d %s\n",
+					pages[i].num, err.Error())
+			}
+			c.stats.Writes++
+			c.stats.PagesWritten += uint64(j - i)
+		}
+		i = j
 	}
-
-	// reset the populated map
-	cache.valid = make([]bool, cacheLength)
-
-	return entries
 }
 
-// read ignores errors. Probably get an empty hash if it doesn't work
-func (d *cacheForestData) read(pos uint64) Hash {
-	var h Hash
-	inCache, cachePos := d.cache.includes(pos, d.hashCount)
-	cacheMissed := false
-
-	// Read `pos` from cache if the cache should include it.
-	if inCache {
-		h, ok := d.cache.get(cachePos)
-		if ok {
-			// The cache did hold the value at `pos`.
-			return h
+// flush writes every dirty page, both waiting and still in the cache.  The
+// pages stay in the cache.
+func (c *diskForestCache) flush() {
+	pages := c.takeWriteBack()
+	for _, pg := range c.pages {
+		if pg.dirty {
+			pages = append(pages, pg)
 		}
-		// The cache did not hold the value at `pos`.
-		cacheMissed = true
 	}
+	c.writePages(pages)
+}
 
-	// Read `pos` from disk.
-	_, err := d.file.ReadAt(h[:], int64(pos*leafSize))
-	if err != nil {
-		fmt.Printf("\tWARNING!! read %x pos %d %s\n", h, pos, err.Error())
+func maxInt(a, b int) int {
+	if a > b {
+		return a
 	}
+	return b
+}
+
+type cacheForestData struct {
+	file  *os.File
+	cache *diskForestCache
+}
 
-	if cacheMissed {
-		// Populate the cache with the value read from disk.
-		// On the next read of `pos` it will be fetched from the cache,
-		// assuming the size of the forest doesn't change.
-		// This is how the cache gets restored when the forest is restored from disk.
-		d.cache.set(cachePos, h[:])
+// newCacheForestData makes a cacheForestData over file with a maxMB cache
+func newCacheForestData(file *os.File, maxMB int) *cacheForestData {
+	d := &cacheForestData{file: file, cache: newDiskForestCache(file, maxMB)}
+	s, err := file.Stat()
+	if err == nil {
+		d.cache.fileSize = s.Size()
 	}
+	return d
+}
 
-	// `h` now holds the hash at `pos`, either read slowly from the disk
-	// or fast from the cache.
-	return h
+// get reads the hash at pos through the cache
+func (d *cacheForestData) get(pos uint64, op cacheOp) (h Hash) {
+	pg := d.cache.page(pos/cachePageHashes, op)
+	off := (pos % cachePageHashes) * leafSize
+	copy(h[:], pg.data[off:off+leafSize])
+	return
 }
 
-// writeHash writes a hash.  Don't go out of bounds.
-func (d *cacheForestData) write(pos uint64, h Hash) {
-	inCache, cachePos := d.cache.includes(pos, d.hashCount)
+// set writes h at pos in the cache.  It goes to disk when the page does.
+func (d *cacheForestData) set(pos uint64, h Hash, op cacheOp) {
+	pg := d.cache.page(pos/cachePageHashes, op)
+	off := (pos % cachePageHashes) * leafSize
+	copy(pg.data[off:off+leafSize], h[:])
+	pg.dirty = true
+}
 
-	// Write `h` to `pos` in the cache if `pos` should be included in the cache.
-	if inCache {
-		d.cache.set(cachePos, h[:])
-		return
-	}
+// read gives the hash at pos
+func (d *cacheForestData) read(pos uint64) Hash {
+	return d.get(pos, cacheRead)
+}
 
-	// Write `h` to disk if it was not included in the cache.
-	_, err := d.file.WriteAt(h[:], int64(pos*leafSize))
-	if err != nil {
-		fmt.Printf("\tWARNING!! write pos %d %s\n", pos, err.Error())
-	}
+// writeHash writes a hash.  Don't go out of bounds.
+func (d *cacheForestData) write(pos uint64, h Hash) {
+	d.set(pos, h, cacheWrite)
 }
 
 // swapHash swaps 2 hashes.  Don't go out of bounds.
 func (d *cacheForestData) swapHash(a, b uint64) {
-	ha := d.read(a)
-	hb := d.read(b)
-	d.write(a, hb)
-	d.write(b, ha)
+	ha := d.get(a, cacheSwap)
+	hb := d.get(b, cacheSwap)
+	d.set(a, hb, cacheSwap)
+	d.set(b, ha, cacheSwap)
 }
 
-// read a range from the forest.
-// reads from cache and disk.
-func (d *cacheForestData) readRange(
-	start, r uint64) (hashes []byte) {
-	// The number of hashes from the range included in the cache.
-	cacheOverlap, cacheStart := d.cache.rangeOverlap(start, r, d.hashCount)
-	// The number of hashes from the range stored on disk.
-	diskOverlap := r - cacheOverlap
-	diskPosition := int64(start * leafSize)
-
-	cacheHashes, misses := d.cache.rangeGet(cacheStart, cacheOverlap)
-
-	if len(misses) != 0 {
-		// Some entries were not in the cache and should be read from disk.
-		for _, miss := range misses {
-			diskPosition := int64((diskOverlap + miss + start) * leafSize)
-			// TODO: batch read for sequential misses.
-			_, err := d.file.ReadAt(cacheHashes[miss*leafSize:(miss+1)*leafSize], diskPosition)
-			if err != nil {
-				fmt.Printf("\tWARNING!! read pos %d %s\n", start, err.Error())
-			}
-		}
-	}
-
-	hashes = make([]byte, leafSize*diskOverlap)
-	_, err := d.file.ReadAt(hashes, diskPosition)
-	if err != nil {
-		fmt.Printf("\tWARNING!! read pos %d %s\n", start, err.Error())
+// readRange copies len(buf)/leafSize hashes starting at start into buf,
+// a page at a time
+func (d *cacheForestData) readRange(start uint64, buf []byte) {
+	for len(buf) > 0 {
+		pg := d.cache.page(start/cachePageHashes, cacheSwap)
+		off := (start % cachePageHashes) * leafSize
+		n := copy(buf, pg.data[off:])
+		buf = buf[n:]
+		start += uint64(n / leafSize)
 	}
-
-	hashes = append(hashes, cacheHashes...)
-	return
 }
 
-// write a range to the forest data.
-// Writes to the cache and the disk.
-func (d *cacheForestData) writeRange(
-	start, r uint64, hashes []byte) {
-	// calculate the cacheOverlap for the range
-	cacheOverlap, cacheStart := d.cache.rangeOverlap(start, r, d.hashCount)
-	diskOverlap := r - cacheOverlap
-	diskPosition := int64(start * leafSize)
-
-	// write the cacheoverlap of the range to the cache.
-	d.cache.rangeSet(cacheStart, cacheOverlap, hashes[diskOverlap*leafSize:])
-
-	// write the diskoverlap of the range to disk
-	_, err := d.file.WriteAt(
-		hashes[:diskOverlap*leafSize],
-		diskPosition,
-	)
-	if err != nil {
-		fmt.Printf("\tWARNING!! write pos %d %s\n", diskPosition, err.Error())
+// writeRange writes the hashes in buf starting at start, a page at a time
+func (d *cacheForestData) writeRange(start uint64, buf []byte) {
+	for len(buf) > 0 {
+		pg := d.cache.page(start/cachePageHashes, cacheSwap)
+		off := (start % cachePageHashes) * leafSize
+		n := copy(pg.data[off:], buf)
+		pg.dirty = true
+		buf = buf[n:]
+		start += uint64(n / leafSize)
 	}
 }
 
 // swapHashRange swaps 2 continuous ranges of hashes.  Don't go out of bounds.
-// uses lots of ram to make only 3 disk seeks (depending on how you count? 4?)
-// seek to a start, read a, seek to b start, read b, write b, seek to a, write a
-// depends if you count seeking from b-end to b-start as a seek. or if you have
-// like read & replace as one operation or something.
+// Goes a page worth at a time, so a small cache never has to hold both
+// whole ranges.
 func (d *cacheForestData) swapHashRange(a, b, w uint64) {
-	hashesA := d.readRange(a, w)
-	hashesB := d.readRange(b, w)
-	d.writeRange(b, w, hashesA)
-	d.writeRange(a, w, hashesB)
+	var bufA, bufB [cachePageBytes]byte
+	for w > 0 {
+		n := w
+		if n > cachePageHashes {
+			n = cachePageHashes
+		}
+		d.readRange(a, bufA[:n*leafSize])
+		d.readRange(b, bufB[:n*leafSize])
+		d.writeRange(b, bufA[:n*leafSize])
+		d.writeRange(a, bufB[:n*leafSize])
+		a += n
+		b += n
+		w -= n
+	}
 }
 
 // size gives you the size of the forest
 func (d *cacheForestData) size() uint64 {
-	s, err := d.file.Stat()
-	if err != nil {
-		fmt.Printf("\tWARNING: %s. Returning 0", err.Error())
-		return 0
-	}
-	d.hashCount = uint64(s.Size() / leafSize)
-	return d.hashCount
+	return uint64(d.cache.fileSize / leafSize)
 }
 
-// resize makes the forest bigger (never gets smaller so don't try)
+// resize makes the forest bigger (never gets smaller so don't try).  The
+// new part of the file is empty, same as the part of any page hanging
+// past the old end, so nothing in the cache changes.
 func (d *cacheForestData) resize(newSize uint64) {
 	err := d.file.Truncate(int64(newSize * leafSize))
 	if err != nil {
 		panic(err)
 	}
-
-	flushCacheToDisk(d)
-
-	d.hashCount = newSize
+	d.cache.fileSize = int64(newSize * leafSize)
 }
 
+// close writes everything in the cache to disk
 func (d *cacheForestData) close() {
-	flushCacheToDisk(d)
+	d.cache.flush()
 }
 
-func flushCacheToDisk(d *cacheForestData) {
-	// flush the entire cache to disk.
-	cacheRanges := d.cache.flush(d.hashCount)
-	// write cache entries to disk.
-	for _, r := range cacheRanges {
-		// write to disk
-		_, err := d.file.WriteAt(
-			d.cache.data[r.startCache*leafSize:(r.startCache+r.count)*leafSize],
-			int64(r.start*leafSize),
-		)
-		if err != nil {
-			fmt.Printf("\tWARNING!! write pos %d %s\n", r.start, err.Error())
-		}
+// CacheStats gives the cache stats for a CacheForest.  false if the forest
+// isn't one.
+func (f *Forest) CacheStats() (CacheStats, bool) {
+	d, ok := f.data.(*cacheForestData)
+	if !ok {
+		return CacheStats{}, false
 	}
+	s := d.cache.stats
+	s.Pages = len(d.cache.pages)
+	s.MaxPages = d.cache.capacity
+	return s, true
 }
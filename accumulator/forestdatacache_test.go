@@ -0,0 +1,104 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCacheForest runs cache forests with caches from 1 page to plenty next
+// to a ram forest, then checks what they flush to disk is the ram forest
+func TestCacheForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cacheforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, pages := range []int{1, 3, 16, 256} {
+		forestFile, err := os.Create(filepath.Join(dir, "forest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewForest(CacheForest, forestFile, "", 1, LegacyHash, nil)
+		d := f.data.(*cacheForestData)
+		d.cache.capacity = pages
+		ramF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+
+		sc := newSimChain(0x07)
+		for b := 0; b < 60; b++ {
+			adds, _, delHashes := sc.NextBlock(40)
+			bp, err := ramF.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []*Forest{f, ramF} {
+				_, err = f.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = f.AssertEqual(ramF)
+			if err != nil {
+				t.Fatalf("%d pages block %d %s", pages, b, err.Error())
+			}
+			if len(d.cache.pages) > pages {
+				t.Fatalf("%d pages in a %d page cache", len(d.cache.pages), pages)
+			}
+		}
+
+		stats, ok := f.CacheStats()
+		if !ok {
+			t.Fatal("no cache stats")
+		}
+		if pages < 16 && stats.Evictions == 0 {
+			t.Fatalf("%d page cache never evicted: %s", pages, stats)
+		}
+
+		f.data.close()
+		stats, _ = f.CacheStats()
+		if stats.PagesWritten == 0 || stats.Writes > stats.PagesWritten {
+			t.Fatalf("%d page cache flush %s", pages, stats)
+		}
+		onDisk, err := ioutil.ReadFile(forestFile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ramData := ramF.data.(*ramForestData).m
+		if string(onDisk[:len(ramData)]) != string(ramData) {
+			t.Fatalf("%d page cache flushed something else", pages)
+		}
+		forestFile.Close()
+	}
+}
+
+// TestCacheScan makes sure a scan through lots of pages used once doesn't
+// push out the pages being used over and over, which it would with LRU
+func TestCacheScan(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "cachescan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+	d := newCacheForestData(forestFile, 1)
+	d.cache.capacity = 8
+	d.resize(1000 * cachePageHashes)
+
+	hot := []uint64{0, 1, 2, 3}
+	for i := 0; i < 2; i++ {
+		for _, num := range hot {
+			d.read(num * cachePageHashes)
+		}
+	}
+	for num := uint64(100); num < 200; num++ {
+		d.read(num * cachePageHashes)
+	}
+	before := d.cache.stats.ReadHits
+	for _, num := range hot {
+		d.read(num * cachePageHashes)
+	}
+	if d.cache.stats.ReadHits-before != uint64(len(hot)) {
+		t.Fatalf("scan pushed out hot pages: %s", d.cache.stats)
+	}
+}
@@ -0,0 +1,168 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package accumulator
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ********************************************* forest mmapped from disk
+
+// mmapForestData is the forest file mapped into memory.  It's the same flat
+// file as a diskForestData, so either can restore the other, but reads and
+// writes are plain memory copies and the kernel decides what stays in ram.
+// Nothing is sure to be on disk until sync.
+type mmapForestData struct {
+	file *os.File
+	m    []byte
+}
+
+// newMmapForestData maps forestFile.  An empty file isn't mapped until the
+// first resize.
+func newMmapForestData(forestFile *os.File) (*mmapForestData, error) {
+	d := &mmapForestData{file: forestFile}
+	s, err := forestFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	err = d.mmap(s.Size())
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// mmap maps the first length bytes of the file
+func (d *mmapForestData) mmap(length int64) error {
+	if length == 0 {
+		d.m = nil
+		return nil
+	}
+	m, err := syscall.Mmap(int(d.file.Fd()), 0, int(length),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap forest: %s", err.Error())
+	}
+	d.m = m
+	return nil
+}
+
+// munmap syncs and unmaps the file
+func (d *mmapForestData) munmap() error {
+	if d.m == nil {
+		return nil
+	}
+	err := d.sync()
+	if err != nil {
+		return err
+	}
+	err = syscall.Munmap(d.m)
+	if err != nil {
+		return fmt.Errorf("munmap forest: %s", err.Error())
+	}
+	d.m = nil
+	return nil
+}
+
+// sync msyncs the whole map, returning when it's all on disk
+func (d *mmapForestData) sync() error {
+	if len(d.m) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&d.m[0])), uintptr(len(d.m)),
+		uintptr(syscall.MS_SYNC))
+	if errno != 0 {
+		return fmt.Errorf("msync forest: %s", errno.Error())
+	}
+	return nil
+}
+
+// reads from specified location.  If you read beyond the bounds that's on you
+// and it'll crash
+func (d *mmapForestData) read(pos uint64) (h Hash) {
+	pos <<= 5
+	copy(h[:], d.m[pos:pos+leafSize])
+	return
+}
+
+// writeHash writes a hash.  Don't go out of bounds.
+func (d *mmapForestData) write(pos uint64, h Hash) {
+	pos <<= 5
+	copy(d.m[pos:pos+leafSize], h[:])
+}
+
+// swapHash swaps 2 hashes.  Don't go out of bounds.
+func (d *mmapForestData) swapHash(a, b uint64) {
+	var h Hash
+	a <<= 5
+	b <<= 5
+	copy(h[:], d.m[a:a+leafSize])
+	copy(d.m[a:a+leafSize], d.m[b:b+leafSize])
+	copy(d.m[b:b+leafSize], h[:])
+}
+
+// mmapSwapChunk is how many bytes swapHashRange moves at a time
+const mmapSwapChunk = 4096
+
+// swapHashRange swaps 2 continuous ranges of hashes in place.  Don't go out
+// of bounds.  Unlike the ram forest it only needs a small buffer, since
+// ranges near the top of a big forest can be bigger than you'd want to copy.
+func (d *mmapForestData) swapHashRange(a, b, w uint64) {
+	var temp [mmapSwapChunk]byte
+	a <<= 5
+	b <<= 5
+	w <<= 5
+	for done := uint64(0); done < w; done += mmapSwapChunk {
+		n := w - done
+		if n > mmapSwapChunk {
+			n = mmapSwapChunk
+		}
+		ac, bc := a+done, b+done
+		copy(temp[:n], d.m[ac:ac+n])
+		copy(d.m[ac:ac+n], d.m[bc:bc+n])
+		copy(d.m[bc:bc+n], temp[:n])
+	}
+}
+
+// size gives you the size of the forest
+func (d *mmapForestData) size() uint64 {
+	return uint64(len(d.m) / leafSize)
+}
+
+// resize makes the forest bigger by growing the file and mapping it again.
+// A file that's already big enough (like one a diskForestData made, which
+// leaves room to grow) is left as is.
+func (d *mmapForestData) resize(newSize uint64) {
+	if newSize <= d.size() {
+		return
+	}
+	err := d.munmap()
+	if err != nil {
+		panic(err)
+	}
+	length := int64(newSize * leafSize)
+	err = d.file.Truncate(length)
+	if err != nil {
+		panic(err)
+	}
+	err = d.mmap(length)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (d *mmapForestData) close() {
+	err := d.munmap()
+	if err != nil {
+		fmt.Printf("mmapForestData close error: %s\n", err.Error())
+	}
+	err = d.file.Close()
+	if err != nil {
+		fmt.Printf("mmapForestData close error: %s\n", err.Error())
+	}
+}
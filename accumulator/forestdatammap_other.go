@@ -0,0 +1,27 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package accumulator
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// mmapForestData is only there on unix-like systems.  Elsewhere the
+// MmapForest can't be made, so none of this ever gets called.
+type mmapForestData struct{}
+
+func newMmapForestData(forestFile *os.File) (*mmapForestData, error) {
+	return nil, fmt.Errorf("mmap forest not supported on %s", runtime.GOOS)
+}
+
+func (d *mmapForestData) sync() error                  { return nil }
+func (d *mmapForestData) read(pos uint64) (h Hash)     { return }
+func (d *mmapForestData) write(pos uint64, h Hash)     {}
+func (d *mmapForestData) swapHash(a, b uint64)         {}
+func (d *mmapForestData) swapHashRange(a, b, w uint64) {}
+func (d *mmapForestData) size() uint64                 { return 0 }
+func (d *mmapForestData) resize(newSize uint64)        {}
+func (d *mmapForestData) close()                       {}
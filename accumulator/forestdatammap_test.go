@@ -0,0 +1,166 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestMmapSwapHashRange swaps ranges bigger and smaller than mmapSwapChunk
+// and checks they end up like they do in a ram forest
+func TestMmapSwapHashRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmapforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := os.Create(filepath.Join(dir, "forest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMmapForestData(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.close()
+	r := new(ramForestData)
+	m.resize(1024)
+	r.resize(1024)
+	for i := uint64(0); i < 1024; i++ {
+		h := createRandomHash(int64(i))
+		m.write(i, h)
+		r.write(i, h)
+	}
+
+	for _, s := range [][3]uint64{{0, 512, 512}, {3, 600, 130}, {10, 20, 1}} {
+		m.swapHashRange(s[0], s[1], s[2])
+		r.swapHashRange(s[0], s[1], s[2])
+		m.swapHash(s[0]+1, s[1]+3)
+		r.swapHash(s[0]+1, s[1]+3)
+		if !reflect.DeepEqual(m.m, r.m) {
+			t.Fatalf("swap %v differs from ram", s)
+		}
+	}
+}
+
+// TestMmapForest runs a mmap forest next to a ram forest, then restores its
+// file as a disk forest and the other way around
+func TestMmapForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmapforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forestPath := filepath.Join(dir, "forest")
+	miscPath := filepath.Join(dir, "misc")
+
+	forestFile, err := os.Create(forestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForest(MmapForest, forestFile, "", 0, LegacyHash, nil)
+	ramF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	sc := newSimChain(0x07)
+
+	// modify runs blocks through f and ramF
+	modify := func(f *Forest, blocks int) {
+		for b := 0; b < blocks; b++ {
+			adds, _, delHashes := sc.NextBlock(20)
+			bp, err := ramF.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range []*Forest{f, ramF} {
+				_, err = f.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = f.AssertEqual(ramF)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+		}
+	}
+	// save closes f's file and opens it again as a different type
+	save := func(f *Forest, mmapped bool) *Forest {
+		err := f.WriteForestToDisk(nil, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		miscFile, err := os.Create(miscPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.WriteMiscData(miscFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = miscFile.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forestFile, err := os.OpenFile(forestPath, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreForest(
+			miscFile, forestFile, false, false, mmapped, "", 0, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(restored.GetRoots(), ramF.GetRoots()) {
+			t.Fatal("restored roots differ")
+		}
+		return restored
+	}
+
+	modify(f, 50)
+	f = save(f, false)
+	modify(f, 50)
+	f = save(f, true)
+	modify(f, 50)
+	f.data.close()
+}
+
+func BenchmarkForestData_Disk(b *testing.B)  { benchmarkForestData(DiskForest, b) }
+func BenchmarkForestData_Cache(b *testing.B) { benchmarkForestData(CacheForest, b) }
+func BenchmarkForestData_Mmap(b *testing.B)  { benchmarkForestData(MmapForest, b) }
+
+// benchmarkForestData times Modify on a forest kept in a file with the given
+// ForestType, getting simChain blocks
+func benchmarkForestData(forestType ForestType, b *testing.B) {
+	dir, err := ioutil.TempDir("", "forestdata")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forestFile, err := os.Create(filepath.Join(dir, "forest"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	f := NewForest(forestType, forestFile, "", 0, LegacyHash, nil)
+	defer f.data.close()
+	sc := newSimChain(0xff)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		adds, _, delHashes := sc.NextBlock(1000)
+		b.StopTimer()
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
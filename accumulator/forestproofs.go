@@ -2,6 +2,7 @@ package accumulator
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,7 +20,7 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 	var pr Proof
 	var empty [32]byte
 	// first look up where the hash is
-	pos, ok := f.positionMap[wanted.Mini()]
+	pos, ok := f.leafPosition(wanted)
 	if !ok {
 		return pr, fmt.Errorf("hash %x not found", wanted)
 	}
@@ -57,8 +58,8 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 
 	}
 
-	donetime := time.Now()
-	f.timeInProve += donetime.Sub(starttime)
+	// proofs can be made from many goroutines at once through a SafeForest
+	atomic.AddInt64((*int64)(&f.timeInProve), int64(time.Since(starttime)))
 	return pr, nil
 }
 
@@ -92,15 +93,16 @@ func (f *Forest) Verify(p Proof) bool {
 	}
 	//	fmt.Printf("verify %04x\n", n[:4])
 	for h, sib := range p.Siblings {
+		row := uint8(h + 1)
 		// fmt.Printf("%04x ", sib[:4])
 		// detect current row parity
 		if 1<<uint(h)&p.Position == 0 {
 			//			fmt.Printf("compute %04x %04x -> ", n[:4], sib[:4])
-			n = parentHash(n, sib)
+			n = f.scheme.parentHash(f.hasher, n, sib, row)
 			//			fmt.Printf("%04x\n", n[:4])
 		} else {
 			//			fmt.Printf("compute %04x %04x -> ", sib[:4], n[:4])
-			n = parentHash(sib, n)
+			n = f.scheme.parentHash(f.hasher, sib, n, row)
 			//			fmt.Printf("%04x\n", n[:4])
 		}
 	}
@@ -154,21 +156,11 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 	bp.Targets = make([]uint64, len(hs))
 
 	for i, wanted := range hs {
-		pos, ok := f.positionMap[wanted.Mini()]
+		pos, ok := f.leafPosition(wanted)
 		if !ok {
 			fmt.Print(f.ToString())
 			return bp, fmt.Errorf("hash %x not found", wanted)
 		}
-
-		// should never happen
-		if pos > f.numLeaves {
-			for m, p := range f.positionMap {
-				fmt.Printf("%x @%d\t", m[:4], p)
-			}
-			return bp, fmt.Errorf(
-				"ProveBatch: got leaf position %d but only %d leaves exist",
-				pos, f.numLeaves)
-		}
 		bp.Targets[i] = pos
 	}
 	// targets need to be sorted because the proof hashes are sorted
@@ -194,13 +186,13 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 		fmt.Printf("blockproof targets: %v\n", bp.Targets)
 	}
 
-	donetime := time.Now()
-	f.timeInProve += donetime.Sub(starttime)
+	atomic.AddInt64((*int64)(&f.timeInProve), int64(time.Since(starttime)))
 	return bp, nil
 }
 
 // VerifyBatchProof is just a wrapper around verifyBatchProof
 func (f *Forest) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
-	_, _, err := verifyBatchProof(toProve, bp, f.GetRoots(), f.numLeaves, nil)
+	_, _, err := verifyBatchProof(toProve, bp, f.GetRoots(), f.numLeaves,
+		f.scheme, f.hasher, nil)
 	return err
 }
@@ -10,7 +10,7 @@ import (
 )
 
 func undoOnceFuzzy(data *bytes.Buffer) error {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	seed0, err := data.ReadByte()
 	if err != nil {
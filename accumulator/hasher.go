@@ -1,18 +1,144 @@
 package accumulator
 
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"runtime"
+	"sync"
+)
+
+// Hasher is the hash function the accumulator is built on.  A HashScheme
+// says what goes into each hash, and the Hasher does the hashing, so a set
+// that isn't Bitcoin can use its own hash, even one from outside this
+// package.  Everyone sharing roots or proofs has to use the same Hasher, and
+// it isn't saved with a forest or pollard so restoring needs the same one.
+type Hasher interface {
+	// Hash hashes all the data slices one after another, as if they were
+	// one big slice.  It's called from many goroutines at once.
+	Hash(data ...[]byte) Hash
+}
+
+// DefaultHasher is SHA-512/256, which is what the accumulator always used
+// before there were Hashers.
+var DefaultHasher Hasher = SHA512_256{}
+
+// SHA512_256 hashes with SHA-512/256
+type SHA512_256 struct{}
+
+// Hash hashes data with SHA-512/256
+func (SHA512_256) Hash(data ...[]byte) Hash {
+	if len(data) == 1 {
+		return sha512.Sum512_256(data[0])
+	}
+	return sumAll(sha512.New512_256(), data)
+}
+
+// SHA256 hashes with SHA-256
+type SHA256 struct{}
+
+// Hash hashes data with SHA-256
+func (SHA256) Hash(data ...[]byte) Hash {
+	if len(data) == 1 {
+		return sha256.Sum256(data[0])
+	}
+	return sumAll(sha256.New(), data)
+}
+
+// sumAll writes all the data to h and gives the first 32 bytes of the sum
+func sumAll(h hash.Hash, data [][]byte) Hash {
+	for _, d := range data {
+		h.Write(d)
+	}
+	var sum Hash
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// minParallelHashes is the fewest hashes worth splitting over goroutines.
+// Below this, starting goroutines costs more than the hashing.
+const minParallelHashes = 64
+
 // hashableNode is the data needed to perform a hash
 type hashableNode struct {
 	sib, dest *polNode
 	position  uint64 // doesn't really need to be there, but convenient for debugging
 }
 
-// hashRow calculates new hashes for all the positions passed in
+// hashPairs puts the parent at row of lefts[i] and rights[i] into out[i]
+// for every i, hashed with scheme on top of hasher.  The hashes in a row
+// don't depend on each other, so they're split up over at most workers
+// goroutines.  0 workers means one per cpu, and 1 means everything is
+// hashed here without any goroutines.
+func hashPairs(lefts, rights, out []Hash,
+	scheme HashScheme, hasher Hasher, row uint8, workers int) {
+
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if workers == 1 || len(out) < minParallelHashes {
+		for i := range out {
+			out[i] = scheme.parentHash(hasher, lefts[i], rights[i], row)
+		}
+		return
+	}
+	if workers > len(out)/minParallelHashes {
+		workers = len(out) / minParallelHashes
+	}
+
+	// give each worker a contiguous chunk
+	var wg sync.WaitGroup
+	chunk := (len(out) + workers - 1) / workers
+	for start := 0; start < len(out); start += chunk {
+		end := start + chunk
+		if end > len(out) {
+			end = len(out)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			for i := start; i < end; i++ {
+				out[i] = scheme.parentHash(hasher, lefts[i], rights[i], row)
+			}
+			wg.Done()
+		}(start, end)
+	}
+	wg.Wait()
+}
+
+// hashRow calculates new hashes for all the positions passed in, which are
+// all on the same row.
+// The reads and writes happen here since not every ForestData is safe to
+// use from multiple goroutines; only the hashing is done in parallel.
 func (f *Forest) hashRow(dirtpositions []uint64) error {
-	for _, hp := range dirtpositions {
-		l := f.data.read(child(hp, f.rows))
-		r := f.data.read(child(hp, f.rows) | 1)
-		f.data.write(hp, parentHash(l, r))
+	if len(dirtpositions) == 0 {
+		return nil
+	}
+	row := detectRow(dirtpositions[0], f.rows)
+
+	lefts := make([]Hash, len(dirtpositions))
+	rights := make([]Hash, len(dirtpositions))
+	for i, hp := range dirtpositions {
+		lefts[i] = f.data.read(child(hp, f.rows))
+		rights[i] = f.data.read(child(hp, f.rows) | 1)
+	}
+
+	pars := make([]Hash, len(dirtpositions))
+	hashPairs(lefts, rights, pars, f.scheme, f.hasher, row, f.hashWorkers)
+	for i, hp := range dirtpositions {
+		f.data.write(hp, pars[i])
 	}
 
 	return nil
 }
+
+// SetHashWorkers sets how many goroutines the forest can use to hash a row.
+// 0 means one per cpu, which is the default.  1 hashes everything serially.
+func (f *Forest) SetHashWorkers(workers int) {
+	f.hashWorkers = workers
+}
+
+// SetHashWorkers sets how many goroutines the pollard can use to hash a row.
+// 0 means one per cpu, which is the default.  1 hashes everything serially.
+func (p *Pollard) SetHashWorkers(workers int) {
+	p.hashWorkers = workers
+}
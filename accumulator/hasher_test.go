@@ -0,0 +1,213 @@
+package accumulator
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// TestHasherVectors checks the root of a 4 leaf forest for each hasher and
+// scheme.  Leaf i is the scheme's LeafHash of the single byte i.
+func TestHasherVectors(t *testing.T) {
+	vectors := []struct {
+		hasher Hasher
+		scheme HashScheme
+		root   string
+	}{
+		{SHA512_256{}, LegacyHash,
+			"db5e7189239014bd6bb96403ef7a619e9e3aa9573040777b63c038017d890173"},
+		{SHA512_256{}, TaggedHashV1,
+			"0d9abc0a61e55784a010767195a1ebc6555df7e54fb335d01f15a412932b6371"},
+		{SHA256{}, LegacyHash,
+			"9675e04b4ba9dc81b06e81731e2d21caa2c95557a85dcfa3fff70c9ff0f30b2e"},
+		{SHA256{}, TaggedHashV1,
+			"006c1e948ce19c6c9ec929d193d5392364344cdc1148472f20dd39b2e3a6fe4a"},
+	}
+
+	for _, v := range vectors {
+		leaves := make([]Leaf, 4)
+		for i := range leaves {
+			leaves[i].Hash = v.scheme.LeafHash(v.hasher, []byte{uint8(i)})
+		}
+		f := NewForest(RamForest, nil, "", 0, v.scheme, v.hasher)
+		_, err := f.Modify(leaves, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPollard(v.scheme, v.hasher)
+		err = p.add(leaves)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := hex.EncodeToString(f.GetRoots()[0][:])
+		if got != v.root {
+			t.Fatalf("%T %s forest root %s want %s", v.hasher, v.scheme, got, v.root)
+		}
+		got = hex.EncodeToString(p.GetRoots()[0][:])
+		if got != v.root {
+			t.Fatalf("%T %s pollard root %s want %s", v.hasher, v.scheme, got, v.root)
+		}
+	}
+
+	// nil is the default, and the default is what it always was
+	if LegacyHash.parentHash(nil, Hash{1}, Hash{2}, 1) !=
+		LegacyHash.parentHash(SHA512_256{}, Hash{1}, Hash{2}, 1) {
+		t.Fatal("nil hasher isn't SHA512_256")
+	}
+}
+
+// TestSHA256Forest runs a SHA256 forest and pollard over blocks with proofs
+// and makes sure they keep agreeing, and that the proofs don't verify with
+// the default hasher.
+func TestSHA256Forest(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0, TaggedHashV1, SHA256{})
+	defaultF := NewForest(RamForest, nil, "", 0, TaggedHashV1, nil)
+	p := NewPollard(TaggedHashV1, SHA256{})
+
+	sc := newSimChain(0x07)
+	sc.lookahead = 4
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sc.NextBlock(20)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(delHashes) > 0 && defaultF.VerifyBatchProof(delHashes, bp) == nil {
+			t.Fatalf("block %d SHA256 proof verified with default hasher", b)
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		_, err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ff := range []*Forest{f, defaultF} {
+			_, err = ff.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(f.GetRoots(), p.GetRoots()) {
+			t.Fatalf("block %d pollard roots differ from forest", b)
+		}
+	}
+}
+
+// TestHashWorkers makes sure forests and pollards hashing in parallel end
+// up with the same roots as ones hashing serially.
+func TestHashWorkers(t *testing.T) {
+	serialF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	serialF.SetHashWorkers(1)
+	parF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	parF.SetHashWorkers(4)
+
+	var serialP, parP Pollard
+	serialP.SetHashWorkers(1)
+	parP.SetHashWorkers(4)
+
+	// enough adds & dels so rows have more than minParallelHashes in them
+	sc := newSimChain(0x1f)
+	sc.lookahead = 8
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(2000)
+
+		bp, err := serialF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range []*Pollard{&serialP, &parP} {
+			err = p.IngestBatchProof(delHashes, bp, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, f := range []*Forest{serialF, parF} {
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		roots := serialF.GetRoots()
+		if !reflect.DeepEqual(roots, parF.GetRoots()) {
+			t.Fatalf("block %d parallel forest roots differ", b)
+		}
+		if !reflect.DeepEqual(roots, serialP.GetRoots()) ||
+			!reflect.DeepEqual(roots, parP.GetRoots()) {
+			t.Fatalf("block %d pollard roots differ from forest", b)
+		}
+	}
+}
+
+func BenchmarkForestModify_Serial(b *testing.B)   { benchmarkForestModify(1, b) }
+func BenchmarkForestModify_Parallel(b *testing.B) { benchmarkForestModify(0, b) }
+
+func BenchmarkPollardModify_Serial(b *testing.B)   { benchmarkPollardModify(1, b) }
+func BenchmarkPollardModify_Parallel(b *testing.B) { benchmarkPollardModify(0, b) }
+
+// benchmarkForestModify times Modify on a forest getting simChain blocks,
+// with the given number of hash workers
+func benchmarkForestModify(workers int, b *testing.B) {
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	f.SetHashWorkers(workers)
+	sc := newSimChain(0xff)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		adds, _, delHashes := sc.NextBlock(5000)
+		b.StopTimer()
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkPollardModify times Modify on a pollard getting simChain blocks,
+// with the given number of hash workers.  The proofs come from a forest,
+// which isn't timed.
+func benchmarkPollardModify(workers int, b *testing.B) {
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	var p Pollard
+	p.SetHashWorkers(workers)
+	sc := newSimChain(0xff)
+	sc.lookahead = 0x7f
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		adds, _, delHashes := sc.NextBlock(5000)
+		b.StopTimer()
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		_, err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
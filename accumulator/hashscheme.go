@@ -0,0 +1,96 @@
+package accumulator
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// HashScheme is how leaves and parents in the accumulator are hashed.
+// Every node in a network has to use the same scheme since it changes all
+// the roots.  The scheme a forest or pollard was made with is saved along
+// with it.  H below is whatever Hasher the forest or pollard uses.
+type HashScheme uint8
+
+const (
+	// LegacyHash is the original scheme: a parent is H(l||r),
+	// with nothing to tell leaves and parents apart and no commitment to
+	// where in the tree the parent is.  Forests and pollards saved before
+	// there were schemes use this.
+	LegacyHash HashScheme = iota
+
+	// TaggedHashV1 domain separates leaves and parents with tagged hashes
+	// (like BIP340) and has every parent commit to its row:
+	//  leaf   = H(leafTag || leafTag || data)
+	//  parent = H(nodeTag || nodeTag || row || l || r)
+	// where the tags are sha256 of "utreexo/leaf" and "utreexo/node".
+	// Since a parent commits to its row, a node can't be passed off as a
+	// leaf or as a node at a different height.
+	TaggedHashV1
+
+	// numHashSchemes is how many schemes there are, for range checks
+	numHashSchemes
+)
+
+var (
+	leafTag = sha256.Sum256([]byte("utreexo/leaf"))
+	nodeTag = sha256.Sum256([]byte("utreexo/node"))
+)
+
+// String gives the scheme name the way ParseHashScheme takes it
+func (s HashScheme) String() string {
+	switch s {
+	case LegacyHash:
+		return "legacy"
+	case TaggedHashV1:
+		return "v1"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// ParseHashScheme gives the scheme for a name from String()
+func ParseHashScheme(name string) (HashScheme, error) {
+	for s := HashScheme(0); s < numHashSchemes; s++ {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash scheme %s", name)
+}
+
+// checkHashScheme errors if s isn't a scheme we know about, like when
+// it's read from disk
+func checkHashScheme(s HashScheme) error {
+	if s >= numHashSchemes {
+		return fmt.Errorf("unknown hash scheme %d", uint8(s))
+	}
+	return nil
+}
+
+// LeafHash hashes the data for a leaf with h.  The accumulator itself only
+// sees leaf hashes, so this is for whatever makes leaves out of its own data.
+// A nil h is the DefaultHasher.
+func (s HashScheme) LeafHash(h Hasher, data []byte) Hash {
+	if h == nil {
+		h = DefaultHasher
+	}
+	if s == LegacyHash {
+		return h.Hash(data)
+	}
+	return h.Hash(leafTag[:], leafTag[:], data)
+}
+
+// parentHash gets you the merkle parent at the given row of two children,
+// hashed with h.  Row is the parent's row, so it's always at least 1.
+// A nil h is the DefaultHasher, so zero value pollards still work.
+func (s HashScheme) parentHash(h Hasher, l, r Hash, row uint8) Hash {
+	if l == empty || r == empty {
+		panic("got an empty leaf here. ")
+	}
+	if h == nil {
+		h = DefaultHasher
+	}
+	if s == LegacyHash {
+		return h.Hash(l[:], r[:])
+	}
+	return h.Hash(nodeTag[:], nodeTag[:], []byte{row}, l[:], r[:])
+}
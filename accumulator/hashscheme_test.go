@@ -0,0 +1,256 @@
+package accumulator
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestHashSchemes runs a forest and a pollard with each scheme over the
+// same blocks.  They have to agree with each other, and the schemes have to
+// give different roots.
+func TestHashSchemes(t *testing.T) {
+	legacyF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	v1F := NewForest(RamForest, nil, "", 0, TaggedHashV1, nil)
+	v1P := NewPollard(TaggedHashV1, nil)
+
+	sc := newSimChain(0x07)
+	sc.lookahead = 4
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sc.NextBlock(20)
+
+		bp, err := v1F.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = v1F.VerifyBatchProof(delHashes, bp)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		// a v1 proof shouldn't check out against a legacy forest
+		if len(delHashes) > 0 {
+			err = legacyF.VerifyBatchProof(delHashes, bp)
+			if err == nil {
+				t.Fatalf("block %d v1 proof verified with legacy", b)
+			}
+		}
+
+		err = v1P.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		_, err = v1P.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = v1F.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = legacyF.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(v1F.GetRoots(), v1P.GetRoots()) {
+			t.Fatalf("block %d v1 pollard roots differ from forest", b)
+		}
+		if v1F.numLeaves > 1 &&
+			reflect.DeepEqual(v1F.GetRoots(), legacyF.GetRoots()) {
+			t.Fatalf("block %d v1 and legacy roots are the same", b)
+		}
+	}
+}
+
+// TestHashSchemeRow makes sure v1 parents commit to their row and are
+// separate from leaf hashes
+func TestHashSchemeRow(t *testing.T) {
+	var l, r Hash
+	l[0], r[0] = 1, 2
+	if TaggedHashV1.parentHash(nil, l, r, 1) ==
+		TaggedHashV1.parentHash(nil, l, r, 2) {
+		t.Fatal("v1 parent doesn't commit to row")
+	}
+	if LegacyHash.parentHash(nil, l, r, 1) !=
+		sha512.Sum512_256(append(l[:], r[:]...)) {
+		t.Fatal("legacy parent changed")
+	}
+	data := append(l[:], r[:]...)
+	if TaggedHashV1.LeafHash(nil, data) == TaggedHashV1.parentHash(nil, l, r, 1) {
+		t.Fatal("v1 leaf and parent hashes collide")
+	}
+
+	for s := HashScheme(0); s < numHashSchemes; s++ {
+		got, err := ParseHashScheme(s.String())
+		if err != nil || got != s {
+			t.Fatalf("ParseHashScheme(%s) gave %s %v", s, got, err)
+		}
+	}
+	_, err := ParseHashScheme("v9")
+	if err == nil {
+		t.Fatal("parsed unknown scheme")
+	}
+}
+
+// TestHashSchemeRestore saves and restores forests and pollards, making
+// sure the scheme comes back, and that files from before schemes restore
+// as LegacyHash.
+func TestHashSchemeRestore(t *testing.T) {
+	leaves := make([]Leaf, 5)
+	for i := range leaves {
+		leaves[i].Hash[0] = uint8(i + 1)
+	}
+
+	// forest misc data
+	for _, s := range []HashScheme{LegacyHash, TaggedHashV1} {
+		f := NewForest(RamForest, nil, "", 0, s, nil)
+		_, err := f.Modify(leaves, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forestFile, err := ioutil.TempFile("", "forestdata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(forestFile.Name())
+		miscFile, err := ioutil.TempFile("", "miscforestdata")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(miscFile.Name())
+
+		err = f.WriteForestToDisk(forestFile, true, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.WriteMiscData(miscFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = miscFile.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = forestFile.Seek(0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreForest(
+			miscFile, forestFile, true, false, false, "", 0, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.HashScheme() != s {
+			t.Fatalf("saved scheme %s, restored %s", s, restored.HashScheme())
+		}
+	}
+
+	// pollards
+	p := NewPollard(TaggedHashV1, nil)
+	err := p.add(leaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = p.WritePollard(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	var q Pollard
+	err = q.RestorePollard(bytes.NewReader(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.HashScheme() != TaggedHashV1 || !reflect.DeepEqual(p.GetRoots(), q.GetRoots()) {
+		t.Fatalf("restored pollard %s %v", q.HashScheme(), q.GetRoots())
+	}
+
+	// Serialize is the same thing
+	ser, err := p.Serialize()
+	if err != nil || !bytes.Equal(ser, saved) {
+		t.Fatalf("Serialize gave %x %v, WritePollard %x", ser, err, saved)
+	}
+	q = Pollard{}
+	err = q.Deserialize(ser)
+	if err != nil || q.HashScheme() != TaggedHashV1 {
+		t.Fatalf("deserialized pollard %s %v", q.HashScheme(), err)
+	}
+
+	// a pollard file can have a bigger old one's bytes after it
+	err = q.RestorePollard(bytes.NewReader(append(saved, 1, 2, 3)))
+	if err != nil || q.HashScheme() != TaggedHashV1 ||
+		!reflect.DeepEqual(p.GetRoots(), q.GetRoots()) {
+		t.Fatalf("pollard with bytes after %s %v", q.HashScheme(), err)
+	}
+
+	// an old one is just numLeaves and the roots
+	var old bytes.Buffer
+	binary.Write(&old, binary.BigEndian, p.numLeaves)
+	for _, r := range p.GetRoots() {
+		old.Write(r[:])
+	}
+	q = NewPollard(TaggedHashV1, nil)
+	err = q.RestorePollard(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.HashScheme() != LegacyHash ||
+		!reflect.DeepEqual(p.GetRoots(), q.GetRoots()) {
+		t.Fatalf("old pollard file restored as %s", q.HashScheme())
+	}
+}
+
+// TestReconstructScheme reconstructs a proof with its targets and checks
+// it hashes up to the forest's roots
+func TestReconstructScheme(t *testing.T) {
+	for _, s := range []HashScheme{LegacyHash, TaggedHashV1} {
+		f := NewForest(RamForest, nil, "", 0, s, nil)
+		leaves := make([]Leaf, 13)
+		for i := range leaves {
+			leaves[i].Hash[0] = uint8(i + 1)
+		}
+		_, err := f.Modify(leaves, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targetHashes := []Hash{leaves[9].Hash, leaves[2].Hash, leaves[3].Hash}
+		bp, err := f.ProveBatch(targetHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := bp.Reconstruct(f.numLeaves, f.rows, targetHashes, s, f.hasher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pos := range bp.Targets {
+			for pos != parent(pos, f.rows) && pos < f.data.size() {
+				want := f.data.read(pos)
+				if got, ok := tree[pos]; !ok || got != want {
+					t.Fatalf("%s pos %d have %x want %x", s, pos, got, want)
+				}
+				row := detectRow(pos, f.rows)
+				if f.numLeaves&(1<<row) != 0 &&
+					pos == rootPosition(f.numLeaves, row, f.rows) {
+					break
+				}
+				pos = parent(pos, f.rows)
+			}
+		}
+
+		// without targets it's just the proof
+		tree, err = bp.Reconstruct(f.numLeaves, f.rows, nil, s, f.hasher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tree) != len(bp.Proof) {
+			t.Fatalf("%s got %d nodes for %d proof hashes", s, len(tree), len(bp.Proof))
+		}
+	}
+}
@@ -45,6 +45,15 @@ type Pollard struct {
 	// It is only used for fullPollard.
 	positionMap map[MiniHash]uint64
 
+	// scheme is how parents are hashed, and hasher is the hash function
+	// it uses.  The zero values are LegacyHash and the DefaultHasher.
+	scheme HashScheme
+	hasher Hasher
+
+	// hashWorkers is how many goroutines can hash a row at once.
+	// 0 means one per cpu.
+	hashWorkers int
+
 	// Below are for keeping statistics.
 	// hashesEver is all the hashes that have ever been performed.
 	// rememberEver is all the nodes that have ever been cached.
@@ -53,23 +62,117 @@ type Pollard struct {
 	hashesEver, rememberEver, currentRemember, overWire uint64
 }
 
-// Modify deletes then adds elements to the accumulator.
-func (p *Pollard) Modify(adds []Leaf, delsUn []uint64) error {
+// NewPollard gives an empty pollard that hashes with the given scheme and
+// hasher.  A nil hasher is the DefaultHasher.
+func NewPollard(scheme HashScheme, hasher Hasher) Pollard {
+	if hasher == nil {
+		hasher = DefaultHasher
+	}
+	return Pollard{scheme: scheme, hasher: hasher}
+}
+
+// NewPollardFromRoots gives a pollard with just the given roots, like one
+// that's been pruned down to them, to start from a trusted snapshot instead
+// of from nothing.  The roots go in the same order GetRoots gives them.
+func NewPollardFromRoots(numLeaves uint64, roots []Hash,
+	scheme HashScheme, hasher Hasher) (Pollard, error) {
+
+	p := NewPollard(scheme, hasher)
+	err := checkHashScheme(scheme)
+	if err != nil {
+		return p, err
+	}
+	if len(roots) != int(numRoots(numLeaves)) {
+		return p, fmt.Errorf("NewPollardFromRoots: %d leaves need %d roots, "+
+			"got %d", numLeaves, numRoots(numLeaves), len(roots))
+	}
+	p.numLeaves = numLeaves
+	p.roots = make([]*polNode, len(roots))
+	for i, root := range roots {
+		if root == empty {
+			return p, fmt.Errorf("NewPollardFromRoots: root %d is empty", i)
+		}
+		p.roots[i] = &polNode{data: root}
+	}
+	return p, nil
+}
+
+// HashScheme is the scheme the pollard hashes with
+func (p *Pollard) HashScheme() HashScheme {
+	return p.scheme
+}
+
+// Hasher is the hash function the pollard hashes with
+func (p *Pollard) Hasher() Hasher {
+	if p.hasher == nil {
+		return DefaultHasher
+	}
+	return p.hasher
+}
+
+// hashRow computes the hashes for a row of hashableNodes and prunes below
+// them.  row is the row the new hashes are on.  The hashes are independent
+// so they're done in parallel, then all the pointer changes happen after,
+// in order.
+func (p *Pollard) hashRow(hnslice []*hashableNode, row uint8) {
+	lefts := make([]Hash, 0, len(hnslice))
+	rights := make([]Hash, 0, len(hnslice))
+	hashable := make([]*hashableNode, 0, len(hnslice))
+	for _, hn := range hnslice {
+		if hashableSib(hn) {
+			lefts = append(lefts, hn.sib.niece[0].data)
+			rights = append(rights, hn.sib.niece[1].data)
+			hashable = append(hashable, hn)
+		}
+	}
+
+	pars := make([]Hash, len(hashable))
+	hashPairs(lefts, rights, pars, p.scheme, p.hasher, row, p.hashWorkers)
+	for i, hn := range hashable {
+		// check again since pruning an earlier one can take away nieces.
+		// Pruning only drops pointers so if they're still there, the hash
+		// from above is still right.
+		if !hashableSib(hn) {
+			continue
+		}
+		hn.dest.data = pars[i]
+		hn.sib.prune()
+	}
+}
+
+// hashableSib says if the hashableNode's sibling has both nieces to hash
+func hashableSib(hn *hashableNode) bool {
+	// skip hashes we can't compute
+	// TODO when is hn nil?  is this OK?
+	// it'd be better to avoid this and not create hns that aren't
+	// supposed to exist.
+	return hn.sib.niece[0] != nil && hn.sib.niece[1] != nil &&
+		hn.sib.niece[0].data != empty && hn.sib.niece[1].data != empty
+}
+
+// Modify deletes then adds elements to the accumulator.  A pollard can't
+// undo, so the UndoBlock is always nil.
+func (p *Pollard) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 	dels := make([]uint64, len(delsUn))
 	copy(dels, delsUn)
 	sortUint64s(dels)
 
-	err := p.rem2(dels)
+	err := checkModify(adds, dels, p.numLeaves)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.rem2(dels)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = p.add(adds)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return nil, nil
 }
 
 // Stats returns the current pollard statistics as a string.
@@ -174,11 +277,11 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 	var h uint8
 	for ; (p.numLeaves>>h)&1 == 1; h++ {
 		// grab, pop, swap, hash, new
-		leftRoot := p.roots[len(p.roots)-1]                        // grab
-		p.roots = p.roots[:len(p.roots)-1]                         // pop
-		leftRoot.niece, n.niece = n.niece, leftRoot.niece          // swap
-		nHash := parentHash(leftRoot.data, n.data)                 // hash
-		n = &polNode{data: nHash, niece: [2]*polNode{leftRoot, n}} // new
+		leftRoot := p.roots[len(p.roots)-1]                                // grab
+		p.roots = p.roots[:len(p.roots)-1]                                 // pop
+		leftRoot.niece, n.niece = n.niece, leftRoot.niece                  // swap
+		nHash := p.scheme.parentHash(p.hasher, leftRoot.data, n.data, h+1) // hash
+		n = &polNode{data: nHash, niece: [2]*polNode{leftRoot, n}}         // new
 		n.remember = remember
 		p.hashesEver++
 
@@ -299,18 +402,7 @@ func (p *Pollard) rem2(dels []uint64) error {
 		hashDirt = nextHashDirt
 		nextHashDirt = []uint64{}
 		// do all the hashes at once at the end
-		for _, hn := range hnslice {
-			// skip hashes we can't compute
-			if hn.sib.niece[0] == nil || hn.sib.niece[1] == nil ||
-				hn.sib.niece[0].data == empty || hn.sib.niece[1].data == empty {
-				// TODO when is hn nil?  is this OK?
-				// it'd be better to avoid this and not create hns that aren't
-				// supposed to exist.
-				continue
-			}
-			hn.dest.data = hn.sib.auntOp()
-			hn.sib.prune()
-		}
+		p.hashRow(hnslice, h+1)
 	}
 
 	positionList := NewPositionList()
@@ -347,6 +439,11 @@ func (p *Pollard) hnFromPos(pos uint64) (*hashableNode, error) {
 	if !inForest(pos, p.numLeaves, p.rows()) {
 		return nil, nil
 	}
+	// roots have no parent to hash.  grabPos would give back the root
+	// itself, which would get rehashed a row too high.
+	if !inForest(parent(pos, p.rows()), p.numLeaves, p.rows()) {
+		return nil, nil
+	}
 	_, _, hn, err := p.grabPos(pos)
 	if err != nil {
 		return nil, err
@@ -496,7 +593,7 @@ func (p *Pollard) grabPos(
 // For debugging and seeing what pollard is doing since there's already
 // a good toString method for  forest.
 func (p *Pollard) toFull() (*Forest, error) {
-	ff := NewForest(RamForest, nil, "", 0)
+	ff := NewForest(RamForest, nil, "", 0, p.scheme, p.hasher)
 	ff.rows = p.rows()
 	ff.numLeaves = p.numLeaves
 	ff.data = new(ramForestData)
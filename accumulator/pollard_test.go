@@ -19,7 +19,7 @@ func TestPollardNoSiblingFound(t *testing.T) {
 	}
 	adds[6].Remember = false
 
-	err := p.Modify(adds, nil)
+	_, err := p.Modify(adds, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -38,14 +38,14 @@ func TestPollardNoSiblingFound(t *testing.T) {
 	newAdds[1].Remember = true
 
 	dels := []uint64{2, 3, 4}
-	err = p.Modify(newAdds, dels)
+	_, err = p.Modify(newAdds, dels)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Then cause the error by deleting 1,3,4,5
 	newDels := []uint64{1, 3, 4, 5}
-	err = p.Modify(nil, newDels)
+	_, err = p.Modify(nil, newDels)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,7 +71,7 @@ func TestPollardFixed(t *testing.T) {
 	}
 }
 func TestPollardSimpleIngest(t *testing.T) {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	adds := make([]Leaf, 15)
 	for i := 0; i < len(adds); i++ {
 		adds[i].Hash[0] = uint8(i + 1)
@@ -101,7 +101,7 @@ func TestPollardSimpleIngest(t *testing.T) {
 }
 
 func pollardRandomRemember(blocks int32) error {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	var p Pollard
 
@@ -139,9 +139,7 @@ func pollardRandomRemember(blocks int32) error {
 		err = f.sanity()
 		if err != nil {
 			fmt.Printf("frs broke %s", f.ToString())
-			for h, p := range f.positionMap {
-				fmt.Printf("%x@%d ", h[:4], p)
-			}
+			fmt.Print(f.PrintPositionMap())
 			return err
 		}
 		err = f.PosMapSanity()
@@ -151,7 +149,7 @@ func pollardRandomRemember(blocks int32) error {
 		}
 
 		// apply adds / dels to pollard
-		err = p.Modify(adds, bp.Targets)
+		_, err = p.Modify(adds, bp.Targets)
 		if err != nil {
 			return err
 		}
@@ -208,7 +206,7 @@ func TestPollardIngestMultiBlockProof(t *testing.T) {
 		blocks int32 = 4000
 	)
 
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	// When generating proofs in intervals of blocks, the addtions that
 	// get created in-between an interval will not be proven.
@@ -303,7 +301,7 @@ func TestPollardIngestMultiBlockProof(t *testing.T) {
 			}
 
 			// Apply adds and dels to the pollard.
-			err = p.Modify(loopAdd, bp.Targets)
+			_, err = p.Modify(loopAdd, bp.Targets)
 			if err != nil {
 				t.Fatal(fmt.Errorf("Pollard modify failed. Error: %s",
 					err.Error()))
@@ -347,7 +345,7 @@ func TestPollardIngestMultiBlockProof(t *testing.T) {
 // fixedPollard adds and removes things in a non-random way
 func fixedPollard(leaves int32) error {
 	fmt.Printf("\t\tpollard test add %d remove 1\n", leaves)
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	leafCounter := uint64(0)
 
@@ -412,7 +410,7 @@ func TestCache(t *testing.T) {
 	chain := newSimChain(7)
 	chain.lookahead = 8
 
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	var p Pollard
 
 	// this leaf map holds all the leaves at the current height and is used to check if the pollard
@@ -436,7 +434,7 @@ func TestCache(t *testing.T) {
 			t.Fatal("IngestBatchProof failed", err)
 		}
 
-		err = p.Modify(adds, proof.Targets)
+		_, err = p.Modify(adds, proof.Targets)
 		if err != nil {
 			t.Fatal("Modify failed", err)
 		}
@@ -43,6 +43,9 @@ func (p *Pollard) PosMapSanity() error {
 // (aka permutation matters).
 func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 	var bp BatchProof
+	if p.positionMap == nil {
+		return bp, fmt.Errorf("ProveBatch: only a full pollard can prove")
+	}
 	// skip everything if empty (should this be an error?
 	if len(hs) == 0 {
 		return bp, nil
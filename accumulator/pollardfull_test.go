@@ -53,7 +53,7 @@ func pollardFullRandomRemember(blocks int32) error {
 		fmt.Printf("del %v\n", bp.Targets)
 
 		// apply adds and deletes to the bridge node (could do this whenever)
-		err = fp.Modify(adds, bp.Targets)
+		_, err = fp.Modify(adds, bp.Targets)
 		if err != nil {
 			return err
 		}
@@ -70,7 +70,7 @@ func pollardFullRandomRemember(blocks int32) error {
 		}
 
 		// apply adds / dels to pollard
-		err = p.Modify(adds, bp.Targets)
+		_, err = p.Modify(adds, bp.Targets)
 		if err != nil {
 			return err
 		}
@@ -13,7 +13,7 @@ import (
 func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
-	_, _, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+	_, _, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves, p.scheme, p.hasher,
 		// pass a closure that checks the pollard for cached nodes.
 		// returns true and the hash value of the node if it exists.
 		// returns false if the node does not exist or the hash value is empty.
@@ -41,7 +41,7 @@ func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 func (p *Pollard) IngestBatchProof(toProve []Hash, bp BatchProof, rememberAll bool) error {
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
-	trees, roots, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+	trees, roots, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves, p.scheme, p.hasher,
 		// pass a closure that checks the pollard for cached nodes.
 		// returns true and the hash value of the node if it exists.
 		// returns false if the node does not exist or the hash value is empty.
@@ -15,12 +15,7 @@ type polNode struct {
 	remember bool
 }
 
-// auntOp returns the hash of a nodes nieces. crashes if you call on nil nieces.
-func (n *polNode) auntOp() Hash {
-	return parentHash(n.niece[0].data, n.niece[1].data)
-}
-
-// auntable tells you if you can call auntOp on a node
+// auntable tells you if a node has both nieces to hash
 func (n *polNode) auntable() bool {
 	return n.niece[0] != nil && n.niece[1] != nil
 }
@@ -121,19 +116,28 @@ func (p *Pollard) rootHashesForward() []Hash {
 // TODO have the option to save restore sparse pollards.  Could use the same
 // idea as verifyBatchProof
 
-// current serialization is just 8byte numleaves, followed by all the hashes
-// (in small to big order)
+// pollardMarker starts pollards saved with a version.  Older ones start with
+// numLeaves there, which is never this.  They have no scheme saved, and are
+// all LegacyHash.
+const pollardMarker uint64 = 0xffffffffffffffff
+
+// pollardVersion 1 is the marker, the version byte, 1 byte for the hash
+// scheme, 8 byte numLeaves, then all the root hashes (in small to big order).
+// Older pollards are the numLeaves and the roots.
+const pollardVersion uint8 = 1
 
 // WritePollard writes the numLeaves field and only the roots into the given writer.
 // Cached leaves are not included in the writer
 func (p *Pollard) WritePollard(w io.Writer) error {
-	var err error
-	err = binary.Write(w, binary.BigEndian, p.numLeaves)
-	if err != nil {
-		return err
+	for _, v := range []interface{}{
+		pollardMarker, pollardVersion, p.scheme, p.numLeaves} {
+		err := binary.Write(w, binary.BigEndian, v)
+		if err != nil {
+			return err
+		}
 	}
 	for _, t := range p.roots {
-		_, err = w.Write(t.data[:])
+		_, err := w.Write(t.data[:])
 		if err != nil {
 			return err
 		}
@@ -141,74 +145,64 @@ func (p *Pollard) WritePollard(w io.Writer) error {
 	return nil
 }
 
-// RestorePollard restores the pollard from the given reader
+// RestorePollard restores the pollard from the given reader.  It reads
+// just what WritePollard wrote, so it doesn't matter what comes after.
 func (p *Pollard) RestorePollard(r io.Reader) error {
 	err := binary.Read(r, binary.BigEndian, &p.numLeaves)
 	if err != nil {
 		return err
 	}
+	p.scheme = LegacyHash
+	if p.numLeaves == pollardMarker {
+		var version uint8
+		err = binary.Read(r, binary.BigEndian, &version)
+		if err != nil {
+			return err
+		}
+		if version != pollardVersion {
+			return fmt.Errorf("pollard version %d, only know %d",
+				version, pollardVersion)
+		}
+		err = binary.Read(r, binary.BigEndian, &p.scheme)
+		if err != nil {
+			return err
+		}
+		err = checkHashScheme(p.scheme)
+		if err != nil {
+			return err
+		}
+		err = binary.Read(r, binary.BigEndian, &p.numLeaves)
+		if err != nil {
+			return err
+		}
+	}
 
 	p.roots = make([]*polNode, numRoots(p.numLeaves))
 	fmt.Printf("%d leaves %d roots ", p.numLeaves, len(p.roots))
-	for i, _ := range p.roots {
+	for i := range p.roots {
 		p.roots[i] = new(polNode)
-		bytesRead, err := r.Read(p.roots[i].data[:])
-		// ignore EOF error at the end of successful reading
-		if err != nil && !(bytesRead == 32 && err == io.EOF) {
-			s := fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
-			return s
+		bytesRead, err := io.ReadFull(r, p.roots[i].data[:])
+		if err != nil {
+			return fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
 		}
 	}
 	return nil
 }
 
-// Serialize serializes the numLeaves field and only the roots into a byte slice.
+// Serialize serializes the pollard like WritePollard into a byte slice.
 // Cached leaves are not included in the byte slice
 func (p *Pollard) Serialize() ([]byte, error) {
-	size := 8 + len(p.roots) // 8 for uint64 numLeaves
-	serialized := make([]byte, 0, size)
-
-	buf := bytes.NewBuffer(serialized)
-
-	err := binary.Write(buf, binary.BigEndian, p.numLeaves)
+	var buf bytes.Buffer
+	err := p.WritePollard(&buf)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, t := range p.roots {
-		_, err = buf.Write(t.data[:])
-		if err != nil {
-			return nil, err
-		}
-	}
-
 	return buf.Bytes(), nil
 }
 
 // Deserialize decodes the bytes into a Pollard
 func (p *Pollard) Deserialize(serialized []byte) error {
-	reader := bytes.NewReader(serialized)
-
-	err := binary.Read(reader, binary.BigEndian, &p.numLeaves)
-	if err != nil {
-		return err
-	}
-	fmt.Println(p.numLeaves)
-
-	p.roots = make([]*polNode, numRoots(p.numLeaves))
-
-	for i, _ := range p.roots {
-		p.roots[i] = new(polNode)
-		bytesRead, err := reader.Read(p.roots[i].data[:])
-
-		// ignore EOF error at the end of successful reading
-		if err != nil && !(bytesRead == 32 && err == io.EOF) {
-			s := fmt.Errorf("err: %v on hash %d read %d", err, i, bytesRead)
-			return s
-		}
-	}
-
-	return nil
+	return p.RestorePollard(bytes.NewReader(serialized))
 }
 
 // PrintRemembers prints all the nodes and their remember status.  Useful for debugging.
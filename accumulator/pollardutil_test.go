@@ -2,6 +2,7 @@ package accumulator
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 )
 
@@ -38,3 +39,47 @@ func TestPollardSerializeDeserialize(t *testing.T) {
 		t.Fatal("Bytes Unequal")
 	}
 }
+
+// TestNewPollardFromRoots starts a pollard from a forest's roots partway
+// through, then keeps it going next to the forest
+func TestNewPollardFromRoots(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0, TaggedHashV1, nil)
+	sc := newSimChain(0x0f)
+	var p Pollard
+	for b := 0; b < 40; b++ {
+		adds, _, delHashes := sc.NextBlock(20)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b > 20 {
+			err = p.IngestBatchProof(delHashes, bp, false)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+			_, err = p.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == 20 {
+			p, err = NewPollardFromRoots(
+				f.numLeaves, f.GetRoots(), f.HashScheme(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if b >= 20 && !reflect.DeepEqual(p.GetRoots(), f.GetRoots()) {
+			t.Fatalf("block %d pollard and forest differ", b)
+		}
+	}
+
+	_, err := NewPollardFromRoots(f.numLeaves, f.GetRoots()[1:], LegacyHash, nil)
+	if err == nil {
+		t.Fatal("made a pollard with a root missing")
+	}
+}
@@ -0,0 +1,228 @@
+package accumulator
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// PositionIndex keeps track of where each leaf is in a forest.  The forest
+// updates it as leaves are added, moved, deleted and undone, and Commits it
+// at the end of every Modify and Undo.
+//
+// There's the ram index every forest starts with, which is a map keyed on
+// MiniHashes and has to be rebuilt on restart, and a leveldb index from
+// OpenPositionIndex that's keyed on whole hashes and kept on disk.
+type PositionIndex interface {
+	// Get gives the position stored for h.  An index keyed on part of the
+	// hash might give the position of a different leaf, so the forest
+	// always checks the leaf there is really h.
+	Get(h Hash) (uint64, bool)
+
+	// Put and Delete change where h is.  They don't need to be saved
+	// anywhere until Commit.
+	Put(h Hash, pos uint64)
+	Delete(h Hash)
+
+	// Commit saves everything since the last Commit, along with the
+	// forest's state (a hash of its numLeaves and roots), so a restored
+	// forest can tell if the index is for it.
+	Commit(state Hash) error
+
+	// Committed is the state given to the last Commit.  false means the
+	// index doesn't know, and has to be rebuilt to be used.
+	Committed() (Hash, bool)
+
+	// Reset empties the index
+	Reset() error
+
+	// Close closes the index.  It isn't committed first.
+	Close() error
+}
+
+// ramPositionIndex is the in-ram index, keyed on MiniHashes to save memory
+type ramPositionIndex map[MiniHash]uint64
+
+func (m ramPositionIndex) Get(h Hash) (uint64, bool) {
+	pos, ok := m[h.Mini()]
+	return pos, ok
+}
+
+func (m ramPositionIndex) Put(h Hash, pos uint64) { m[h.Mini()] = pos }
+func (m ramPositionIndex) Delete(h Hash)          { delete(m, h.Mini()) }
+
+// Commit does nothing since a ram index is gone after a restart anyway
+func (m ramPositionIndex) Commit(state Hash) error { return nil }
+
+func (m ramPositionIndex) Committed() (Hash, bool) { return Hash{}, false }
+
+func (m ramPositionIndex) Reset() error {
+	for k := range m {
+		delete(m, k)
+	}
+	return nil
+}
+
+func (m ramPositionIndex) Close() error { return nil }
+
+// stateKey is where a diskPositionIndex keeps the committed forest state.
+// It isn't 32 bytes long so it can't be a leaf.  Indexes from before the
+// state was committed only have a "numleaves" key, and get rebuilt.
+var stateKey = []byte("forest state")
+
+// pendingPos is a change to a diskPositionIndex that hasn't been committed
+type pendingPos struct {
+	pos     uint64
+	deleted bool
+}
+
+// diskPositionIndex is a PositionIndex in leveldb, keyed on whole hashes so
+// leaves can't collide.  Changes are kept in ram until Commit writes them
+// all in one batch, since leaves move many times in a Modify.
+type diskPositionIndex struct {
+	db      *leveldb.DB
+	pending map[Hash]pendingPos
+}
+
+// OpenPositionIndex opens (or makes) a leveldb PositionIndex at path
+func OpenPositionIndex(path string) (PositionIndex, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &diskPositionIndex{db: db, pending: make(map[Hash]pendingPos)}, nil
+}
+
+func (d *diskPositionIndex) Get(h Hash) (uint64, bool) {
+	if p, ok := d.pending[h]; ok {
+		return p.pos, !p.deleted
+	}
+	v, err := d.db.Get(h[:], nil)
+	if err != nil || len(v) != 8 {
+		// leveldb.ErrNotFound, or the db is broken; either way the
+		// forest can't use this
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(v), true
+}
+
+func (d *diskPositionIndex) Put(h Hash, pos uint64) {
+	d.pending[h] = pendingPos{pos: pos}
+}
+
+func (d *diskPositionIndex) Delete(h Hash) {
+	d.pending[h] = pendingPos{deleted: true}
+}
+
+func (d *diskPositionIndex) Commit(state Hash) error {
+	var batch leveldb.Batch
+	var v [8]byte
+	for h, p := range d.pending {
+		if p.deleted {
+			batch.Delete(h[:])
+			continue
+		}
+		binary.BigEndian.PutUint64(v[:], p.pos)
+		batch.Put(h[:], v[:])
+	}
+	batch.Put(stateKey, state[:])
+
+	err := d.db.Write(&batch, nil)
+	if err != nil {
+		return fmt.Errorf("PositionIndex Commit: %s", err.Error())
+	}
+	d.pending = make(map[Hash]pendingPos)
+	return nil
+}
+
+func (d *diskPositionIndex) Committed() (Hash, bool) {
+	v, err := d.db.Get(stateKey, nil)
+	if err != nil || len(v) != 32 {
+		return Hash{}, false
+	}
+	var state Hash
+	copy(state[:], v)
+	return state, true
+}
+
+func (d *diskPositionIndex) Reset() error {
+	d.pending = make(map[Hash]pendingPos)
+	iter := d.db.NewIterator(nil, nil)
+	var batch leveldb.Batch
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	return d.db.Write(&batch, nil)
+}
+
+func (d *diskPositionIndex) Close() error {
+	return d.db.Close()
+}
+
+// leafPosition gives where leaf h is in the forest.  The index might only
+// have part of the hash, so it's checked against the leaf that's there.
+func (f *Forest) leafPosition(h Hash) (uint64, bool) {
+	pos, ok := f.positionMap.Get(h)
+	if !ok || pos >= f.numLeaves || f.data.read(pos) != h {
+		return 0, false
+	}
+	return pos, true
+}
+
+// indexState is what the position index is committed with: a hash of the
+// forest's numLeaves and roots.  Two forests with the same leaves in the
+// same places have the same state.
+func (f *Forest) indexState() Hash {
+	h := sha256.New()
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], f.numLeaves)
+	h.Write(n[:])
+	for _, root := range f.GetRoots() {
+		h.Write(root[:])
+	}
+	var state Hash
+	copy(state[:], h.Sum(nil))
+	return state
+}
+
+// commitPositionIndex commits the position index at the forest's state
+func (f *Forest) commitPositionIndex() error {
+	return f.positionMap.Commit(f.indexState())
+}
+
+// SetPositionIndex has the forest use idx to find its leaves, like one from
+// OpenPositionIndex.  If idx was committed at the forest's numLeaves and
+// roots it's used as is, otherwise it's rebuilt from the leaves.
+func (f *Forest) SetPositionIndex(idx PositionIndex) error {
+	committed, ok := idx.Committed()
+	if ok && committed == f.indexState() {
+		f.positionMap = idx
+		return nil
+	}
+
+	err := idx.Reset()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < f.numLeaves; i++ {
+		idx.Put(f.data.read(i), i)
+	}
+	f.positionMap = idx
+	return f.commitPositionIndex()
+}
+
+// ClosePositionIndex commits and closes the forest's position index
+func (f *Forest) ClosePositionIndex() error {
+	err := f.commitPositionIndex()
+	if err != nil {
+		return err
+	}
+	return f.positionMap.Close()
+}
@@ -0,0 +1,220 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestDiskPositionIndex runs a forest with a leveldb position index next to
+// one with the ram index, with undos, then saves and restores it and makes
+// sure the index comes back without being rebuilt.
+func TestDiskPositionIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "posindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	indexPath := filepath.Join(dir, "posindex")
+
+	index, err := OpenPositionIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	err = f.SetPositionIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ramF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+
+	sc := newSimChain(0x07)
+	sc.lookahead = 4
+	for b := 0; b < 100; b++ {
+		adds, durations, delHashes := sc.NextBlock(10)
+		bp, err := ramF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diskBP, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bp, diskBP) {
+			t.Fatalf("block %d proofs differ", b)
+		}
+
+		ub, err := f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b%3 == 2 {
+			err = f.Undo(*ub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc.BackOne(adds, durations, delHashes)
+		} else {
+			_, err = ramF.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = f.PosMapSanity()
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		err = f.AssertEqual(ramF)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+	}
+
+	// save and restore
+	forestFile, err := os.Create(filepath.Join(dir, "forest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile, err := os.Create(filepath.Join(dir, "misc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.ClosePositionIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = forestFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err = OpenPositionIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, ok := index.Committed()
+	if !ok || committed != ramF.indexState() {
+		t.Fatalf("index committed at %x %v, forest is at %x",
+			committed, ok, ramF.indexState())
+	}
+	restored, err := RestoreForest(
+		miscFile, forestFile, true, false, false, "", 0, nil, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.positionMap != index {
+		t.Fatal("restored forest isn't using the index")
+	}
+	err = restored.PosMapSanity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an index for some other forest gets rebuilt, even one with as many
+	// leaves
+	other := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	otherLeaves := make([]Leaf, restored.numLeaves)
+	for i := range otherLeaves {
+		otherLeaves[i].Hash[0] = 0xff
+		otherLeaves[i].Hash[1] = byte(i)
+		otherLeaves[i].Hash[2] = byte(i >> 8)
+	}
+	_, err = other.Modify(otherLeaves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Put(Hash{1}, 3)
+	err = index.Commit(other.indexState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restored.SetPositionIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := index.Get(Hash{1}); ok {
+		t.Fatal("rebuilt index still has old entries")
+	}
+	err = restored.PosMapSanity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restored.ClosePositionIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPositionIndexCollision adds two leaves with the same MiniHash.  The
+// ram index loses one of them, but must not give a proof for the wrong leaf.
+// The disk index has whole hashes so it has both.
+func TestPositionIndexCollision(t *testing.T) {
+	leaves := make([]Leaf, 4)
+	for i := range leaves {
+		leaves[i].Hash[31] = uint8(i)
+		leaves[i].Hash[0] = 0xff
+	}
+	// 1 and 2 only differ after the MiniHash
+	leaves[2].Hash = leaves[1].Hash
+	leaves[2].Hash[20] = 0xaa
+
+	ramF := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	_, err := ramF.Modify(leaves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the map says 2 for leaf 1, but it's not there
+	if ramF.FindLeaf(leaves[1].Hash) {
+		t.Fatal("found a leaf with a colliding MiniHash")
+	}
+	_, err = ramF.ProveBatch([]Hash{leaves[1].Hash})
+	if err == nil {
+		t.Fatal("proved a leaf with a colliding MiniHash")
+	}
+
+	dir, err := ioutil.TempDir("", "posindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := OpenPositionIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	err = f.SetPositionIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.ClosePositionIndex()
+	_, err = f.Modify(leaves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toProve := []Hash{leaves[1].Hash, leaves[2].Hash}
+	bp, err := f.ProveBatch(toProve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bp.Targets, []uint64{1, 2}) {
+		t.Fatalf("targets %v", bp.Targets)
+	}
+	err = f.VerifyBatchProof(toProve, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,350 @@
+package accumulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A pollard that's far behind would otherwise get a BatchProof for every
+// block, and the hashes near the roots show up in almost every one of them.
+// A RangeProof proves all the deletions for a range of blocks at once: one
+// BatchProof, made at the start of the range, for every leaf deleted in the
+// range that was already there.  Leaves added and deleted within the range
+// don't need proving at all, since the pollard remembers them when they're
+// added.  Then the adds and deletes for each block take the pollard through
+// the range.
+
+// RangeProof is everything a pollard needs to get through a range of blocks.
+type RangeProof struct {
+	// NumLeaves and Roots are the accumulator at the start of the range
+	NumLeaves uint64
+	Roots     []Hash
+
+	// Proof proves the leaves deleted in the range that were there at the
+	// start, with positions from the start of the range.
+	Proof BatchProof
+
+	// Blocks are the adds and deletes for each block in the range
+	Blocks []RangeBlock
+}
+
+// RangeBlock is what a block in a RangeProof does to the accumulator.
+type RangeBlock struct {
+	// Adds are remembered if they're deleted before the range ends
+	Adds []Leaf
+	// Dels are the positions deleted, as of this block
+	Dels []uint64
+}
+
+// StartRangeProof gives a RangeProof for a range of blocks starting from
+// where the forest is now, with the adds and deleted hashes of each block.
+// It doesn't change the forest, so the RangeBlocks don't have their Dels
+// yet; those get filled in as the forest goes through each block.  Also gives
+// the hashes proven in rp.Proof, in the same order as rp.Proof.Targets.
+func (f *Forest) StartRangeProof(adds [][]Leaf, delHashes [][]Hash) (
+	rp RangeProof, proven []Hash, err error) {
+
+	if len(adds) != len(delHashes) {
+		err = fmt.Errorf("StartRangeProof: %d blocks of adds but %d of deletes",
+			len(adds), len(delHashes))
+		return
+	}
+
+	deleted := make(map[Hash]bool)
+	for _, dels := range delHashes {
+		for _, h := range dels {
+			deleted[h] = true
+		}
+	}
+
+	added := make(map[Hash]bool)
+	rp.Blocks = make([]RangeBlock, len(adds))
+	for i, blockAdds := range adds {
+		rp.Blocks[i].Adds = make([]Leaf, len(blockAdds))
+		for j, a := range blockAdds {
+			added[a.Hash] = true
+			rp.Blocks[i].Adds[j] = Leaf{Hash: a.Hash, Remember: deleted[a.Hash]}
+		}
+	}
+
+	for _, dels := range delHashes {
+		for _, h := range dels {
+			if !added[h] {
+				proven = append(proven, h)
+			}
+		}
+	}
+
+	rp.NumLeaves = f.numLeaves
+	rp.Roots = f.GetRoots()
+	rp.Proof, err = f.ProveBatch(proven)
+	if err != nil {
+		err = fmt.Errorf("StartRangeProof: %s", err.Error())
+		return
+	}
+	if len(proven) != 0 && len(rp.Proof.Targets) == 0 {
+		// ProveBatch leaves out the target when the forest is a single leaf,
+		// but the pollard still needs to know to remember it
+		rp.Proof.Targets, err = f.leafPositions(proven)
+		if err != nil {
+			err = fmt.Errorf("StartRangeProof: %s", err.Error())
+		}
+	}
+	return
+}
+
+// ProveRange makes a RangeProof for a range of blocks, taking the forest
+// through the range.
+func (f *Forest) ProveRange(adds [][]Leaf, delHashes [][]Hash) (
+	RangeProof, []Hash, error) {
+
+	rp, proven, err := f.StartRangeProof(adds, delHashes)
+	if err != nil {
+		return rp, nil, err
+	}
+	for i, dels := range delHashes {
+		rp.Blocks[i].Dels, err = f.leafPositions(dels)
+		if err != nil {
+			return rp, nil, fmt.Errorf("ProveRange block %d: %s", i, err.Error())
+		}
+		_, err = f.Modify(rp.Blocks[i].Adds, rp.Blocks[i].Dels)
+		if err != nil {
+			return rp, nil, fmt.Errorf("ProveRange block %d: %s", i, err.Error())
+		}
+	}
+	return rp, proven, nil
+}
+
+// leafPositions gives the positions of the leaves with the given hashes
+func (f *Forest) leafPositions(hs []Hash) ([]uint64, error) {
+	positions := make([]uint64, len(hs))
+	for i, h := range hs {
+		pos, ok := f.leafPosition(h)
+		if !ok {
+			return nil, fmt.Errorf("hash %x not found", h)
+		}
+		positions[i] = pos
+	}
+	return positions, nil
+}
+
+// IngestRangeProof takes the pollard through all the blocks in a RangeProof.
+// The pollard has to be at the start of the range, and delHashes are the
+// hashes each block deletes, in the same order as its Dels.  The leaves that
+// were there before the range are checked against rp.Proof and remembered so
+// they can be deleted when their block comes, and every deleted position is
+// checked to hold the hash it's supposed to.
+func (p *Pollard) IngestRangeProof(rp RangeProof, delHashes [][]Hash) error {
+	if rp.NumLeaves != p.numLeaves {
+		return fmt.Errorf("IngestRangeProof: range starts at %d leaves, "+
+			"pollard has %d", rp.NumLeaves, p.numLeaves)
+	}
+	roots := p.GetRoots()
+	if len(roots) != len(rp.Roots) {
+		return fmt.Errorf("IngestRangeProof: range starts with %d roots, "+
+			"pollard has %d", len(rp.Roots), len(roots))
+	}
+	for i, root := range roots {
+		if root != rp.Roots[i] {
+			return fmt.Errorf("IngestRangeProof: root %d is %x, range has %x",
+				i, root[:4], rp.Roots[i][:4])
+		}
+	}
+	if len(delHashes) != len(rp.Blocks) {
+		return fmt.Errorf("IngestRangeProof: %d blocks but %d of deletes",
+			len(rp.Blocks), len(delHashes))
+	}
+
+	// the proof is for what's deleted in the range but not added in it, in
+	// the same order StartRangeProof put them in
+	added := make(map[Hash]bool)
+	for _, b := range rp.Blocks {
+		for _, a := range b.Adds {
+			added[a.Hash] = true
+		}
+	}
+	var proven []Hash
+	for _, dels := range delHashes {
+		for _, h := range dels {
+			if !added[h] {
+				proven = append(proven, h)
+			}
+		}
+	}
+	if len(proven) != len(rp.Proof.Targets) {
+		return fmt.Errorf("IngestRangeProof: %d targets but %d hashes",
+			len(rp.Proof.Targets), len(proven))
+	}
+
+	if p.numLeaves == 1 && len(proven) == 1 {
+		// the only leaf is the root, so there's nothing to ingest
+		if proven[0] != roots[0] {
+			return fmt.Errorf("IngestRangeProof: %x isn't the only leaf %x",
+				proven[0][:4], roots[0][:4])
+		}
+		p.roots[0].remember = true
+	} else {
+		// remember everything in the proof, or the blocks before a proven
+		// leaf's would prune away what it needs
+		err := p.IngestBatchProof(proven, rp.Proof, true)
+		if err != nil {
+			return fmt.Errorf("IngestRangeProof: %s", err.Error())
+		}
+	}
+
+	for i, b := range rp.Blocks {
+		if len(b.Dels) != len(delHashes[i]) {
+			return fmt.Errorf("IngestRangeProof block %d: %d deletes but "+
+				"%d hashes", i, len(b.Dels), len(delHashes[i]))
+		}
+		for j, pos := range b.Dels {
+			n, _, _, err := p.readPos(pos)
+			if err != nil || n == nil || n.data != delHashes[i][j] {
+				return fmt.Errorf("IngestRangeProof block %d: position %d "+
+					"isn't %x", i, pos, delHashes[i][j][:4])
+			}
+		}
+		_, err := p.Modify(b.Adds, b.Dels)
+		if err != nil {
+			return fmt.Errorf("IngestRangeProof block %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// Serialize writes out a RangeProof.  In order:
+// 8 bytes numLeaves
+// 4 bytes numRoots, then the roots
+// the BatchProof
+// 4 bytes numBlocks
+// for each block, 4 bytes numAdds, then each add's hash and 1 byte remember,
+// then 4 bytes numDels and 8 bytes for each del
+func (rp *RangeProof) Serialize(w io.Writer) error {
+	err := binary.Write(w, binary.BigEndian, rp.NumLeaves)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.BigEndian, uint32(len(rp.Roots)))
+	if err != nil {
+		return err
+	}
+	for _, root := range rp.Roots {
+		_, err = w.Write(root[:])
+		if err != nil {
+			return err
+		}
+	}
+	err = rp.Proof.Serialize(w)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(w, binary.BigEndian, uint32(len(rp.Blocks)))
+	if err != nil {
+		return err
+	}
+	for _, b := range rp.Blocks {
+		err = binary.Write(w, binary.BigEndian, uint32(len(b.Adds)))
+		if err != nil {
+			return err
+		}
+		for _, a := range b.Adds {
+			var remember byte
+			if a.Remember {
+				remember = 1
+			}
+			_, err = w.Write(append(a.Hash[:], remember))
+			if err != nil {
+				return err
+			}
+		}
+		err = binary.Write(w, binary.BigEndian, uint32(len(b.Dels)))
+		if err != nil {
+			return err
+		}
+		for _, del := range b.Dels {
+			err = binary.Write(w, binary.BigEndian, del)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SerializeSize is how many bytes Serialize writes
+func (rp *RangeProof) SerializeSize() int {
+	size := 8 + 4 + (len(rp.Roots) * 32) + rp.Proof.SerializeSize() + 4
+	for _, b := range rp.Blocks {
+		size += 4 + (len(b.Adds) * 33) + 4 + (len(b.Dels) * 8)
+	}
+	return size
+}
+
+// Deserialize reads in a RangeProof written by Serialize
+func (rp *RangeProof) Deserialize(r io.Reader) error {
+	err := binary.Read(r, binary.BigEndian, &rp.NumLeaves)
+	if err != nil {
+		return err
+	}
+	var numRoots uint32
+	err = binary.Read(r, binary.BigEndian, &numRoots)
+	if err != nil {
+		return err
+	}
+	if numRoots > 64 {
+		return fmt.Errorf("RangeProof has %d roots, max 64", numRoots)
+	}
+	rp.Roots = make([]Hash, numRoots)
+	for i := range rp.Roots {
+		_, err = io.ReadFull(r, rp.Roots[i][:])
+		if err != nil {
+			return err
+		}
+	}
+	err = rp.Proof.Deserialize(r)
+	if err != nil {
+		return err
+	}
+
+	var numBlocks uint32
+	err = binary.Read(r, binary.BigEndian, &numBlocks)
+	if err != nil {
+		return err
+	}
+	rp.Blocks = nil
+	for i := uint32(0); i < numBlocks; i++ {
+		var b RangeBlock
+		var numAdds, numDels uint32
+		err = binary.Read(r, binary.BigEndian, &numAdds)
+		if err != nil {
+			return err
+		}
+		var add [33]byte
+		for j := uint32(0); j < numAdds; j++ {
+			_, err = io.ReadFull(r, add[:])
+			if err != nil {
+				return err
+			}
+			var a Leaf
+			copy(a.Hash[:], add[:32])
+			a.Remember = add[32] != 0
+			b.Adds = append(b.Adds, a)
+		}
+		err = binary.Read(r, binary.BigEndian, &numDels)
+		if err != nil {
+			return err
+		}
+		for j := uint32(0); j < numDels; j++ {
+			var del uint64
+			err = binary.Read(r, binary.BigEndian, &del)
+			if err != nil {
+				return err
+			}
+			b.Dels = append(b.Dels, del)
+		}
+		rp.Blocks = append(rp.Blocks, b)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package accumulator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestRangeProof catches a pollard up over ranges of blocks with RangeProofs,
+// next to a forest going block by block, and checks the RangeProofs are
+// smaller than the block proofs they replace
+func TestRangeProof(t *testing.T) {
+	for _, scheme := range []HashScheme{LegacyHash, TaggedHashV1} {
+		f := NewForest(RamForest, nil, "", 0, scheme, nil)
+		rangeF := NewForest(RamForest, nil, "", 0, scheme, nil)
+		p := NewPollard(scheme, nil)
+		sc := newSimChain(0x1f)
+
+		for _, blocks := range []int{1, 5, 30, 12, 60, 2, 90, 7, 33} {
+			var adds [][]Leaf
+			var delHashes [][]Hash
+			var blockProofHashes int
+			for b := 0; b < blocks; b++ {
+				blockAdds, _, dels := sc.NextBlock(50)
+				adds = append(adds, blockAdds)
+				delHashes = append(delHashes, dels)
+
+				bp, err := f.ProveBatch(dels)
+				if err != nil {
+					t.Fatal(err)
+				}
+				blockProofHashes += len(bp.Proof)
+				_, err = f.Modify(blockAdds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rp, _, err := rangeF.ProveRange(adds, delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = rangeF.AssertEqual(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rp.Proof.Proof) > blockProofHashes {
+				t.Fatalf("%d blocks range proof %d hashes, block proofs %d",
+					blocks, len(rp.Proof.Proof), blockProofHashes)
+			}
+
+			var buf bytes.Buffer
+			err = rp.Serialize(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != rp.SerializeSize() {
+				t.Fatalf("wrote %d bytes, SerializeSize %d",
+					buf.Len(), rp.SerializeSize())
+			}
+			var readRP RangeProof
+			err = readRP.Deserialize(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(normalRangeProof(rp), normalRangeProof(readRP)) {
+				t.Fatalf("deserialized a different range proof")
+			}
+
+			err = p.IngestRangeProof(readRP, delHashes)
+			if err != nil {
+				t.Fatalf("%d blocks: %s", blocks, err.Error())
+			}
+			if !reflect.DeepEqual(p.GetRoots(), f.GetRoots()) {
+				t.Fatalf("%d blocks: pollard roots differ from forest", blocks)
+			}
+			// a range proof for somewhere else doesn't go in
+			if blocks > 1 && p.IngestRangeProof(rp, delHashes) == nil {
+				t.Fatal("ingested a range proof for a different start")
+			}
+		}
+	}
+}
+
+// normalRangeProof makes empty slices nil so deserialized range proofs can
+// be compared to what was serialized
+func normalRangeProof(rp RangeProof) RangeProof {
+	if len(rp.Proof.Targets) == 0 {
+		rp.Proof.Targets = nil
+	}
+	if len(rp.Proof.Proof) == 0 {
+		rp.Proof.Proof = nil
+	}
+	blocks := make([]RangeBlock, len(rp.Blocks))
+	for i, b := range rp.Blocks {
+		if len(b.Adds) != 0 {
+			blocks[i].Adds = b.Adds
+		}
+		if len(b.Dels) != 0 {
+			blocks[i].Dels = b.Dels
+		}
+	}
+	rp.Blocks = blocks
+	return rp
+}
+
+// TestRangeProofBadDels checks a RangeProof that deletes the wrong positions
+// doesn't go in
+func TestRangeProofBadDels(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
+	p := NewPollard(LegacyHash, nil)
+	sc := newSimChain(0x1f)
+	for b := 0; b < 20; b++ {
+		adds, _, dels := sc.NextBlock(50)
+		bp, err := f.ProveBatch(dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.IngestBatchProof(dels, bp, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var adds [][]Leaf
+	var delHashes [][]Hash
+	for b := 0; b < 10; b++ {
+		blockAdds, _, dels := sc.NextBlock(50)
+		adds = append(adds, blockAdds)
+		delHashes = append(delHashes, dels)
+	}
+	rp, _, err := f.ProveRange(adds, delHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := false
+	for i := range rp.Blocks {
+		dels := rp.Blocks[i].Dels
+		if len(dels) > 1 {
+			dels[0], dels[1] = dels[1], dels[0]
+			swapped = true
+			break
+		}
+	}
+	if !swapped {
+		t.Fatal("no block with two deletes")
+	}
+	if p.IngestRangeProof(rp, delHashes) == nil {
+		t.Fatal("ingested a range proof deleting the wrong positions")
+	}
+}
@@ -0,0 +1,117 @@
+package accumulator
+
+import (
+	"sync"
+)
+
+// SafeForest is a Forest that other goroutines can read while it's being
+// modified, like a bridge serving proofs while it builds them.  Modify,
+// Undo and Update take a write lock, and everything else a read lock, so
+// readers always see the forest after some whole block, and know which.
+//
+// The ram, disk and mmap forests can be read from many goroutines at once.
+// The cache and cow forests move pages around even when they're only read,
+// so readers of those take turns.
+type SafeForest struct {
+	mu sync.RWMutex
+	// readMu is held by readers too when the forest can't share reads
+	readMu      sync.Mutex
+	sharedReads bool
+
+	forest *Forest
+	height int32
+}
+
+// NewSafeForest wraps f, which is at the block at height.  f shouldn't be
+// used on its own after this.
+func NewSafeForest(f *Forest, height int32) *SafeForest {
+	s := &SafeForest{forest: f, height: height}
+	switch f.data.(type) {
+	case *ramForestData, *diskForestData, *mmapForestData:
+		s.sharedReads = true
+	}
+	return s
+}
+
+// Update runs fn with the forest locked for writing, and after it returns
+// nil the forest is at height.  Anything that has to change along with the
+// forest, like an index of its leaves, can be changed in fn so readers
+// never see one without the other.
+func (s *SafeForest) Update(height int32, fn func(f *Forest) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := fn(s.forest)
+	if err != nil {
+		return err
+	}
+	s.height = height
+	return nil
+}
+
+// View runs fn with the forest locked for reading.  The forest is at
+// height, and stays there until fn returns.  fn mustn't change it.
+func (s *SafeForest) View(fn func(f *Forest, height int32) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.sharedReads {
+		s.readMu.Lock()
+		defer s.readMu.Unlock()
+	}
+	return fn(s.forest, s.height)
+}
+
+// Modify modifies the forest for the block at height
+func (s *SafeForest) Modify(height int32, adds []Leaf, dels []uint64) (
+	ub *UndoBlock, err error) {
+
+	err = s.Update(height, func(f *Forest) error {
+		ub, err = f.Modify(adds, dels)
+		return err
+	})
+	return
+}
+
+// Undo undoes the block ub is for, taking the forest back to the block
+// before it
+func (s *SafeForest) Undo(ub UndoBlock) error {
+	return s.Update(ub.Height-1, func(f *Forest) error {
+		return f.Undo(ub)
+	})
+}
+
+// ProveBatch proves hs, and gives the height it proved them at
+func (s *SafeForest) ProveBatch(hs []Hash) (
+	bp BatchProof, height int32, err error) {
+
+	err = s.View(func(f *Forest, h int32) error {
+		height = h
+		bp, err = f.ProveBatch(hs)
+		return err
+	})
+	return
+}
+
+// GetRoots gives the roots, and the height they're at
+func (s *SafeForest) GetRoots() (roots []Hash, height int32) {
+	s.View(func(f *Forest, h int32) error {
+		roots, height = f.GetRoots(), h
+		return nil
+	})
+	return
+}
+
+// FindLeaf says if leaf is in the forest, and the height it looked at
+func (s *SafeForest) FindLeaf(leaf Hash) (found bool, height int32) {
+	s.View(func(f *Forest, h int32) error {
+		found, height = f.FindLeaf(leaf), h
+		return nil
+	})
+	return
+}
+
+// Height is the block the forest is at
+func (s *SafeForest) Height() int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.height
+}
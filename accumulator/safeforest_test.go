@@ -0,0 +1,139 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestSafeForest proves leaves from a few goroutines while another one
+// modifies the forest, and checks every proof and set of roots is the one
+// for the height it says it's from
+func TestSafeForest(t *testing.T) {
+	for _, forestType := range []ForestType{RamForest, CacheForest} {
+		var f *Forest
+		if forestType == CacheForest {
+			file, err := ioutil.TempFile("", "safeforest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(file.Name())
+			f = NewForest(CacheForest, file, "", 1, TaggedHashV1, nil)
+		} else {
+			f = NewForest(RamForest, nil, "", 0, TaggedHashV1, nil)
+		}
+
+		// keep is added in the first block and never deleted
+		keep := make([]Leaf, 20)
+		for i := range keep {
+			keep[i].Hash[0] = 0xff
+			keep[i].Hash[1] = byte(i)
+		}
+		_, err := f.Modify(keep, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keepHashes := make([]Hash, len(keep))
+		for i, l := range keep {
+			keepHashes[i] = l.Hash
+		}
+
+		sf := NewSafeForest(f, 1)
+		var rootsMu sync.Mutex
+		rootsAt := map[int32][]Hash{1: f.GetRoots()}
+		numLeavesAt := map[int32]uint64{1: f.NumLeaves()}
+
+		done := make(chan struct{})
+		errs := make(chan error, 4)
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func(r int) {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					proven := keepHashes[r : r+5]
+					bp, h, err := sf.ProveBatch(proven)
+					if err != nil {
+						errs <- err
+						return
+					}
+					rootsMu.Lock()
+					roots, numLeaves := rootsAt[h], numLeavesAt[h]
+					rootsMu.Unlock()
+					p, err := NewPollardFromRoots(numLeaves, roots, TaggedHashV1, nil)
+					if err != nil {
+						errs <- err
+						return
+					}
+					err = p.VerifyBatchProof(proven, bp)
+					if err != nil {
+						errs <- fmt.Errorf("h %d: %s", h, err.Error())
+						return
+					}
+					got, gotH := sf.GetRoots()
+					rootsMu.Lock()
+					want := rootsAt[gotH]
+					rootsMu.Unlock()
+					if !reflect.DeepEqual(got, want) {
+						errs <- fmt.Errorf("roots for h %d aren't the ones "+
+							"recorded", gotH)
+						return
+					}
+				}
+			}(r)
+		}
+
+		// every block adds 10 leaves and deletes the ones from the block
+		// before, except for keep
+		var last []Hash
+		for h := int32(2); h <= 200; h++ {
+			adds := make([]Leaf, 10)
+			for i := range adds {
+				adds[i].Hash[0] = byte(h)
+				adds[i].Hash[1] = byte(h >> 8)
+				adds[i].Hash[2] = byte(i)
+			}
+			err = sf.Update(h, func(f *Forest) error {
+				bp, err := f.ProveBatch(last)
+				if err != nil {
+					return err
+				}
+				_, err = f.Modify(adds, bp.Targets)
+				if err != nil {
+					return err
+				}
+				rootsMu.Lock()
+				rootsAt[h], numLeavesAt[h] = f.GetRoots(), f.NumLeaves()
+				rootsMu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			last = last[:0]
+			for _, a := range adds {
+				last = append(last, a.Hash)
+			}
+			if found, _ := sf.FindLeaf(last[3]); !found {
+				t.Fatalf("h %d didn't find a leaf just added", h)
+			}
+		}
+		close(done)
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("%d: %s", forestType, err.Error())
+		}
+		if sf.Height() != 200 {
+			t.Fatalf("height %d, expect 200", sf.Height())
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package accumulator
+
+import (
+	"fmt"
+	"io"
+)
+
+// The sets here are for using the accumulator as a plain set of hashes,
+// for things that aren't Bitcoin (revocation lists, membership sets...).
+// Everything is in terms of hashes, never positions or remember bits.
+//
+// A FullSet keeps every hash in a forest, so it can prove anything in the
+// set.  A CompactSet only keeps a pollard, so it's small but has to be
+// given a proof to delete anything.  A FullSet can give out the proofs a
+// CompactSet needs, as long as both have seen the same inserts and deletes
+// in the same order.
+//
+// All of them take the hashes they work on as ...Hash.
+
+// SetProof proves some hashes are in a set.  It's what a FullSet's Prove
+// gives and a CompactSet's Delete takes, and is only good until the set
+// changes.
+type SetProof struct {
+	bp BatchProof
+}
+
+// Serialize writes the proof to w
+func (sp *SetProof) Serialize(w io.Writer) error {
+	return sp.bp.Serialize(w)
+}
+
+// Deserialize reads a proof written by Serialize from r
+func (sp *SetProof) Deserialize(r io.Reader) error {
+	return sp.bp.Deserialize(r)
+}
+
+// FullSet is a set of hashes backed by a Forest in ram
+type FullSet struct {
+	f *Forest
+}
+
+// NewFullSet gives an empty FullSet using the given hash scheme and hasher.
+// A nil hasher is the DefaultHasher.
+func NewFullSet(scheme HashScheme, hasher Hasher) *FullSet {
+	return &FullSet{f: NewForest(RamForest, nil, "", 0, scheme, hasher)}
+}
+
+// Insert adds hashes to the set.  Hashes already in the set, or in hs more
+// than once, are an error and nothing gets added.
+func (s *FullSet) Insert(hs ...Hash) error {
+	adds, err := toAdds(hs)
+	if err != nil {
+		return err
+	}
+	for _, h := range hs {
+		if s.Has(h) {
+			return fmt.Errorf("Insert: %x already in set", h)
+		}
+	}
+	_, err = s.f.Modify(adds, nil)
+	return err
+}
+
+// Delete takes hashes out of the set.  If any of them aren't in the set
+// nothing gets deleted.
+func (s *FullSet) Delete(hs ...Hash) error {
+	dels, err := s.positions(hs)
+	if err != nil {
+		return err
+	}
+	_, err = s.f.Modify(nil, dels)
+	return err
+}
+
+// Has says if h is in the set
+func (s *FullSet) Has(h Hash) bool {
+	_, ok := s.position(h)
+	return ok
+}
+
+// Prove gives a proof for all the hashes in hs.  It's only good until the
+// set changes.
+func (s *FullSet) Prove(hs ...Hash) (SetProof, error) {
+	targets, err := s.positions(hs)
+	if err != nil {
+		return SetProof{}, err
+	}
+	// made here instead of with ProveBatch, which leaves out the targets
+	// when there's only one leaf.  They're needed to delete with.
+	sorted := make([]uint64, len(targets))
+	copy(sorted, targets)
+	sortUint64s(sorted)
+	var proofPositions []uint64
+	ProofPositions(sorted, s.f.numLeaves, s.f.rows, &proofPositions)
+	bp := BatchProof{Targets: targets, Proof: make([]Hash, len(proofPositions))}
+	for i, pos := range proofPositions {
+		bp.Proof[i] = s.f.data.read(pos)
+	}
+	return SetProof{bp: bp}, nil
+}
+
+// Verify checks that sp proves all of hs are in the set
+func (s *FullSet) Verify(sp SetProof, hs ...Hash) error {
+	return verifySet(hs, sp.bp, s.f.numLeaves, s.f.VerifyBatchProof)
+}
+
+// Roots gives the roots of the set's accumulator
+func (s *FullSet) Roots() []Hash {
+	return s.f.GetRoots()
+}
+
+// Len is how many hashes are in the set
+func (s *FullSet) Len() uint64 {
+	return s.f.numLeaves
+}
+
+// position gives where h is in the forest
+func (s *FullSet) position(h Hash) (uint64, bool) {
+	return s.f.leafPosition(h)
+}
+
+// positions gives the positions of all of hs, erroring if any of them are
+// missing or repeated
+func (s *FullSet) positions(hs []Hash) ([]uint64, error) {
+	seen := make(map[Hash]bool, len(hs))
+	positions := make([]uint64, len(hs))
+	for i, h := range hs {
+		if seen[h] {
+			return nil, fmt.Errorf("%x given more than once", h)
+		}
+		seen[h] = true
+		pos, ok := s.position(h)
+		if !ok {
+			return nil, fmt.Errorf("%x not in set", h)
+		}
+		positions[i] = pos
+	}
+	return positions, nil
+}
+
+// CompactSet is a set of hashes backed by a Pollard.  It only keeps the
+// roots, so deleting needs a proof.
+type CompactSet struct {
+	p Pollard
+}
+
+// NewCompactSet gives an empty CompactSet using the given hash scheme and
+// hasher.  A nil hasher is the DefaultHasher.
+func NewCompactSet(scheme HashScheme, hasher Hasher) *CompactSet {
+	return &CompactSet{p: NewPollard(scheme, hasher)}
+}
+
+// Insert adds hashes to the set.  Hashes in hs more than once are an error.
+// A CompactSet doesn't know what's in it, so it can't tell if the hashes
+// are already there; inserting them again means the set has them twice.
+func (s *CompactSet) Insert(hs ...Hash) error {
+	adds, err := toAdds(hs)
+	if err != nil {
+		return err
+	}
+	_, err = s.p.Modify(adds, nil)
+	return err
+}
+
+// Delete takes hashes out of the set after checking sp proves they're all
+// in it.  If the proof doesn't check out nothing gets deleted.
+func (s *CompactSet) Delete(sp SetProof, hs ...Hash) error {
+	if len(hs) == 0 {
+		return nil
+	}
+	bp := sp.bp
+	err := checkSetProof(hs, bp, s.p.numLeaves)
+	if err != nil {
+		return err
+	}
+	err = s.p.IngestBatchProof(hs, bp, false)
+	if err != nil {
+		return err
+	}
+	_, err = s.p.Modify(nil, bp.Targets)
+	return err
+}
+
+// Verify checks that sp proves all of hs are in the set
+func (s *CompactSet) Verify(sp SetProof, hs ...Hash) error {
+	return verifySet(hs, sp.bp, s.p.numLeaves, s.p.VerifyBatchProof)
+}
+
+// Roots gives the roots of the set's accumulator
+func (s *CompactSet) Roots() []Hash {
+	return s.p.GetRoots()
+}
+
+// Len is how many hashes are in the set
+func (s *CompactSet) Len() uint64 {
+	return s.p.numLeaves
+}
+
+// toAdds turns hashes into leaves to add, erroring on empty or repeated ones
+func toAdds(hs []Hash) ([]Leaf, error) {
+	seen := make(map[Hash]bool, len(hs))
+	adds := make([]Leaf, len(hs))
+	for i, h := range hs {
+		if h == empty {
+			return nil, fmt.Errorf("can't insert empty (all 0s) hash")
+		}
+		if seen[h] {
+			return nil, fmt.Errorf("%x given more than once", h)
+		}
+		seen[h] = true
+		adds[i].Hash = h
+	}
+	return adds, nil
+}
+
+// checkSetProof makes sure bp has a target for every hash, all of them
+// leaves, and no target twice.  verifyBatchProof says an empty proof is fine
+// no matter what it's for, which isn't what a set wants.
+func checkSetProof(hs []Hash, bp BatchProof, numLeaves uint64) error {
+	if len(bp.Targets) != len(hs) {
+		return fmt.Errorf("proof has %d targets for %d hashes",
+			len(bp.Targets), len(hs))
+	}
+	seen := make(map[uint64]bool, len(bp.Targets))
+	for _, pos := range bp.Targets {
+		if pos >= numLeaves {
+			return fmt.Errorf("proof target %d but set has %d hashes",
+				pos, numLeaves)
+		}
+		if seen[pos] {
+			return fmt.Errorf("proof has target %d more than once", pos)
+		}
+		seen[pos] = true
+	}
+	return nil
+}
+
+// verifySet checks the proof's shape and then has verify check the hashes
+func verifySet(hs []Hash, bp BatchProof, numLeaves uint64,
+	verify func([]Hash, BatchProof) error) error {
+
+	if len(hs) == 0 {
+		return nil
+	}
+	err := checkSetProof(hs, bp, numLeaves)
+	if err != nil {
+		return err
+	}
+	return verify(hs, bp)
+}
@@ -0,0 +1,216 @@
+package accumulator
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// TestSets inserts and deletes random hashes in a FullSet and a CompactSet,
+// with the FullSet giving the CompactSet its proofs, and checks they agree
+func TestSets(t *testing.T) {
+	for _, scheme := range []HashScheme{LegacyHash, TaggedHashV1} {
+		full := NewFullSet(scheme, nil)
+		compact := NewCompactSet(scheme, nil)
+		rnd := rand.New(rand.NewSource(7))
+		var in []Hash
+
+		for b := 0; b < 100; b++ {
+			// delete some random ones
+			var dels []Hash
+			for i := rnd.Intn(len(in) + 1); i > 0; i-- {
+				j := rnd.Intn(len(in))
+				dels = append(dels, in[j])
+				in[j] = in[len(in)-1]
+				in = in[:len(in)-1]
+			}
+			sp, err := full.Prove(dels...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the compact set gets the proof over the wire
+			var buf bytes.Buffer
+			err = sp.Serialize(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sent SetProof
+			err = sent.Deserialize(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = compact.Verify(sent, dels...)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+			err = compact.Delete(sent, dels...)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+			err = full.Delete(dels...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range dels {
+				if full.Has(h) {
+					t.Fatalf("block %d deleted %x still there", b, h)
+				}
+			}
+
+			// and insert some new ones
+			adds := make([]Hash, rnd.Intn(8))
+			for i := range adds {
+				rnd.Read(adds[i][:])
+			}
+			in = append(in, adds...)
+			err = full.Insert(adds...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = compact.Insert(adds...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(full.Roots(), compact.Roots()) {
+				t.Fatalf("block %d roots differ", b)
+			}
+			if full.Len() != uint64(len(in)) || compact.Len() != uint64(len(in)) {
+				t.Fatalf("block %d have %d %d want %d",
+					b, full.Len(), compact.Len(), len(in))
+			}
+		}
+	}
+}
+
+// TestSetErrors makes sure bad inserts, deletes and proofs are errors and
+// don't change the sets
+func TestSetErrors(t *testing.T) {
+	full := NewFullSet(TaggedHashV1, SHA256{})
+	compact := NewCompactSet(TaggedHashV1, SHA256{})
+	hs := []Hash{{1}, {2}, {3}, {4}, {5}}
+	for _, s := range []interface{ Insert(...Hash) error }{full, compact} {
+		err := s.Insert(hs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Insert(Hash{6}, Hash{6}) == nil {
+			t.Fatal("inserted a hash twice in one go")
+		}
+		if s.Insert(empty) == nil {
+			t.Fatal("inserted empty hash")
+		}
+	}
+	if full.Insert(hs[0]) == nil {
+		t.Fatal("inserted a hash already in the full set")
+	}
+	if full.Delete(Hash{9}) == nil {
+		t.Fatal("deleted a hash not in the full set")
+	}
+	if _, err := full.Prove(hs[1], hs[1]); err == nil {
+		t.Fatal("proved a hash twice")
+	}
+	roots := full.Roots()
+
+	sp, err := full.Prove(hs[1:3]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// proof for the wrong hashes
+	if compact.Delete(sp, hs[1], hs[4]) == nil {
+		t.Fatal("deleted with a proof for other hashes")
+	}
+	// proof with no targets
+	if compact.Verify(SetProof{}, hs[1:3]...) == nil {
+		t.Fatal("verified with an empty proof")
+	}
+	if !reflect.DeepEqual(roots, compact.Roots()) {
+		t.Fatal("failed delete changed the compact set")
+	}
+
+	// down to one hash, which is its own root
+	sp, err = full.Prove(hs[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compact.Delete(sp, hs[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = full.Delete(hs[1:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err = full.Prove(hs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compact.Delete(sp, hs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compact.Len() != 0 {
+		t.Fatalf("compact set has %d left", compact.Len())
+	}
+}
+
+// TestSetRootForgery tries proofs with a non-member at a root position,
+// where the leaf is its own tree, on Verify and Delete
+func TestSetRootForgery(t *testing.T) {
+	x := Hash{0xee}
+	for _, hs := range [][]Hash{{{1}}, {{1}, {2}, {3}}} {
+		full := NewFullSet(TaggedHashV1, nil)
+		compact := NewCompactSet(TaggedHashV1, nil)
+		err := full.Insert(hs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compact.Insert(hs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := compact.Roots()
+
+		// the last leaf is a root in both sets
+		last := uint64(len(hs) - 1)
+		forged := SetProof{bp: BatchProof{Targets: []uint64{last}}}
+		if full.Verify(forged, x) == nil {
+			t.Fatalf("%d leaves: full set verified a non-member", len(hs))
+		}
+		if compact.Verify(forged, x) == nil {
+			t.Fatalf("%d leaves: compact set verified a non-member", len(hs))
+		}
+		if compact.Delete(forged, x) == nil {
+			t.Fatalf("%d leaves: compact set deleted a non-member", len(hs))
+		}
+		if !reflect.DeepEqual(roots, compact.Roots()) {
+			t.Fatalf("%d leaves: failed delete changed the set", len(hs))
+		}
+		outside := SetProof{bp: BatchProof{Targets: []uint64{last + 1}}}
+		if compact.Verify(outside, x) == nil {
+			t.Fatalf("%d leaves: verified a target past the leaves", len(hs))
+		}
+
+		// the real member there still proves and deletes
+		sp, err := full.Prove(hs[last])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = compact.Verify(sp, hs[last])
+		if err != nil {
+			t.Fatalf("%d leaves: %s", len(hs), err.Error())
+		}
+		err = compact.Delete(sp, hs[last])
+		if err != nil {
+			t.Fatalf("%d leaves: %s", len(hs), err.Error())
+		}
+		err = full.Delete(hs[last])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(full.Roots(), compact.Roots()) {
+			t.Fatalf("%d leaves: roots differ after delete", len(hs))
+		}
+	}
+}
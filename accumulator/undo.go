@@ -141,7 +141,7 @@ func (f *Forest) Undo(ub UndoBlock) error {
 
 	// remove everything between prevNumLeaves and numLeaves from positionMap
 	for p := f.numLeaves; p < f.numLeaves+prevAdds; p++ {
-		delete(f.positionMap, f.data.read(p).Mini())
+		f.positionMap.Delete(f.data.read(p))
 	}
 
 	// also add everything past numleaves and prevnumleaves to dirt
@@ -169,19 +169,18 @@ func (f *Forest) Undo(ub UndoBlock) error {
 	// update positionMap.  The stuff we do want has been moved in to the forest,
 	// the stuff we don't want has been moved to the right past the edge
 	for p := f.numLeaves; p < prevNumLeaves; p++ {
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.positionMap.Put(f.data.read(p), p)
 	}
 	for _, p := range ub.positions {
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.positionMap.Put(f.data.read(p), p)
 	}
 	for _, d := range dirt {
 		// everything that moved needs to have its position updated in the map
 		// TODO does it..?
-		m := f.data.read(d).Mini()
-		oldpos := f.positionMap[m]
-		if oldpos != d {
-			delete(f.positionMap, m)
-			f.positionMap[m] = d
+		h := f.data.read(d)
+		oldpos, ok := f.positionMap.Get(h)
+		if !ok || oldpos != d {
+			f.positionMap.Put(h, d)
 		}
 	}
 
@@ -193,7 +192,7 @@ func (f *Forest) Undo(ub UndoBlock) error {
 		return err
 	}
 
-	return nil
+	return f.commitPositionIndex()
 }
 
 // BuildUndoData makes an undoBlock from the same data that you'd give to Modify
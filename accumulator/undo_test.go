@@ -142,7 +142,7 @@ func TestUndoTest(t *testing.T) {
 }
 
 func undoOnceRandom(blocks int32) error {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 
 	sc := newSimChain(0x07)
 	sc.lookahead = 0
@@ -168,9 +168,7 @@ func undoOnceRandom(blocks int32) error {
 			fmt.Print(f.ToString())
 			fmt.Print(sc.ttlString())
 
-			for h, p := range f.positionMap {
-				fmt.Printf("%x@%d ", h[:4], p)
-			}
+			fmt.Print(f.PrintPositionMap())
 		}
 		err = f.PosMapSanity()
 		if err != nil {
@@ -188,9 +186,7 @@ func undoOnceRandom(blocks int32) error {
 			}
 			if verbose {
 				fmt.Print("\n post undo map: ")
-				for h, p := range f.positionMap {
-					fmt.Printf("%x@%d ", h[:4], p)
-				}
+				fmt.Print(f.PrintPositionMap())
 			}
 			sc.BackOne(adds, durations, delHashes)
 			afterRoot := f.GetRoots()
@@ -207,7 +203,7 @@ func undoOnceRandom(blocks int32) error {
 }
 
 func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
-	f := NewForest(RamForest, nil, "", 0)
+	f := NewForest(RamForest, nil, "", 0, LegacyHash, nil)
 	sc := newSimChain(0xff)
 
 	// --------------- block 0
@@ -261,9 +257,7 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 	for i, h := range undoneTops {
 		fmt.Printf("undoneTops %d %x\n", i, h)
 	}
-	for h, p := range f.positionMap {
-		fmt.Printf("%x@%d ", h[:4], p)
-	}
+	fmt.Print(f.PrintPositionMap())
 	fmt.Printf("tops: ")
 	for i, _ := range beforeTops {
 		fmt.Printf("pre %04x post %04x ", beforeTops[i][:4], undoneTops[i][:4])
@@ -3,25 +3,42 @@ package bridgenode
 import (
 	"flag"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
 )
 
 var HelpMsg = `
 Usage: server [OPTION]
+       server convert [OPTION]
+       server roots HEIGHT [OPTION]
 A dynamic hash based accumulator designed for the Bitcoin UTXO set
 The bridgenode server generates proofs and serves to the CSN node.
 
+SUBCOMMANDS:
+  convert                      convert the forest on disk to the -forest
+                               type and exit.  -forest=cow converts a disk,
+                               cache, mmap or ram forest to a cow forest,
+                               anything else converts a cow forest to the
+                               forest file the others use
+  roots HEIGHT                 print the number of leaves and the roots
+                               after the block at HEIGHT and exit.  CSNs
+                               can ask a running bridge for the same thing
+
 OPTIONS:
   -net=mainnet                 configure whether to use mainnet. Optional.
   -net=regtest                 configure whether to use regtest. Optional.
-  -forest                      select forest type to use (ram, cow, cache, disk). 
+  -forest                      select forest type to use (ram, cow, cache, disk, mmap). 
   Defaults to disk
   -net=signet                 configure whether to use signet. Optional.
-  -forest                      select forest type to use (ram, cow, cache, disk). Defaults to disk
+  -forest                      select forest type to use (ram, cow, cache, disk, mmap). Defaults to disk
 
   -datadir="path/to/directory" set a custom DATADIR.
                                Defaults to the Bitcoin Core DATADIR path
@@ -31,6 +48,46 @@ OPTIONS:
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
   -serve		       immediately serve whatever data is built
+  -checkheaders                validate the headers in the blk files (PoW,
+                               difficulty, timestamps, checkpoints)
+  -checkblocks                 validate every block before making proofs
+  -checksigs                   also validate scripts. Implies -checkblocks
+  -forestcache=64              MB of ram for the cache forest to keep pages
+                               of the forest in.  Hit rates are printed
+                               every 1000 blocks to help size it
+  -hashworkers=0               goroutines to hash the forest with. 0 is one
+                               per cpu, 1 hashes serially
+  -blockhashheight=-1          height from which leaves commit to their
+                               block hash.  Must match the CSNs.  Saved
+                               with the forest; -1 is the saved one, or 0
+                               for a new forest
+  -hashscheme=legacy           how the accumulator hashes: legacy or v1
+                               (tagged, row committing).  Must match the
+                               CSNs and the forest already on disk
+  -posindex                    keep the index of where leaves are in leveldb
+                               instead of ram.  Saves ram and a rebuild of
+                               the index on every restart
+  -aggregate=0                 also write a range proof for every this many
+                               blocks, for CSNs catching up with the same
+                               -rangeproofs.  0 is off
+  -opindex                     keep the leaf data of every utxo by outpoint
+                               in leveldb, so wallets can ask for proofs of
+                               their utxos at the tip.  Has to be on from
+                               the first block
+  -electrum=""                 keep a scripthash index and serve electrum
+                               wallets on this port, like 50001.  Has to be
+                               on from the first block
+  -http=""                     serve udata, blocks, roots, proofs and status
+                               over HTTP on this port, like 8080
+  -p2p=""                      serve ublocks and roots to bitcoin p2p peers
+                               on this port, like 8339
+  -listen=0.0.0.0:8338         address and port the bridge server listens on
+  -maxconns=125                most connections served at once.  0 is no limit
+  -maxperip=8                  most connections served at once to one IP.
+                               0 is no limit
+  -conntimeout=1m              how long each read from or write to a
+                               connection can take.  0 is forever
+  -ipkbps=0                    KB/s sent to each IP.  0 is no limit
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -44,17 +101,53 @@ var (
 	bridgeDirCmd = argCmd.String("bridgedir", "",
 		`Set a custom bridgenode datadir. Usage: "-bridgedir='path/to/directory"`)
 	forestTypeCmd = argCmd.String("forest", "disk",
-		`Set a forest type to use (cow, ram, disk, cache). Usage: "-forest=cow"`)
+		`Set a forest type to use (cow, ram, disk, cache, mmap). Usage: "-forest=cow"`)
 	quitAfterCmd = argCmd.Int("quitafter", -1,
 		`quit generating proofs after the given block height. (meant for testing)`)
 	cowMaxCache = argCmd.Int("cowmaxcache", 4000,
 		`how much memory to use in MB for the copy-on-write forest`)
+	forestCacheCmd = argCmd.Int("forestcache", 64,
+		`how much memory to use in MB for the cache forest`)
 	memTTL = argCmd.Bool("memttl", false,
 		`keep the ttls in memory instead of on disk. Uses lots of ram.`)
 	serve = argCmd.Bool("serve", false,
 		`immediately start server without building or checking proof data`)
 	noServeCmd = argCmd.Bool("noserve", false,
 		`don't serve proofs after finishing generating them`)
+	checkHeadersCmd = argCmd.Bool("checkheaders", false,
+		`validate headers from the blk files before building proofs`)
+	checkBlocksCmd = argCmd.Bool("checkblocks", false,
+		`validate each block (without scripts) before making its proof`)
+	checkSigsCmd = argCmd.Bool("checksigs", false,
+		`validate scripts too when checking blocks. Implies -checkblocks`)
+	hashWorkersCmd = argCmd.Int("hashworkers", 0,
+		`how many goroutines hash the forest. 0 is one per cpu`)
+	blockHashHeightCmd = argCmd.Int("blockhashheight", -1,
+		`height from which leaves commit to their block hash. Must match the CSNs. -1 is the one saved with the forest`)
+	hashSchemeCmd = argCmd.String("hashscheme", "legacy",
+		`how the accumulator hashes, legacy or v1. Must match the CSNs`)
+	posIndexCmd = argCmd.Bool("posindex", false,
+		`keep the leaf position index on disk in leveldb instead of in ram`)
+	aggregateCmd = argCmd.Int("aggregate", 0,
+		`write a range proof for every this many blocks. 0 is off`)
+	opIndexCmd = argCmd.Bool("opindex", false,
+		`keep an outpoint index to prove any utxo at the tip`)
+	electrumCmd = argCmd.String("electrum", "",
+		`keep a scripthash index and serve electrum wallets on this port`)
+	httpCmd = argCmd.String("http", "",
+		`serve bridge data over HTTP on this port`)
+	p2pCmd = argCmd.String("p2p", "",
+		`serve ublocks and roots to bitcoin p2p peers on this port`)
+	listenCmd = argCmd.String("listen", "0.0.0.0:8338",
+		`address and port the bridge server listens on`)
+	maxConnsCmd = argCmd.Int("maxconns", 125,
+		`most connections served at once. 0 is no limit`)
+	maxPerIPCmd = argCmd.Int("maxperip", 8,
+		`most connections served at once to one IP. 0 is no limit`)
+	connTimeoutCmd = argCmd.Duration("conntimeout", time.Minute,
+		`how long each read or write on a connection can take. 0 is forever`)
+	ipKBpsCmd = argCmd.Int("ipkbps", 0,
+		`KB/s sent to each IP. 0 is no limit`)
 	traceCmd = argCmd.String("trace", "",
 		`Enable trace. Usage: 'trace='path/to/file'`)
 	cpuProfCmd = argCmd.String("cpuprof", "",
@@ -73,8 +166,12 @@ type forestDir struct {
 	forestFile                      string
 	miscForestFile                  string
 	forestLastSyncedBlockHeightFile string
+	blockHashHeightFile             string
 	cowForestCurFile                string
 	cowForestDir                    string
+	positionIndexDir                string
+	outpointIndexDir                string
+	scriptHashIndexDir              string
 }
 
 type proofDir struct {
@@ -95,6 +192,17 @@ type undoDir struct {
 	undoFile   string
 	offsetFile string
 }
+type rangeDir struct {
+	base      string
+	rangeFile string
+}
+
+type rootsDir struct {
+	base       string
+	rootsFile  string
+	offsetFile string
+}
+
 type ttlDir struct {
 	base       string
 	ttlsetFile string
@@ -108,6 +216,8 @@ type utreeDir struct {
 	ForestDir forestDir
 	TtlDir    ttlDir
 	UndoDir   undoDir
+	RangeDir  rangeDir
+	RootsDir  rootsDir
 }
 
 // init an utreeDir with a selected basepath. Has all the names for the forest
@@ -136,8 +246,13 @@ func initUtreeDir(basePath string) utreeDir {
 		miscForestFile: filepath.Join(forestBase, "miscforestfile.dat"),
 		forestLastSyncedBlockHeightFile: filepath.Join(forestBase,
 			"forestlastsyncedheight.dat"),
-		cowForestDir:     cowDir,
-		cowForestCurFile: filepath.Join(cowDir, "CURRENT"),
+		cowForestDir:       cowDir,
+		cowForestCurFile:   filepath.Join(cowDir, "CURRENT"),
+		positionIndexDir:   filepath.Join(forestBase, "posindex"),
+		outpointIndexDir:   filepath.Join(forestBase, "opindex"),
+		scriptHashIndexDir: filepath.Join(forestBase, "scripthashindex"),
+		blockHashHeightFile: filepath.Join(forestBase,
+			"blockhashheight.dat"),
 	}
 	ttlBase := filepath.Join(basePath, "ttldata")
 	ttl := ttlDir{
@@ -151,6 +266,17 @@ func initUtreeDir(basePath string) utreeDir {
 		undoFile:   filepath.Join(undoBase, "undo.dat"),
 		offsetFile: filepath.Join(undoBase, "offset.dat"),
 	}
+	rangeBase := filepath.Join(basePath, "rangedata")
+	rangeProofs := rangeDir{
+		base:      rangeBase,
+		rangeFile: filepath.Join(rangeBase, "range.dat"),
+	}
+	rootsBase := filepath.Join(basePath, "rootsdata")
+	roots := rootsDir{
+		base:       rootsBase,
+		rootsFile:  filepath.Join(rootsBase, "roots.dat"),
+		offsetFile: filepath.Join(rootsBase, "rootsoffset.dat"),
+	}
 
 	return utreeDir{
 		OffsetDir: off,
@@ -158,6 +284,8 @@ func initUtreeDir(basePath string) utreeDir {
 		ForestDir: forest,
 		TtlDir:    ttl,
 		UndoDir:   undo,
+		RangeDir:  rangeProofs,
+		RootsDir:  roots,
 	}
 }
 
@@ -181,15 +309,23 @@ func makePaths(dir utreeDir) error {
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.UndoDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
+	}
+	err = os.MkdirAll(dir.RangeDir.base, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("init makePaths error %s", err.Error())
+	}
+	err = os.MkdirAll(dir.RootsDir.base, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	return nil
 }
@@ -209,6 +345,9 @@ const (
 
 	// keeps the entire forest in ram. doable if theres lots of ram (30GB+)
 	ramForest
+
+	// the diskForest file mmapped. Same file as disk so you can switch
+	mmapForest
 )
 
 // all the configs for utreexoserver
@@ -232,6 +371,9 @@ type Config struct {
 	// how much cache to allow for cowforest
 	cowMaxCache int
 
+	// how much cache to allow for the cache forest, in MB
+	forestCache int
+
 	// keep ttls in memory
 	memTTL bool
 
@@ -241,6 +383,51 @@ type Config struct {
 	// don't serve after generating proofs
 	noServe bool
 
+	// validate headers from the blk files instead of trusting them
+	checkHeaders bool
+
+	// validate blocks before making proofs for them
+	checkBlocks bool
+
+	// validate scripts as well when checking blocks
+	checkSigs bool
+
+	// leaves created from this height on commit to their block hash.
+	// btcacc.NoSwitchHeight until the forest is made or restored
+	blockHashHeight int32
+
+	// how many goroutines hash the forest
+	hashWorkers int
+
+	// how the forest hashes leaves and parents
+	hashScheme accumulator.HashScheme
+
+	// keep the forest's position index in leveldb instead of ram
+	diskPosIndex bool
+
+	// write a range proof for every this many blocks
+	aggregate int
+
+	// keep the LeafData of every utxo by outpoint, to prove them on request
+	opIndex bool
+
+	// port to serve electrum wallets on, with a scripthash index.  "" is off
+	electrum string
+
+	// port to serve bridge data over HTTP on.  "" is off
+	httpPort string
+
+	// port to serve ublocks to bitcoin p2p peers on.  "" is off
+	p2pPort string
+
+	// where the bridge server listens
+	listenAddr string
+
+	// connection limits for the bridge server; 0 is no limit
+	maxConns, maxPerIP int
+	connTimeout        time.Duration
+	ipKBps             int
+
 	// enable tracing
 	TraceProf string
 
@@ -255,6 +442,16 @@ type Config struct {
 }
 
 // Parse parses the command line arguments and inits the server Config
+// withDefaultPort gives addr with port on the end if it doesn't have one.
+// addr can be a bare IPv6 address, with or without brackets.
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	return net.JoinHostPort(host, port)
+}
+
 func Parse(args []string) (*Config, error) {
 	argCmd.Parse(args)
 
@@ -324,18 +521,53 @@ func Parse(args []string) (*Config, error) {
 		cfg.forestType = diskForest
 	case "cache":
 		cfg.forestType = cacheForest
+		cfg.forestCache = *forestCacheCmd
 	case "cow":
 		cfg.forestType = cowForest
-		cfg.cowMaxCache = *cowMaxCache
 	case "ram":
 		cfg.forestType = ramForest
+	case "mmap":
+		cfg.forestType = mmapForest
 	default:
 		return nil, errWrongForestType(*forestTypeCmd)
 	}
 
+	// converting from a cow forest needs this too
+	cfg.cowMaxCache = *cowMaxCache
 	cfg.quitAfter = int32(*quitAfterCmd)
 	cfg.noServe = *noServeCmd
 	cfg.serve = *serve
+	cfg.checkHeaders = *checkHeadersCmd
+	cfg.checkSigs = *checkSigsCmd
+	cfg.checkBlocks = *checkBlocksCmd || cfg.checkSigs
+	cfg.blockHashHeight = int32(*blockHashHeightCmd)
+	cfg.hashWorkers = *hashWorkersCmd
+	cfg.diskPosIndex = *posIndexCmd
+	cfg.aggregate = *aggregateCmd
+	cfg.opIndex = *opIndexCmd
+	cfg.electrum = *electrumCmd
+	cfg.httpPort = *httpCmd
+	cfg.p2pPort = *p2pCmd
+	if cfg.blockHashHeight < btcacc.NoSwitchHeight {
+		return nil, fmt.Errorf("-blockhashheight=%d, can't be below -1",
+			cfg.blockHashHeight)
+	}
+	if cfg.aggregate < 0 {
+		return nil, fmt.Errorf("-aggregate=%d, can't be negative", cfg.aggregate)
+	}
+	cfg.listenAddr = withDefaultPort(*listenCmd, "8338")
+	cfg.maxConns = *maxConnsCmd
+	cfg.maxPerIP = *maxPerIPCmd
+	cfg.connTimeout = *connTimeoutCmd
+	cfg.ipKBps = *ipKBpsCmd
+	if cfg.maxConns < 0 || cfg.maxPerIP < 0 || cfg.connTimeout < 0 ||
+		cfg.ipKBps < 0 {
+		return nil, fmt.Errorf("connection limits can't be negative")
+	}
+	cfg.hashScheme, err = accumulator.ParseHashScheme(*hashSchemeCmd)
+	if err != nil {
+		return nil, err
+	}
 
 	return &cfg, nil
 }
@@ -0,0 +1,293 @@
+package bridgenode
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxWriteChunk is the most written to a connection at once, so bandwidth
+// limits and write deadlines apply to big blocks a bit at a time
+const maxWriteChunk = 32 * 1024
+
+// maxAcceptDelay is the longest accept waits after an error before trying
+// again
+const maxAcceptDelay = time.Second
+
+// connLimiter keeps track of the connections a server is serving.  It caps
+// how many there are, in total and from each IP, gives each read and write
+// a deadline, and limits how fast each IP is sent to.
+type connLimiter struct {
+	maxConns, maxPerIP int
+	// how long each read or write can take.  0 is forever
+	readTimeout, writeTimeout time.Duration
+	// bytes per second each IP is sent.  0 is no limit
+	ipRate int
+
+	mu       sync.Mutex
+	conns    map[*limitedConn]struct{}
+	ips      map[string]*ipConns
+	shutdown bool
+	// one for every connection being served
+	wg sync.WaitGroup
+}
+
+// ipConns is the connections from one IP
+type ipConns struct {
+	count int
+	// shared by all of them; nil without a bandwidth limit
+	rate *rateLimit
+}
+
+func newConnLimiter(cfg *Config) *connLimiter {
+	return &connLimiter{
+		maxConns:     cfg.maxConns,
+		maxPerIP:     cfg.maxPerIP,
+		readTimeout:  cfg.connTimeout,
+		writeTimeout: cfg.connTimeout,
+		ipRate:       cfg.ipKBps * 1000,
+		conns:        make(map[*limitedConn]struct{}),
+		ips:          make(map[string]*ipConns),
+	}
+}
+
+// newIdleConnLimiter is a connLimiter for clients that can sit idle between
+// requests, like electrum wallets and p2p peers, so reads don't time out
+func newIdleConnLimiter(cfg *Config) *connLimiter {
+	cl := newConnLimiter(cfg)
+	cl.readTimeout = 0
+	return cl
+}
+
+// serve accepts connections on listener until it's closed, and calls
+// serveConn with each one there's room for.  Accept errors that don't last,
+// like running out of file descriptors, are tried again after a wait.
+func (cl *connLimiter) serve(
+	listener net.Listener, name string, serveConn func(net.Conn)) {
+
+	var delay time.Duration
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				fmt.Printf("%s accept error: %s; trying again in %s\n",
+					name, err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			fmt.Printf("%s accept error: %s\n", name, err.Error())
+			return
+		}
+		delay = 0
+		lc, err := cl.add(c)
+		if err != nil {
+			fmt.Printf("%s turned away %s: %s\n",
+				name, c.RemoteAddr().String(), err.Error())
+			continue
+		}
+		go func() {
+			defer cl.done(lc)
+			serveConn(lc)
+		}()
+	}
+}
+
+// listener wraps l so the connections it accepts go through cl, for servers
+// like net/http that run their own accept loop.  Ones there's no room for
+// are hung up on and not handed out.
+func (cl *connLimiter) listener(l net.Listener, name string) net.Listener {
+	return &limitedListener{Listener: l, cl: cl, name: name}
+}
+
+type limitedListener struct {
+	net.Listener
+	cl   *connLimiter
+	name string
+}
+
+func (ll *limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		lc, err := ll.cl.add(c)
+		if err != nil {
+			fmt.Printf("%s turned away %s: %s\n",
+				ll.name, c.RemoteAddr().String(), err.Error())
+			continue
+		}
+		return &listenedConn{limitedConn: lc, cl: ll.cl}, nil
+	}
+}
+
+// listenedConn is a connection handed out by a limitedListener, which
+// frees its place in the limiter when closed
+type listenedConn struct {
+	*limitedConn
+	cl *connLimiter
+}
+
+func (c *listenedConn) Close() error {
+	c.cl.done(c.limitedConn)
+	return nil
+}
+
+// add takes c on, giving the connection to serve it with.  Call done on that
+// when finished with it.  If there's no room for c, it's closed and add
+// says why.
+func (cl *connLimiter) add(c net.Conn) (*limitedConn, error) {
+	ip, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		ip = c.RemoteAddr().String()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	ipc := cl.ips[ip]
+	switch {
+	case cl.shutdown:
+		err = fmt.Errorf("shutting down")
+	case cl.maxConns > 0 && len(cl.conns) >= cl.maxConns:
+		err = fmt.Errorf("already serving %d connections", len(cl.conns))
+	case cl.maxPerIP > 0 && ipc != nil && ipc.count >= cl.maxPerIP:
+		err = fmt.Errorf("already serving %d connections from %s",
+			ipc.count, ip)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if ipc == nil {
+		ipc = new(ipConns)
+		if cl.ipRate > 0 {
+			ipc.rate = &rateLimit{rate: float64(cl.ipRate)}
+		}
+		cl.ips[ip] = ipc
+	}
+	ipc.count++
+	lc := &limitedConn{Conn: c, ip: ip, readTimeout: cl.readTimeout,
+		writeTimeout: cl.writeTimeout, rate: ipc.rate}
+	cl.conns[lc] = struct{}{}
+	cl.wg.Add(1)
+	return lc, nil
+}
+
+// done closes lc and forgets about it
+func (cl *connLimiter) done(lc *limitedConn) {
+	lc.Close()
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if _, ok := cl.conns[lc]; !ok {
+		return
+	}
+	delete(cl.conns, lc)
+	ipc := cl.ips[lc.ip]
+	ipc.count--
+	if ipc.count == 0 {
+		delete(cl.ips, lc.ip)
+	}
+	cl.wg.Done()
+}
+
+// stop turns away new connections, and waits up to drain for the ones being
+// served to finish.  Any left then are closed.
+func (cl *connLimiter) stop(drain time.Duration) {
+	cl.mu.Lock()
+	cl.shutdown = true
+	cl.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		cl.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return
+	case <-time.After(drain):
+	}
+
+	cl.mu.Lock()
+	fmt.Printf("hanging up on %d connections still being served\n",
+		len(cl.conns))
+	for lc := range cl.conns {
+		lc.Close()
+	}
+	cl.mu.Unlock()
+	<-finished
+}
+
+// limitedConn is a connection with deadlines on every read and write, and
+// writes held to its IP's bandwidth limit
+type limitedConn struct {
+	net.Conn
+	ip                        string
+	readTimeout, writeTimeout time.Duration
+	rate                      *rateLimit
+}
+
+func (lc *limitedConn) Read(b []byte) (int, error) {
+	if lc.readTimeout != 0 {
+		err := lc.SetReadDeadline(time.Now().Add(lc.readTimeout))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return lc.Conn.Read(b)
+}
+
+func (lc *limitedConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxWriteChunk {
+			chunk = chunk[:maxWriteChunk]
+		}
+		if lc.rate != nil {
+			lc.rate.wait(len(chunk))
+		}
+		if lc.writeTimeout != 0 {
+			err := lc.SetWriteDeadline(time.Now().Add(lc.writeTimeout))
+			if err != nil {
+				return written, err
+			}
+		}
+		n, err := lc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// rateLimit lets through rate bytes a second, between everything using it
+type rateLimit struct {
+	rate float64
+
+	mu sync.Mutex
+	// when everything let through so far will have gone at rate
+	next time.Time
+}
+
+// wait blocks until it's n bytes' turn to go
+func (rl *rateLimit) wait(n int) {
+	rl.mu.Lock()
+	now := time.Now()
+	start := rl.next
+	if start.Before(now) {
+		start = now
+	}
+	rl.next = start.Add(time.Duration(float64(n) / rl.rate * float64(time.Second)))
+	rl.mu.Unlock()
+	time.Sleep(start.Sub(now))
+}
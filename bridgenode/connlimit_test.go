@@ -0,0 +1,197 @@
+package bridgenode
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestConnLimiter checks the connection caps, deadlines, the per-IP
+// bandwidth limit, and that stop hangs up on connections that don't finish
+func TestConnLimiter(t *testing.T) {
+	cl := newConnLimiter(&Config{maxConns: 3, maxPerIP: 2,
+		connTimeout: 200 * time.Millisecond, ipKBps: 100})
+
+	// conn makes a connection from ip, and gives the other end of it
+	conn := func(ip byte) (net.Conn, net.Conn) {
+		client, server := net.Pipe()
+		return client, pipeConn{server, &net.TCPAddr{
+			IP: net.IPv4(10, 0, 0, ip), Port: 50000}}
+	}
+
+	a1, sa1 := conn(1)
+	la1, err := cl.add(sa1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, sa2 := conn(1)
+	la2, err := cl.add(sa2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sa3 := conn(1)
+	_, err = cl.add(sa3)
+	if err == nil {
+		t.Fatal("took a third connection from one IP")
+	}
+	_, sb1 := conn(2)
+	lb1, err := cl.add(sb1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sc1 := conn(3)
+	_, err = cl.add(sc1)
+	if err == nil {
+		t.Fatal("took more than maxConns connections")
+	}
+
+	// nothing's sent on lb1, so reading times out
+	start := time.Now()
+	_, err = lb1.Read(make([]byte, 1))
+	if err == nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("read with nothing sent gave %v after %s",
+			err, time.Since(start))
+	}
+	cl.done(lb1)
+	_, sc2 := conn(3)
+	lc2, err := cl.add(sc2)
+	if err != nil {
+		t.Fatalf("no room after one was done: %s", err.Error())
+	}
+	cl.done(lc2)
+
+	// both connections from 10.0.0.1 share 100KB/s, so 120KB between them
+	// takes over a second, less whatever the last chunk is
+	const size = 60 * 1000
+	read := func(c net.Conn) {
+		io.Copy(ioutil.Discard, c)
+	}
+	go read(a1)
+	go read(a2)
+	start = time.Now()
+	finished := make(chan error, 2)
+	for _, lc := range []*limitedConn{la1, la2} {
+		go func(lc *limitedConn) {
+			_, err := lc.Write(make([]byte, size))
+			finished <- err
+		}(lc)
+	}
+	for i := 0; i < 2; i++ {
+		err = <-finished
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatalf("sent %d bytes from one IP in %s", 2*size, elapsed)
+	}
+	cl.done(la2)
+
+	// la1 is still being served, and isn't going to finish
+	stopped := make(chan struct{})
+	go func() {
+		cl.stop(50 * time.Millisecond)
+		close(stopped)
+	}()
+	go func() {
+		defer cl.done(la1)
+		for {
+			_, err := la1.Write([]byte{1})
+			if err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop didn't hang up on a connection still being served")
+	}
+	_, sd1 := conn(4)
+	_, err = cl.add(sd1)
+	if err == nil {
+		t.Fatal("took a connection after stopping")
+	}
+}
+
+// tempError is an accept error that goes away
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+// flakyListener gives a temporary error before every connection, then a
+// permanent one once it's out of connections
+type flakyListener struct {
+	net.Listener
+	conns  []net.Conn
+	failed bool
+}
+
+func (fl *flakyListener) Accept() (net.Conn, error) {
+	if len(fl.conns) == 0 {
+		return nil, io.EOF
+	}
+	fl.failed = !fl.failed
+	if fl.failed {
+		return nil, tempError{}
+	}
+	c := fl.conns[0]
+	fl.conns = fl.conns[1:]
+	return c, nil
+}
+
+// TestServeRetries checks serve keeps accepting after temporary errors, and
+// stops at one that isn't
+func TestServeRetries(t *testing.T) {
+	cl := newConnLimiter(&Config{})
+	var clients []net.Conn
+	fl := &flakyListener{}
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		clients = append(clients, client)
+		fl.conns = append(fl.conns, pipeConn{server, &net.TCPAddr{
+			IP: net.IPv4(10, 0, 0, byte(i)), Port: 50000}})
+	}
+
+	served := make(chan struct{}, 3)
+	finished := make(chan struct{})
+	go func() {
+		cl.serve(fl, "test", func(c net.Conn) {
+			served <- struct{}{}
+		})
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't stop at a permanent error")
+	}
+	cl.stop(time.Second)
+	if len(served) != 3 {
+		t.Fatalf("served %d connections, expect 3", len(served))
+	}
+	for _, c := range clients {
+		c.Close()
+	}
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	for addr, want := range map[string]string{
+		"0.0.0.0:8338": "0.0.0.0:8338",
+		"10.0.0.1":     "10.0.0.1:8338",
+		"localhost":    "localhost:8338",
+		":9000":        ":9000",
+		"::1":          "[::1]:8338",
+		"[::1]":        "[::1]:8338",
+		"[::1]:9000":   "[::1]:9000",
+		"fe80::1%eth0": "[fe80::1%eth0]:8338",
+	} {
+		if got := withDefaultPort(addr, "8338"); got != want {
+			t.Errorf("withDefaultPort(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
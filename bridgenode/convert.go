@@ -0,0 +1,68 @@
+package bridgenode
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// ConvertForest converts the forest on disk to what -forest says to use, so
+// the forest doesn't have to be built again from genesis.  -forest=cow makes
+// a CowForest from the flat forest file that disk, cache, mmap and ram
+// forests use, and any other -forest makes the flat file from a CowForest.
+// The old forest is left where it is.
+func ConvertForest(cfg *Config) error {
+	forestDir := cfg.UtreeDir.ForestDir
+	hasCow := util.HasAccess(forestDir.cowForestCurFile)
+	hasFlat := util.HasAccess(forestDir.forestFile)
+
+	if cfg.forestType == cowForest {
+		if hasCow {
+			return fmt.Errorf("already a cow forest at %s", forestDir.cowForestDir)
+		}
+		if !hasFlat {
+			return fmt.Errorf("no forest at %s to convert", forestDir.forestFile)
+		}
+		flatFile, err := os.Open(forestDir.forestFile)
+		if err != nil {
+			return err
+		}
+		defer flatFile.Close()
+		miscForestFile, err := os.Open(forestDir.miscForestFile)
+		if err != nil {
+			return err
+		}
+		defer miscForestFile.Close()
+
+		fmt.Printf("converting %s to a cow forest in %s\n",
+			forestDir.forestFile, forestDir.cowForestDir)
+		return accumulator.FlatToCow(miscForestFile, flatFile,
+			forestDir.cowForestDir, cfg.cowMaxCache)
+	}
+
+	if hasFlat {
+		return fmt.Errorf("already a forest at %s", forestDir.forestFile)
+	}
+	if !hasCow {
+		return fmt.Errorf("no cow forest at %s to convert", forestDir.cowForestDir)
+	}
+	flatFile, err := os.OpenFile(
+		forestDir.forestFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer flatFile.Close()
+
+	fmt.Printf("converting cow forest in %s to %s\n",
+		forestDir.cowForestDir, forestDir.forestFile)
+	err = accumulator.CowToFlat(
+		forestDir.cowForestDir, cfg.cowMaxCache, flatFile)
+	if err != nil {
+		// don't leave half a forest for the next start to resume from
+		os.Remove(forestDir.forestFile)
+		return err
+	}
+	return nil
+}
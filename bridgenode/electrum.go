@@ -0,0 +1,444 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+/*
+The electrum server speaks enough of the electrum protocol for a wallet to
+find its history and utxos, from the scripthash index: newline separated
+JSON-RPC over TCP, with
+
+server.version, server.ping
+blockchain.headers.subscribe
+blockchain.scripthash.get_history, get_balance, listunspent
+blockchain.transaction.get
+
+Only confirmed txs are known, so there's never anything unconfirmed.
+listunspent takes an extra param; if it's true every utxo comes with a
+"utreexo" object holding its LeafData and a BatchProof for it, both in hex,
+and the height and numLeaves the proof is for.
+*/
+
+// electrumHeadersInterval is how often subscribed clients are checked for
+// a new tip
+const electrumHeadersInterval = 2 * time.Second
+
+// maxElectrumRequest is the longest line a client can send
+const maxElectrumRequest = 1 << 20
+
+// electrumServer serves electrum wallets from whatever indexes the bridge
+// has at the moment
+type electrumServer struct {
+	listener net.Listener
+	conns    *connLimiter
+
+	mu     sync.Mutex
+	prover *outpointProver
+
+	// where headers and blocks are read from
+	header func(height int32) ([80]byte, error)
+	block  func(height int32) (*btcutil.Block, error)
+}
+
+// newElectrumServer makes an electrum server that reads headers and blocks
+// from the blk files
+func newElectrumServer(cfg *Config) *electrumServer {
+	offsetFile := cfg.UtreeDir.OffsetDir.OffsetFile
+	return &electrumServer{
+		conns: newIdleConnLimiter(cfg),
+		header: func(height int32) ([80]byte, error) {
+			hr, err := newHeaderFileReader(offsetFile, cfg.BlockDir)
+			if err != nil {
+				return [80]byte{}, err
+			}
+			defer hr.close()
+			return hr.read(height)
+		},
+		block: func(height int32) (*btcutil.Block, error) {
+			b, err := GetBlockBytesFromFile(height, offsetFile, cfg.BlockDir)
+			if err != nil {
+				return nil, err
+			}
+			return btcutil.NewBlockFromBytes(b)
+		},
+	}
+}
+
+// listen accepts electrum clients on port
+func (es *electrumServer) listen(port string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("electrum server listening on %s\n", listener.Addr().String())
+	es.listener = listener
+	go es.conns.serve(listener, "electrum", es.serveConn)
+	return nil
+}
+
+// close stops taking new clients, and waits up to drain for the ones
+// connected to hang up before hanging up on them
+func (es *electrumServer) close(drain time.Duration) {
+	if es.listener != nil {
+		es.listener.Close()
+		es.conns.stop(drain)
+	}
+}
+
+// set changes the indexes served from
+func (es *electrumServer) set(prover *outpointProver) {
+	es.mu.Lock()
+	es.prover = prover
+	es.mu.Unlock()
+}
+
+// view runs fn on the scripthash index and the forest it goes with, at the
+// height they're both at
+func (es *electrumServer) view(fn func(f *accumulator.Forest, height int32,
+	scripts *scriptHashIndex) error) error {
+
+	es.mu.Lock()
+	prover := es.prover
+	es.mu.Unlock()
+	if prover == nil || prover.scripts == nil {
+		return fmt.Errorf("no scripthash index loaded")
+	}
+	return prover.forest.View(func(f *accumulator.Forest, height int32) error {
+		if prover.done {
+			return fmt.Errorf("bridge is shutting down")
+		}
+		return fn(f, height, prover.scripts)
+	})
+}
+
+type electrumRequest struct {
+	ID     json.RawMessage   `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type electrumError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type electrumHeader struct {
+	Hex    string `json:"hex"`
+	Height int32  `json:"height"`
+}
+
+type electrumHistory struct {
+	TxHash string `json:"tx_hash"`
+	Height int32  `json:"height"`
+}
+
+type electrumBalance struct {
+	Confirmed   int64 `json:"confirmed"`
+	Unconfirmed int64 `json:"unconfirmed"`
+}
+
+type electrumUtxo struct {
+	TxHash  string          `json:"tx_hash"`
+	TxPos   uint32          `json:"tx_pos"`
+	Height  int32           `json:"height"`
+	Value   int64           `json:"value"`
+	Utreexo *electrumUProof `json:"utreexo,omitempty"`
+}
+
+// electrumUProof is the proof extension for a utxo
+type electrumUProof struct {
+	LeafData  string `json:"leaf_data"`
+	Proof     string `json:"proof"`
+	Height    int32  `json:"height"`
+	NumLeaves uint64 `json:"num_leaves"`
+}
+
+// serveConn answers requests from one client until it hangs up
+func (es *electrumServer) serveConn(c net.Conn) {
+	defer c.Close()
+	fmt.Printf("electrum client %s\n", c.RemoteAddr().String())
+
+	// notifications and responses can be sent at the same time
+	var sendMu sync.Mutex
+	send := func(msg map[string]interface{}) error {
+		msg["jsonrpc"] = "2.0"
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		_, err = c.Write(append(b, '\n'))
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	subscribed := false
+
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 4096), maxElectrumRequest)
+	for scanner.Scan() {
+		var req electrumRequest
+		resp := make(map[string]interface{})
+		err := json.Unmarshal(scanner.Bytes(), &req)
+		if err != nil {
+			resp["id"] = nil
+			resp["error"] = electrumError{-32700, err.Error()}
+		} else {
+			resp["id"] = req.ID
+			result, eerr := es.handle(req)
+			if eerr != nil {
+				resp["error"] = eerr
+			} else {
+				resp["result"] = result
+			}
+			if eerr == nil && !subscribed &&
+				req.Method == "blockchain.headers.subscribe" {
+				subscribed = true
+				go es.notifyHeaders(result.(electrumHeader).Height, send, done)
+			}
+		}
+		err = send(resp)
+		if err != nil {
+			fmt.Printf("electrum write %s\n", err.Error())
+			return
+		}
+	}
+	fmt.Printf("electrum client %s gone\n", c.RemoteAddr().String())
+}
+
+// notifyHeaders sends the new tip whenever it changes, until done
+func (es *electrumServer) notifyHeaders(height int32,
+	send func(map[string]interface{}) error, done chan struct{}) {
+
+	ticker := time.NewTicker(electrumHeadersInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		tip, err := es.tip()
+		if err != nil || tip.Height == height {
+			continue
+		}
+		height = tip.Height
+		err = send(map[string]interface{}{
+			"method": "blockchain.headers.subscribe",
+			"params": []electrumHeader{tip},
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// tip gives the header at the height the index is at
+func (es *electrumServer) tip() (electrumHeader, error) {
+	var height int32
+	err := es.view(func(_ *accumulator.Forest, h int32, _ *scriptHashIndex) error {
+		height = h
+		return nil
+	})
+	if err != nil {
+		return electrumHeader{}, err
+	}
+	hdr, err := es.header(height)
+	if err != nil {
+		return electrumHeader{}, err
+	}
+	return electrumHeader{Hex: hex.EncodeToString(hdr[:]), Height: height}, nil
+}
+
+// handle gives the result of a request
+func (es *electrumServer) handle(req electrumRequest) (
+	interface{}, *electrumError) {
+
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "server.version":
+		return []string{"utreexo bridge", "1.4"}, nil
+	case "server.ping":
+		return nil, nil
+	case "blockchain.headers.subscribe":
+		result, err = es.tip()
+
+	case "blockchain.scripthash.get_history":
+		sh, perr := hashParam(req.Params, 0)
+		if perr != nil {
+			return nil, perr
+		}
+		hist := []electrumHistory{}
+		err = es.view(func(_ *accumulator.Forest, _ int32,
+			scripts *scriptHashIndex) error {
+			entries, err := scripts.history(sh)
+			for _, e := range entries {
+				hist = append(hist, electrumHistory{e.txid.String(), e.height})
+			}
+			return err
+		})
+		result = hist
+
+	case "blockchain.scripthash.get_balance":
+		sh, perr := hashParam(req.Params, 0)
+		if perr != nil {
+			return nil, perr
+		}
+		var balance electrumBalance
+		err = es.view(func(_ *accumulator.Forest, _ int32,
+			scripts *scriptHashIndex) error {
+			utxos, err := scripts.utxos(sh)
+			for _, ld := range utxos {
+				balance.Confirmed += ld.Amt
+			}
+			return err
+		})
+		result = balance
+
+	case "blockchain.scripthash.listunspent":
+		sh, perr := hashParam(req.Params, 0)
+		if perr != nil {
+			return nil, perr
+		}
+		var withProofs bool
+		if len(req.Params) > 1 && json.Unmarshal(req.Params[1], &withProofs) != nil {
+			return nil, &electrumError{-32602, "second param should be a bool"}
+		}
+		utxos := []electrumUtxo{}
+		err = es.view(func(f *accumulator.Forest, height int32,
+			scripts *scriptHashIndex) error {
+			lds, err := scripts.utxos(sh)
+			if err != nil {
+				return err
+			}
+			for _, ld := range lds {
+				u := electrumUtxo{TxHash: ld.TxHash.String(), TxPos: ld.Index,
+					Height: ld.Height, Value: ld.Amt}
+				if withProofs {
+					u.Utreexo, err = utxoProof(f, height, ld)
+					if err != nil {
+						return err
+					}
+				}
+				utxos = append(utxos, u)
+			}
+			return nil
+		})
+		result = utxos
+
+	case "blockchain.transaction.get":
+		txid, perr := hashParam(req.Params, 0)
+		if perr != nil {
+			return nil, perr
+		}
+		var verbose bool
+		if len(req.Params) > 1 &&
+			(json.Unmarshal(req.Params[1], &verbose) != nil || verbose) {
+			return nil, &electrumError{-32602, "only non-verbose is supported"}
+		}
+		result, err = es.getTx(txid)
+
+	default:
+		return nil, &electrumError{-32601, "unknown method " + req.Method}
+	}
+	if err != nil {
+		return nil, &electrumError{1, err.Error()}
+	}
+	return result, nil
+}
+
+// getTx gives the hex of a confirmed tx
+func (es *electrumServer) getTx(txid btcacc.Hash) (string, error) {
+	var height int32
+	var found bool
+	err := es.view(func(_ *accumulator.Forest, _ int32,
+		scripts *scriptHashIndex) error {
+		var err error
+		height, found, err = scripts.txHeight(txid)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("no tx %s", txid.String())
+	}
+	blk, err := es.block(height)
+	if err != nil {
+		return "", err
+	}
+	for _, tx := range blk.Transactions() {
+		if btcacc.Hash(*tx.Hash()) != txid {
+			continue
+		}
+		var buf bytes.Buffer
+		err = tx.MsgTx().Serialize(&buf)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(buf.Bytes()), nil
+	}
+	return "", fmt.Errorf("tx %s isn't in block %d", txid.String(), height)
+}
+
+// utxoProof proves the utxo ld in f
+func utxoProof(f *accumulator.Forest, height int32, ld btcacc.LeafData) (
+	*electrumUProof, error) {
+
+	bp, err := f.ProveBatch(
+		[]accumulator.Hash{ld.LeafHashWith(f.HashScheme(), f.Hasher())})
+	if err != nil {
+		return nil, fmt.Errorf("utxo %s isn't in the forest: %s",
+			ld.OPString(), err.Error())
+	}
+	var ldBuf, bpBuf bytes.Buffer
+	err = ld.Serialize(&ldBuf)
+	if err != nil {
+		return nil, err
+	}
+	err = bp.Serialize(&bpBuf)
+	if err != nil {
+		return nil, err
+	}
+	return &electrumUProof{
+		LeafData:  hex.EncodeToString(ldBuf.Bytes()),
+		Proof:     hex.EncodeToString(bpBuf.Bytes()),
+		Height:    height,
+		NumLeaves: f.NumLeaves(),
+	}, nil
+}
+
+// hashParam reads the i'th param as a hash in hex, byte-reversed the way
+// electrum and bitcoin show txids and scripthashes
+func hashParam(params []json.RawMessage, i int) (btcacc.Hash, *electrumError) {
+	var h btcacc.Hash
+	var s string
+	if len(params) <= i || json.Unmarshal(params[i], &s) != nil {
+		return h, &electrumError{-32602, fmt.Sprintf("param %d should be a "+
+			"hash in hex", i)}
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return h, &electrumError{-32602, fmt.Sprintf("param %d %s isn't 32 "+
+			"bytes of hex", i, s)}
+	}
+	for j := range b {
+		h[j] = b[31-j]
+	}
+	return h, nil
+}
@@ -0,0 +1,297 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// TestElectrum builds the scripthash index for a couple of synthetic blocks,
+// with a spend in the same block, and asks the electrum server about them
+// over TCP
+func TestElectrum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "electrum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{electrum: "0"}
+	cfg.UtreeDir.ForestDir.scriptHashIndexDir = filepath.Join(dir, "shindex")
+
+	scriptA, scriptB := []byte{0x51, 0xaa}, []byte{0x51, 0xbb}
+	newTx := func(ins []wire.OutPoint, outs ...*wire.TxOut) *wire.MsgTx {
+		tx := wire.NewMsgTx(1)
+		for _, in := range ins {
+			tx.AddTxIn(wire.NewTxIn(&in, nil, nil))
+		}
+		for _, out := range outs {
+			tx.AddTxOut(out)
+		}
+		return tx
+	}
+	coinbase := func(height byte, outs ...*wire.TxOut) *wire.MsgTx {
+		tx := newTx(nil, outs...)
+		tx.AddTxIn(wire.NewTxIn(
+			wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff), []byte{height}, nil))
+		return tx
+	}
+	newBlock := func(height uint32, txs ...*wire.MsgTx) *btcutil.Block {
+		msg := wire.NewMsgBlock(&wire.BlockHeader{Nonce: height})
+		for _, tx := range txs {
+			msg.AddTransaction(tx)
+		}
+		return btcutil.NewBlock(msg)
+	}
+
+	// block 1 pays 50 to A and 10 to B
+	cb1 := coinbase(1, wire.NewTxOut(50, scriptA), wire.NewTxOut(10, scriptB))
+	// block 2 pays 50 to B, spends A's 50 to 30 for A and 19 for B, then
+	// spends that 19 to 18 for A
+	cb2 := coinbase(2, wire.NewTxOut(50, scriptB))
+	tx2 := newTx([]wire.OutPoint{{Hash: cb1.TxHash(), Index: 0}},
+		wire.NewTxOut(30, scriptA), wire.NewTxOut(19, scriptB))
+	tx3 := newTx([]wire.OutPoint{{Hash: tx2.TxHash(), Index: 1}},
+		wire.NewTxOut(18, scriptA))
+
+	bnrs := []blockAndRev{{
+		Height: 1, Blk: newBlock(1, cb1),
+		inSkipList: []uint32{0}, inCount: 1, outCount: 2,
+	}, {
+		Height: 2, Blk: newBlock(2, cb2, tx2, tx3),
+		Rev: RevBlock{Txs: []*TxUndo{
+			{TxIn: []*TxInUndo{{Height: 1, Coinbase: true, PKScript: scriptA,
+				Amount: 50}}},
+			{TxIn: []*TxInUndo{{Height: 2, PKScript: scriptB, Amount: 19}}},
+		}},
+		inSkipList: []uint32{0, 2}, outSkipList: []uint32{2},
+		inCount: 3, outCount: 4,
+	}}
+
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.LegacyHash, nil)
+	prover, err := newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prover.close()
+	blockHashes := btcacc.NewBlockHashIndex(1000)
+	for _, bnr := range bnrs {
+		bnr := bnr
+		delLeaves, err := bnr.toDelLeaves(blockHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		adds := uwire.BlockToAddLeafData(
+			bnr.Blk, bnr.outSkipList, bnr.Height, blockHashes)
+		err = prover.forest.Update(bnr.Height, func(f *accumulator.Forest) error {
+			delHashes := make([]accumulator.Hash, len(delLeaves))
+			for i, ld := range delLeaves {
+				delHashes[i] = ld.LeafHash()
+			}
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				return err
+			}
+			leaves := make([]accumulator.Leaf, len(adds))
+			for i, ld := range adds {
+				leaves[i].Hash = ld.LeafHash()
+			}
+			_, err = f.Modify(leaves, bp.Targets)
+			if err != nil {
+				return err
+			}
+			return prover.blockDone(&bnr, adds, delLeaves)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	es := &electrumServer{
+		header: func(height int32) (hdr [80]byte, err error) {
+			var buf bytes.Buffer
+			err = bnrs[height-1].Blk.MsgBlock().Header.Serialize(&buf)
+			copy(hdr[:], buf.Bytes())
+			return
+		},
+		block: func(height int32) (*btcutil.Block, error) {
+			return bnrs[height-1].Blk, nil
+		},
+	}
+	es.set(prover)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			es.serveConn(c)
+		}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	// call sends a request and reads the response into result
+	id := 0
+	call := func(result interface{}, method string, params ...interface{}) error {
+		id++
+		if params == nil {
+			params = []interface{}{}
+		}
+		req, err := json.Marshal(map[string]interface{}{
+			"id": id, "method": method, "params": params})
+		if err != nil {
+			return err
+		}
+		_, err = c.Write(append(req, '\n'))
+		if err != nil {
+			return err
+		}
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var resp struct {
+			ID     int             `json:"id"`
+			Result json.RawMessage `json:"result"`
+			Error  *electrumError  `json:"error"`
+		}
+		err = json.Unmarshal(line, &resp)
+		if err != nil {
+			return err
+		}
+		if resp.ID != id {
+			return fmt.Errorf("response id %d, expect %d", resp.ID, id)
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("%d %s", resp.Error.Code, resp.Error.Message)
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+	sh := func(script []byte) string {
+		return btcacc.Hash(sha256.Sum256(script)).String()
+	}
+	txid := func(tx *wire.MsgTx) string {
+		return btcacc.Hash(tx.TxHash()).String()
+	}
+
+	var tip electrumHeader
+	err = call(&tip, "blockchain.headers.subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, _ := es.header(2)
+	if tip.Height != 2 || tip.Hex != hex.EncodeToString(hdr[:]) {
+		t.Fatalf("tip %d %s, expect 2 %x", tip.Height, tip.Hex, hdr)
+	}
+
+	for script, want := range map[string]int64{
+		string(scriptA): 48, string(scriptB): 60, "nobody": 0} {
+		var balance electrumBalance
+		err = call(&balance, "blockchain.scripthash.get_balance",
+			sh([]byte(script)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if balance.Confirmed != want || balance.Unconfirmed != 0 {
+			t.Fatalf("%x balance %v, expect %d", script, balance, want)
+		}
+	}
+
+	var hist []electrumHistory
+	err = call(&hist, "blockchain.scripthash.get_history", sh(scriptA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// within a block, history is in txid order
+	h2, h3 := tx2.TxHash(), tx3.TxHash()
+	if bytes.Compare(h3[:], h2[:]) < 0 {
+		tx2, tx3 = tx3, tx2
+	}
+	wantHist := []electrumHistory{
+		{txid(cb1), 1}, {txid(tx2), 2}, {txid(tx3), 2}}
+	if fmt.Sprint(hist) != fmt.Sprint(wantHist) {
+		t.Fatalf("history %v, expect %v", hist, wantHist)
+	}
+
+	var utxos []electrumUtxo
+	err = call(&utxos, "blockchain.scripthash.listunspent", sh(scriptB), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 2 {
+		t.Fatalf("%d utxos for B, expect 2", len(utxos))
+	}
+	for _, u := range utxos {
+		if u.Utreexo == nil || u.Utreexo.Height != 2 ||
+			u.Utreexo.NumLeaves != forest.NumLeaves() {
+			t.Fatalf("utxo %s:%d proof %v", u.TxHash, u.TxPos, u.Utreexo)
+		}
+		ldBytes, err := hex.DecodeString(u.Utreexo.LeafData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ld btcacc.LeafData
+		err = ld.Deserialize(bytes.NewReader(ldBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ld.Amt != u.Value || ld.TxHash.String() != u.TxHash {
+			t.Fatalf("leaf data %s for utxo %s:%d", ld.ToString(),
+				u.TxHash, u.TxPos)
+		}
+		bpBytes, err := hex.DecodeString(u.Utreexo.Proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var bp accumulator.BatchProof
+		err = bp.Deserialize(bytes.NewReader(bpBytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = forest.VerifyBatchProof([]accumulator.Hash{ld.LeafHash()}, bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var txHex string
+	err = call(&txHex, "blockchain.transaction.get", txid(tx3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tx3.Serialize(&buf)
+	if txHex != hex.EncodeToString(buf.Bytes()) {
+		t.Fatalf("got tx %s, expect %x", txHex, buf.Bytes())
+	}
+
+	if call(&txHex, "blockchain.transaction.get", sh(scriptA)) == nil {
+		t.Fatal("got a tx that doesn't exist")
+	}
+	if call(&txHex, "blockchain.block.header", 1) == nil {
+		t.Fatal("unsupported method didn't error")
+	}
+}
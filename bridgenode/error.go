@@ -11,6 +11,7 @@ var (
 	ErrInvalidNetwork  = errors.New("Invalid/not supported net flag given")
 	ErrBuildProofs     = errors.New("BuildProofs error")
 	ErrArchiveServer   = errors.New("ArchiveServer error")
+	ErrStopped         = errors.New("Stopped by the user")
 )
 
 func errNoDataDir(path string) error {
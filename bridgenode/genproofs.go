@@ -3,14 +3,13 @@ package bridgenode
 import (
 	"bytes"
 	"fmt"
-	"os"
 	"runtime/pprof"
 	"runtime/trace"
 	"sync"
-	"time"
 
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 /*
@@ -63,22 +62,26 @@ buffer clears out.
 */
 
 // build the bridge node / proofs
-func BuildProofs(cfg *Config, sig chan bool) error {
+// srv, if not nil, serves from the forest as it's built.  If the user stops
+// it, it saves what's done and gives ErrStopped.
+func BuildProofs(cfg *Config, sig chan bool, srv *bridgeServer) error {
 	// Channel to alert the tell the main loop it's ok to exit
 	haltRequest := make(chan bool, 1)
 
-	// Waitgroup to alert stopBuildProofs() that revoffet and offset has
-	// been finished
-	offsetFinished := make(chan bool, 1)
-
 	// Channel for stopBuildProofs() to wait
 	haltAccept := make(chan bool, 1)
 
+	// closed when the user asks to stop
+	stopping := make(chan struct{})
+
 	// Handle user interruptions
-	go stopBuildProofs(cfg, sig, offsetFinished, haltRequest, haltAccept)
+	go stopBuildProofs(sig, haltRequest, haltAccept, stopping)
 
 	// Init forest and variables. Resumes if the data directory exists
-	forest, finishedHeight, err := InitBridgeNodeState(cfg, offsetFinished)
+	forest, finishedHeight, err := InitBridgeNodeState(cfg, haltRequest)
+	if err == ErrStopped {
+		return err
+	}
 	if err != nil {
 		err := fmt.Errorf("initialization error: %s.  If your .blk and .dat "+
 			"files are not in %s, specify alternate path with -datadir\n.",
@@ -87,6 +90,64 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	}
 
 	fmt.Printf("Starting forest: %s\n", forest.ToString())
+	forest.SetHashWorkers(cfg.hashWorkers)
+
+	// roots after every block.  Anything past where the forest was saved
+	// is from blocks that are about to be done again.
+	rootsIdx, err := openRootsIndex(cfg.UtreeDir.RootsDir)
+	if err != nil {
+		return err
+	}
+	err = rootsIdx.rollBack(finishedHeight)
+	if err != nil {
+		return err
+	}
+	if finishedHeight == 0 {
+		err = rootsIdx.put(0, 0, nil)
+		if err != nil {
+			return err
+		}
+	}
+	// same for the range proofs
+	err = trimRangeFile(cfg.UtreeDir.RangeDir.rangeFile, finishedHeight)
+	if err != nil {
+		return err
+	}
+
+	// the server reads the forest between blocks.  With -opindex, the
+	// prover keeps the utxos by outpoint alongside it.
+	safeForest := accumulator.NewSafeForest(forest, finishedHeight)
+	prover, err := newOutpointProver(cfg, safeForest, false)
+	if err != nil {
+		return err
+	}
+	// after a crash the indexes can be past the forest
+	err = prover.rollBack(cfg)
+	if err != nil {
+		prover.close()
+		return err
+	}
+	if srv != nil {
+		// the blocks before this run are all on disk
+		srv.set(finishedHeight, prover)
+		fmt.Printf("serving blocks up to %d while building\n", finishedHeight)
+	}
+
+	// leaves commit to the hash of the block that made them
+	blockHashes, err := buildBlockHashIndex(cfg, cfg.quitAfter)
+	if err != nil {
+		return err
+	}
+
+	// Check the headers first so that a bad header stops us before
+	// building anything on top of it
+	var headers *uwire.HeaderChain
+	if cfg.checkHeaders {
+		headers, err = verifyHeaders(cfg, cfg.quitAfter)
+		if err != nil {
+			return err
+		}
+	}
 
 	// BlockAndRevReader will push blocks into here
 	blockAndRevProofChan := make(chan blockAndRev, 10) // blocks for accumulator
@@ -111,6 +172,79 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 
 	go BNRTTLSpliter(blockAndRevTTLChan, ttlResultChan, cfg.UtreeDir)
 
+	// proveBlock makes the proof for a block, modifies the forest, and sends
+	// the proof and undo block to be written.  Gives the deleted positions.
+	// Only the modify and the indexes that go with it hold the write lock,
+	// so readers don't wait on anything else.
+	proveBlock := func(b pendingBlock) (targets []uint64, err error) {
+		// use the accumulator to get inclusion proofs, and produce a block
+		// proof with all data needed to verify the block.  Nothing else
+		// modifies the forest, so it's the same once this has the write lock.
+		var ud btcacc.UData
+		err = safeForest.View(func(forest *accumulator.Forest, _ int32) error {
+			var err error
+			ud, err = btcacc.GenUData(b.delLeaves, forest, b.bnr.Height)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if cfg.checkBlocks {
+			err = verifyBlock(cfg, headers, &b.bnr, ud)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// We don't know the TTL values, but know how many spots to allocate
+		ud.TxoTTLs = make([]int32, b.bnr.outCount)
+
+		var addData []btcacc.LeafData
+		if prover.needsLeafData() {
+			addData = uwire.BlockToAddLeafData(
+				b.bnr.Blk, b.bnr.outSkipList, b.bnr.Height, blockHashes)
+		}
+
+		var undoblock *accumulator.UndoBlock
+		err = safeForest.Update(b.bnr.Height, func(forest *accumulator.Forest) error {
+			var err error
+			undoblock, err = forest.Modify(b.blockAdds, ud.AccProof.Targets)
+			if err != nil {
+				return err
+			}
+			err = rootsIdx.put(b.bnr.Height, forest.NumLeaves(), forest.GetRoots())
+			if err != nil {
+				return err
+			}
+			err = prover.blockDone(&b.bnr, addData, b.delLeaves)
+			if err != nil {
+				return err
+			}
+			if b.bnr.Height%1000 == 0 {
+				fmt.Printf("Finished block %d of max %d\n",
+					b.bnr.Height, cfg.quitAfter)
+				if stats, ok := forest.CacheStats(); ok {
+					fmt.Printf("\t%s\n", stats)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		finishedHeight = b.bnr.Height
+
+		// send proof udata and the undoBlock to be written to disk
+		proofChan <- ud
+		undoblock.Height = b.bnr.Height // set undoBlocks Height
+		undoChan <- *undoblock
+
+		return ud.AccProof.Targets, nil
+	}
+
+	// with -aggregate, blocks wait here until the end of their range
+	var pending []pendingBlock
+
 	fmt.Println("Building Proofs and ttls...")
 
 	for {
@@ -131,44 +265,66 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 
 		// Get the add and remove data needed from the block & undo block
 		// wants the skiplist to omit proofs
-		blockAdds, delLeaves, err := bnr.toAddDel()
+		blockAdds, delLeaves, err := bnr.toAddDel(
+			blockHashes, forest.HashScheme(), forest.Hasher())
 		if err != nil {
 			return err
 		}
 
-		// use the accumulator to get inclusion proofs, and produce a block
-		// proof with all data needed to verify the block
-		ud, err := btcacc.GenUData(delLeaves, forest, bnr.Height)
-		if err != nil {
-			return err
+		b := pendingBlock{bnr: bnr, blockAdds: blockAdds, delLeaves: delLeaves}
+		if cfg.aggregate == 0 {
+			_, err = proveBlock(b)
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		// We don't know the TTL values, but know how many spots to allocate
-		ud.TxoTTLs = make([]int32, bnr.outCount)
-
-		// fmt.Printf("block on proofchan?\n")
-		// send proof udata to channel to be written to disk
-		proofChan <- ud
 
-		undoblock, err := forest.Modify(blockAdds, ud.AccProof.Targets)
+		pending = append(pending, b)
+		if bnr.Height%int32(cfg.aggregate) != 0 {
+			continue
+		}
+		err = proveRange(safeForest, pending, proveBlock,
+			cfg.UtreeDir.RangeDir.rangeFile)
 		if err != nil {
 			return err
 		}
-		undoblock.Height = bnr.Height // set undoBlocks Height
-		// send undoBlock data to undo channel to be written to the disk
-		// fmt.Printf("block on undochan?\n")
-		undoChan <- *undoblock
+		pending = pending[:0]
+	}
 
-		finishedHeight = bnr.Height
-		if finishedHeight%1000 == 0 {
-			fmt.Printf("Finished block %d of max %d\n",
-				finishedHeight, cfg.quitAfter)
+	// whatever's left over when stopping is a shorter range
+	if len(pending) > 0 {
+		err = proveRange(safeForest, pending, proveBlock,
+			cfg.UtreeDir.RangeDir.rangeFile)
+		if err != nil {
+			return err
 		}
-
 	}
 
 	// Wait for the file workers to finish
 	fileWait.Wait()
 
+	err = rootsIdx.sync()
+	if err != nil {
+		return err
+	}
+	err = rootsIdx.close()
+	if err != nil {
+		return err
+	}
+	// new connections don't get the forest, and the ones that already
+	// have it are done with it once this has the write lock
+	if srv != nil {
+		srv.set(finishedHeight, nil)
+	}
+	err = safeForest.Update(finishedHeight, func(*accumulator.Forest) error {
+		prover.done = true
+		return prover.close()
+	})
+	if err != nil {
+		return err
+	}
+
 	// Save the current state so genproofs can be resumed
 	err = saveBridgeNodeData(forest, finishedHeight, cfg)
 	if err != nil {
@@ -180,12 +336,18 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 
 	// Tell stopBuildProofs that it's ok to exit
 	haltAccept <- true
+	select {
+	case <-stopping:
+		return ErrStopped
+	default:
+	}
 	return nil
 }
 
-// stopBuildProofs listens for the signal from the OS and initiates an exit sequence
+// stopBuildProofs listens for the signal from the OS and tells whatever's
+// being built to stop.  stopping is closed once it has.
 func stopBuildProofs(
-	cfg *Config, sig, offsetfinished, haltRequest, haltAccept chan bool) {
+	sig, haltRequest, haltAccept chan bool, stopping chan struct{}) {
 
 	// Listen for SIGINT, SIGQUIT, SIGTERM
 	// Also listen for an unrequested haltAccept which means upstream is finshed
@@ -199,37 +361,13 @@ func stopBuildProofs(
 	trace.Stop()
 	pprof.StopCPUProfile()
 
-	// Sometimes there are bugs that make the program run forever.
-	// Utreexo binary should never take more than 10 seconds to exit
-	go func() {
-		time.Sleep(1000 * time.Second)
-		fmt.Println("Program timed out. Force quitting. Data likely corrupted")
-		os.Exit(1)
-	}()
-
 	// Tell the user that the sig is received
-	fmt.Println("User exit signal received. Exiting...")
-
-	select {
-	// If offsetfile is there or was built, don't remove it
-	case <-offsetfinished:
-		haltRequest <- true
-	// If nothing is received, delete offsetfile and other directories
-	// Don't wait for done channel from the main BuildProofs() for loop
-	default:
-		fmt.Println("offsetfile incomplete, removing...")
-		// May not work sometimes.
-		err := os.RemoveAll(cfg.UtreeDir.OffsetDir.base)
-		if err != nil {
-			fmt.Println("ERR. offsetdata/ directory not removed. Please manually remove it.")
-		}
-		fmt.Println("Exiting...")
-		os.Exit(0)
-	}
+	fmt.Println("User exit signal received. Stopping...")
 
-	// Wait until BuildProofs() or buildOffsetFile() says it's ok to exit
-	<-haltAccept
-	os.Exit(0)
+	// the offset file builder or BlockAndRevReader stop at the next blk
+	// file or block, and BuildProofs saves what's done and returns
+	close(stopping)
+	haltRequest <- true
 }
 
 // go through all the proofs and just try to deserialize them
@@ -0,0 +1,429 @@
+package bridgenode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+/*
+With -http the bridge also serves what it has over HTTP, for web tooling
+that can't speak the TCP protocol:
+
+/udata/{height}    the block's UData, raw like the TCP server sends it, or
+                   JSON with ?format=json or Accept: application/json
+/block/{height}    the raw block
+/roots/{height}    numLeaves and the roots after the block, as JSON
+/proof?leaf=HEX    a BatchProof for leaf hashes in the forest right now, as
+                   JSON.  leaf can be given more than once
+/status            how far the bridge is and the forest stats, as JSON
+
+Hashes in the accumulator (leaves, roots, proofs) are hex in the order they're
+stored; txids and block hashes are byte-reversed like bitcoin shows them.
+
+Per-height responses have a strong ETag (the sha256 of the body), and go
+through http.ServeContent, which does Range, If-Range and If-None-Match.
+Blocks and roots can be cached forever once they're far enough under the tip
+that a reorg won't change them.  Udata can't: its TTLs are written in as later
+blocks spend the outputs, so caches have to check the ETag every time.
+*/
+
+// bridgeFiles is where servers read udata, blocks and roots from
+type bridgeFiles struct {
+	udata func(height int32) ([]byte, error)
+	block func(height int32) ([]byte, error)
+	roots func(height int32) (uint64, []accumulator.Hash, error)
+}
+
+// newBridgeFiles reads from the files genproofs writes
+func newBridgeFiles(cfg *Config) bridgeFiles {
+	return bridgeFiles{
+		udata: func(height int32) ([]byte, error) {
+			return GetUDataBytesFromFile(cfg.UtreeDir.ProofDir, height)
+		},
+		block: func(height int32) ([]byte, error) {
+			return GetBlockBytesFromFile(
+				height, cfg.UtreeDir.OffsetDir.OffsetFile, cfg.BlockDir)
+		},
+		roots: func(height int32) (uint64, []accumulator.Hash, error) {
+			return GetRootsAtHeight(cfg, height)
+		},
+	}
+}
+
+// httpGateway serves bridge data over HTTP from whatever the bridge has at
+// the moment
+type httpGateway struct {
+	bridgeFiles
+	server *http.Server
+	conns  *connLimiter
+	// how long reading a request and writing a response can take
+	readTimeout, writeTimeout time.Duration
+	servedState
+}
+
+// newHTTPGateway makes a gateway that reads from the bridge's files
+func newHTTPGateway(cfg *Config) *httpGateway {
+	// net/http sets its own deadlines for a whole request or response,
+	// which the limiter's per read and write ones would keep pushing back
+	conns := newConnLimiter(cfg)
+	conns.readTimeout, conns.writeTimeout = 0, 0
+	writeTimeout := cfg.connTimeout
+	if writeTimeout != 0 && cfg.ipKBps > 0 {
+		// leave time to send the biggest block at -ipkbps
+		writeTimeout += time.Duration(
+			wire.MaxBlockPayload/(cfg.ipKBps*1000)) * time.Second
+	}
+	return &httpGateway{bridgeFiles: newBridgeFiles(cfg), conns: conns,
+		readTimeout: cfg.connTimeout, writeTimeout: writeTimeout}
+}
+
+// listen serves HTTP on port
+func (hg *httpGateway) listen(port string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("http gateway listening on %s\n", listener.Addr().String())
+	hg.serve(listener)
+	return nil
+}
+
+// serve answers HTTP on listener in the background
+func (hg *httpGateway) serve(listener net.Listener) {
+	hg.server = &http.Server{
+		Handler:           hg.handler(),
+		ReadHeaderTimeout: hg.readTimeout,
+		ReadTimeout:       hg.readTimeout,
+		WriteTimeout:      hg.writeTimeout,
+		IdleTimeout:       hg.readTimeout,
+	}
+	go func() {
+		err := hg.server.Serve(hg.conns.listener(listener, "http gateway"))
+		fmt.Printf("http gateway: %s\n", err.Error())
+	}()
+}
+
+// close stops taking requests, and waits up to drain for the ones being
+// answered
+func (hg *httpGateway) close(drain time.Duration) {
+	if hg.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	err := hg.server.Shutdown(ctx)
+	if err != nil {
+		fmt.Printf("http gateway shutdown: %s\n", err.Error())
+		hg.server.Close()
+	}
+	hg.conns.stop(0)
+}
+
+func (hg *httpGateway) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/udata/", hg.serveUData)
+	mux.HandleFunc("/block/", hg.serveBlock)
+	mux.HandleFunc("/roots/", hg.serveRoots)
+	mux.HandleFunc("/proof", hg.serveProof)
+	mux.HandleFunc("/status", hg.serveStatus)
+	return mux
+}
+
+type httpLeafData struct {
+	BlockHash string `json:"block_hash"`
+	TxHash    string `json:"tx_hash"`
+	Index     uint32 `json:"index"`
+	Height    int32  `json:"height"`
+	Coinbase  bool   `json:"coinbase"`
+	Amount    int64  `json:"amount"`
+	PkScript  string `json:"pk_script"`
+}
+
+type httpUData struct {
+	Height  int32          `json:"height"`
+	Targets []uint64       `json:"targets"`
+	Proof   []string       `json:"proof"`
+	Leaves  []httpLeafData `json:"leaves"`
+	TTLs    []int32        `json:"ttls"`
+}
+
+type httpRoots struct {
+	Height    int32    `json:"height"`
+	NumLeaves uint64   `json:"num_leaves"`
+	Roots     []string `json:"roots"`
+}
+
+type httpProof struct {
+	Height    int32    `json:"height"`
+	NumLeaves uint64   `json:"num_leaves"`
+	Targets   []uint64 `json:"targets"`
+	Proof     []string `json:"proof"`
+}
+
+type httpStatus struct {
+	BlockHeight  int32  `json:"block_height"`
+	ForestHeight *int32 `json:"forest_height,omitempty"`
+	NumLeaves    uint64 `json:"num_leaves"`
+	ForestStats  string `json:"forest_stats,omitempty"`
+
+	Cache *accumulator.CacheStats `json:"cache,omitempty"`
+}
+
+// heightParam reads the height after prefix in the path, and says why not
+// if it isn't one that's served
+func heightParam(r *http.Request, prefix string, max int32) (
+	int32, int, error) {
+
+	s := strings.TrimPrefix(r.URL.Path, prefix)
+	h, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || h < 0 {
+		return 0, http.StatusBadRequest, fmt.Errorf("bad height %q", s)
+	}
+	if int32(h) > max {
+		return 0, http.StatusNotFound,
+			fmt.Errorf("height %d not served yet, at %d", h, max)
+	}
+	return int32(h), http.StatusOK, nil
+}
+
+// Cache-Control for per-height responses
+const (
+	cacheForever    = "public, max-age=31536000, immutable"
+	cacheRevalidate = "public, no-cache"
+)
+
+// finalDepth is how far under the tip a block or roots have to be to be
+// cached forever.  Above that a reorg could change what's at the height.
+const finalDepth = 100
+
+// serveHeight sends body for a height, with an ETag and cacheControl
+func serveHeight(w http.ResponseWriter, r *http.Request,
+	contentType, cacheControl string, body []byte) {
+
+	etag := sha256.Sum256(body)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf("\"%x\"", etag))
+	w.Header().Set("Cache-Control", cacheControl)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// serveJSON sends v, which is only good for now
+func serveJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Printf("http gateway write %s\n", err.Error())
+	}
+}
+
+func hashesToHex(hashes []accumulator.Hash) []string {
+	s := make([]string, len(hashes))
+	for i, h := range hashes {
+		s[i] = hex.EncodeToString(h[:])
+	}
+	return s
+}
+
+// wantsJSON says if the client asked for udata as JSON instead of raw
+func wantsJSON(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return true
+	case "raw":
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func (hg *httpGateway) serveUData(w http.ResponseWriter, r *http.Request) {
+	blockHeight, _ := hg.current()
+	height, code, err := heightParam(r, "/udata/", blockHeight)
+	if err == nil && height == 0 {
+		code, err = http.StatusNotFound, fmt.Errorf("block 0 has no udata")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	udb, err := hg.udata(height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	if !wantsJSON(r) {
+		serveHeight(w, r, "application/octet-stream", cacheRevalidate, udb)
+		return
+	}
+
+	var ud btcacc.UData
+	err = ud.Deserialize(bytes.NewReader(udb))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("udata h %d: %s", height, err.Error()),
+			http.StatusInternalServerError)
+		return
+	}
+	j := httpUData{
+		Height:  ud.Height,
+		Targets: ud.AccProof.Targets,
+		Proof:   hashesToHex(ud.AccProof.Proof),
+		Leaves:  make([]httpLeafData, len(ud.Stxos)),
+		TTLs:    ud.TxoTTLs,
+	}
+	for i, ld := range ud.Stxos {
+		j.Leaves[i] = httpLeafData{
+			BlockHash: btcacc.Hash(ld.BlockHash).String(),
+			TxHash:    ld.TxHash.String(),
+			Index:     ld.Index,
+			Height:    ld.Height,
+			Coinbase:  ld.Coinbase,
+			Amount:    ld.Amt,
+			PkScript:  hex.EncodeToString(ld.PkScript),
+		}
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveHeight(w, r, "application/json", cacheRevalidate, b)
+}
+
+func (hg *httpGateway) serveBlock(w http.ResponseWriter, r *http.Request) {
+	blockHeight, _ := hg.current()
+	height, code, err := heightParam(r, "/block/", blockHeight)
+	if err == nil && height == 0 {
+		code, err = http.StatusNotFound, fmt.Errorf("block 0 isn't served")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	b, err := hg.block(height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cacheControl := cacheRevalidate
+	if height <= blockHeight-finalDepth {
+		cacheControl = cacheForever
+	}
+	serveHeight(w, r, "application/octet-stream", cacheControl, b)
+}
+
+func (hg *httpGateway) serveRoots(w http.ResponseWriter, r *http.Request) {
+	rootsHeight := hg.rootsHeight()
+	height, code, err := heightParam(r, "/roots/", rootsHeight)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	numLeaves, roots, err := hg.roots(height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(httpRoots{
+		Height: height, NumLeaves: numLeaves, Roots: hashesToHex(roots)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cacheControl := cacheRevalidate
+	if height <= rootsHeight-finalDepth {
+		cacheControl = cacheForever
+	}
+	serveHeight(w, r, "application/json", cacheControl, b)
+}
+
+func (hg *httpGateway) serveProof(w http.ResponseWriter, r *http.Request) {
+	_, prover := hg.current()
+	if prover == nil {
+		http.Error(w, "no forest loaded", http.StatusServiceUnavailable)
+		return
+	}
+	params := r.URL.Query()["leaf"]
+	if len(params) == 0 || len(params) > maxProofOutpoints {
+		http.Error(w, fmt.Sprintf("give 1 to %d leaf hashes",
+			maxProofOutpoints), http.StatusBadRequest)
+		return
+	}
+	leaves := make([]accumulator.Hash, len(params))
+	seen := make(map[accumulator.Hash]bool, len(params))
+	for i, s := range params {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != 32 {
+			http.Error(w, fmt.Sprintf("leaf %s isn't 32 bytes of hex", s),
+				http.StatusBadRequest)
+			return
+		}
+		copy(leaves[i][:], b)
+		// a target twice makes a proof that doesn't verify
+		if seen[leaves[i]] {
+			http.Error(w, fmt.Sprintf("leaf %s given more than once", s),
+				http.StatusBadRequest)
+			return
+		}
+		seen[leaves[i]] = true
+	}
+
+	var p httpProof
+	code := http.StatusOK
+	err := prover.forest.View(func(f *accumulator.Forest, h int32) error {
+		if prover.done {
+			code = http.StatusServiceUnavailable
+			return fmt.Errorf("bridge is shutting down")
+		}
+		for i, leaf := range leaves {
+			if !f.FindLeaf(leaf) {
+				code = http.StatusNotFound
+				return fmt.Errorf("leaf %s isn't in the forest at h %d",
+					params[i], h)
+			}
+		}
+		bp, err := f.ProveBatch(leaves)
+		if err != nil {
+			code = http.StatusInternalServerError
+			return err
+		}
+		p = httpProof{Height: h, NumLeaves: f.NumLeaves(),
+			Targets: bp.Targets, Proof: hashesToHex(bp.Proof)}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	serveJSON(w, p)
+}
+
+func (hg *httpGateway) serveStatus(w http.ResponseWriter, r *http.Request) {
+	blockHeight, prover := hg.current()
+	s := httpStatus{BlockHeight: blockHeight}
+	if prover != nil {
+		prover.forest.View(func(f *accumulator.Forest, h int32) error {
+			s.ForestHeight = &h
+			s.NumLeaves = f.NumLeaves()
+			s.ForestStats = f.Stats()
+			if cs, ok := f.CacheStats(); ok {
+				s.Cache = &cs
+			}
+			return nil
+		})
+	}
+	serveJSON(w, s)
+}
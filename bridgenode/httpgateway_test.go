@@ -0,0 +1,271 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// TestHTTPGateway serves a forest and some udata over HTTP and checks the
+// JSON, raw, Range and ETag responses
+func TestHTTPGateway(t *testing.T) {
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.LegacyHash, nil)
+	leaves := make([]accumulator.Leaf, 10)
+	for i := range leaves {
+		leaves[i].Hash[0] = byte(i + 1)
+	}
+	_, err := forest.Modify(leaves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prover, err := newOutpointProver(
+		&Config{}, accumulator.NewSafeForest(forest, 2), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stxo := btcacc.LeafData{TxHash: btcacc.Hash{1}, Index: 3, Height: 1,
+		Amt: 50, PkScript: []byte{0x51}}
+	bp, err := forest.ProveBatch([]accumulator.Hash{leaves[4].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ud := btcacc.UData{Height: 2, AccProof: bp,
+		Stxos: []btcacc.LeafData{stxo}, TxoTTLs: []int32{0, 0}}
+	var udBuf bytes.Buffer
+	err = ud.Serialize(&udBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udb := udBuf.Bytes()
+
+	hg := &httpGateway{bridgeFiles: bridgeFiles{
+		udata: func(height int32) ([]byte, error) {
+			if height != 2 {
+				return nil, fmt.Errorf("no udata at %d", height)
+			}
+			return udb, nil
+		},
+		block: func(height int32) ([]byte, error) {
+			return []byte{byte(height)}, nil
+		},
+		roots: func(height int32) (uint64, []accumulator.Hash, error) {
+			return forest.NumLeaves(), forest.GetRoots(), nil
+		},
+	}}
+	hg.set(2, prover)
+	ts := httptest.NewServer(hg.handler())
+	defer ts.Close()
+
+	// get does a request and gives the status, body and response headers
+	get := func(path string, header ...string) (int, []byte, http.Header) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body, resp.Header
+	}
+
+	code, body, hdr := get("/udata/2")
+	if code != http.StatusOK || !bytes.Equal(body, udb) {
+		t.Fatalf("raw udata %d %x, expect %x", code, body, udb)
+	}
+	etag := hdr.Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on udata")
+	}
+	// later blocks write TTLs into udata
+	if hdr.Get("Cache-Control") != cacheRevalidate {
+		t.Fatalf("udata Cache-Control %s", hdr.Get("Cache-Control"))
+	}
+	code, _, _ = get("/udata/2", "If-None-Match", etag)
+	if code != http.StatusNotModified {
+		t.Fatalf("If-None-Match gave %d, expect 304", code)
+	}
+	code, body, _ = get("/udata/2", "Range", "bytes=2-5")
+	if code != http.StatusPartialContent || !bytes.Equal(body, udb[2:6]) {
+		t.Fatalf("range gave %d %x, expect 206 %x", code, body, udb[2:6])
+	}
+
+	var j httpUData
+	code, body, hdr = get("/udata/2", "Accept", "application/json")
+	if code != http.StatusOK || json.Unmarshal(body, &j) != nil {
+		t.Fatalf("json udata %d %s", code, body)
+	}
+	if hdr.Get("ETag") == etag {
+		t.Fatal("json and raw udata have the same ETag")
+	}
+	if j.Height != 2 || len(j.Leaves) != 1 ||
+		j.Leaves[0].TxHash != stxo.TxHash.String() ||
+		j.Leaves[0].Amount != 50 || len(j.Targets) != 1 ||
+		j.Targets[0] != bp.Targets[0] {
+		t.Fatalf("json udata %s", body)
+	}
+
+	for path, want := range map[string]int{
+		"/udata/3": http.StatusNotFound, "/udata/x": http.StatusBadRequest,
+		"/udata/0": http.StatusNotFound, "/block/3": http.StatusNotFound,
+		"/block/-1": http.StatusBadRequest} {
+		code, _, _ = get(path)
+		if code != want {
+			t.Fatalf("%s gave %d, expect %d", path, code, want)
+		}
+	}
+	// a block at the tip could still be reorged out
+	code, body, hdr = get("/block/2")
+	if code != http.StatusOK || !bytes.Equal(body, []byte{2}) ||
+		hdr.Get("Cache-Control") != cacheRevalidate {
+		t.Fatalf("block %d %x %s", code, body, hdr.Get("Cache-Control"))
+	}
+
+	// roots at the tip could still be reorged out
+	var roots httpRoots
+	code, body, hdr = get("/roots/2")
+	if code != http.StatusOK || json.Unmarshal(body, &roots) != nil ||
+		roots.NumLeaves != 10 || len(roots.Roots) != 2 ||
+		hdr.Get("Cache-Control") != cacheRevalidate {
+		t.Fatalf("roots %d %s %s", code, body, hdr.Get("Cache-Control"))
+	}
+
+	// prove a couple of leaves and check it against the roots
+	var p httpProof
+	code, body, _ = get(fmt.Sprintf("/proof?leaf=%x&leaf=%x",
+		leaves[7].Hash, leaves[2].Hash))
+	if code != http.StatusOK || json.Unmarshal(body, &p) != nil {
+		t.Fatalf("proof %d %s", code, body)
+	}
+	proof := accumulator.BatchProof{Targets: p.Targets}
+	for _, s := range p.Proof {
+		var h accumulator.Hash
+		b, _ := hex.DecodeString(s)
+		copy(h[:], b)
+		proof.Proof = append(proof.Proof, h)
+	}
+	err = forest.VerifyBatchProof(
+		[]accumulator.Hash{leaves[7].Hash, leaves[2].Hash}, proof)
+	if err != nil || p.Height != 2 || p.NumLeaves != 10 {
+		t.Fatalf("proof %s: %v", body, err)
+	}
+	code, _, _ = get(fmt.Sprintf("/proof?leaf=%x", accumulator.Hash{0xee}))
+	if code != http.StatusNotFound {
+		t.Fatalf("proof of a leaf that isn't there gave %d", code)
+	}
+	code, _, _ = get(fmt.Sprintf("/proof?leaf=%x&leaf=%x",
+		leaves[7].Hash, leaves[7].Hash))
+	if code != http.StatusBadRequest {
+		t.Fatalf("proof of the same leaf twice gave %d", code)
+	}
+
+	var status httpStatus
+	code, body, _ = get("/status")
+	if code != http.StatusOK || json.Unmarshal(body, &status) != nil ||
+		status.BlockHeight != 2 || status.ForestHeight == nil ||
+		*status.ForestHeight != 2 || status.NumLeaves != 10 {
+		t.Fatalf("status %d %s", code, body)
+	}
+
+	// once the tip is far enough on, block 2 can't change
+	hg.set(2+finalDepth, prover)
+	for height, want := range map[int]string{
+		2: cacheForever, 3: cacheRevalidate} {
+		_, _, hdr = get(fmt.Sprintf("/block/%d", height))
+		if hdr.Get("Cache-Control") != want {
+			t.Fatalf("block %d Cache-Control %s, expect %s",
+				height, hdr.Get("Cache-Control"), want)
+		}
+	}
+}
+
+// TestHTTPGatewayLimits checks the gateway turns away connections past
+// -maxperip, and hangs up on a client that never finishes its request
+func TestHTTPGatewayLimits(t *testing.T) {
+	hg := newHTTPGateway(&Config{maxPerIP: 1,
+		connTimeout: 200 * time.Millisecond})
+	hg.bridgeFiles = bridgeFiles{
+		block: func(height int32) ([]byte, error) {
+			return []byte{byte(height)}, nil
+		},
+	}
+	hg.set(5, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hg.serve(listener)
+	defer hg.close(time.Second)
+	addr := listener.Addr().String()
+
+	// half a request, and then nothing
+	slow, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	_, err = slow.Write([]byte("GET /block/1 HTTP/1.1\r\nHost: x\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the slow client is the one connection its IP gets, so this one's
+	// hung up on before it could time out
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = second.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("second connection from one IP read %v, expect EOF", err)
+	}
+
+	start := time.Now()
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(slow)
+	if err != nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("unfinished request hung up on after %s with %v",
+			time.Since(start), err)
+	}
+
+	// which frees up its place
+	var resp *http.Response
+	for tries := 0; ; tries++ {
+		resp, err = http.Get("http://" + addr + "/block/1")
+		if err == nil || tries == 10 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("block after the slow client left gave %d", resp.StatusCode)
+	}
+}
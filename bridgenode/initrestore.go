@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 )
 
@@ -13,7 +14,7 @@ import (
 // If a chain state is not present, chain is initialized to the genesis
 // returns forest, height, lastIndexOffsetHeight, pOffset and error
 func InitBridgeNodeState(
-	cfg *Config, offsetFinished chan bool) (forest *accumulator.Forest,
+	cfg *Config, haltRequest chan bool) (forest *accumulator.Forest,
 	height int32, err error) {
 
 	// Default behavior is that the user should delete all offsetdata
@@ -27,7 +28,7 @@ func InitBridgeNodeState(
 	var knownTipHeight int32
 	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
 		knownTipHeight, err = restoreLastIndexOffsetHeight(
-			cfg.UtreeDir.OffsetDir, offsetFinished)
+			cfg.UtreeDir.OffsetDir)
 		if err != nil {
 			err = fmt.Errorf("restoreLastIndexOffsetHeight error: %s", err.Error())
 			return
@@ -35,7 +36,10 @@ func InitBridgeNodeState(
 	} else {
 		fmt.Println("Offsetfile not present or half present. " +
 			"Indexing offset for blocks blk*.dat files...")
-		knownTipHeight, err = createOffsetData(cfg, offsetFinished)
+		knownTipHeight, err = createOffsetData(cfg, haltRequest)
+		if err == ErrStopped {
+			return
+		}
 		if err != nil {
 			err = fmt.Errorf("createOffsetData error: %s", err.Error())
 			return
@@ -50,6 +54,11 @@ func InitBridgeNodeState(
 			err = fmt.Errorf("restoreForest error: %s", err.Error())
 			return
 		}
+		err = restoreBlockHashHeight(cfg)
+		if err != nil {
+			err = fmt.Errorf("restoreBlockHashHeight error: %s", err.Error())
+			return
+		}
 		height, err = restoreHeight(cfg)
 		if err != nil {
 			err = fmt.Errorf("restoreHeight error: %s", err.Error())
@@ -65,6 +74,14 @@ func InitBridgeNodeState(
 			err = fmt.Errorf("createForest error: %s", err.Error())
 			return
 		}
+		if cfg.blockHashHeight == btcacc.NoSwitchHeight {
+			cfg.blockHashHeight = 0
+		}
+		err = saveBlockHashHeight(cfg)
+		if err != nil {
+			err = fmt.Errorf("saveBlockHashHeight error: %s", err.Error())
+			return
+		}
 	}
 
 	if cfg.quitAfter < 1 { // quitafter not assigned, go to tip
@@ -101,7 +118,7 @@ func saveBridgeNodeData(
 			return err
 		}
 
-	case cowForest:
+	case cowForest, mmapForest:
 		err := forest.WriteForestToDisk(nil, false, true)
 		if err != nil {
 			return err
@@ -130,13 +147,20 @@ func saveBridgeNodeData(
 		return err
 	}
 
+	// commits the position index if it's on disk
+	err = forest.ClosePositionIndex()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // createOffsetData restores the offsetfile needed to index the
-// blocks in the raw blk*.dat and raw rev*.dat files.
+// blocks in the raw blk*.dat and raw rev*.dat files.  If it's stopped
+// part way, the incomplete offset data is removed and it gives ErrStopped.
 func createOffsetData(
-	cfg *Config, offsetFinished chan bool) (
+	cfg *Config, haltRequest chan bool) (
 	lastIndexOffsetHeight int32, err error) {
 
 	// Set the Block Header hash
@@ -149,13 +173,19 @@ func createOffsetData(
 
 	// TODO allow the user to pass a custom offsetfile path and
 	// custom lastOffsetHeight path instead of just ""
-	lastIndexOffsetHeight, err = buildOffsetFile(cfg, *hash, "", "")
+	lastIndexOffsetHeight, err = buildOffsetFile(cfg, *hash, "", "", haltRequest)
+	if err == ErrStopped {
+		fmt.Println("offsetfile incomplete, removing...")
+		rmErr := os.RemoveAll(cfg.UtreeDir.OffsetDir.base)
+		if rmErr != nil {
+			fmt.Println("ERR. offsetdata/ directory not removed. Please manually remove it.")
+		}
+		return 0, err
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	offsetFinished <- true
-
 	return
 }
 
@@ -165,12 +195,12 @@ func createForest(cfg *Config) (
 
 	switch cfg.forestType {
 	case ramForest:
-		forest = accumulator.NewForest(accumulator.RamForest, nil, "", 0)
-		return
+		forest = accumulator.NewForest(accumulator.RamForest, nil,
+			"", 0, cfg.hashScheme, accumulator.DefaultHasher)
 	case cowForest:
 		forest = accumulator.NewForest(accumulator.CowForest, nil,
-			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
-		return
+			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache,
+			cfg.hashScheme, accumulator.DefaultHasher)
 	default:
 		// Where the forestfile exists
 		forestFile, err := os.OpenFile(
@@ -180,21 +210,52 @@ func createForest(cfg *Config) (
 		}
 
 		// Restores all the forest data
-		if cfg.forestType == cacheForest {
-			forest = accumulator.NewForest(accumulator.CacheForest, forestFile, "", 0)
-		} else {
-			forest = accumulator.NewForest(accumulator.DiskForest, forestFile, "", 0)
+		switch cfg.forestType {
+		case cacheForest:
+			forest = accumulator.NewForest(accumulator.CacheForest, forestFile,
+				"", cfg.forestCache, cfg.hashScheme, accumulator.DefaultHasher)
+		case mmapForest:
+			forest = accumulator.NewForest(accumulator.MmapForest, forestFile,
+				"", 0, cfg.hashScheme, accumulator.DefaultHasher)
+		default:
+			forest = accumulator.NewForest(accumulator.DiskForest, forestFile,
+				"", 0, cfg.hashScheme, accumulator.DefaultHasher)
+		}
+	}
+
+	index, err := openPositionIndex(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		err = forest.SetPositionIndex(index)
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return
 }
 
+// openPositionIndex opens the leveldb position index if -posindex was given.
+// nil means the forest keeps its index in ram.
+func openPositionIndex(cfg *Config) (accumulator.PositionIndex, error) {
+	if !cfg.diskPosIndex {
+		return nil, nil
+	}
+	return accumulator.OpenPositionIndex(cfg.UtreeDir.ForestDir.positionIndexDir)
+}
+
 // restoreForest restores forest fields based off the existing forestdata
 // on disk.
 func restoreForest(cfg *Config) (
 	forest *accumulator.Forest, err error) {
 
+	index, err := openPositionIndex(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	switch cfg.forestType {
 	case cowForest:
 		var miscForestFile *os.File
@@ -205,19 +266,23 @@ func restoreForest(cfg *Config) (
 			return nil, err
 		}
 		forest, err = accumulator.RestoreForest(
-			miscForestFile, nil, false, false,
-			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
+			miscForestFile, nil, false, false, false,
+			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache,
+			accumulator.DefaultHasher, index)
 
 	default:
 		var (
 			inRam bool
 			cache bool
+			mmap  bool
 		)
 		switch cfg.forestType {
 		case ramForest:
 			inRam = true
 		case cacheForest:
 			cache = true
+		case mmapForest:
+			mmap = true
 		}
 
 		var forestFile *os.File
@@ -236,13 +301,68 @@ func restoreForest(cfg *Config) (
 		}
 
 		forest, err = accumulator.RestoreForest(
-			miscForestFile, forestFile, inRam, cache, "", 0)
+			miscForestFile, forestFile, inRam, cache, mmap, "", cfg.forestCache,
+			accumulator.DefaultHasher, index)
+
+	}
+	if err != nil {
+		return
+	}
 
+	// the scheme is saved with the forest; hashing the rest of the chain
+	// a different way would make roots nobody else has
+	if forest.HashScheme() != cfg.hashScheme {
+		err = fmt.Errorf("forest on disk uses hash scheme %s but -hashscheme=%s",
+			forest.HashScheme(), cfg.hashScheme)
+		return nil, err
 	}
 
 	return
 }
 
+// saveBlockHashHeight saves the block hash switch-over height the forest is
+// built with, so restarting with another -blockhashheight can't change it
+func saveBlockHashHeight(cfg *Config) error {
+	f, err := os.OpenFile(cfg.UtreeDir.ForestDir.blockHashHeightFile,
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(f, binary.BigEndian, cfg.blockHashHeight)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// restoreBlockHashHeight sets cfg's block hash switch-over height to the one
+// the forest was built with.  Forests from before it was saved need
+// -blockhashheight, which is then saved.
+func restoreBlockHashHeight(cfg *Config) error {
+	saved := btcacc.NoSwitchHeight
+	if util.HasAccess(cfg.UtreeDir.ForestDir.blockHashHeightFile) {
+		f, err := os.Open(cfg.UtreeDir.ForestDir.blockHashHeightFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		err = binary.Read(f, binary.BigEndian, &saved)
+		if err != nil {
+			return err
+		}
+	}
+	switchHeight, err := btcacc.ResumeSwitchHeight(saved, cfg.blockHashHeight)
+	if err != nil {
+		return err
+	}
+	cfg.blockHashHeight = switchHeight
+	if saved == btcacc.NoSwitchHeight {
+		return saveBlockHashHeight(cfg)
+	}
+	return nil
+}
+
 // restoreHeight restores height from util.ForestLastSyncedBlockHeightFileName
 func restoreHeight(cfg *Config) (height int32, err error) {
 	// if there is a heightfile, get the height from that
@@ -267,7 +387,7 @@ func restoreHeight(cfg *Config) (height int32, err error) {
 }
 
 // restoreLastIndexOffsetHeight restores the lastIndexOffsetHeight
-func restoreLastIndexOffsetHeight(offsetDir offsetDir, offsetFinished chan bool) (
+func restoreLastIndexOffsetHeight(offsetDir offsetDir) (
 	lastIndexOffsetHeight int32, err error) {
 
 	f, err := os.OpenFile(
@@ -282,9 +402,6 @@ func restoreLastIndexOffsetHeight(offsetDir offsetDir, offsetFinished chan bool)
 	if err != nil {
 		return 0, err
 	}
-	// if there is a offset file, we should pass true to offsetFinished
-	// to let stopParse() know that it shouldn't delete offsetfile
-	offsetFinished <- true
 
 	return
 }
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 )
 
@@ -20,9 +21,11 @@ import (
 // delete the current offsetfile directory and run genproofs again.
 // Fairly quick process with one blk*.dat file taking a few seconds.
 //
-// Returns the last block height that it processed.
+// Returns the last block height that it processed, or ErrStopped if
+// haltRequest came before it finished.
 func buildOffsetFile(cfg *Config, tip util.Hash,
-	cOffsetFile, cLastOffsetHeightFile string) (int32, error) {
+	cOffsetFile, cLastOffsetHeightFile string, haltRequest chan bool) (
+	int32, error) {
 
 	// Map to store Block Header Hashes for sorting purposes
 	// blk*.dat files aren't in block order so this is needed
@@ -74,6 +77,11 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 			fmt.Printf("%s doesn't exist; done building\n", filePath)
 			break
 		}
+		select {
+		case <-haltRequest:
+			return 0, ErrStopped
+		default:
+		}
 		// grab headers from the .dat file as RawHeaderData type
 		rawheaders, err :=
 			readRawHeadersFromFile(bufReader, filePath, uint32(fileNum), bufDB)
@@ -126,13 +134,48 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 	return lastOffsetHeight, nil
 }
 
+// buildBlockHashIndex reads the headers for heights 1 through tipHeight
+// using the offset file, and indexes their hashes by height so leaves can
+// commit to the block that created them.
+func buildBlockHashIndex(
+	cfg *Config, tipHeight int32) (*btcacc.BlockHashIndex, error) {
+
+	blockHashes := btcacc.NewBlockHashIndex(cfg.blockHashHeight)
+	err := blockHashes.Add(0, btcacc.Hash(*cfg.params.GenesisHash))
+	if err != nil {
+		return nil, err
+	}
+
+	hr, err := newHeaderFileReader(
+		cfg.UtreeDir.OffsetDir.OffsetFile, cfg.BlockDir)
+	if err != nil {
+		return nil, err
+	}
+	defer hr.close()
+
+	for h := int32(1); h <= tipHeight; h++ {
+		hdr, err := hr.read(h)
+		if err != nil {
+			return nil, fmt.Errorf("buildBlockHashIndex read height %d %s",
+				h, err.Error())
+		}
+		// double sha256 like in readRawHeadersFromFile
+		first := sha256.Sum256(hdr[:])
+		err = blockHashes.Add(h, sha256.Sum256(first[:]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blockHashes, nil
+}
+
 // readRawHeadersFromFile reads only the headers from the given .dat file
 func readRawHeadersFromFile(
 	bufReader *bufio.Reader, fileDir string,
 	fileNum uint32, bufMap map[[32]byte]uint32) ([]RawHeaderData, error) {
 	var blockHeaders []RawHeaderData
 
-	f, err := os.Open(fileDir)
+	f, err := openXorFile(fileDir)
 	if err != nil {
 		panic(err)
 	}
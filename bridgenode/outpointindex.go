@@ -0,0 +1,464 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+/*
+With -opindex the bridge keeps the LeafData of every utxo in the accumulator
+in leveldb, keyed on its outpoint.  A wallet that finds its utxos some other
+way, like restoring from a seed, only knows the outpoints; the LeafData is
+what gives the leaf hash, so with the index the bridge can prove them at
+the tip.
+
+The index is updated in the same batch as the height it's at, after the
+forest is modified for that block.  After a crash it can be ahead of the
+forest on disk, and would prove outpoints the forest doesn't have yet, so
+genproofs rolls it back first with the blocks and rev data on disk.  One
+that's behind the forest is missing blocks.
+*/
+
+// indexHeightKey is where the leveldb indexes keep their height.  It isn't
+// the length of any of their other keys.
+var indexHeightKey = []byte("height")
+
+// maxProofOutpoints is the most outpoints a client can ask to prove at once
+const maxProofOutpoints = 1 << 16
+
+// outpointIndex is the LeafData of every utxo in the accumulator
+type outpointIndex struct {
+	db *leveldb.DB
+}
+
+// outpointKey is the 32 byte txid then the 4 byte index
+func outpointKey(txid btcacc.Hash, index uint32) []byte {
+	key := make([]byte, 36)
+	copy(key, txid[:])
+	binary.BigEndian.PutUint32(key[32:], index)
+	return key
+}
+
+// openOutpointIndex opens, or makes, the outpoint index at path
+func openOutpointIndex(path string) (*outpointIndex, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &outpointIndex{db: db}, nil
+}
+
+// height gives the last block in the index, and false if it's empty
+func (oi *outpointIndex) height() (int32, bool, error) {
+	v, err := oi.db.Get(indexHeightKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(v) != 4 {
+		return 0, false, fmt.Errorf("outpoint index height is %d bytes", len(v))
+	}
+	return int32(binary.BigEndian.Uint32(v)), true, nil
+}
+
+// update puts in the utxos a block added, takes out the ones it spent, and
+// moves the index to its height
+func (oi *outpointIndex) update(
+	height int32, adds, dels []btcacc.LeafData) error {
+
+	var batch leveldb.Batch
+	for _, ld := range dels {
+		batch.Delete(outpointKey(ld.TxHash, ld.Index))
+	}
+	for _, ld := range adds {
+		var buf bytes.Buffer
+		err := ld.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+		batch.Put(outpointKey(ld.TxHash, ld.Index), buf.Bytes())
+	}
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(height))
+	batch.Put(indexHeightKey, h[:])
+
+	err := oi.db.Write(&batch, nil)
+	if err != nil {
+		return fmt.Errorf("outpoint index h %d: %s", height, err.Error())
+	}
+	return nil
+}
+
+// undo takes a block at height back out of the index: the utxos it added
+// come out and the ones it spent go back in
+func (oi *outpointIndex) undo(
+	height int32, adds, dels []btcacc.LeafData) error {
+
+	var batch leveldb.Batch
+	for _, ld := range adds {
+		batch.Delete(outpointKey(ld.TxHash, ld.Index))
+	}
+	for _, ld := range dels {
+		var buf bytes.Buffer
+		err := ld.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+		batch.Put(outpointKey(ld.TxHash, ld.Index), buf.Bytes())
+	}
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(height-1))
+	batch.Put(indexHeightKey, h[:])
+
+	err := oi.db.Write(&batch, nil)
+	if err != nil {
+		return fmt.Errorf("outpoint index undo h %d: %s", height, err.Error())
+	}
+	return nil
+}
+
+// get gives the LeafData for an outpoint, and false if it isn't a utxo
+func (oi *outpointIndex) get(op wire.OutPoint) (btcacc.LeafData, bool, error) {
+	var ld btcacc.LeafData
+	v, err := oi.db.Get(outpointKey(btcacc.Hash(op.Hash), op.Index), nil)
+	if err == leveldb.ErrNotFound {
+		return ld, false, nil
+	}
+	if err != nil {
+		return ld, false, err
+	}
+	err = ld.Deserialize(bytes.NewReader(v))
+	if err != nil {
+		return ld, false, fmt.Errorf("outpoint index %s: %s",
+			op.String(), err.Error())
+	}
+	return ld, true, nil
+}
+
+func (oi *outpointIndex) close() error {
+	return oi.db.Close()
+}
+
+// outpointProver is the forest with the indexes that go with it.  The
+// indexes are only changed inside forest.Update, so nothing read from them
+// is from a different block than the forest is at.
+type outpointProver struct {
+	forest *accumulator.SafeForest
+	// nil without -opindex
+	index *outpointIndex
+	// nil without -electrum
+	scripts *scriptHashIndex
+	// done is set in forest.Update once the forest is being put away
+	done bool
+}
+
+// newOutpointProver opens the indexes to go with forest that the config
+// asks for.  When serving, they have to be at the same height as the
+// forest.  Otherwise they can be ahead, and rollBack has to take them back
+// before anything's proven with them.
+func newOutpointProver(cfg *Config, forest *accumulator.SafeForest,
+	serving bool) (*outpointProver, error) {
+
+	op := &outpointProver{forest: forest}
+	height := forest.Height()
+	if cfg.opIndex {
+		index, err := openOutpointIndex(cfg.UtreeDir.ForestDir.outpointIndexDir)
+		if err != nil {
+			return nil, err
+		}
+		op.index = index
+		indexHeight, ok, err := index.height()
+		if err == nil {
+			err = checkIndexHeight("outpoint", indexHeight, ok, height, serving)
+		}
+		if err != nil {
+			op.close()
+			return nil, err
+		}
+	}
+	if cfg.electrum != "" {
+		scripts, err := openScriptHashIndex(
+			cfg.UtreeDir.ForestDir.scriptHashIndexDir)
+		if err != nil {
+			op.close()
+			return nil, err
+		}
+		op.scripts = scripts
+		indexHeight, ok, err := scripts.height()
+		if err == nil {
+			err = checkIndexHeight("scripthash", indexHeight, ok, height, serving)
+		}
+		if err != nil {
+			op.close()
+			return nil, err
+		}
+	}
+	return op, nil
+}
+
+// checkIndexHeight says if an index at indexHeight (ok false if it's empty)
+// can be used with a forest at height
+func checkIndexHeight(
+	name string, indexHeight int32, ok bool, height int32, serving bool) error {
+
+	switch {
+	case !ok && height != 0:
+		return fmt.Errorf("%s index is empty but the forest is at h %d.  "+
+			"It has to be on from the first block", name, height)
+	case ok && indexHeight < height:
+		return fmt.Errorf("%s index is at h %d but the forest is at h %d.  "+
+			"It has to be on from the first block", name, indexHeight, height)
+	case ok && serving && indexHeight != height:
+		return fmt.Errorf("%s index is at h %d but the forest is at h %d.  "+
+			"Run genproofs again to catch the forest up",
+			name, indexHeight, height)
+	}
+	return nil
+}
+
+// rollBack takes the indexes back to the forest's height, undoing the blocks
+// they have past it with the blocks and rev data on disk
+func (op *outpointProver) rollBack(cfg *Config) error {
+	height := op.forest.Height()
+	var indexHeight, scriptsHeight int32
+	var err error
+	if op.index != nil {
+		indexHeight, _, err = op.index.height()
+		if err != nil {
+			return err
+		}
+	}
+	if op.scripts != nil {
+		scriptsHeight, _, err = op.scripts.height()
+		if err != nil {
+			return err
+		}
+	}
+	top := indexHeight
+	if scriptsHeight > top {
+		top = scriptsHeight
+	}
+	if top <= height {
+		return nil
+	}
+
+	fmt.Printf("rolling the indexes back from h %d to %d\n", top, height)
+	blockHashes, err := buildBlockHashIndex(cfg, top)
+	if err != nil {
+		return err
+	}
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	for h := top; h > height; h-- {
+		blocks, revs, err := GetRawBlocksFromDisk(h, 1, offsetFile, cfg.BlockDir)
+		if err != nil {
+			return err
+		}
+		if len(blocks) != 1 {
+			return fmt.Errorf("rolling back indexes: no block %d on disk", h)
+		}
+		bnr := blockAndRev{Height: h, Blk: btcutil.NewBlock(&blocks[0]),
+			Rev: revs[0]}
+		bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+			util.DedupeBlock(bnr.Blk)
+		dels, err := bnr.toDelLeaves(blockHashes)
+		if err != nil {
+			return err
+		}
+		adds := uwire.BlockToAddLeafData(
+			bnr.Blk, bnr.outSkipList, h, blockHashes)
+
+		if op.index != nil && h <= indexHeight {
+			err = op.index.undo(h, adds, dels)
+			if err != nil {
+				return err
+			}
+		}
+		if op.scripts != nil && h <= scriptsHeight {
+			err = op.scripts.undo(&bnr, adds, dels)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockDone puts a block in whichever indexes there are.  adds are the
+// utxos it made that go in the accumulator and dels the ones it spent.
+// Call it in the forest.Update that modified the forest for that block.
+func (op *outpointProver) blockDone(
+	bnr *blockAndRev, adds, dels []btcacc.LeafData) error {
+
+	if op.index != nil {
+		err := op.index.update(bnr.Height, adds, dels)
+		if err != nil {
+			return err
+		}
+	}
+	if op.scripts != nil {
+		err := op.scripts.update(bnr, adds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// needsLeafData says if blockDone needs the LeafData of the block's adds
+func (op *outpointProver) needsLeafData() bool {
+	return op.index != nil || op.scripts != nil
+}
+
+func (op *outpointProver) close() error {
+	var err error
+	if op.index != nil {
+		err = op.index.close()
+	}
+	if op.scripts != nil {
+		scriptsErr := op.scripts.close()
+		if err == nil {
+			err = scriptsErr
+		}
+	}
+	return err
+}
+
+// prove gives the LeafData of whichever outpoints are utxos, and a
+// BatchProof for them with targets in the same order, along with the height
+// and numLeaves they're proven at.  Outpoints that aren't utxos are left out,
+// and ones asked for more than once are only in there once.
+func (op *outpointProver) prove(ops []wire.OutPoint) (
+	height int32, numLeaves uint64, found []btcacc.LeafData,
+	bp accumulator.BatchProof, err error) {
+
+	if op.index == nil {
+		err = fmt.Errorf("no outpoint index, start the bridge with -opindex")
+		return
+	}
+	err = op.forest.View(func(f *accumulator.Forest, h int32) error {
+		if op.done {
+			return fmt.Errorf("bridge is shutting down")
+		}
+		hashes := make([]accumulator.Hash, 0, len(ops))
+		// the same leaf can't be in a batch proof twice
+		asked := make(map[wire.OutPoint]bool, len(ops))
+		for _, o := range ops {
+			if asked[o] {
+				continue
+			}
+			asked[o] = true
+			ld, ok, err := op.index.get(o)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			found = append(found, ld)
+			hashes = append(hashes, ld.LeafHashWith(f.HashScheme(), f.Hasher()))
+		}
+		var err error
+		bp, err = f.ProveBatch(hashes)
+		if err != nil {
+			return fmt.Errorf("outpoint index and forest differ at h %d: %s",
+				h, err.Error())
+		}
+		height, numLeaves = h, f.NumLeaves()
+		return nil
+	})
+	return
+}
+
+// serveOutpointProofs reads a count and that many 36 byte outpoints from the
+// client, and sends back the height and numLeaves they're proven at, how
+// many of them are utxos, the LeafData of each of those, then the BatchProof
+// for them.  It hangs up without sending anything if it can't prove them.
+func serveOutpointProofs(c net.Conn, prover *outpointProver) {
+	var count uint32
+	err := binary.Read(c, binary.BigEndian, &count)
+	if err != nil {
+		fmt.Printf("serveOutpointProofs Read %s\n", err.Error())
+		return
+	}
+	if count > maxProofOutpoints {
+		fmt.Printf("%s wanted proofs for %d outpoints, max %d\n",
+			c.RemoteAddr().String(), count, maxProofOutpoints)
+		return
+	}
+	ops := make([]wire.OutPoint, count)
+	var key [36]byte
+	for i := range ops {
+		_, err = io.ReadFull(c, key[:])
+		if err != nil {
+			fmt.Printf("serveOutpointProofs Read %s\n", err.Error())
+			return
+		}
+		copy(ops[i].Hash[:], key[:32])
+		ops[i].Index = binary.BigEndian.Uint32(key[32:])
+	}
+
+	if prover == nil {
+		fmt.Printf("%s wanted outpoint proofs but there's no forest loaded\n",
+			c.RemoteAddr().String())
+		return
+	}
+	height, numLeaves, found, bp, err := prover.prove(ops)
+	if err != nil {
+		fmt.Printf("serveOutpointProofs %s\n", err.Error())
+		return
+	}
+
+	w := bufio.NewWriter(c)
+	err = binary.Write(w, binary.BigEndian, height)
+	if err != nil {
+		fmt.Printf("serveOutpointProofs write %s\n", err.Error())
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, numLeaves)
+	if err != nil {
+		fmt.Printf("serveOutpointProofs write %s\n", err.Error())
+		return
+	}
+	err = binary.Write(w, binary.BigEndian, uint32(len(found)))
+	if err != nil {
+		fmt.Printf("serveOutpointProofs write %s\n", err.Error())
+		return
+	}
+	for _, ld := range found {
+		err = ld.Serialize(w)
+		if err != nil {
+			fmt.Printf("serveOutpointProofs write %s\n", err.Error())
+			return
+		}
+	}
+	err = bp.Serialize(w)
+	if err != nil {
+		fmt.Printf("serveOutpointProofs write %s\n", err.Error())
+		return
+	}
+	err = w.Flush()
+	if err != nil {
+		fmt.Printf("serveOutpointProofs write %s\n", err.Error())
+	}
+	fmt.Printf("proved %d of %d outpoints at h %d for %s\n",
+		len(found), len(ops), height, c.RemoteAddr().String())
+}
@@ -0,0 +1,246 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// TestOutpointIndex takes a forest and outpoint index through some blocks,
+// then asks for proofs of outpoints that are and aren't utxos and checks
+// the served proofs against the forest
+func TestOutpointIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "opindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{opIndex: true}
+	cfg.UtreeDir.ForestDir.outpointIndexDir = filepath.Join(dir, "opindex")
+
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.TaggedHashV1, nil)
+	prover, err := newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every block makes 5 utxos and spends the first 2 of the block before
+	var utxos, spent, adds, dels []btcacc.LeafData
+	for h := int32(1); h <= 20; h++ {
+		adds = nil
+		for i := uint32(0); i < 5; i++ {
+			ld := btcacc.LeafData{Index: i, Height: h, Amt: int64(h) * 1000,
+				PkScript: []byte{byte(h), byte(i)}}
+			ld.TxHash[0] = byte(h)
+			adds = append(adds, ld)
+		}
+		dels = nil
+		if h > 1 {
+			dels = utxos[len(utxos)-5 : len(utxos)-3]
+		}
+
+		delHashes := make([]accumulator.Hash, len(dels))
+		for i, ld := range dels {
+			delHashes[i] = ld.LeafHashWith(forest.HashScheme(), nil)
+		}
+		bp, err := forest.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves := make([]accumulator.Leaf, len(adds))
+		for i, ld := range adds {
+			leaves[i].Hash = ld.LeafHashWith(forest.HashScheme(), nil)
+		}
+		err = prover.forest.Update(h, func(f *accumulator.Forest) error {
+			_, err := f.Modify(leaves, bp.Targets)
+			if err != nil {
+				return err
+			}
+			return prover.blockDone(&blockAndRev{Height: h}, adds, dels)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		spent = append(spent, dels...)
+		utxos = append(utxos, adds...)
+	}
+
+	// taking the last block back out puts back what it spent
+	err = prover.index.undo(20, adds, dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexHeight, _, err := prover.index.height()
+	if err != nil || indexHeight != 19 {
+		t.Fatalf("undid block 20 to h %d %v", indexHeight, err)
+	}
+	for _, ld := range append(adds, dels...) {
+		_, ok, err := prover.index.get(
+			wire.OutPoint{Hash: chainhash.Hash(ld.TxHash), Index: ld.Index})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (ld.Height != 20) {
+			t.Fatalf("after undo %s is there: %v", ld.OPString(), ok)
+		}
+	}
+	err = prover.index.update(20, adds, dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = prover.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an index ahead of the forest is fine to build from, not to serve
+	_, err = newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 19), true)
+	if err == nil {
+		t.Fatal("served an index ahead of the forest")
+	}
+	_, err = newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 21), false)
+	if err == nil {
+		t.Fatal("built on an index behind the forest")
+	}
+	prover, err = newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 20), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prover.close()
+
+	// ask for a spent one, some unspent ones, one that was never there, and
+	// one twice
+	wanted := []btcacc.LeafData{spent[3], utxos[len(utxos)-1], utxos[7],
+		{Index: 9}, utxos[2], utxos[7]}
+	found := []btcacc.LeafData{wanted[1], wanted[2], wanted[4]}
+	client, server := net.Pipe()
+	go serveOutpointProofs(server, prover)
+	req := []uint32{uint32(len(wanted))}
+	err = binary.Write(client, binary.BigEndian, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ld := range wanted {
+		op := wire.OutPoint{Hash: chainhash.Hash(ld.TxHash), Index: ld.Index}
+		_, err = client.Write(op.Hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = binary.Write(client, binary.BigEndian, op.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var height int32
+	var numLeaves uint64
+	var numFound uint32
+	for _, v := range []interface{}{&height, &numLeaves, &numFound} {
+		err = binary.Read(client, binary.BigEndian, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if height != 20 || numLeaves != forest.NumLeaves() ||
+		numFound != uint32(len(found)) {
+		t.Fatalf("served h %d %d leaves %d found, expect 20 %d %d",
+			height, numLeaves, numFound, forest.NumLeaves(), len(found))
+	}
+	hashes := make([]accumulator.Hash, numFound)
+	for i := range hashes {
+		var ld btcacc.LeafData
+		err = ld.Deserialize(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ld.OPString() != found[i].OPString() || ld.Amt != found[i].Amt {
+			t.Fatalf("served %s, expect %s", ld.ToString(), found[i].ToString())
+		}
+		hashes[i] = ld.LeafHashWith(forest.HashScheme(), nil)
+	}
+	var bp accumulator.BatchProof
+	err = bp.Deserialize(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	err = forest.VerifyBatchProof(hashes, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRollBackIndexes builds the indexes past where the forest is, like a
+// crash leaves them, and rolls them back with the blocks on disk
+func TestRollBackIndexes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := testConfig(dir)
+	cfg.opIndex = true
+	cfg.electrum = "50001"
+	cfg.UtreeDir.ForestDir.outpointIndexDir = filepath.Join(dir, "opindex")
+	cfg.UtreeDir.ForestDir.scriptHashIndexDir = filepath.Join(dir, "shindex")
+	headers := makeTestHeaders(&cfg.params, 5)
+	writeTestBlocks(t, cfg, headers, []int{0, 1, 2, 3, 4}, xorKey{})
+
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.LegacyHash, nil)
+	prover, err := newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 0), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := int32(1); h <= 5; h++ {
+		blk := btcutil.NewBlock(wire.NewMsgBlock(&headers[h-1]))
+		err = prover.blockDone(&blockAndRev{Height: h, Blk: blk}, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = prover.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the forest was only saved at 3
+	_, err = newOutpointProver(cfg, accumulator.NewSafeForest(forest, 3), true)
+	if err == nil {
+		t.Fatal("served indexes ahead of the forest")
+	}
+	prover, err = newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 3), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = prover.rollBack(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = prover.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prover, err = newOutpointProver(
+		cfg, accumulator.NewSafeForest(forest, 3), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prover.close()
+}
@@ -0,0 +1,177 @@
+package bridgenode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// p2pServer serves ublocks and roots to btcd peers, with the utreexo
+// messages in the wire package, from whatever the bridge has at the moment
+type p2pServer struct {
+	bridgeFiles
+	// every peer gets a copy
+	peerConfig peer.Config
+	listener   net.Listener
+	conns      *connLimiter
+	servedState
+}
+
+// newP2PServer makes a p2p server that reads from the bridge's files
+func newP2PServer(cfg *Config) *p2pServer {
+	return &p2pServer{
+		bridgeFiles: newBridgeFiles(cfg),
+		conns:       newIdleConnLimiter(cfg),
+		peerConfig: peer.Config{
+			UserAgentName:    "utreexo-bridge",
+			UserAgentVersion: "0.1",
+			ChainParams:      &cfg.params,
+			Services:         uwire.SFNodeUtreexo | wire.SFNodeWitness,
+		},
+	}
+}
+
+// listen accepts peers on port
+func (ps *p2pServer) listen(port string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("p2p server listening on %s\n", listener.Addr().String())
+	ps.listener = listener
+	go ps.conns.serve(listener, "p2p", func(c net.Conn) {
+		ps.servePeer(c).WaitForDisconnect()
+	})
+	return nil
+}
+
+// close stops taking new peers, and waits up to drain for the ones
+// connected to hang up before hanging up on them
+func (ps *p2pServer) close(drain time.Duration) {
+	if ps.listener != nil {
+		ps.listener.Close()
+		ps.conns.stop(drain)
+	}
+}
+
+// servePeer does the handshake with the peer on c, then answers its
+// requests one at a time until it hangs up
+func (ps *p2pServer) servePeer(c net.Conn) *peer.Peer {
+	peerConfig := ps.peerConfig
+	p := peer.NewInboundPeer(&peerConfig)
+
+	requests := make(chan wire.Message, 1)
+	quit := make(chan struct{})
+	p.AssociateConnection(uwire.NewMsgConn(c, peerConfig.ChainParams.Net,
+		func(msg wire.Message) {
+			select {
+			case requests <- msg:
+			case <-quit:
+			}
+		}))
+	go func() {
+		p.WaitForDisconnect()
+		close(quit)
+	}()
+	go func() {
+		for {
+			select {
+			case msg := <-requests:
+				ps.handle(p, msg)
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// handle answers one request from p
+func (ps *p2pServer) handle(p *peer.Peer, msg wire.Message) {
+	switch m := msg.(type) {
+	case *uwire.MsgGetUData:
+		ps.sendUBlocks(p, m)
+	case *uwire.MsgGetUtreexoRoots:
+		ps.sendRoots(p, m)
+	default:
+		fmt.Printf("p2p peer %s sent %s, which a bridge doesn't take\n",
+			p.Addr(), msg.Command())
+	}
+}
+
+// notFound tells p there's nothing more of invType
+func notFound(p *peer.Peer, invType wire.InvType) {
+	msg := wire.NewMsgNotFound()
+	msg.AddInvVect(wire.NewInvVect(invType, &chainhash.Hash{}))
+	p.QueueMessage(msg, nil)
+}
+
+// sendUBlocks sends the ublocks asked for, waiting for each to go out
+// before reading the next
+func (ps *p2pServer) sendUBlocks(p *peer.Peer, req *uwire.MsgGetUData) {
+	blockHeight, _ := ps.current()
+	from := req.FromHeight
+	if from < 1 {
+		from = 1
+	}
+	done := make(chan struct{})
+	for h := from; h <= req.ToHeight; h++ {
+		if !p.Connected() {
+			return
+		}
+		if h > blockHeight {
+			notFound(p, uwire.InvTypeUBlock)
+			return
+		}
+		msg, err := ps.readUBlock(h)
+		if err != nil {
+			fmt.Printf("p2p sendUBlocks %s\n", err.Error())
+			notFound(p, uwire.InvTypeUBlock)
+			return
+		}
+		p.QueueMessageWithEncoding(msg, done, wire.WitnessEncoding)
+		<-done
+	}
+}
+
+// readUBlock reads the block and udata at height
+func (ps *p2pServer) readUBlock(height int32) (*uwire.MsgUBlock, error) {
+	udb, err := ps.udata(height)
+	if err != nil {
+		return nil, err
+	}
+	blkbytes, err := ps.block(height)
+	if err != nil {
+		return nil, err
+	}
+	var msg uwire.MsgUBlock
+	err = msg.Deserialize(io.MultiReader(
+		bytes.NewReader(blkbytes), bytes.NewReader(udb)))
+	if err != nil {
+		return nil, fmt.Errorf("ublock h %d: %s", height, err.Error())
+	}
+	return &msg, nil
+}
+
+// sendRoots sends the roots asked for
+func (ps *p2pServer) sendRoots(p *peer.Peer, req *uwire.MsgGetUtreexoRoots) {
+	if req.Height > ps.rootsHeight() {
+		notFound(p, uwire.InvTypeUtreexoRoots)
+		return
+	}
+	numLeaves, roots, err := ps.roots(req.Height)
+	if err != nil {
+		fmt.Printf("p2p sendRoots %s\n", err.Error())
+		notFound(p, uwire.InvTypeUtreexoRoots)
+		return
+	}
+	p.QueueMessage(&uwire.MsgUtreexoRoots{
+		Height: req.Height, NumLeaves: numLeaves, Roots: roots}, nil)
+}
@@ -0,0 +1,134 @@
+package bridgenode
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// pipeConn is one end of a net.Pipe with a TCP address, which a peer wants
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (pc pipeConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// TestP2PServer has a CSN's BridgePeer do the handshake with the bridge's
+// p2p server in process, then ask it for ublocks and roots
+func TestP2PServer(t *testing.T) {
+	params := &chaincfg.RegressionNetParams
+	const served = 3
+
+	// a block and udata at every height; the block only needs to parse, and
+	// is told apart by its nonce
+	blocks, udatas := make([][]byte, served+1), make([][]byte, served+1)
+	for h := int32(1); h <= served; h++ {
+		blk := wire.NewMsgBlock(&wire.BlockHeader{Nonce: uint32(h)})
+		cb := wire.NewMsgTx(1)
+		cb.AddTxIn(wire.NewTxIn(
+			wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff), []byte{byte(h)}, nil))
+		cb.AddTxOut(wire.NewTxOut(50, []byte{0x51}))
+		blk.AddTransaction(cb)
+		var buf bytes.Buffer
+		err := blk.Serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks[h] = buf.Bytes()
+		ud := btcacc.UData{Height: h, TxoTTLs: []int32{0}}
+		buf = bytes.Buffer{}
+		err = ud.Serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		udatas[h] = buf.Bytes()
+	}
+	roots := []accumulator.Hash{{1}, {2}}
+	ps := newP2PServer(&Config{params: *params})
+	// the CSN's peer is in the same process
+	ps.peerConfig.AllowSelfConns = true
+	ps.bridgeFiles = bridgeFiles{
+		udata: func(height int32) ([]byte, error) {
+			return udatas[height], nil
+		},
+		block: func(height int32) ([]byte, error) {
+			return blocks[height], nil
+		},
+		roots: func(height int32) (uint64, []accumulator.Hash, error) {
+			if height != 2 {
+				return 0, nil, fmt.Errorf("no roots at %d", height)
+			}
+			return 6, roots, nil
+		},
+	}
+	ps.set(served, nil)
+
+	csnEnd, bridgeEnd := net.Pipe()
+	p := ps.servePeer(pipeConn{bridgeEnd, &net.TCPAddr{
+		IP: net.IPv4(127, 0, 0, 1), Port: 50000}})
+	defer p.Disconnect()
+	csnConfig := uwire.BridgePeerConfig(params)
+	csnConfig.AllowSelfConns = true
+	bp, err := uwire.NewBridgePeer(csnEnd, "127.0.0.1:18444", csnConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+
+	// check gets the ublocks from fromHeight to toHeight, and says how many
+	// came
+	check := func(fromHeight, toHeight int32) (int32, error) {
+		blockChan := make(chan uwire.UBlock, served)
+		err := bp.GetUBlocks(blockChan, fromHeight, toHeight)
+		close(blockChan)
+		var n int32
+		for ub := range blockChan {
+			h := fromHeight + n
+			if ub.Block.MsgBlock().Header.Nonce != uint32(h) ||
+				ub.UtreexoData.Height != h {
+				t.Fatalf("ublock %d isn't the one for height %d", n, h)
+			}
+			n++
+		}
+		return n, err
+	}
+	n, err := check(1, served)
+	if err != nil || n != served {
+		t.Fatalf("got %d ublocks, expect %d: %v", n, served, err)
+	}
+	n, err = check(2, served+5)
+	if err == nil || n != served-1 {
+		t.Fatalf("asking past the tip got %d ublocks, err %v", n, err)
+	}
+
+	numLeaves, gotRoots, err := bp.GetRoots(2)
+	if err != nil || numLeaves != 6 ||
+		len(gotRoots) != 2 || gotRoots[0] != roots[0] || gotRoots[1] != roots[1] {
+		t.Fatalf("roots %d %v: %v", numLeaves, gotRoots, err)
+	}
+	_, _, err = bp.GetRoots(1)
+	if err == nil {
+		t.Fatal("got roots that aren't there")
+	}
+	_, _, err = bp.GetRoots(served + 1)
+	if err == nil {
+		t.Fatal("got roots past the tip")
+	}
+
+	// and after all that it's still a normal peer
+	if !p.Connected() || p.Services()&uwire.SFNodeUtreexo != 0 {
+		t.Fatalf("bridge sees peer connected %v services %s",
+			p.Connected(), p.Services())
+	}
+}
@@ -151,17 +151,19 @@ type ttlResult struct {
 	indexWithinBlock uint16 // index in that block where the txo is created
 }
 
-func (bnr *blockAndRev) toAddDel() (
+func (bnr *blockAndRev) toAddDel(blockHashes *btcacc.BlockHashIndex,
+	scheme accumulator.HashScheme, hasher accumulator.Hasher) (
 	blockAdds []accumulator.Leaf, delLeaves []btcacc.LeafData, err error) {
 
-	delLeaves, err = bnr.toDelLeaves()
+	delLeaves, err = bnr.toDelLeaves(blockHashes)
 	if err != nil {
 		return
 	}
 
 	// this is bridgenode, so don't need to deal with memorable leaves
 	blockAdds = uwire.BlockToAddLeaves(
-		bnr.Blk, nil, bnr.outSkipList, bnr.Height, bnr.outCount)
+		bnr.Blk, nil, bnr.outSkipList, bnr.Height, bnr.outCount, blockHashes,
+		scheme, hasher)
 
 	// if bnr.Height == 106 {
 	// fmt.Printf("h %d outskip %v\n", bnr.Height, bnr.outSkipList)
@@ -172,7 +174,7 @@ func (bnr *blockAndRev) toAddDel() (
 
 // blockNRevToDelLeaves turns a block's inputs into delLeaves to be removed from the
 // accumulator
-func (bnr *blockAndRev) toDelLeaves() (
+func (bnr *blockAndRev) toDelLeaves(blockHashes *btcacc.BlockHashIndex) (
 	delLeaves []btcacc.LeafData, err error) {
 
 	// finish early if there's nothing to prove
@@ -232,8 +234,10 @@ func (bnr *blockAndRev) toDelLeaves() (
 
 			l.Height = bnr.Rev.Txs[txInBlock].TxIn[i].Height
 			l.Coinbase = bnr.Rev.Txs[txInBlock].TxIn[i].Coinbase
-			// TODO get blockhash from headers here -- empty for now
-			// l.BlockHash = getBlockHashByHeight(l.CbHeight >> 1)
+			l.BlockHash, err = blockHashes.LeafBlockHash(l.Height)
+			if err != nil {
+				return
+			}
 			l.Amt = bnr.Rev.Txs[txInBlock].TxIn[i].Amount
 			l.PkScript = bnr.Rev.Txs[txInBlock].TxIn[i].PKScript
 			delLeaves = append(delLeaves, l)
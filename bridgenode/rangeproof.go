@@ -0,0 +1,201 @@
+package bridgenode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+/*
+With -aggregate=N, genproofs also writes a RangeProof for every N blocks, so
+a CSN that's far behind can catch up with one proof for the whole range
+instead of one for every block.  Ranges end at multiples of N, so a CSN
+knows which range to ask for from its height; the first range after a
+restart, and the last one before stopping, are shorter.  The range file is
+just range proofs one after another: 4 bytes start height, 4 bytes number
+of blocks, 4 bytes size, then the serialized RangeProof.  There aren't many
+ranges, so finding one is a scan through the file.
+*/
+
+// pendingBlock is a block waiting for the rest of its range to come in
+// before it gets proven
+type pendingBlock struct {
+	bnr       blockAndRev
+	blockAdds []accumulator.Leaf
+	delLeaves []btcacc.LeafData
+}
+
+// proveRange proves a range of blocks one at a time with proveBlock, and
+// writes out a RangeProof for the whole range.
+func proveRange(forest *accumulator.SafeForest, blocks []pendingBlock,
+	proveBlock func(pendingBlock) ([]uint64, error), rangeFile string) error {
+
+	var rp accumulator.RangeProof
+	err := forest.View(func(f *accumulator.Forest, _ int32) error {
+		adds := make([][]accumulator.Leaf, len(blocks))
+		delHashes := make([][]accumulator.Hash, len(blocks))
+		for i, b := range blocks {
+			adds[i] = b.blockAdds
+			delHashes[i] = make([]accumulator.Hash, len(b.delLeaves))
+			for j, ld := range b.delLeaves {
+				delHashes[i][j] = ld.LeafHashWith(f.HashScheme(), f.Hasher())
+			}
+		}
+		var err error
+		rp, _, err = f.StartRangeProof(adds, delHashes)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i, b := range blocks {
+		rp.Blocks[i].Dels, err = proveBlock(b)
+		if err != nil {
+			return err
+		}
+	}
+	return writeRangeProof(rangeFile, blocks[0].bnr.Height, rp)
+}
+
+// writeRangeProof appends a RangeProof starting at height to the range file.
+// If it can't write all of it, the file is cut back to where it was.
+func writeRangeProof(
+	rangeFile string, height int32, rp accumulator.RangeProof) error {
+
+	f, err := os.OpenFile(rangeFile, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, n := range []uint32{
+		uint32(height), uint32(len(rp.Blocks)), uint32(rp.SerializeSize())} {
+		err = binary.Write(w, binary.BigEndian, n)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = rp.Serialize(w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// a torn record would be read as the start of the next one
+		terr := f.Truncate(offset)
+		f.Close()
+		if terr != nil {
+			return fmt.Errorf("writeRangeProof: %s, and truncate: %s",
+				err.Error(), terr.Error())
+		}
+		return err
+	}
+	return f.Close()
+}
+
+// readRangeHeader reads the start height, number of blocks and size at the
+// front of a record in the range file
+func readRangeHeader(r io.Reader) (start, numBlocks int32, size uint32,
+	err error) {
+
+	err = binary.Read(r, binary.BigEndian, &start)
+	if err != nil {
+		return
+	}
+	err = binary.Read(r, binary.BigEndian, &numBlocks)
+	if err != nil {
+		return
+	}
+	err = binary.Read(r, binary.BigEndian, &size)
+	return
+}
+
+// trimRangeFile cuts the range file back to the ranges that end at or
+// before height, the height the forest was saved at, and drops a torn
+// record left by a crash.  Ranges past height get proven again.
+func trimRangeFile(rangeFile string, height int32) error {
+	f, err := os.OpenFile(rangeFile, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r := bufio.NewReader(f)
+	var offset int64
+	for offset < fi.Size() {
+		start, numBlocks, size, err := readRangeHeader(r)
+		if err != nil || offset+12+int64(size) > fi.Size() ||
+			start+numBlocks-1 > height {
+			break
+		}
+		_, err = r.Discard(int(size))
+		if err != nil {
+			break
+		}
+		offset += 12 + int64(size)
+	}
+	if offset < fi.Size() {
+		fmt.Printf("cutting range file from %d bytes to %d\n",
+			fi.Size(), offset)
+		err = f.Truncate(offset)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// GetRangeProofFromFile gives the RangeProof from the range file for the
+// blocks from start to end.
+func GetRangeProofFromFile(rangeDir rangeDir, start, end int32) (
+	rp accumulator.RangeProof, err error) {
+
+	f, err := os.Open(rangeDir.rangeFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	for {
+		var s, numBlocks int32
+		var size uint32
+		s, numBlocks, size, err = readRangeHeader(r)
+		if err == io.EOF {
+			err = fmt.Errorf("no range proof from %d to %d", start, end)
+			return
+		}
+		if err != nil {
+			return
+		}
+		if s == start && s+numBlocks-1 == end {
+			err = rp.Deserialize(io.LimitReader(r, int64(size)))
+			if err == nil && len(rp.Blocks) != int(numBlocks) {
+				err = fmt.Errorf("range proof from %d to %d has %d blocks",
+					start, end, len(rp.Blocks))
+			}
+			return
+		}
+		_, err = r.Discard(int(size))
+		if err != nil {
+			return
+		}
+	}
+}
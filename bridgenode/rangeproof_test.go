@@ -0,0 +1,155 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// TestRangeFile writes a few range proofs to a range file, reads them back
+// by start and end height and from a server, and trims the file
+func TestRangeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rangefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rd := rangeDir{base: dir, rangeFile: filepath.Join(dir, "range.dat")}
+
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.LegacyHash, nil)
+	var leaf byte
+	var written []accumulator.RangeProof
+	for r := 0; r < 3; r++ {
+		adds := make([][]accumulator.Leaf, 4)
+		dels := make([][]accumulator.Hash, 4)
+		for b := range adds {
+			for i := 0; i < 3; i++ {
+				leaf++
+				adds[b] = append(adds[b], accumulator.Leaf{
+					Hash: accumulator.Hash{leaf}})
+			}
+			// spend the first leaf of the block before
+			if leaf > 3 {
+				dels[b] = []accumulator.Hash{{leaf - 5}}
+			}
+		}
+		rp, _, err := forest.ProveRange(adds, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeRangeProof(rd.rangeFile, int32(1+(r*4)), rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, rp)
+	}
+
+	for r, want := range written {
+		start := int32(1 + (r * 4))
+		rp, err := GetRangeProofFromFile(rd, start, start+3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rp.Blocks) != 4 || rp.NumLeaves != want.NumLeaves ||
+			!reflect.DeepEqual(rp.Roots, want.Roots) ||
+			rp.Proof.ToString() != want.Proof.ToString() {
+			t.Fatalf("range %d read back different", r)
+		}
+	}
+	_, err = GetRangeProofFromFile(rd, 2, 5)
+	if err == nil {
+		t.Fatal("got a range proof that doesn't start anywhere")
+	}
+	_, err = GetRangeProofFromFile(rd, 5, 6)
+	if err == nil {
+		t.Fatal("got a range proof that ends somewhere else")
+	}
+
+	// a range server gives them out the same
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveBlocksWorker(utreeDir{RangeDir: rd}, c, "",
+				&servedState{blockHeight: 8})
+		}
+	}()
+	rp, err := uwire.GetRangeProof(listener.Addr().String(), 5, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rp.NumLeaves != written[1].NumLeaves ||
+		rp.Proof.ToString() != written[1].Proof.ToString() {
+		t.Fatal("served a different range proof")
+	}
+	for i, b := range rp.Blocks {
+		if len(b.Adds) != 0 ||
+			!reflect.DeepEqual(b.Dels, written[1].Blocks[i].Dels) {
+			t.Fatalf("served block %d with adds %d dels %v, want no adds "+
+				"and dels %v", i, len(b.Adds), b.Dels, written[1].Blocks[i].Dels)
+		}
+	}
+	// the blocks after 8 aren't there to be served
+	_, err = uwire.GetRangeProof(listener.Addr().String(), 9, 12)
+	if err == nil {
+		t.Fatal("served a range past the blocks")
+	}
+
+	// half a record at the end, like from a crash, doesn't get read and
+	// gets trimmed off
+	fi, err := os.Stat(rd.rangeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeRangeProof(rd.rangeFile, 13, written[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(rd.rangeFile, fi.Size()+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetRangeProofFromFile(rd, 13, 16)
+	if err == nil {
+		t.Fatal("read a torn range proof")
+	}
+	err = trimRangeFile(rd.rangeFile, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trimmed, err := os.Stat(rd.rangeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trimmed.Size() != fi.Size() {
+		t.Fatalf("trimmed to %d bytes, want %d", trimmed.Size(), fi.Size())
+	}
+
+	// ranges past where the forest was saved get dropped
+	err = trimRangeFile(rd.rangeFile, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetRangeProofFromFile(rd, 9, 12)
+	if err == nil {
+		t.Fatal("range past the forest wasn't dropped")
+	}
+	_, err = GetRangeProofFromFile(rd, 5, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -158,7 +158,7 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 		return
 	}
 
-	blockFile, err := os.Open(filepath.Join(blockDir,
+	blockFile, err := openXorFile(filepath.Join(blockDir,
 		fmt.Sprintf("blk%05d.dat", datFileNum)))
 	if err != nil {
 		return
@@ -173,7 +173,7 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 		return
 	}
 
-	revFile, err := os.Open(filepath.Join(blockDir,
+	revFile, err := openXorFile(filepath.Join(blockDir,
 		fmt.Sprintf("rev%05d.dat", datFileNum)))
 	if err != nil {
 		return
@@ -283,7 +283,7 @@ func GetBlockBytesFromFile(
 
 	blockFName := fmt.Sprintf("blk%05d.dat", datFile)
 	bDir := filepath.Join(blockDir, blockFName)
-	blockFile, err := os.Open(bDir)
+	blockFile, err := openXorFile(bDir)
 	if err != nil {
 		return
 	}
@@ -310,6 +310,69 @@ func GetBlockBytesFromFile(
 	return
 }
 
+// headerFileReader reads 80 byte block headers by height from the blk files.
+// It keeps the offset file and the last blk file open, since headers are
+// usually read one height after another.
+type headerFileReader struct {
+	offsetFile *os.File
+	blockDir   string
+	blkNum     uint32
+	blkFile    *xorFile
+}
+
+// newHeaderFileReader opens the offset file for reading headers
+func newHeaderFileReader(
+	offsetFileName, blockDir string) (*headerFileReader, error) {
+	offsetFile, err := os.Open(offsetFileName)
+	if err != nil {
+		return nil, err
+	}
+	return &headerFileReader{offsetFile: offsetFile, blockDir: blockDir}, nil
+}
+
+// read gives the header for the block at the given height.
+// Like GetBlockBytesFromFile, block 0 isn't in the offset file.
+func (hr *headerFileReader) read(height int32) (hdr [80]byte, err error) {
+	if height == 0 {
+		err = fmt.Errorf("headerFileReader: Block 0 is not not a thing")
+		return
+	}
+
+	// offset file is 12 bytes per block: file number, offset, rev offset
+	var loc [8]byte
+	_, err = hr.offsetFile.ReadAt(loc[:], int64(12*(height-1)))
+	if err != nil {
+		return
+	}
+	datFile := binary.BigEndian.Uint32(loc[:4])
+	offset := binary.BigEndian.Uint32(loc[4:])
+
+	if hr.blkFile == nil || datFile != hr.blkNum {
+		if hr.blkFile != nil {
+			hr.blkFile.Close()
+		}
+		hr.blkFile, err = openXorFile(filepath.Join(hr.blockDir,
+			fmt.Sprintf("blk%05d.dat", datFile)))
+		if err != nil {
+			hr.blkFile = nil
+			return
+		}
+		hr.blkNum = datFile
+	}
+
+	// +8 skips the magic bytes and block size
+	_, err = hr.blkFile.ReadAt(hdr[:], int64(offset)+8)
+	return
+}
+
+// close closes any files the headerFileReader has open
+func (hr *headerFileReader) close() {
+	hr.offsetFile.Close()
+	if hr.blkFile != nil {
+		hr.blkFile.Close()
+	}
+}
+
 // BlockAndRev is a regular block and a rev block stuck together
 // also contains the skiplists, and number of total inputs and outputs
 type blockAndRev struct {
@@ -0,0 +1,201 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+/*
+The roots index keeps the accumulator roots after every block, so anyone can
+ask what the roots were at some height, to check a checkpoint, cross-check
+another bridge, or start a CSN from there.
+
+roots.dat is append-only: for each height, 8 bytes numLeaves then the roots,
+32 bytes each.  How many roots there are comes from numLeaves.
+rootsoffset.dat is 8 bytes per height, like the proof offset file, but
+holding offset+1 so that a height that was never recorded (a bridge that
+was already synced before the index existed) reads back as 0.
+*/
+
+// rootsIndex is the roots at every height
+type rootsIndex struct {
+	dataFile, offsetFile *os.File
+	// where the next roots go in dataFile
+	dataSize int64
+}
+
+// openRootsIndex opens, or makes, the roots index in dir
+func openRootsIndex(dir rootsDir) (*rootsIndex, error) {
+	var err error
+	ri := new(rootsIndex)
+	ri.dataFile, err = os.OpenFile(dir.rootsFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ri.offsetFile, err = os.OpenFile(
+		dir.offsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		ri.dataFile.Close()
+		return nil, err
+	}
+	s, err := ri.dataFile.Stat()
+	if err != nil {
+		ri.close()
+		return nil, err
+	}
+	ri.dataSize = s.Size()
+	return ri, nil
+}
+
+// rootsSize is how many bytes the roots for numLeaves take up on disk
+func rootsSize(numLeaves uint64) int64 {
+	return 8 + (32 * int64(bits.OnesCount64(numLeaves)))
+}
+
+// put records the roots after the block at height.  Heights have to go
+// up; to record over a height again, roll back first.
+func (ri *rootsIndex) put(
+	height int32, numLeaves uint64, roots []accumulator.Hash) error {
+
+	if len(roots) != bits.OnesCount64(numLeaves) {
+		return fmt.Errorf("rootsIndex put h %d: %d leaves but %d roots",
+			height, numLeaves, len(roots))
+	}
+	buf := make([]byte, rootsSize(numLeaves))
+	binary.BigEndian.PutUint64(buf, numLeaves)
+	for i, root := range roots {
+		copy(buf[8+(32*i):], root[:])
+	}
+	_, err := ri.dataFile.WriteAt(buf, ri.dataSize)
+	if err != nil {
+		return err
+	}
+
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(ri.dataSize+1))
+	_, err = ri.offsetFile.WriteAt(offset[:], int64(height)*8)
+	if err != nil {
+		return err
+	}
+	ri.dataSize += int64(len(buf))
+	return nil
+}
+
+// offset gives where the roots for height are in dataFile, and false if
+// they were never recorded
+func (ri *rootsIndex) offset(height int32) (int64, bool, error) {
+	if height < 0 {
+		return 0, false, nil
+	}
+	var buf [8]byte
+	_, err := ri.offsetFile.ReadAt(buf[:], int64(height)*8)
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	offset := binary.BigEndian.Uint64(buf[:])
+	if offset == 0 {
+		return 0, false, nil
+	}
+	return int64(offset - 1), true, nil
+}
+
+// get gives the numLeaves and roots after the block at height
+func (ri *rootsIndex) get(height int32) (
+	numLeaves uint64, roots []accumulator.Hash, err error) {
+
+	offset, ok, err := ri.offset(height)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("no roots recorded for height %d", height)
+		return
+	}
+	var buf [32]byte
+	_, err = ri.dataFile.ReadAt(buf[:8], offset)
+	if err != nil {
+		return
+	}
+	numLeaves = binary.BigEndian.Uint64(buf[:8])
+	roots = make([]accumulator.Hash, bits.OnesCount64(numLeaves))
+	for i := range roots {
+		_, err = ri.dataFile.ReadAt(roots[i][:], offset+8+int64(32*i))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rollBack forgets the roots for every height after height, like when the
+// blocks after it are undone.
+func (ri *rootsIndex) rollBack(height int32) error {
+	// the data ends after the last height at or below that was recorded
+	var dataSize int64
+	for h := height; h >= 0; h-- {
+		offset, ok, err := ri.offset(h)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		var numLeaves [8]byte
+		_, err = ri.dataFile.ReadAt(numLeaves[:], offset)
+		if err != nil {
+			return err
+		}
+		dataSize = offset + rootsSize(binary.BigEndian.Uint64(numLeaves[:]))
+		break
+	}
+
+	err := ri.offsetFile.Truncate(int64(height+1) * 8)
+	if err != nil {
+		return err
+	}
+	err = ri.dataFile.Truncate(dataSize)
+	if err != nil {
+		return err
+	}
+	ri.dataSize = dataSize
+	return nil
+}
+
+// sync flushes the roots index to disk
+func (ri *rootsIndex) sync() error {
+	err := ri.dataFile.Sync()
+	if err != nil {
+		return err
+	}
+	return ri.offsetFile.Sync()
+}
+
+func (ri *rootsIndex) close() error {
+	err := ri.dataFile.Close()
+	if err != nil {
+		ri.offsetFile.Close()
+		return err
+	}
+	return ri.offsetFile.Close()
+}
+
+// GetRootsAtHeight gives the numLeaves and roots the bridge recorded after
+// the block at height.
+func GetRootsAtHeight(cfg *Config, height int32) (
+	uint64, []accumulator.Hash, error) {
+
+	ri, err := openRootsIndex(cfg.UtreeDir.RootsDir)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer ri.close()
+	return ri.get(height)
+}
@@ -0,0 +1,144 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// TestRootsIndex records the roots of a forest at every height, rolls back
+// and records them again, and checks they all read back
+func TestRootsIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootsindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rd := rootsDir{
+		base:       dir,
+		rootsFile:  filepath.Join(dir, "roots.dat"),
+		offsetFile: filepath.Join(dir, "rootsoffset.dat"),
+	}
+	ri, err := openRootsIndex(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.LegacyHash, nil)
+	type rootsAt struct {
+		numLeaves uint64
+		roots     []accumulator.Hash
+	}
+	var want []rootsAt
+	// addBlocks adds a few leaves a block from height on
+	addBlocks := func(from, to int32) {
+		for h := from; h <= to; h++ {
+			adds := make([]accumulator.Leaf, h%3+1)
+			for i := range adds {
+				adds[i].Hash[0] = byte(h)
+				adds[i].Hash[1] = byte(i)
+				adds[i].Hash[2] = byte(len(want))
+			}
+			_, err := forest.Modify(adds, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ri.put(h, forest.NumLeaves(), forest.GetRoots())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want[:h], rootsAt{forest.NumLeaves(), forest.GetRoots()})
+		}
+	}
+	check := func() {
+		for h, w := range want {
+			numLeaves, roots, err := ri.get(int32(h))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if numLeaves != w.numLeaves || !reflect.DeepEqual(roots, w.roots) {
+				t.Fatalf("height %d read back %d leaves %d roots, expect %d %d",
+					h, numLeaves, len(roots), w.numLeaves, len(w.roots))
+			}
+		}
+		_, _, err := ri.get(int32(len(want)))
+		if err == nil {
+			t.Fatalf("got roots at %d past the end", len(want))
+		}
+	}
+
+	err = ri.put(0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, rootsAt{0, []accumulator.Hash{}})
+	addBlocks(1, 30)
+	check()
+
+	// roll back to 12, and the forest goes a different way from there
+	err = ri.rollBack(12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = want[:13]
+	forest = accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, accumulator.LegacyHash, nil)
+	adds := make([]accumulator.Leaf, want[12].numLeaves)
+	for i := range adds {
+		adds[i].Hash[3] = byte(i)
+		adds[i].Hash[4] = 1
+	}
+	_, err = forest.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addBlocks(13, 20)
+	check()
+
+	// still there after reopening
+	err = ri.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ri, err = openRootsIndex(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// and served the same
+	client, server := net.Pipe()
+	go serveRoots(utreeDir{RootsDir: rd}, server, 20)
+	err = binary.Write(client, binary.BigEndian, int32(17))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numLeaves uint64
+	err = binary.Read(client, binary.BigEndian, &numLeaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numLeaves != want[17].numLeaves {
+		t.Fatalf("served %d leaves, expect %d", numLeaves, want[17].numLeaves)
+	}
+	for _, root := range want[17].roots {
+		var got accumulator.Hash
+		_, err = io.ReadFull(client, got[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != root {
+			t.Fatalf("served root %x, expect %x", got, root)
+		}
+	}
+	client.Close()
+	ri.close()
+}
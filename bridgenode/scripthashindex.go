@@ -0,0 +1,246 @@
+package bridgenode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+/*
+With -electrum the bridge keeps a scripthash index in leveldb, for the
+electrum server.  A scripthash is the sha256 of an output script, like
+electrum uses.  Keys are:
+
+h | scripthash | 4 byte height | txid   every tx that pays to or spends
+                                       from the script, in height order
+u | scripthash | txid | 4 byte index   every utxo paying to the script,
+                                       with its LeafData
+t | txid                               the height of every tx
+
+and the height the index is at.  Like the outpoint index it's updated in
+one batch per block, in the same forest.Update as the forest, and rolled
+back the same way if it's ahead of the forest on disk.
+*/
+
+// scriptHashIndex keeps the history and utxos of every script
+type scriptHashIndex struct {
+	db *leveldb.DB
+}
+
+// histEntry is a tx in a script's history
+type histEntry struct {
+	txid   btcacc.Hash
+	height int32
+}
+
+// scriptHash is what the index is keyed on
+func scriptHash(pkScript []byte) btcacc.Hash {
+	return sha256.Sum256(pkScript)
+}
+
+func historyKey(sh btcacc.Hash, height int32, txid btcacc.Hash) []byte {
+	key := make([]byte, 1+32+4+32)
+	key[0] = 'h'
+	copy(key[1:], sh[:])
+	binary.BigEndian.PutUint32(key[33:], uint32(height))
+	copy(key[37:], txid[:])
+	return key
+}
+
+func utxoKey(sh btcacc.Hash, txid btcacc.Hash, index uint32) []byte {
+	key := make([]byte, 1+32+32+4)
+	key[0] = 'u'
+	copy(key[1:], sh[:])
+	copy(key[33:], txid[:])
+	binary.BigEndian.PutUint32(key[65:], index)
+	return key
+}
+
+func txKey(txid btcacc.Hash) []byte {
+	return append([]byte{'t'}, txid[:]...)
+}
+
+// openScriptHashIndex opens, or makes, the scripthash index at path
+func openScriptHashIndex(path string) (*scriptHashIndex, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &scriptHashIndex{db: db}, nil
+}
+
+// height gives the last block in the index, and false if it's empty
+func (si *scriptHashIndex) height() (int32, bool, error) {
+	v, err := si.db.Get(indexHeightKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(v) != 4 {
+		return 0, false, fmt.Errorf("scripthash index height is %d bytes", len(v))
+	}
+	return int32(binary.BigEndian.Uint32(v)), true, nil
+}
+
+// update puts a block in the index.  adds are the utxos the block made that
+// are left at the end of it, like the outpoint index gets.
+func (si *scriptHashIndex) update(
+	bnr *blockAndRev, adds []btcacc.LeafData) error {
+
+	var batch leveldb.Batch
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(bnr.Height))
+
+	for i, tx := range bnr.Blk.Transactions() {
+		txid := btcacc.Hash(*tx.Hash())
+		batch.Put(txKey(txid), h[:])
+		for _, out := range tx.MsgTx().TxOut {
+			batch.Put(historyKey(scriptHash(out.PkScript), bnr.Height, txid), nil)
+		}
+		if i == 0 {
+			continue
+		}
+		// the rev data has the scripts being spent; the coinbase has none
+		if i-1 >= len(bnr.Rev.Txs) ||
+			len(bnr.Rev.Txs[i-1].TxIn) != len(tx.MsgTx().TxIn) {
+			return fmt.Errorf("scripthash index h %d tx %d: rev data doesn't "+
+				"match the block", bnr.Height, i)
+		}
+		for j, in := range tx.MsgTx().TxIn {
+			sh := scriptHash(bnr.Rev.Txs[i-1].TxIn[j].PKScript)
+			batch.Put(historyKey(sh, bnr.Height, txid), nil)
+			batch.Delete(utxoKey(sh, btcacc.Hash(in.PreviousOutPoint.Hash),
+				in.PreviousOutPoint.Index))
+		}
+	}
+
+	for _, ld := range adds {
+		var buf bytes.Buffer
+		err := ld.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+		batch.Put(utxoKey(scriptHash(ld.PkScript), ld.TxHash, ld.Index),
+			buf.Bytes())
+	}
+	batch.Put(indexHeightKey, h[:])
+
+	err := si.db.Write(&batch, nil)
+	if err != nil {
+		return fmt.Errorf("scripthash index h %d: %s", bnr.Height, err.Error())
+	}
+	return nil
+}
+
+// undo takes a block back out of the index.  adds and dels are the utxos
+// the block made and spent, like the outpoint index gets.
+func (si *scriptHashIndex) undo(
+	bnr *blockAndRev, adds, dels []btcacc.LeafData) error {
+
+	var batch leveldb.Batch
+	for i, tx := range bnr.Blk.Transactions() {
+		txid := btcacc.Hash(*tx.Hash())
+		batch.Delete(txKey(txid))
+		for _, out := range tx.MsgTx().TxOut {
+			batch.Delete(historyKey(scriptHash(out.PkScript), bnr.Height, txid))
+		}
+		if i == 0 {
+			continue
+		}
+		if i-1 >= len(bnr.Rev.Txs) ||
+			len(bnr.Rev.Txs[i-1].TxIn) != len(tx.MsgTx().TxIn) {
+			return fmt.Errorf("scripthash index undo h %d tx %d: rev data "+
+				"doesn't match the block", bnr.Height, i)
+		}
+		for j := range tx.MsgTx().TxIn {
+			sh := scriptHash(bnr.Rev.Txs[i-1].TxIn[j].PKScript)
+			batch.Delete(historyKey(sh, bnr.Height, txid))
+		}
+	}
+
+	for _, ld := range adds {
+		batch.Delete(utxoKey(scriptHash(ld.PkScript), ld.TxHash, ld.Index))
+	}
+	for _, ld := range dels {
+		var buf bytes.Buffer
+		err := ld.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+		batch.Put(utxoKey(scriptHash(ld.PkScript), ld.TxHash, ld.Index),
+			buf.Bytes())
+	}
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(bnr.Height-1))
+	batch.Put(indexHeightKey, h[:])
+
+	err := si.db.Write(&batch, nil)
+	if err != nil {
+		return fmt.Errorf("scripthash index undo h %d: %s",
+			bnr.Height, err.Error())
+	}
+	return nil
+}
+
+// history gives every tx that pays to or spends from sh, by height
+func (si *scriptHashIndex) history(sh btcacc.Hash) ([]histEntry, error) {
+	var hist []histEntry
+	prefix := append([]byte{'h'}, sh[:]...)
+	iter := si.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		k := iter.Key()
+		var e histEntry
+		e.height = int32(binary.BigEndian.Uint32(k[33:]))
+		copy(e.txid[:], k[37:])
+		hist = append(hist, e)
+	}
+	iter.Release()
+	return hist, iter.Error()
+}
+
+// utxos gives the LeafData of every utxo paying to sh
+func (si *scriptHashIndex) utxos(sh btcacc.Hash) ([]btcacc.LeafData, error) {
+	var lds []btcacc.LeafData
+	prefix := append([]byte{'u'}, sh[:]...)
+	iter := si.db.NewIterator(util.BytesPrefix(prefix), nil)
+	for iter.Next() {
+		var ld btcacc.LeafData
+		err := ld.Deserialize(bytes.NewReader(iter.Value()))
+		if err != nil {
+			err = fmt.Errorf("scripthash index %x: %s", iter.Key(), err.Error())
+			iter.Release()
+			return nil, err
+		}
+		lds = append(lds, ld)
+	}
+	iter.Release()
+	return lds, iter.Error()
+}
+
+// txHeight gives the height of the block txid is in, and false if it isn't
+// in any
+func (si *scriptHashIndex) txHeight(txid btcacc.Hash) (int32, bool, error) {
+	v, err := si.db.Get(txKey(txid), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if len(v) != 4 {
+		return 0, false, fmt.Errorf("scripthash index tx %s height is %d bytes",
+			txid.String(), len(v))
+	}
+	return int32(binary.BigEndian.Uint32(v)), true, nil
+}
+
+func (si *scriptHashIndex) close() error {
+	return si.db.Close()
+}
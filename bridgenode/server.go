@@ -1,6 +1,7 @@
 package bridgenode
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
@@ -9,10 +10,13 @@ import (
 	"os"
 	"runtime/pprof"
 	"runtime/trace"
+	"sync"
 	"time"
 
+	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 func Start(cfg *Config, sig chan bool) error {
@@ -40,9 +44,27 @@ func Start(cfg *Config, sig chan bool) error {
 		}()
 	}
 
+	// Start listening first, so the forest can be asked about while it's
+	// being built
+	var srv *bridgeServer
+	if !cfg.noServe {
+		var err error
+		srv, err = listen(cfg)
+		if err != nil {
+			return errArchiveServer(err)
+		}
+	}
+
 	// If serve option wasn't given
 	if !cfg.serve {
-		err := BuildProofs(cfg, sig)
+		err := BuildProofs(cfg, sig, srv)
+		if err == ErrStopped {
+			// what was built is saved; stop serving it
+			if srv != nil {
+				srv.shutdown()
+			}
+			return nil
+		}
 		if err != nil {
 			return errBuildProofs(err)
 		}
@@ -53,9 +75,9 @@ func Start(cfg *Config, sig chan bool) error {
 		return err
 	}
 
-	if !cfg.noServe {
+	if srv != nil {
 		// serve when finished
-		err := ArchiveServer(cfg, sig)
+		err := ArchiveServer(cfg, sig, srv)
 		if err != nil {
 			return errArchiveServer(err)
 		}
@@ -64,16 +86,10 @@ func Start(cfg *Config, sig chan bool) error {
 	return nil
 }
 
-func ArchiveServer(cfg *Config, sig chan bool) error {
-	// Channel to alert the tell the main loop it's ok to exit
-	haltRequest := make(chan bool, 1)
-
-	// Channel for ServeBlock() to wait
-	haltAccept := make(chan bool, 1)
-
-	// Handle user interruptions
-	go stopServer(sig, haltRequest, haltAccept)
-
+// ArchiveServer serves everything genproofs built, with srv from listen,
+// until the user exits.  Then it stops taking connections, lets the ones
+// being served finish, and returns.
+func ArchiveServer(cfg *Config, sig chan bool, srv *bridgeServer) error {
 	if !util.HasAccess(cfg.BlockDir) {
 		return errNoDataDir(cfg.BlockDir)
 	}
@@ -84,113 +100,185 @@ func ArchiveServer(cfg *Config, sig chan bool) error {
 		return err
 	}
 
-	blockServer(maxHeight, cfg, haltRequest, haltAccept)
-	return nil
-}
+	// proving utxos or leaves needs the forest, but nothing else does
+	var prover *outpointProver
+	if cfg.opIndex || cfg.electrum != "" || cfg.httpPort != "" {
+		forest, err := restoreForest(cfg)
+		if err != nil {
+			return err
+		}
+		prover, err = newOutpointProver(
+			cfg, accumulator.NewSafeForest(forest, maxHeight), true)
+		if err != nil {
+			return err
+		}
+	}
+
+	srv.set(maxHeight, prover)
+	fmt.Printf("serving up to & including block height %d\n", maxHeight)
 
-// stopServer listens for the signal from the OS and initiates an exit sequence
-func stopServer(sig, haltRequest, haltAccept chan bool) {
 	// Listen for SIGINT, SIGQUIT, SIGTERM
 	<-sig
-	haltRequest <- true
-	// Sometimes there are bugs that make the program run forever.
-	// Utreexo binary should never take more than 10 seconds to exit
-	go func() {
-		time.Sleep(2 * time.Second)
-		fmt.Println("Exit timed out. Force quitting.")
-		os.Exit(1)
-	}()
-
-	// Tell the user that the sig is received
-	fmt.Println("User exit signal received. Exiting...")
-
-	// Wait until server says it's ok to exit
-	<-haltAccept
-	os.Exit(0)
+	fmt.Println("User exit signal received. Stopping the server...")
+	srv.shutdown()
+
+	// electrum and p2p clients can still be connected; they can't use the
+	// forest once this has the write lock
+	if prover != nil {
+		err = prover.forest.Update(maxHeight, func(*accumulator.Forest) error {
+			prover.done = true
+			return prover.close()
+		})
+	}
+	fmt.Println("Server stopped")
+	return err
 }
 
-// blockServer listens on a TCP port for incoming connections, then gives
-// ublocks blocks over that connection
-func blockServer(
-	endHeight int32, cfg *Config, haltRequest, haltAccept chan bool) {
+// drainTimeout is how long connections get to finish when the bridge stops
+const drainTimeout = 10 * time.Second
+
+// bridgeServer listens on a TCP port for incoming connections, and gives
+// each one to serveBlocksWorker with whatever can be served right then.
+// While genproofs runs, blocks are only served up to where it started, but
+// roots and outpoint proofs come from the forest as it's built.
+type bridgeServer struct {
+	cfg      *Config
+	listener net.Listener
+	conns    *connLimiter
+	servedState
+
+	// nil without -electrum
+	electrum *electrumServer
+	// nil without -http
+	http *httpGateway
+	// nil without -p2p
+	p2p *p2pServer
+}
 
-	// before doing anything... this breaks
-	/*
-		udb, err := util.GetUDataBytesFromFile(385)
-		if err != nil {
-			fmt.Printf(err.Error())
-			panic("ded")
-		}
+// servedState is how far a server can serve at the moment.  The servers
+// each embed one, and bridgeServer.set moves them all along.
+type servedState struct {
+	mu sync.Mutex
+	// blocks and their udata are served up to here
+	blockHeight int32
+	// the forest, if one's loaded
+	prover *outpointProver
+}
 
-		var buf bytes.Buffer
-		var ud util.UData
-		buf.Write(udb)
-		fmt.Printf("buf len %d\n", buf.Len())
-		err = ud.Deserialize(&buf)
-		if err != nil {
-			fmt.Printf(" ubd %s\n", err.Error())
-			panic("ded")
-		}
-		fmt.Printf(ud.AccProof.ToString())
-		fmt.Printf("h %d ud %d targets %d ttls\n",
-			ud.Height, len(ud.AccProof.Targets), len(ud.TxoTTLs))
-	*/
-	// --------------
-
-	fmt.Printf("serving up to & including block height %d\n", endHeight)
-	listenAdr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:8338")
-	if err != nil {
-		fmt.Printf(err.Error())
-		return
+// set changes what's served
+func (ss *servedState) set(blockHeight int32, prover *outpointProver) {
+	ss.mu.Lock()
+	ss.blockHeight, ss.prover = blockHeight, prover
+	ss.mu.Unlock()
+}
+
+func (ss *servedState) current() (int32, *outpointProver) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.blockHeight, ss.prover
+}
+
+// rootsHeight is how far roots are served.  The roots index keeps up with
+// the forest, not the blocks on disk.
+func (ss *servedState) rootsHeight() int32 {
+	blockHeight, prover := ss.current()
+	if prover != nil {
+		return prover.forest.Height()
 	}
+	return blockHeight
+}
 
-	listener, err := net.ListenTCP("tcp", listenAdr)
+// listen starts accepting connections.  Nothing past block 0 is served until
+// set is called.
+func listen(cfg *Config) (*bridgeServer, error) {
+	listener, err := net.Listen("tcp", cfg.listenAddr)
 	if err != nil {
-		fmt.Printf(err.Error())
-		return
+		return nil, err
 	}
-
-	cons := make(chan net.Conn)
-	go acceptConnections(listener, cons)
-	for {
-		select {
-		case <-haltRequest:
-			listener.Close()
-			haltAccept <- true
-			close(cons)
-			return
-		case con := <-cons:
-			go serveBlocksWorker(cfg.UtreeDir, con, endHeight, cfg.BlockDir)
+	s := &bridgeServer{cfg: cfg, listener: listener, conns: newConnLimiter(cfg)}
+	if cfg.electrum != "" {
+		s.electrum = newElectrumServer(cfg)
+		err = s.electrum.listen(cfg.electrum)
+		if err != nil {
+			s.shutdown()
+			return nil, err
 		}
 	}
-}
-
-func acceptConnections(listener *net.TCPListener, cons chan net.Conn) {
-	fmt.Printf("listening for connections on %s\n", listener.Addr().String())
-	for {
-		select {
-		case <-cons:
-			// cons got closed, stop accepting new connections
-			fmt.Printf("dropped con\n")
-			return
-		default:
+	if cfg.httpPort != "" {
+		s.http = newHTTPGateway(cfg)
+		err = s.http.listen(cfg.httpPort)
+		if err != nil {
+			s.shutdown()
+			return nil, err
 		}
-
-		con, err := listener.Accept()
+	}
+	if cfg.p2pPort != "" {
+		s.p2p = newP2PServer(cfg)
+		err = s.p2p.listen(cfg.p2pPort)
 		if err != nil {
-			fmt.Printf("blockServer accept error: %s\n", err.Error())
-			return
+			s.shutdown()
+			return nil, err
 		}
+	}
 
-		cons <- con
+	go s.accept()
+	return s, nil
+}
+
+// set changes what's served to new connections
+func (s *bridgeServer) set(blockHeight int32, prover *outpointProver) {
+	s.servedState.set(blockHeight, prover)
+	if s.electrum != nil {
+		s.electrum.set(prover)
+	}
+	if s.http != nil {
+		s.http.set(blockHeight, prover)
+	}
+	if s.p2p != nil {
+		s.p2p.set(blockHeight, prover)
 	}
 }
 
+// accept serves connections, as many as the limits let it, until the
+// listener is closed
+func (s *bridgeServer) accept() {
+	fmt.Printf("listening for connections on %s\n", s.listener.Addr().String())
+	s.conns.serve(s.listener, "blockServer", func(c net.Conn) {
+		serveBlocksWorker(s.cfg.UtreeDir, c, s.cfg.BlockDir, &s.servedState)
+	})
+}
+
+// shutdown stops every server taking connections.  Connections and HTTP
+// requests get drainTimeout to finish, then any that are left are hung up on.
+func (s *bridgeServer) shutdown() {
+	s.listener.Close()
+	var wg sync.WaitGroup
+	drain := func(stop func(time.Duration)) {
+		wg.Add(1)
+		go func() {
+			stop(drainTimeout)
+			wg.Done()
+		}()
+	}
+	if s.electrum != nil {
+		drain(s.electrum.close)
+	}
+	if s.p2p != nil {
+		drain(s.p2p.close)
+	}
+	if s.http != nil {
+		drain(s.http.close)
+	}
+	s.conns.stop(drainTimeout)
+	wg.Wait()
+}
+
 // serveBlocksWorker gets height requests from client and sends out the ublock
-// for that height
-func serveBlocksWorker(UtreeDir utreeDir,
-	c net.Conn, endHeight int32, blockDir string) {
+// for that height, serving whatever ss has when it connects
+func serveBlocksWorker(UtreeDir utreeDir, c net.Conn, blockDir string,
+	ss *servedState) {
 	defer c.Close()
+	endHeight, prover := ss.current()
 	fmt.Printf("start serving %s\n", c.RemoteAddr().String())
 	var fromHeight, toHeight int32
 
@@ -200,6 +288,33 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		return
 	}
 
+	// headers instead of blocks; the real start height comes next
+	if fromHeight == uwire.HeaderRequest {
+		serveHeaders(UtreeDir, c, endHeight, blockDir)
+		return
+	}
+	if fromHeight == uwire.RootsRequest {
+		serveRoots(UtreeDir, c, ss.rootsHeight())
+		return
+	}
+	if fromHeight == uwire.ProofRequest {
+		serveOutpointProofs(c, prover)
+		return
+	}
+	if fromHeight == uwire.RangeProofRequest {
+		serveRangeProof(UtreeDir, c, endHeight)
+		return
+	}
+	// ublocks without proofs; the real start height comes next
+	bare := fromHeight == uwire.BareUBlockRequest
+	if bare {
+		err = binary.Read(c, binary.BigEndian, &fromHeight)
+		if err != nil {
+			fmt.Printf("pushBlocks Read %s\n", err.Error())
+			return
+		}
+	}
+
 	err = binary.Read(c, binary.BigEndian, &toHeight)
 	if err != nil {
 		fmt.Printf("pushBlocks Read %s\n", err.Error())
@@ -248,7 +363,18 @@ func serveBlocksWorker(UtreeDir utreeDir,
 			fmt.Printf("udb: %x\n", udb)
 			break
 		}
-		if len(ud.AccProof.Targets) != 0 {
+		if bare {
+			// the range proof has the hashes.  The targets stay since
+			// they say how many stxos there are.
+			ud.AccProof.Proof = nil
+			var ubuf bytes.Buffer
+			err = ud.Serialize(&ubuf)
+			if err != nil {
+				fmt.Printf("serveBlocksWorker h %d %s\n", curHeight, err.Error())
+				break
+			}
+			udb = ubuf.Bytes()
+		} else if len(ud.AccProof.Targets) != 0 {
 			fmt.Printf("h %d proof %s\n", curHeight, ud.AccProof.ToString())
 		}
 
@@ -273,6 +399,149 @@ func serveBlocksWorker(UtreeDir utreeDir,
 	fmt.Printf("hung up on %s\n", c.RemoteAddr().String())
 }
 
+// serveHeaders reads a start and end height from the client and sends the
+// block headers for that range, in order, then hangs up.
+func serveHeaders(UtreeDir utreeDir,
+	c net.Conn, endHeight int32, blockDir string) {
+
+	var fromHeight, toHeight int32
+	err := binary.Read(c, binary.BigEndian, &fromHeight)
+	if err != nil {
+		fmt.Printf("serveHeaders Read %s\n", err.Error())
+		return
+	}
+	err = binary.Read(c, binary.BigEndian, &toHeight)
+	if err != nil {
+		fmt.Printf("serveHeaders Read %s\n", err.Error())
+		return
+	}
+	if toHeight > endHeight {
+		toHeight = endHeight
+	}
+	if fromHeight < 1 {
+		fromHeight = 1
+	}
+
+	hr, err := newHeaderFileReader(UtreeDir.OffsetDir.OffsetFile, blockDir)
+	if err != nil {
+		fmt.Printf("serveHeaders %s\n", err.Error())
+		return
+	}
+	defer hr.close()
+
+	w := bufio.NewWriter(c)
+	h := fromHeight
+	for ; h <= toHeight; h++ {
+		hdr, err := hr.read(h)
+		if err != nil {
+			fmt.Printf("serveHeaders h %d %s\n", h, err.Error())
+			break
+		}
+		_, err = w.Write(hdr[:])
+		if err != nil {
+			fmt.Printf("serveHeaders write %s\n", err.Error())
+			return
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		fmt.Printf("serveHeaders write %s\n", err.Error())
+	}
+	fmt.Printf("sent headers %d to %d to %s\n",
+		fromHeight, h-1, c.RemoteAddr().String())
+}
+
+// serveRangeProof reads a start and end height from the client and sends
+// the range proof for those blocks, then hangs up.  If there isn't one for
+// exactly that range it just hangs up.  The adds are left out, since a CSN
+// makes them from the blocks, which it gets anyway.
+func serveRangeProof(UtreeDir utreeDir, c net.Conn, endHeight int32) {
+	var start, end int32
+	err := binary.Read(c, binary.BigEndian, &start)
+	if err != nil {
+		fmt.Printf("serveRangeProof Read %s\n", err.Error())
+		return
+	}
+	err = binary.Read(c, binary.BigEndian, &end)
+	if err != nil {
+		fmt.Printf("serveRangeProof Read %s\n", err.Error())
+		return
+	}
+	// the blocks in the range have to be servable too
+	if end > endHeight {
+		fmt.Printf("%s wanted range to %d but have %d\n",
+			c.RemoteAddr().String(), end, endHeight)
+		return
+	}
+
+	rp, err := GetRangeProofFromFile(UtreeDir.RangeDir, start, end)
+	if err != nil {
+		fmt.Printf("serveRangeProof %s\n", err.Error())
+		return
+	}
+	for i := range rp.Blocks {
+		rp.Blocks[i].Adds = nil
+	}
+	w := bufio.NewWriter(c)
+	err = rp.Serialize(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Printf("serveRangeProof write %s\n", err.Error())
+		return
+	}
+	fmt.Printf("sent range proof %d to %d to %s\n",
+		start, end, c.RemoteAddr().String())
+}
+
+// serveRoots reads a height from the client and sends the numLeaves and
+// roots after that block, then hangs up.  If there aren't any roots for
+// that height it just hangs up.
+func serveRoots(UtreeDir utreeDir, c net.Conn, endHeight int32) {
+	var height int32
+	err := binary.Read(c, binary.BigEndian, &height)
+	if err != nil {
+		fmt.Printf("serveRoots Read %s\n", err.Error())
+		return
+	}
+	if height > endHeight {
+		fmt.Printf("%s wanted roots at %d but have %d\n",
+			c.RemoteAddr().String(), height, endHeight)
+		return
+	}
+
+	ri, err := openRootsIndex(UtreeDir.RootsDir)
+	if err != nil {
+		fmt.Printf("serveRoots %s\n", err.Error())
+		return
+	}
+	numLeaves, roots, err := ri.get(height)
+	ri.close()
+	if err != nil {
+		fmt.Printf("serveRoots %s\n", err.Error())
+		return
+	}
+
+	w := bufio.NewWriter(c)
+	err = binary.Write(w, binary.BigEndian, numLeaves)
+	if err != nil {
+		fmt.Printf("serveRoots write %s\n", err.Error())
+		return
+	}
+	for _, root := range roots {
+		_, err = w.Write(root[:])
+		if err != nil {
+			fmt.Printf("serveRoots write %s\n", err.Error())
+			return
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		fmt.Printf("serveRoots write %s\n", err.Error())
+	}
+}
+
 // GetUDataBytesFromFile reads the proof data from proof.dat and proofoffset.dat
 // and gives the proof & utxo data back.
 // Don't ask for block 0, there is no proof for that.
@@ -325,5 +325,4 @@ func interpolationSearch(mi miniIn,
 
 	for {
 	}
-	return
 }
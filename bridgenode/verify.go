@@ -0,0 +1,70 @@
+package bridgenode
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// verifyHeaders reads the headers for heights 1 through tipHeight out of the
+// blk files, in offset file order, and validates them into a header chain.
+// The offset file is only ordered by prevhash, so this is what makes sure
+// the blocks we build proofs for have valid proof of work, difficulty,
+// timestamps and match the checkpoints.
+func verifyHeaders(cfg *Config, tipHeight int32) (*uwire.HeaderChain, error) {
+	hr, err := newHeaderFileReader(
+		cfg.UtreeDir.OffsetDir.OffsetFile, cfg.BlockDir)
+	if err != nil {
+		return nil, err
+	}
+	defer hr.close()
+
+	fmt.Printf("Verifying headers up to height %d\n", tipHeight)
+	hc := uwire.NewHeaderChain(&cfg.params)
+	for h := int32(1); h <= tipHeight; h++ {
+		raw, err := hr.read(h)
+		if err != nil {
+			return nil, fmt.Errorf("verifyHeaders read height %d %s",
+				h, err.Error())
+		}
+		var hdr wire.BlockHeader
+		err = hdr.Deserialize(bytes.NewReader(raw[:]))
+		if err != nil {
+			return nil, err
+		}
+		err = hc.AddHeader(&hdr)
+		if err != nil {
+			return nil, fmt.Errorf("verifyHeaders: %w", err)
+		}
+		// every header should build on the last one, so if the tip moved
+		// anywhere else the offset file is out of order
+		if hc.BestHeight() != h {
+			return nil, fmt.Errorf("verifyHeaders: header %s at height %d "+
+				"but header tip is %d", hdr.BlockHash().String(),
+				h, hc.BestHeight())
+		}
+		if h%100000 == 0 {
+			fmt.Printf("Verified headers to %d\n", h)
+		}
+	}
+	return hc, nil
+}
+
+// verifyBlock checks a block from the blk files the same way the CSN does,
+// using the rev data for the spent outputs.  If hc is given, the block also
+// has to be the one the validated header chain has at that height.
+func verifyBlock(cfg *Config, hc *uwire.HeaderChain,
+	bnr *blockAndRev, ud btcacc.UData) error {
+
+	ub := uwire.UBlock{UtreexoData: ud, Block: bnr.Blk}
+	if hc != nil {
+		err := hc.CheckUBlock(&ub, bnr.Height)
+		if err != nil {
+			return err
+		}
+	}
+	return ub.CheckBlock(bnr.outSkipList, &cfg.params, cfg.checkSigs)
+}
@@ -0,0 +1,148 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// writeTestBlocks writes the headers into a regtest blk00000.dat as blocks
+// with no transactions, and a rev00000.dat with an empty undo block for each.
+// The offset file lists them in the order given by heights.  If key isn't
+// all zeros, the blk and rev files are obfuscated with it like Bitcoin Core
+// does, and it's written to xor.dat.
+func writeTestBlocks(t *testing.T, cfg *Config,
+	headers []wire.BlockHeader, heights []int, key xorKey) {
+
+	var blk, rev, off bytes.Buffer
+	offsets := make([]uint32, len(headers))
+	revOffsets := make([]uint32, len(headers))
+	for i := range headers {
+		offsets[i] = uint32(blk.Len())
+		blk.Write([]byte{0xfa, 0xbf, 0xb5, 0xda})
+		binary.Write(&blk, binary.LittleEndian, uint32(81))
+		err := headers[i].Serialize(&blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk.WriteByte(0) // no txs
+
+		// rev offsets point past the magic and size, at the undo block
+		rev.Write([]byte{0xfa, 0xbf, 0xb5, 0xda})
+		binary.Write(&rev, binary.LittleEndian, uint32(1))
+		revOffsets[i] = uint32(rev.Len())
+		rev.WriteByte(0) // no tx undos
+		rev.Write(make([]byte, 32))
+	}
+	for _, i := range heights {
+		binary.Write(&off, binary.BigEndian, uint32(0)) // file number
+		binary.Write(&off, binary.BigEndian, offsets[i])
+		binary.Write(&off, binary.BigEndian, revOffsets[i])
+	}
+
+	blkBytes, revBytes := blk.Bytes(), rev.Bytes()
+	key.apply(blkBytes, 0)
+	key.apply(revBytes, 0)
+	files := map[string][]byte{
+		filepath.Join(cfg.BlockDir, "blk00000.dat"): blkBytes,
+		filepath.Join(cfg.BlockDir, "rev00000.dat"): revBytes,
+		cfg.UtreeDir.OffsetDir.OffsetFile:           off.Bytes(),
+	}
+	if key != (xorKey{}) {
+		files[filepath.Join(cfg.BlockDir, xorKeyFileName)] = key[:]
+	}
+	for name, b := range files {
+		err := ioutil.WriteFile(name, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// makeTestHeaders makes a chain of n solved regtest headers
+func makeTestHeaders(p *chaincfg.Params, n int) []wire.BlockHeader {
+	headers := make([]wire.BlockHeader, n)
+	prev := p.GenesisBlock.Header
+	for i := range headers {
+		headers[i] = wire.BlockHeader{
+			Version:   4,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(10 * time.Minute),
+			Bits:      p.PowLimitBits,
+		}
+		target := blockchain.CompactToBig(headers[i].Bits)
+		for {
+			hash := headers[i].BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			headers[i].Nonce++
+		}
+		prev = headers[i]
+	}
+	return headers
+}
+
+// testConfig makes a regtest config with everything in dir
+func testConfig(dir string) *Config {
+	cfg := &Config{
+		params:   chaincfg.RegressionNetParams,
+		BlockDir: dir,
+		UtreeDir: initUtreeDir(dir),
+	}
+	cfg.UtreeDir.OffsetDir.OffsetFile = filepath.Join(dir, "offsetfile.dat")
+	return cfg
+}
+
+func TestVerifyHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verifyheaders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig(dir)
+	headers := makeTestHeaders(&cfg.params, 5)
+
+	writeTestBlocks(t, cfg, headers, []int{0, 1, 2, 3, 4}, xorKey{})
+	hc, err := verifyHeaders(cfg, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, _ := hc.HashAt(5)
+	if tip != headers[4].BlockHash() {
+		t.Fatalf("header tip %s, expected %s",
+			tip.String(), headers[4].BlockHash().String())
+	}
+
+	// out of order offset file
+	writeTestBlocks(t, cfg, headers, []int{0, 2, 1, 3, 4}, xorKey{})
+	_, err = verifyHeaders(cfg, 5)
+	if err == nil {
+		t.Fatal("out of order headers verified")
+	}
+
+	// header that doesn't meet its target
+	headers[3].Nonce++
+	for {
+		hash := headers[3].BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(
+			blockchain.CompactToBig(headers[3].Bits)) > 0 {
+			break
+		}
+		headers[3].Nonce++
+	}
+	writeTestBlocks(t, cfg, headers, []int{0, 1, 2, 3, 4}, xorKey{})
+	_, err = verifyHeaders(cfg, 5)
+	if err == nil {
+		t.Fatal("header with high hash verified")
+	}
+}
@@ -0,0 +1,103 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// xorKeyFileName is the file in the blocks directory that newer versions of
+// Bitcoin Core keep the blk/rev file obfuscation key in
+const xorKeyFileName = "xor.dat"
+
+// xorKey is the key the blk and rev files are obfuscated with.  Byte n of a
+// file is xored with key[n%8].  An all zero key means no obfuscation.
+type xorKey [8]byte
+
+// readXorKey reads the obfuscation key for the blocks directory.  If there's
+// no xor.dat the files aren't obfuscated and the key is all zeros.
+func readXorKey(blockDir string) (key xorKey, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(blockDir, xorKeyFileName))
+	if os.IsNotExist(err) {
+		return key, nil
+	}
+	if err != nil {
+		return
+	}
+	if len(b) != len(key) {
+		err = fmt.Errorf("%s is %d bytes, expected %d",
+			xorKeyFileName, len(b), len(key))
+		return
+	}
+	copy(key[:], b)
+	return
+}
+
+// apply xors data that was read starting at file position pos.  Doing it
+// again gives back what was there before.
+func (k *xorKey) apply(data []byte, pos int64) {
+	if *k == (xorKey{}) {
+		return
+	}
+	for i := range data {
+		data[i] ^= k[(pos+int64(i))%int64(len(k))]
+	}
+}
+
+// xorFile is a blk or rev file that's de-obfuscated as it's read, so callers
+// can treat it like a regular file.
+type xorFile struct {
+	f   *os.File
+	key xorKey
+	pos int64
+}
+
+// openXorFile opens a blk or rev file along with the key from the xor.dat
+// in the same directory.
+func openXorFile(path string) (*xorFile, error) {
+	key, err := readXorKey(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &xorFile{f: f, key: key}, nil
+}
+
+// Read reads from the current position and de-obfuscates
+func (xf *xorFile) Read(p []byte) (int, error) {
+	n, err := xf.f.Read(p)
+	xf.key.apply(p[:n], xf.pos)
+	xf.pos += int64(n)
+	return n, err
+}
+
+// ReadAt reads from the given position and de-obfuscates
+func (xf *xorFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := xf.f.ReadAt(p, off)
+	xf.key.apply(p[:n], off)
+	return n, err
+}
+
+// Seek moves the position the next Read starts from
+func (xf *xorFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := xf.f.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	xf.pos = pos
+	return pos, nil
+}
+
+// Stat gives the FileInfo of the underlying file
+func (xf *xorFile) Stat() (os.FileInfo, error) {
+	return xf.f.Stat()
+}
+
+// Close closes the underlying file
+func (xf *xorFile) Close() error {
+	return xf.f.Close()
+}
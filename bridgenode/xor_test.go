@@ -0,0 +1,140 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestXorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xorfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := xorKey{0x13, 0x37, 0xde, 0xad, 0xbe, 0xef, 0x00, 0x42}
+	plain := make([]byte, 1000)
+	rand.Read(plain)
+	obf := make([]byte, len(plain))
+	copy(obf, plain)
+	key.apply(obf, 0)
+	if bytes.Equal(obf, plain) {
+		t.Fatal("obfuscating did nothing")
+	}
+
+	name := filepath.Join(dir, "blk00000.dat")
+	err = ioutil.WriteFile(name, obf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFileName), key[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xf, err := openXorFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer xf.Close()
+
+	// reads in odd sized pieces so they don't line up with the key
+	got, err := ioutil.ReadAll(bufio.NewReaderSize(xf, 17))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("Read didn't de-obfuscate")
+	}
+
+	buf := make([]byte, 33)
+	_, err = xf.ReadAt(buf, 101)
+	if err != nil || !bytes.Equal(buf, plain[101:134]) {
+		t.Fatalf("ReadAt didn't de-obfuscate: %v", err)
+	}
+
+	_, err = xf.Seek(555, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadFull(xf, buf)
+	if err != nil || !bytes.Equal(buf, plain[555:588]) {
+		t.Fatalf("Seek then Read didn't de-obfuscate: %v", err)
+	}
+}
+
+// TestXorBlocks makes sure all the ways of reading blocks and undo blocks
+// work on obfuscated files
+func TestXorBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xorblocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig(dir)
+	headers := makeTestHeaders(&cfg.params, 5)
+	key := xorKey{1, 2, 3, 4, 5, 6, 7, 8}
+	writeTestBlocks(t, cfg, headers, []int{0, 1, 2, 3, 4}, key)
+
+	// header reads
+	_, err = verifyHeaders(cfg, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// offset file building reads
+	undoPos := make(map[[32]byte]uint32)
+	for _, hdr := range headers {
+		undoPos[hdr.BlockHash()] = 0
+	}
+	raw, err := readRawHeadersFromFile(bufio.NewReaderSize(nil, 1<<10),
+		filepath.Join(dir, "blk00000.dat"), 0, undoPos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != len(headers) {
+		t.Fatalf("read %d raw headers, expected %d", len(raw), len(headers))
+	}
+	for i := range raw {
+		if raw[i].CurrentHeaderHash != headers[i].BlockHash() {
+			t.Fatalf("raw header %d hash mismatch", i)
+		}
+	}
+
+	// single block reads for the server
+	b, err := GetBlockBytesFromFile(3, cfg.UtreeDir.OffsetDir.OffsetFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hdrBuf bytes.Buffer
+	headers[2].Serialize(&hdrBuf)
+	if !bytes.Equal(b[:80], hdrBuf.Bytes()) {
+		t.Fatal("GetBlockBytesFromFile didn't de-obfuscate")
+	}
+
+	// block and rev reads for building proofs
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	blocks, revs, err := GetRawBlocksFromDisk(1, 5, offsetFile, dir)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if len(blocks) != 5 || len(revs) != 5 {
+		t.Fatalf("got %d blocks %d revs", len(blocks), len(revs))
+	}
+	for i := range blocks {
+		if blocks[i].BlockHash() != headers[i].BlockHash() {
+			t.Fatalf("block %d hash mismatch", i)
+		}
+	}
+}
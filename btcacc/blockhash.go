@@ -0,0 +1,85 @@
+package btcacc
+
+import (
+	"fmt"
+)
+
+// BlockHashIndex keeps the hash of every block by height, so that leaves
+// can commit to the hash of the block that created them.
+//
+// Leaves created below SwitchHeight keep a zero BlockHash, the way every
+// leaf used to.  That way an accumulator built before leaves committed to
+// block hashes is still good; set SwitchHeight past where it was built.
+// Every node on a network has to use the same SwitchHeight, or their leaf
+// hashes won't match.
+type BlockHashIndex struct {
+	SwitchHeight int32
+
+	// hashes[h] is the hash of the block at height h, starting at genesis
+	hashes []Hash
+}
+
+// NoSwitchHeight is a switch-over height that wasn't given, or wasn't saved
+// with an accumulator from before they were
+const NoSwitchHeight int32 = -1
+
+// ResumeSwitchHeight gives the switch-over height to keep building an
+// accumulator with, from the one saved with it and the one given.  They have
+// to agree, since leaves hashed with another one make roots nobody else has.
+// An accumulator saved without one needs it given.
+func ResumeSwitchHeight(saved, given int32) (int32, error) {
+	switch {
+	case saved == NoSwitchHeight && given == NoSwitchHeight:
+		return 0, fmt.Errorf("accumulator was saved without a block hash " +
+			"switch-over height, so it has to be given")
+	case saved == NoSwitchHeight:
+		return given, nil
+	case given != NoSwitchHeight && given != saved:
+		return 0, fmt.Errorf("accumulator was built with block hash "+
+			"switch-over height %d but %d was given", saved, given)
+	}
+	return saved, nil
+}
+
+// NewBlockHashIndex makes an empty index with the given switch-over height
+func NewBlockHashIndex(switchHeight int32) *BlockHashIndex {
+	return &BlockHashIndex{SwitchHeight: switchHeight}
+}
+
+// Height is the highest block the index has, or -1 if it's empty
+func (bi *BlockHashIndex) Height() int32 {
+	return int32(len(bi.hashes)) - 1
+}
+
+// Add puts the hash of the block at the given height into the index.
+// Blocks have to be added in order, starting with genesis at 0.
+func (bi *BlockHashIndex) Add(height int32, hash Hash) error {
+	if height != bi.Height()+1 {
+		return fmt.Errorf("BlockHashIndex: adding height %d but at %d",
+			height, bi.Height())
+	}
+	bi.hashes = append(bi.hashes, hash)
+	return nil
+}
+
+// Commits says if leaves created at the given height commit to their
+// block hash
+func (bi *BlockHashIndex) Commits(height int32) bool {
+	return height >= bi.SwitchHeight
+}
+
+// LeafBlockHash gives the BlockHash for a leaf created at the given height.
+// It's zero if the height is before the switch-over, and an error if the
+// index doesn't have that height.
+func (bi *BlockHashIndex) LeafBlockHash(height int32) (bh [32]byte, err error) {
+	if !bi.Commits(height) {
+		return
+	}
+	if height < 0 || height > bi.Height() {
+		err = fmt.Errorf("BlockHashIndex: no hash for height %d, tip %d",
+			height, bi.Height())
+		return
+	}
+	bh = bi.hashes[height]
+	return
+}
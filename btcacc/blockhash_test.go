@@ -0,0 +1,25 @@
+package btcacc
+
+import "testing"
+
+// TestResumeSwitchHeight checks the saved switch-over height is kept, and
+// that a different one given is refused
+func TestResumeSwitchHeight(t *testing.T) {
+	tests := []struct {
+		saved, given, want int32
+		ok                 bool
+	}{
+		{saved: 0, given: NoSwitchHeight, want: 0, ok: true},
+		{saved: 500, given: 500, want: 500, ok: true},
+		{saved: 500, given: 0, ok: false},
+		{saved: NoSwitchHeight, given: 700, want: 700, ok: true},
+		{saved: NoSwitchHeight, given: NoSwitchHeight, ok: false},
+	}
+	for _, test := range tests {
+		got, err := ResumeSwitchHeight(test.saved, test.given)
+		if (err == nil) != test.ok || got != test.want {
+			t.Fatalf("saved %d given %d: got %d %v, expect %d ok %v",
+				test.saved, test.given, got, err, test.want, test.ok)
+		}
+	}
+}
@@ -2,12 +2,13 @@ package btcacc
 
 import (
 	"bytes"
-	"crypto/sha512"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"strconv"
+
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 const HashSize = 32
@@ -119,9 +120,17 @@ func (l *LeafData) Deserialize(r io.Reader) (err error) {
 // can use tags for PkScript
 // so it's just height, coinbaseness, amt, pkscript tag
 
-// LeafHash turns a LeafData into a LeafHash
+// LeafHash turns a LeafData into a LeafHash, the LegacyHash way with the
+// DefaultHasher
 func (l *LeafData) LeafHash() [32]byte {
+	return l.LeafHashWith(accumulator.LegacyHash, accumulator.DefaultHasher)
+}
+
+// LeafHashWith turns a LeafData into a LeafHash for an accumulator using
+// the given hash scheme and hasher
+func (l *LeafData) LeafHashWith(
+	s accumulator.HashScheme, h accumulator.Hasher) accumulator.Hash {
 	var buf bytes.Buffer
 	l.Serialize(&buf)
-	return sha512.Sum512_256(buf.Bytes())
+	return s.LeafHash(h, buf.Bytes())
 }
@@ -36,3 +36,38 @@ func TestLeafDataSerialize(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestBlockHashIndex(t *testing.T) {
+	bi := NewBlockHashIndex(3)
+	for h := int32(0); h < 5; h++ {
+		err := bi.Add(h, Hash{byte(h + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bi.Add(7, Hash{}) == nil {
+		t.Fatal("added height out of order")
+	}
+
+	// before the switch-over, leaves commit to nothing
+	bh, err := bi.LeafBlockHash(2)
+	if err != nil || bh != [32]byte{} {
+		t.Fatalf("height 2 block hash %x err %v", bh, err)
+	}
+	bh, err = bi.LeafBlockHash(4)
+	if err != nil || bh != [32]byte{5} {
+		t.Fatalf("height 4 block hash %x err %v", bh, err)
+	}
+	_, err = bi.LeafBlockHash(5)
+	if err == nil {
+		t.Fatal("got block hash past the tip")
+	}
+
+	// a different block hash gives a different leaf
+	ld := LeafData{TxHash: Hash{1}, Height: 4, Amt: 1}
+	before := ld.LeafHash()
+	ld.BlockHash = bh
+	if ld.LeafHash() == before {
+		t.Fatal("leaf hash doesn't commit to block hash")
+	}
+}
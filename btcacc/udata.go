@@ -180,7 +180,8 @@ func GenUData(delLeaves []LeafData, forest *accumulator.Forest, height int32) (
 	// make slice of hashes from leafdata
 	delHashes := make([]accumulator.Hash, len(ud.Stxos))
 	for i, _ := range ud.Stxos {
-		delHashes[i] = ud.Stxos[i].LeafHash()
+		delHashes[i] = ud.Stxos[i].LeafHashWith(
+			forest.HashScheme(), forest.Hasher())
 	}
 	// generate block proof. Errors if the tx cannot be proven
 	// Should never error out with genproofs as it takes
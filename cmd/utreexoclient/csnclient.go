@@ -24,7 +24,8 @@ func main() {
 
 	err = csn.RunIBD(cfg, sig)
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		os.Exit(1)
 	}
 }
 
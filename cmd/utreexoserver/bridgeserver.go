@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	_ "net/http/pprof"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"runtime/debug"
 	"runtime/pprof"
 	"runtime/trace"
+	"strconv"
+	"strings"
 	"syscall"
 
 	bridge "github.com/mit-dci/utreexo/bridgenode"
@@ -20,14 +23,64 @@ func main() {
 	// by collecting garbage early.
 	debug.SetGCPercent(20)
 
+	args := os.Args[1:]
+	convert := len(args) > 0 && args[0] == "convert"
+	if convert {
+		args = args[1:]
+	}
+	roots := len(args) > 0 && args[0] == "roots"
+	var rootsHeight int64
+	if roots {
+		if len(args) < 2 {
+			fmt.Println("roots needs a height")
+			fmt.Println(bridge.HelpMsg)
+			os.Exit(1)
+		}
+		var err error
+		rootsHeight, err = strconv.ParseInt(args[1], 10, 32)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		args = args[2:]
+	}
+
 	// parse the config
-	cfg, err := bridge.Parse(os.Args[1:])
+	cfg, err := bridge.Parse(args)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println(bridge.HelpMsg)
 		os.Exit(1)
 	}
 
+	if convert {
+		err = bridge.ConvertForest(cfg)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if roots {
+		numLeaves, rootHashes, err := bridge.GetRootsAtHeight(
+			cfg, int32(rootsHeight))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("height %d numleaves %d\n", rootsHeight, numLeaves)
+		hexRoots := make([]string, len(rootHashes))
+		for i, root := range rootHashes {
+			fmt.Printf("%x\n", root)
+			hexRoots[i] = hex.EncodeToString(root[:])
+		}
+		// ready to give to a CSN
+		fmt.Printf("-assumeroots=%d:%d:%s\n",
+			rootsHeight, numLeaves, strings.Join(hexRoots, ","))
+		return
+	}
+
 	// listen for SIGINT, SIGTERM, or SIGQUIT from the os
 	sig := make(chan bool, 1)
 	handleIntSig(sig, cfg)
@@ -0,0 +1,126 @@
+package csn
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// assumedRoots is an accumulator state given with -assumeroots, to start IBD
+// from instead of genesis.  Like assumeutxo, the blocks up to it aren't
+// checked unless -checkassumed is given, which checks them in the background.
+type assumedRoots struct {
+	height    int32
+	numLeaves uint64
+	roots     []accumulator.Hash
+}
+
+// parseAssumeRoots reads height:numleaves:root,root,... with the roots in
+// hex, in the order the bridge's roots command prints them
+func parseAssumeRoots(s string) (*assumedRoots, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("-assumeroots=%s should be "+
+			"height:numleaves:root,root,...", s)
+	}
+	height, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("-assumeroots height: %s", err.Error())
+	}
+	if height < 1 {
+		return nil, fmt.Errorf("-assumeroots height %d, must be at least 1",
+			height)
+	}
+	numLeaves, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("-assumeroots numleaves: %s", err.Error())
+	}
+
+	ar := assumedRoots{height: int32(height), numLeaves: numLeaves}
+	if parts[2] != "" {
+		for i, r := range strings.Split(parts[2], ",") {
+			b, err := hex.DecodeString(r)
+			if err != nil || len(b) != 32 {
+				return nil, fmt.Errorf("-assumeroots root %d %s isn't 32 "+
+					"bytes of hex", i, r)
+			}
+			var root accumulator.Hash
+			copy(root[:], b)
+			ar.roots = append(ar.roots, root)
+		}
+	}
+	return &ar, nil
+}
+
+// checkAssumedRoots does IBD from genesis up to the assumed height with a
+// pollard of its own, next to the main IBD, and compares the roots it gets
+// to the assumed ones.  If they don't match, nothing after the assumed
+// height can be trusted, so the error should stop everything.
+func (c *Csn) checkAssumedRoots(cfg Config, ar *assumedRoots) error {
+	bg := Csn{
+		CurrentHeight:   1,
+		pollard:         accumulator.NewPollard(cfg.hashScheme, nil),
+		CheckSignatures: c.CheckSignatures,
+		Params:          c.Params,
+		headers:         c.headers,
+	}
+	bg.pollard.Lookahead = c.pollard.Lookahead
+	bg.pollard.SetHashWorkers(cfg.hashWorkers)
+	// genesis, so blocks go in from 1 like for the main CSN
+	var err error
+	bg.blockHashes, err = bg.initBlockHashes(cfg.blockHashHeight)
+	if err != nil {
+		return fmt.Errorf("checking assumed roots: %s", err.Error())
+	}
+
+	ublockQueue := make(chan uwire.UBlock, 10)
+	go c.ublockReader(ublockQueue, 1, ar.height, bg.pollard.Lookahead)
+
+	fmt.Printf("checking blocks up to assumed height %d in the background\n",
+		ar.height)
+	starttime := time.Now()
+	var totalTXOAdded, totalDels int
+	for ; bg.CurrentHeight <= ar.height; bg.CurrentHeight++ {
+		ub, open := <-ublockQueue
+		if !open {
+			return fmt.Errorf("checking assumed roots: bridge hung up "+
+				"at height %d", bg.CurrentHeight)
+		}
+		err = bg.putBlockInPollard(ub, &totalTXOAdded, &totalDels, 0)
+		if err != nil {
+			return fmt.Errorf("checking assumed roots at height %d: %s",
+				bg.CurrentHeight, err.Error())
+		}
+		if bg.CurrentHeight%10000 == 0 {
+			fmt.Printf("assumed roots check at block %d\n", bg.CurrentHeight)
+		}
+	}
+
+	if bg.pollard.NumLeaves() != ar.numLeaves ||
+		!rootsEqual(bg.pollard.GetRoots(), ar.roots) {
+		return fmt.Errorf("assumed roots at height %d are WRONG: the blocks "+
+			"make %d leaves, assumed %d", ar.height, bg.pollard.NumLeaves(),
+			ar.numLeaves)
+	}
+	fmt.Printf("assumed roots at height %d checked out in %.2f sec\n",
+		ar.height, time.Since(starttime).Seconds())
+	return nil
+}
+
+// rootsEqual says if two sets of roots are the same
+func rootsEqual(a, b []accumulator.Hash) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package csn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// makeBlock makes a solved regtest block on top of prev with a coinbase
+// and txs
+func makeBlock(t *testing.T, prev *wire.BlockHeader, height int32,
+	p *chaincfg.Params, txs ...*wire.MsgTx) *btcutil.Block {
+
+	sigScript, err := txscript.NewScriptBuilder().
+		AddInt64(int64(height)).AddInt64(0).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := wire.NewMsgTx(1)
+	cb.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		SignatureScript:  sigScript,
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	cb.AddTxOut(wire.NewTxOut(50*1e8, []byte{txscript.OP_TRUE}))
+
+	blk := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   4,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Timestamp.Add(10 * time.Minute),
+		Bits:      p.PowLimitBits,
+	})
+	blk.AddTransaction(cb)
+	for _, tx := range txs {
+		blk.AddTransaction(tx)
+	}
+	merkles := blockchain.BuildMerkleTreeStore(
+		btcutil.NewBlock(blk).Transactions(), false)
+	blk.Header.MerkleRoot = *merkles[len(merkles)-1]
+	target := blockchain.CompactToBig(blk.Header.Bits)
+	for {
+		hash := blk.Header.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			break
+		}
+		blk.Header.Nonce++
+	}
+	return btcutil.NewBlock(blk)
+}
+
+// serveUBlocks answers ublock requests on a local port, the way the bridge
+// server does, with ublocks[h] at height h
+func serveUBlocks(t *testing.T, ublocks []uwire.UBlock) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var from, to int32
+				binary.Read(c, binary.BigEndian, &from)
+				binary.Read(c, binary.BigEndian, &to)
+				for h := from; h <= to && int(h) < len(ublocks); h++ {
+					err := ublocks[h].Serialize(c)
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+// TestCheckAssumedRoots checks blocks from a bridge against the right roots
+// and wrong ones.  Leaves commit to their block hash part way up, so the
+// background CSN's block hash index gets used.
+func TestCheckAssumedRoots(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	const height = 6
+	cfg := Config{params: *p, blockHashHeight: 3, hashWorkers: 1}
+
+	headers := uwire.NewHeaderChain(p)
+	blockHashes := btcacc.NewBlockHashIndex(cfg.blockHashHeight)
+	err := blockHashes.Add(0, btcacc.Hash(*p.GenesisHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what the roots should be, from the same leaves put in a pollard
+	want := accumulator.NewPollard(cfg.hashScheme, nil)
+	ublocks := make([]uwire.UBlock, height+1)
+	prev := &p.GenesisBlock.Header
+	for h := int32(1); h <= height; h++ {
+		blk := makeBlock(t, prev, h, p)
+		prev = &blk.MsgBlock().Header
+		err = headers.AddHeader(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = blockHashes.Add(h, btcacc.Hash(*blk.Hash()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ublocks[h] = uwire.UBlock{Block: blk,
+			UtreexoData: btcacc.UData{Height: h, TxoTTLs: []int32{0}}}
+		_, err = want.Modify(uwire.BlockToAddLeaves(blk, nil, nil, h, 1,
+			blockHashes, cfg.hashScheme, accumulator.DefaultHasher), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listener := serveUBlocks(t, ublocks)
+	defer listener.Close()
+	c := Csn{
+		pollard:    accumulator.NewPollard(cfg.hashScheme, nil),
+		Params:     *p,
+		headers:    headers,
+		remoteHost: listener.Addr().String(),
+	}
+	ar := &assumedRoots{height: height,
+		numLeaves: want.NumLeaves(), roots: want.GetRoots()}
+	err = c.checkAssumedRoots(cfg, ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ar.roots[0][0] ^= 1
+	err = c.checkAssumedRoots(cfg, ar)
+	if err == nil {
+		t.Fatal("wrong assumed roots checked out")
+	}
+}
+
+// TestFailedCheckStopsIBD has the background check fail while IBD waits on
+// the bridge, and checks IBD stops with that error without saving anything
+func TestFailedCheckStopsIBD(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	headers := uwire.NewHeaderChain(p)
+	blk := makeBlock(t, &p.GenesisBlock.Header, 1, p)
+	err := headers.AddHeader(&blk.MsgBlock().Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bridge that takes the request and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	c := Csn{
+		CurrentHeight: 1,
+		pollard:       accumulator.NewPollard(accumulator.LegacyHash, nil),
+		Params:        *p,
+		headers:       headers,
+		remoteHost:    listener.Addr().String(),
+		HeightChan:    make(chan int32, 10),
+		ErrChan:       make(chan error, 1),
+		checkFailed:   make(chan error, 1),
+	}
+	go c.IBDThread(Config{quitafter: -1}, make(chan bool, 1))
+	time.Sleep(50 * time.Millisecond)
+	failed := fmt.Errorf("assumed roots don't match")
+	c.checkFailed <- failed
+
+	select {
+	case err = <-c.ErrChan:
+		if err != failed {
+			t.Fatalf("IBD stopped with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("IBD didn't stop on a failed check")
+	}
+	if util.HasAccess(PollardFilePath) {
+		t.Fatal("saved the pollard after a failed check")
+	}
+}
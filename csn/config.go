@@ -2,13 +2,19 @@ package csn
 
 import (
 	"flag"
+	"fmt"
 	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
 )
 
 var PollardFilePath string = "pollardFile"
 
+// HeaderFilePath is where the validated header chain is kept between runs
+var HeaderFilePath string = "headerFile"
+
 var HelpMsg = `
 Usage: client [OPTION]
 A dynamic hash based accumulator designed for the Bitcoin UTXO set.
@@ -25,6 +31,29 @@ OPTIONS:
 
   -host                        server to connect to.  Default to localhost
                                if you need a public server, try 35.188.186.244
+  -p2phost=host:port           get ublocks from a bridge started with -p2p,
+                               over the bitcoin p2p protocol.  Headers still
+                               come from -host
+  -hashworkers=0               goroutines to hash the pollard with. 0 is one
+                               per cpu, 1 hashes serially
+  -blockhashheight=-1          height from which leaves commit to their
+                               block hash.  Must match the bridge.  Saved
+                               with the pollard; -1 is the saved one, or 0
+                               for a new pollard
+  -hashscheme=legacy           how the accumulator hashes: legacy or v1
+                               (tagged, row committing).  Must match the
+                               bridge and the pollard already on disk
+  -assumeroots=h:n:r,r,...     start IBD after height h from an accumulator
+                               with n leaves and the given roots (hex, as
+                               the bridge's roots command prints them)
+                               instead of from genesis.  Only used when
+                               there's no pollard on disk yet
+  -rangeproofs=0               catch up a range of this many blocks at a
+                               time with one range proof from -host.  Has
+                               to match the bridge's -aggregate.  0 is off
+  -checkassumed                check the blocks up to the -assumeroots height
+                               in the background, and stop if they don't
+                               make the assumed roots
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -43,6 +72,8 @@ var (
 		`Address to watch & report transactions. Only bech32 p2wpkh supported`)
 	remoteHost = argCmd.String("host", "127.0.0.1",
 		`remote server to connect to`)
+	p2pHostCmd = argCmd.String("p2phost", "",
+		`bridge to get ublocks from over the bitcoin p2p protocol`)
 
 	checkSig = argCmd.Bool("checksig", true,
 		`check signatures (slower)`)
@@ -50,6 +81,18 @@ var (
 		`size of the look-ahead cache in blocks`)
 	quitafter = argCmd.Int("quitafter", -1,
 		`quit ibd after n blocks. (for testing)`)
+	hashWorkers = argCmd.Int("hashworkers", 0,
+		`how many goroutines hash the pollard. 0 is one per cpu`)
+	blockHashHeight = argCmd.Int("blockhashheight", -1,
+		`height from which leaves commit to their block hash. Must match the bridge. -1 is the one saved with the pollard`)
+	hashScheme = argCmd.String("hashscheme", "legacy",
+		`how the accumulator hashes, legacy or v1. Must match the bridge`)
+	assumeRootsCmd = argCmd.String("assumeroots", "",
+		`start from height:numleaves:roots instead of genesis`)
+	rangeProofsCmd = argCmd.Int("rangeproofs", 0,
+		`catch up with a range proof for every this many blocks. 0 is off`)
+	checkAssumedCmd = argCmd.Bool("checkassumed", false,
+		`check the blocks up to -assumeroots in the background`)
 	profServerCmd = argCmd.String("profserver", "",
 		`Enable pprof server. Usage: 'profserver='port'`)
 )
@@ -60,6 +103,9 @@ type Config struct {
 	// host server
 	remoteHost string
 
+	// bridge to get ublocks from over p2p instead of remoteHost, if any
+	p2pHost string
+
 	// address to watch for txs
 	watchAddr string
 
@@ -72,6 +118,25 @@ type Config struct {
 	// Check Bitcoin tx signatures
 	checkSig bool
 
+	// leaves created from this height on commit to their block hash.
+	// btcacc.NoSwitchHeight until the pollard is made or restored
+	blockHashHeight int32
+
+	// how many goroutines hash the pollard
+	hashWorkers int
+
+	// how the pollard hashes, for a new one
+	hashScheme accumulator.HashScheme
+
+	// accumulator to start from instead of genesis, if any
+	assumeRoots *assumedRoots
+
+	// check the blocks up to assumeRoots in the background
+	checkAssumed bool
+
+	// blocks in each range proof from the bridge.  0 doesn't use them
+	rangeProofs int32
+
 	// enable tracing
 	TraceProf string
 
@@ -103,10 +168,37 @@ func Parse(args []string) (*Config, error) {
 	}
 
 	cfg.remoteHost = *remoteHost
+	cfg.p2pHost = *p2pHostCmd
 	cfg.watchAddr = *watchAddr
 	cfg.lookAhead = *lookahead
 	cfg.quitafter = *quitafter
 	cfg.checkSig = *checkSig
+	cfg.blockHashHeight = int32(*blockHashHeight)
+	cfg.hashWorkers = *hashWorkers
+	var err error
+	cfg.hashScheme, err = accumulator.ParseHashScheme(*hashScheme)
+	if err != nil {
+		return nil, err
+	}
+	if *assumeRootsCmd != "" {
+		cfg.assumeRoots, err = parseAssumeRoots(*assumeRootsCmd)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.checkAssumed = *checkAssumedCmd
+	cfg.rangeProofs = int32(*rangeProofsCmd)
+	if cfg.rangeProofs < 0 {
+		return nil, fmt.Errorf("-rangeproofs=%d, can't be negative",
+			cfg.rangeProofs)
+	}
+	if cfg.blockHashHeight < btcacc.NoSwitchHeight {
+		return nil, fmt.Errorf("-blockhashheight=%d, can't be below -1",
+			cfg.blockHashHeight)
+	}
+	if cfg.checkAssumed && cfg.assumeRoots == nil {
+		return nil, fmt.Errorf("-checkassumed needs -assumeroots")
+	}
 
 	// if no host was given, default to localhost
 	if *remoteHost == "" {
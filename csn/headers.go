@@ -0,0 +1,157 @@
+package csn
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// headerBatchSize is how many headers are asked for at once, the most a
+// bitcoin headers message holds
+const headerBatchSize = 2000
+
+// syncHeaders loads the headers saved by earlier runs, then downloads the
+// rest from the bridge in batches and validates them into the header chain.
+// Each batch is saved as it comes in.  Ublocks are only accepted if they
+// match this chain, so this runs before IBD.
+func (c *Csn) syncHeaders() error {
+	err := loadHeaders(c.headers, HeaderFilePath)
+	if err != nil {
+		return err
+	}
+	saved := c.headers.BestHeight()
+	savedTip, _ := c.headers.HashAt(saved)
+
+	for {
+		fromHeight := c.headers.BestHeight() + 1
+		headers, err := uwire.GetHeaders(c.remoteHost,
+			fromHeight, fromHeight+headerBatchSize-1)
+		if err != nil {
+			return err
+		}
+		for i := range headers {
+			err = c.headers.AddHeader(&headers[i])
+			if err != nil {
+				return fmt.Errorf("header %d from %s: %w",
+					fromHeight+int32(i), c.remoteHost, err)
+			}
+		}
+		if c.headers.BestHeight() < fromHeight {
+			break
+		}
+
+		// only append to the file, unless a reorg went below what's in it
+		from := saved + 1
+		if tip, _ := c.headers.HashAt(saved); tip != savedTip {
+			from = 1
+		}
+		err = saveHeaders(c.headers, HeaderFilePath, from)
+		if err != nil {
+			return err
+		}
+		saved = c.headers.BestHeight()
+		savedTip, _ = c.headers.HashAt(saved)
+
+		if len(headers) < headerBatchSize {
+			break
+		}
+	}
+
+	tip, _ := c.headers.HashAt(c.headers.BestHeight())
+	fmt.Printf("header chain synced to height %d %s\n",
+		c.headers.BestHeight(), tip.String())
+	return nil
+}
+
+// loadHeaders adds the headers saved in path to the header chain.  The file
+// has the best chain's headers from height 1 on, 80 bytes each.  A torn last
+// header from a crash part way through a write is left out; saveHeaders
+// writes over it.
+func loadHeaders(hc *uwire.HeaderChain, path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		var hdr wire.BlockHeader
+		err = hdr.Deserialize(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = hc.AddHeader(&hdr)
+		if err != nil {
+			return fmt.Errorf("%s header %d: %w",
+				path, hc.BestHeight()+1, err)
+		}
+	}
+}
+
+// saveHeaders writes the best chain's headers from height from up to the
+// tip into path, replacing whatever the file had from there on.
+func saveHeaders(hc *uwire.HeaderChain, path string, from int32) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	offset := int64(from-1) * wire.MaxBlockHeaderPayload
+	err = f.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for h := from; h <= hc.BestHeight(); h++ {
+		hdr, _ := hc.HeaderAt(h)
+		err = hdr.Serialize(w)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// initBlockHashes makes the block hash index for leaves, with every block
+// below CurrentHeight in it.  Those blocks were accepted on an earlier run
+// and matched the header chain, so their hashes come from there.  Blocks
+// from here on get added as they're received.
+func (c *Csn) initBlockHashes(
+	switchHeight int32) (*btcacc.BlockHashIndex, error) {
+
+	blockHashes := btcacc.NewBlockHashIndex(switchHeight)
+	for h := int32(0); h < c.CurrentHeight; h++ {
+		hash, ok := c.headers.HashAt(h)
+		if !ok {
+			return nil, fmt.Errorf("at height %d but header tip is %d",
+				c.CurrentHeight, c.headers.BestHeight())
+		}
+		err := blockHashes.Add(h, btcacc.Hash(hash))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blockHashes, nil
+}
@@ -0,0 +1,179 @@
+package csn
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// headerServer answers header requests on a local port the way the bridge
+// server does, with headers[h] at height h, and keeps the ranges asked for
+type headerServer struct {
+	listener net.Listener
+	headers  []wire.BlockHeader
+
+	mtx      sync.Mutex
+	requests [][2]int32
+}
+
+func serveHeaderList(t *testing.T, headers []wire.BlockHeader) *headerServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &headerServer{listener: listener, headers: headers}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var request, from, to int32
+				binary.Read(c, binary.BigEndian, &request)
+				binary.Read(c, binary.BigEndian, &from)
+				binary.Read(c, binary.BigEndian, &to)
+				if request != uwire.HeaderRequest {
+					return
+				}
+				hs.mtx.Lock()
+				hs.requests = append(hs.requests, [2]int32{from, to})
+				hs.mtx.Unlock()
+				for h := from; h <= to && int(h) < len(headers); h++ {
+					err := headers[h].Serialize(c)
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return hs
+}
+
+// takeRequests gives the ranges asked for since the last call
+func (hs *headerServer) takeRequests() [][2]int32 {
+	hs.mtx.Lock()
+	defer hs.mtx.Unlock()
+	requests := hs.requests
+	hs.requests = nil
+	return requests
+}
+
+// makeHeaders makes n solved regtest headers after genesis, with genesis
+// at index 0
+func makeHeaders(n int, p *chaincfg.Params) []wire.BlockHeader {
+	headers := []wire.BlockHeader{p.GenesisBlock.Header}
+	target := blockchain.CompactToBig(p.PowLimitBits)
+	for i := 1; i <= n; i++ {
+		prev := &headers[i-1]
+		hdr := wire.BlockHeader{
+			Version:   4,
+			PrevBlock: prev.BlockHash(),
+			Timestamp: prev.Timestamp.Add(10 * time.Minute),
+			Bits:      p.PowLimitBits,
+		}
+		for {
+			hash := hdr.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			hdr.Nonce++
+		}
+		headers = append(headers, hdr)
+	}
+	return headers
+}
+
+// TestSyncHeaders syncs headers in batches, then restarts from the saved
+// header file, with a torn last header, and gets only the new headers.
+func TestSyncHeaders(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	oldPath := HeaderFilePath
+	HeaderFilePath = filepath.Join(t.TempDir(), "headerFile")
+	defer func() { HeaderFilePath = oldPath }()
+
+	const first = 2*headerBatchSize + 10
+	headers := makeHeaders(first+10, p)
+
+	hs := serveHeaderList(t, headers[:first+1])
+	c := Csn{headers: uwire.NewHeaderChain(p),
+		remoteHost: hs.listener.Addr().String()}
+	err := c.syncHeaders()
+	hs.listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.headers.BestHeight() != first {
+		t.Fatalf("synced to %d, expect %d", c.headers.BestHeight(), first)
+	}
+	requests := hs.takeRequests()
+	if len(requests) != 3 {
+		t.Fatalf("%d requests, expect 3: %v", len(requests), requests)
+	}
+	for i, r := range requests {
+		from := int32(i*headerBatchSize + 1)
+		if r != [2]int32{from, from + headerBatchSize - 1} {
+			t.Fatalf("request %d for %v", i, r)
+		}
+	}
+
+	// lose half the last header, as if we crashed writing it
+	err = os.Truncate(HeaderFilePath, first*wire.MaxBlockHeaderPayload-40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs = serveHeaderList(t, headers)
+	c = Csn{headers: uwire.NewHeaderChain(p),
+		remoteHost: hs.listener.Addr().String()}
+	err = c.syncHeaders()
+	hs.listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.headers.BestHeight() != first+10 {
+		t.Fatalf("synced to %d, expect %d", c.headers.BestHeight(), first+10)
+	}
+	requests = hs.takeRequests()
+	if len(requests) != 1 || requests[0][0] != first {
+		t.Fatalf("expect one request from %d, got %v", first, requests)
+	}
+	fi, err := os.Stat(HeaderFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != (first+10)*wire.MaxBlockHeaderPayload {
+		t.Fatalf("header file is %d bytes, expect %d headers",
+			fi.Size(), first+10)
+	}
+
+	// everything comes from the file when the bridge has nothing new
+	hs = serveHeaderList(t, nil)
+	c = Csn{headers: uwire.NewHeaderChain(p),
+		remoteHost: hs.listener.Addr().String()}
+	err = c.syncHeaders()
+	hs.listener.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.headers.BestHeight() != first+10 {
+		t.Fatalf("loaded to %d, expect %d", c.headers.BestHeight(), first+10)
+	}
+	for h := int32(1); h <= first+10; h++ {
+		hash, _ := c.headers.HashAt(h)
+		if hash != headers[h].BlockHash() {
+			t.Fatalf("height %d hash %s, expect %s",
+				h, hash, headers[h].BlockHash())
+		}
+	}
+}
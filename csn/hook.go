@@ -7,6 +7,7 @@ import (
 	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 /*
@@ -46,11 +47,23 @@ type Csn struct {
 	// TODO use better addresses, either []byte or something fancy
 	TxChan     chan wire.MsgTx
 	HeightChan chan int32
+	// gets why IBD stopped, if it stopped on an error
+	ErrChan chan error
+	// gets an error from a background check, like the assumed roots one,
+	// that means IBD can't go on
+	checkFailed chan error
 
 	CheckSignatures bool
 	Params          chaincfg.Params
 
+	// validated headers; only blocks matching these are accepted
+	headers *uwire.HeaderChain
+
+	// hashes of the blocks we've accepted, for leaf block hashes
+	blockHashes *btcacc.BlockHashIndex
+
 	remoteHost string
+	p2pHost    string
 	utxoStore  map[wire.OutPoint]btcacc.LeafData
 	totalScore int64
 }
@@ -31,15 +31,19 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	// for benchmarking
 	var totalTXOAdded, totalDels int
 
-	// blocks come in and sit in the blockQueue
-	// They should come in from the network -- right now they're coming from the
-	// disk but it should be the exact same thing
-	ublockQueue := make(chan uwire.UBlock, 10)
-
-	// Reads blocks asynchronously from blk*.dat files, and the proof.dat, and DB
-	// this will be a network reader, with the server sending the same stuff over
-	go uwire.UblockNetworkReader(
-		ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+	// blocks come in and sit in the ibdQueue, one at a time or a range
+	// at a time with -rangeproofs
+	ibdQueue := make(chan ibdChunk, 10)
+
+	// Only asks for blocks up to the validated header tip.  If we're
+	// already there, there's nothing to ask for.
+	if c.CurrentHeight > c.headers.BestHeight() {
+		fmt.Printf("already at header tip %d\n", c.headers.BestHeight())
+		close(ibdQueue)
+	} else {
+		go c.chunkReader(ibdQueue, cfg.rangeProofs,
+			c.CurrentHeight, c.headers.BestHeight(), lookahead)
+	}
 
 	var plustime time.Duration
 	starttime := time.Now()
@@ -49,22 +53,42 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	var blockCount int
 	for ; !stop; c.CurrentHeight++ {
 
-		blocknproof, open := <-ublockQueue
+		var chunk ibdChunk
+		var open bool
+		select {
+		case chunk, open = <-ibdQueue:
+		case err := <-c.checkFailed:
+			// don't save a pollard built on roots that didn't check out
+			c.ErrChan <- err
+			return
+		}
 		if !open {
-			fmt.Printf("ublockQueue channel closed ")
+			fmt.Printf("ibdQueue channel closed ")
 			sig <- true
 			break
 		}
 
-		err := c.putBlockInPollard(blocknproof, &totalTXOAdded, &totalDels, plustime)
+		ubs := chunk.ubs
+		var err error
+		if chunk.rp != nil {
+			err = c.putRangeInPollard(
+				ubs, *chunk.rp, &totalTXOAdded, &totalDels)
+		} else {
+			err = c.putBlockInPollard(
+				ubs[0], &totalTXOAdded, &totalDels, plustime)
+		}
 		if err != nil {
 			// crash if there's a bad proof or signature, OK for testing
 			panic(err)
 		}
 
-		c.HeightChan <- c.CurrentHeight
-
-		c.ScanBlock(blocknproof.Block)
+		for i, ub := range ubs {
+			if i > 0 {
+				c.CurrentHeight++
+			}
+			c.HeightChan <- c.CurrentHeight
+			c.ScanBlock(ub.Block)
+		}
 
 		if c.CurrentHeight%10000 == 0 {
 			fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
@@ -73,7 +97,7 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 		}
 
 		// quit after `quitafter` blocks if the -quitafter option is set
-		blockCount++
+		blockCount += len(ubs)
 		if cfg.quitafter > -1 && blockCount >= cfg.quitafter {
 			fmt.Println("quit after", quitafter, "blocks")
 			sig <- true
@@ -100,11 +124,92 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	haltAccept <- true
 }
 
+// ibdChunk is what the IBD loop takes in at once: a ublock with its proof,
+// or the ublocks of a range without their proof hashes and the range proof
+// for them all
+type ibdChunk struct {
+	ubs []uwire.UBlock
+	rp  *accumulator.RangeProof
+}
+
+// chunkReader puts the ublocks from curHeight to endHeight in the queue.
+// With a rangeSize it goes a range at a time, getting the range proof and
+// then the range's ublocks without proof hashes, so each proof hash only
+// comes over once per range.  Ranges end at multiples of rangeSize.  Where the
+// bridge has no range proof, that range's ublocks come with their proofs.
+func (c *Csn) chunkReader(chunks chan ibdChunk,
+	rangeSize, curHeight, endHeight, lookahead int32) {
+
+	defer close(chunks)
+	if rangeSize == 0 || c.p2pHost != "" {
+		c.blockChunks(chunks, curHeight, endHeight, lookahead)
+		return
+	}
+	for curHeight <= endHeight {
+		end := ((curHeight-1)/rangeSize + 1) * rangeSize
+		if end > endHeight {
+			end = endHeight
+		}
+		chunk, ok := c.rangeChunk(curHeight, end)
+		if ok {
+			chunks <- chunk
+		} else {
+			c.blockChunks(chunks, curHeight, end, lookahead)
+		}
+		curHeight = end + 1
+	}
+}
+
+// rangeChunk gets the range proof and bare ublocks from start to end.
+// Gives false if the bridge doesn't have them, or the range is one block.
+func (c *Csn) rangeChunk(start, end int32) (ibdChunk, bool) {
+	if end == start {
+		return ibdChunk{}, false
+	}
+	rp, err := uwire.GetRangeProof(c.remoteHost, start, end)
+	if err != nil {
+		fmt.Printf("going block by block: %s\n", err.Error())
+		return ibdChunk{}, false
+	}
+	ubs, err := uwire.GetBareUBlocks(c.remoteHost, start, end)
+	if err != nil {
+		fmt.Printf("going block by block: %s\n", err.Error())
+		return ibdChunk{}, false
+	}
+	return ibdChunk{ubs: ubs, rp: &rp}, true
+}
+
+// blockChunks puts the ublocks from curHeight to endHeight, with their
+// proofs, in the queue one at a time
+func (c *Csn) blockChunks(chunks chan ibdChunk,
+	curHeight, endHeight, lookahead int32) {
+
+	ublockQueue := make(chan uwire.UBlock, 10)
+	go c.ublockReader(ublockQueue, curHeight, endHeight, lookahead)
+	for ub := range ublockQueue {
+		chunks <- ibdChunk{ubs: []uwire.UBlock{ub}}
+	}
+}
+
+// ublockReader gets ublocks from the bridge into blockChan, over p2p if
+// -p2phost was given
+func (c *Csn) ublockReader(
+	blockChan chan uwire.UBlock, curHeight, endHeight, lookahead int32) {
+
+	if c.p2pHost != "" {
+		uwire.UblockPeerReader(
+			blockChan, c.p2pHost, &c.Params, curHeight, endHeight)
+		return
+	}
+	uwire.UblockNetworkReader(
+		blockChan, c.remoteHost, curHeight, endHeight, lookahead)
+}
+
 // ScanBlock looks through a block using the CSN's maps and sends matches
 // into the tx channel.
 func (c *Csn) ScanBlock(b *btcutil.Block) {
 	var curAdr [20]byte
-	for _, tx := range b.Transactions() {
+	for txnum, tx := range b.Transactions() {
 		// first check utxo loss
 		for _, in := range tx.MsgTx().TxIn {
 			lostTxo, exists := c.utxoStore[in.PreviousOutPoint]
@@ -127,8 +232,16 @@ func (c *Csn) ScanBlock(b *btcutil.Block) {
 			if c.WatchAdrs[curAdr] {
 				newOut := wire.OutPoint{Hash: *tx.Hash(), Index: uint32(i)}
 				c.RegisterOutPoint(newOut)
-				c.utxoStore[newOut] =
-					btcacc.LeafData{TxHash: btcacc.Hash(newOut.Hash), Index: newOut.Index, Amt: out.Value}
+				bh, _ := c.blockHashes.LeafBlockHash(c.CurrentHeight)
+				c.utxoStore[newOut] = btcacc.LeafData{
+					BlockHash: bh,
+					TxHash:    btcacc.Hash(newOut.Hash),
+					Index:     newOut.Index,
+					Height:    c.CurrentHeight,
+					Coinbase:  txnum == 0,
+					Amt:       out.Value,
+					PkScript:  out.PkScript,
+				}
 				c.totalScore += out.Value
 				fmt.Printf("got utxo %s with %d satoshis! Now have %d in %d utxos\n",
 					newOut.String(), out.Value, c.totalScore, len(c.utxoStore))
@@ -147,26 +260,130 @@ func (c *Csn) putBlockInPollard(
 
 	plusstart := time.Now()
 
-	nl, h := c.pollard.ReconstructStats()
-
-	_, outCount, _, outskip := util.DedupeBlock(ub.Block)
+	delHashes, outCount, outskip, err := c.checkUBlock(ub)
+	if err != nil {
+		return err
+	}
 
-	err := ub.ProofSanity(nl, h)
+	nl, h := c.pollard.ReconstructStats()
+	err = ub.ProofSanity(nl, h)
 	if err != nil {
 		return fmt.Errorf(
 			"uData missing utxo data for block %d err: %s",
 			ub.UtreexoData.Height, err.Error())
 	}
 
+	*totalDels += len(ub.UtreexoData.AccProof.Targets) // for benchmarking
+
+	// Fills in the empty(nil) nieces for verification && deletion
+	err = c.pollard.IngestBatchProof(delHashes, ub.UtreexoData.AccProof, false)
+	if err != nil {
+		fmt.Printf("height %d ingest error\n", ub.UtreexoData.Height)
+		fmt.Printf("proof %s\n", ub.UtreexoData.AccProof.ToString())
+		return err
+	}
+
+	// get hashes to add into the accumulator
+	blockAdds := c.blockAdds(ub, outCount, outskip)
+	*totalTXOAdded += len(blockAdds) // for benchmarking
+
+	// Utreexo tree modification. blockAdds are the added txos and
+	// AccProof.Targets are the positions of the leaves to delete
+	_, err = c.pollard.Modify(blockAdds, ub.UtreexoData.AccProof.Targets)
+	if err != nil {
+
+		return fmt.Errorf("csn h %d modify %s", c.CurrentHeight, err.Error())
+	}
+
+	donetime := time.Now()
+	plustime += donetime.Sub(plusstart)
+
+	return nil
+}
+
+// putRangeInPollard checks the blocks of a range like putBlockInPollard, then
+// takes the pollard through all of them with the range proof instead of each
+// block's own proof.  The adds are made from the blocks, so only the deleted
+// positions come from the range proof, and those get checked as they go.
+// The first block is at the current height.
+func (c *Csn) putRangeInPollard(ubs []uwire.UBlock, rp accumulator.RangeProof,
+	totalTXOAdded, totalDels *int) error {
+
+	if len(rp.Blocks) != len(ubs) {
+		return fmt.Errorf("range proof for %d blocks but got %d",
+			len(rp.Blocks), len(ubs))
+	}
+	start := c.CurrentHeight
+	defer func() {
+		c.CurrentHeight = start
+	}()
+
+	delHashes := make([][]accumulator.Hash, len(ubs))
+	deleted := make(map[accumulator.Hash]bool)
+	outCounts := make([]uint32, len(ubs))
+	outskips := make([][]uint32, len(ubs))
+	for i, ub := range ubs {
+		c.CurrentHeight = start + int32(i)
+		var err error
+		delHashes[i], outCounts[i], outskips[i], err = c.checkUBlock(ub)
+		if err != nil {
+			return err
+		}
+		for _, h := range delHashes[i] {
+			deleted[h] = true
+		}
+		*totalDels += len(delHashes[i]) // for benchmarking
+	}
+	for i, ub := range ubs {
+		adds := c.blockAdds(ub, outCounts[i], outskips[i])
+		// what's spent before the range ends has to be remembered until then
+		for j := range adds {
+			adds[j].Remember = adds[j].Remember || deleted[adds[j].Hash]
+		}
+		rp.Blocks[i].Adds = adds
+		*totalTXOAdded += len(adds) // for benchmarking
+	}
+
+	err := c.pollard.IngestRangeProof(rp, delHashes)
+	if err != nil {
+		return fmt.Errorf("csn h %d to %d range proof %s",
+			start, start+int32(len(ubs))-1, err.Error())
+	}
+	return nil
+}
+
+// checkUBlock checks a ublock at the current height against the headers
+// and the block rules, and adds it to the block hash index.  It gives the
+// hashes of the leaves the block deletes, and the output count and skip
+// list for its adds.
+func (c *Csn) checkUBlock(ub uwire.UBlock) (
+	delHashes []accumulator.Hash, outCount uint32, outskip []uint32, err error) {
+
+	// the block has to be the one the header chain has at this height
+	err = c.headers.CheckUBlock(&ub, c.CurrentHeight)
+	if err != nil {
+		return
+	}
+	err = c.blockHashes.Add(c.CurrentHeight, btcacc.Hash(*ub.Block.Hash()))
+	if err != nil {
+		return
+	}
+
+	_, outCount, _, outskip = util.DedupeBlock(ub.Block)
+
+	err = ub.CheckLeafBlockHashes(c.blockHashes)
+	if err != nil {
+		return
+	}
+
 	// make slice of hashes from leafdata. These are the hash commitments
 	// to be proven.
-	delHashes := make([]accumulator.Hash, len(ub.UtreexoData.Stxos))
+	delHashes = make([]accumulator.Hash, len(ub.UtreexoData.Stxos))
 	for i, _ := range ub.UtreexoData.Stxos {
-		delHashes[i] = ub.UtreexoData.Stxos[i].LeafHash()
+		delHashes[i] = ub.UtreexoData.Stxos[i].LeafHashWith(
+			c.pollard.HashScheme(), c.pollard.Hasher())
 	}
 
-	*totalDels += len(ub.UtreexoData.AccProof.Targets) // for benchmarking
-
 	// **************************************
 	// check transactions and signatures here
 	// TODO: it'd be better to do it after IngestBatchProof(),
@@ -177,20 +394,19 @@ func (c *Csn) putBlockInPollard(
 	// thing first.  (Especially since that thing isn't committed to in the
 	// PoW, but the signatures are...
 
-	if c.CheckSignatures {
-		if !ub.CheckBlock(outskip, &c.Params) {
-			return fmt.Errorf("height %d hash %s block invalid",
-				ub.UtreexoData.Height, ub.Block.Hash().String())
-		}
-	}
-
-	// Fills in the empty(nil) nieces for verification && deletion
-	err = c.pollard.IngestBatchProof(delHashes, ub.UtreexoData.AccProof, false)
+	// block and coinbase rules are always checked; the scripts only
+	// if CheckSignatures is set
+	err = ub.CheckBlock(outskip, &c.Params, c.CheckSignatures)
 	if err != nil {
-		fmt.Printf("height %d ingest error\n", ub.UtreexoData.Height)
-		fmt.Printf("proof %s\n", ub.UtreexoData.AccProof.ToString())
-		return err
+		err = fmt.Errorf("hash %s invalid: %w", ub.Block.Hash().String(), err)
 	}
+	return
+}
+
+// blockAdds gives the leaves a block adds, remembering the ones its TTLs
+// say are spent within the lookahead
+func (c *Csn) blockAdds(
+	ub uwire.UBlock, outCount uint32, outskip []uint32) []accumulator.Leaf {
 
 	remember := make([]bool, len(ub.UtreexoData.TxoTTLs))
 	for i, ttl := range ub.UtreexoData.TxoTTLs {
@@ -202,21 +418,7 @@ func (c *Csn) putBlockInPollard(
 		}
 	}
 
-	// get hashes to add into the accumulator
-	blockAdds := uwire.BlockToAddLeaves(
-		ub.Block, remember, outskip, ub.UtreexoData.Height, outCount)
-	*totalTXOAdded += len(blockAdds) // for benchmarking
-
-	// Utreexo tree modification. blockAdds are the added txos and
-	// AccProof.Targets are the positions of the leaves to delete
-	err = c.pollard.Modify(blockAdds, ub.UtreexoData.AccProof.Targets)
-	if err != nil {
-
-		return fmt.Errorf("csn h %d modify %s", c.CurrentHeight, err.Error())
-	}
-
-	donetime := time.Now()
-	plustime += donetime.Sub(plusstart)
-
-	return nil
+	return uwire.BlockToAddLeaves(
+		ub.Block, remember, outskip, ub.UtreexoData.Height, outCount,
+		c.blockHashes, c.pollard.HashScheme(), c.pollard.Hasher())
 }
@@ -0,0 +1,271 @@
+package csn
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// rangeBridge answers ublock, bare ublock and range proof requests on a
+// local port, the way the bridge server does, with ublocks[h] at height h
+// and the range proofs keyed on their start height.  It counts the bytes
+// it sends for blocks from rangeStart on, with and without range proofs.
+type rangeBridge struct {
+	listener   net.Listener
+	rangeStart int32
+
+	mtx        sync.Mutex
+	blockBytes int
+	rangeBytes int
+}
+
+func serveRangeBridge(t *testing.T, ublocks []uwire.UBlock,
+	ranges map[int32]accumulator.RangeProof, rangeStart int32) *rangeBridge {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rb := &rangeBridge{listener: listener, rangeStart: rangeStart}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var request, start, end int32
+				binary.Read(c, binary.BigEndian, &request)
+				switch request {
+				case uwire.RangeProofRequest:
+					binary.Read(c, binary.BigEndian, &start)
+					binary.Read(c, binary.BigEndian, &end)
+					rp, ok := ranges[start]
+					if !ok || start+int32(len(rp.Blocks))-1 != end {
+						return
+					}
+					// the bridge leaves out the adds
+					bare := rp
+					bare.Blocks = make([]accumulator.RangeBlock, len(rp.Blocks))
+					for i, b := range rp.Blocks {
+						bare.Blocks[i].Dels = b.Dels
+					}
+					rb.sent(true, start, bare.SerializeSize())
+					bare.Serialize(c)
+				case uwire.BareUBlockRequest:
+					binary.Read(c, binary.BigEndian, &start)
+					binary.Read(c, binary.BigEndian, &end)
+					for h := start; h <= end && int(h) < len(ublocks); h++ {
+						ub := ublocks[h]
+						ub.UtreexoData.AccProof.Proof = nil
+						rb.sent(true, h, ub.SerializeSize())
+						if ub.Serialize(c) != nil {
+							return
+						}
+					}
+				default:
+					start = request
+					binary.Read(c, binary.BigEndian, &end)
+					for h := start; h <= end && int(h) < len(ublocks); h++ {
+						rb.sent(false, h, ublocks[h].SerializeSize())
+						if ublocks[h].Serialize(c) != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+	return rb
+}
+
+// sent counts n bytes sent for height h
+func (rb *rangeBridge) sent(inRange bool, h int32, n int) {
+	if h < rb.rangeStart {
+		return
+	}
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+	if inRange {
+		rb.rangeBytes += n
+	} else {
+		rb.blockBytes += n
+	}
+}
+
+// catchUp takes the CSN to height the way IBDThread does, a block or a
+// range at a time
+func catchUp(t *testing.T, c *Csn, rangeSize, height int32) (dels int) {
+	chunks := make(chan ibdChunk, 10)
+	go c.chunkReader(chunks, rangeSize, c.CurrentHeight, height, 1000)
+	var totalTXOAdded int
+	for chunk := range chunks {
+		var err error
+		if chunk.rp != nil {
+			err = c.putRangeInPollard(
+				chunk.ubs, *chunk.rp, &totalTXOAdded, &dels)
+		} else {
+			err = c.putBlockInPollard(
+				chunk.ubs[0], &totalTXOAdded, &dels, 0)
+		}
+		if err != nil {
+			t.Fatalf("h %d: %s", c.CurrentHeight, err.Error())
+		}
+		c.CurrentHeight += int32(len(chunk.ubs))
+	}
+	if c.CurrentHeight != height+1 {
+		t.Fatalf("stopped at %d, expect %d", c.CurrentHeight, height+1)
+	}
+	return dels
+}
+
+// TestPutRangeInPollard takes a CSN through 110 blocks, where the last 10
+// spend the first 10 coinbases, once block by block and once with ranges
+// of 10.  The bridge only has the range proof for the last range, so the
+// rest go block by block either way.  Both should end up with the roots
+// the bridge's forest has, and the last range should cost fewer bytes with
+// its range proof than with a proof in every block.
+func TestPutRangeInPollard(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	const height = 110
+	scheme := accumulator.LegacyHash
+	hasher := accumulator.DefaultHasher
+
+	headers := uwire.NewHeaderChain(p)
+	blockHashes := btcacc.NewBlockHashIndex(0)
+	err := blockHashes.Add(0, btcacc.Hash(*p.GenesisHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// forest gets to the start of the range and proves it; stepped goes
+	// block by block for the per-block proofs
+	forest := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, scheme, nil)
+	stepped := accumulator.NewForest(
+		accumulator.RamForest, nil, "", 0, scheme, nil)
+	ublocks := make([]uwire.UBlock, height+1)
+	coinbases := make([]btcacc.LeafData, height+1)
+	var rangeAdds [][]accumulator.Leaf
+	var rangeDels [][]accumulator.Hash
+	prev := &p.GenesisBlock.Header
+	for h := int32(1); h <= height; h++ {
+		ud := btcacc.UData{Height: h, TxoTTLs: []int32{0}}
+		var txs []*wire.MsgTx
+		var dels []accumulator.Hash
+		if h > 100 {
+			// spend the coinbase from 100 blocks ago
+			spent := coinbases[h-100]
+			tx := wire.NewMsgTx(1)
+			tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(
+				(*chainhash.Hash)(&spent.TxHash), 0), nil, nil))
+			tx.AddTxOut(wire.NewTxOut(49*1e8, []byte{txscript.OP_TRUE}))
+			txs = append(txs, tx)
+			ud.Stxos = []btcacc.LeafData{spent}
+			ud.TxoTTLs = []int32{0, 0}
+			dels = []accumulator.Hash{spent.LeafHashWith(scheme, hasher)}
+		}
+		blk := makeBlock(t, prev, h, p, txs...)
+		prev = &blk.MsgBlock().Header
+		err = headers.AddHeader(prev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = blockHashes.Add(h, btcacc.Hash(*blk.Hash()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bh, err := blockHashes.LeafBlockHash(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb := blk.Transactions()[0]
+		coinbases[h] = btcacc.LeafData{BlockHash: bh,
+			TxHash: btcacc.Hash(*cb.Hash()), Height: h, Coinbase: true,
+			Amt: cb.MsgTx().TxOut[0].Value, PkScript: cb.MsgTx().TxOut[0].PkScript}
+
+		adds := uwire.BlockToAddLeaves(blk, nil, nil, h,
+			uint32(len(ud.TxoTTLs)), blockHashes, scheme, hasher)
+		ud.AccProof, err = stepped.ProveBatch(dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = stepped.Modify(adds, ud.AccProof.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ublocks[h] = uwire.UBlock{Block: blk, UtreexoData: ud}
+
+		if h <= 100 {
+			_, err = forest.Modify(adds, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		rangeAdds = append(rangeAdds, adds)
+		rangeDels = append(rangeDels, dels)
+	}
+	rp, _, err := forest.ProveRange(rangeAdds, rangeDels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rb := serveRangeBridge(t, ublocks,
+		map[int32]accumulator.RangeProof{101: rp}, 101)
+	defer rb.listener.Close()
+	var blockBytes int
+	for _, rangeSize := range []int32{0, 10} {
+		c := Csn{
+			pollard:    accumulator.NewPollard(scheme, nil),
+			Params:     *p,
+			headers:    headers,
+			remoteHost: rb.listener.Addr().String(),
+		}
+		c.pollard.Lookahead = 1000
+		c.CurrentHeight = 1
+		c.blockHashes, err = c.initBlockHashes(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dels := catchUp(t, &c, rangeSize, height)
+		if !reflect.DeepEqual(c.pollard.GetRoots(), forest.GetRoots()) {
+			t.Fatalf("range size %d: pollard roots differ from the "+
+				"bridge's", rangeSize)
+		}
+		if dels != 10 {
+			t.Fatalf("range size %d: %d deletes, want 10", rangeSize, dels)
+		}
+
+		rb.mtx.Lock()
+		if rangeSize == 0 {
+			if rb.rangeBytes != 0 {
+				t.Fatal("asked for a range without -rangeproofs")
+			}
+			blockBytes = rb.blockBytes
+		} else {
+			if rb.blockBytes != blockBytes {
+				t.Fatal("blocks in the range came with their proofs")
+			}
+			t.Logf("last 10 blocks: %d bytes with proofs, %d with a "+
+				"range proof", blockBytes, rb.rangeBytes)
+			if rb.rangeBytes >= blockBytes {
+				t.Fatalf("range took %d bytes, block by block %d",
+					rb.rangeBytes, blockBytes)
+			}
+		}
+		rb.mtx.Unlock()
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 // RunIBD calls everything to run IBD
@@ -46,12 +47,15 @@ func RunIBD(cfg *Config, sig chan bool) error {
 	}
 
 	// check on disk for pre-existing state and load it
-	pol, height, utxos, err := initCSNState()
+	pol, height, switchHeight, utxos, err := initCSNState(
+		cfg.hashScheme, cfg.blockHashHeight, cfg.assumeRoots)
 	if err != nil {
 		return fmt.Errorf("initCSNState error: %s", err.Error())
 	}
+	cfg.blockHashHeight = switchHeight
 
 	pol.Lookahead = int32(cfg.lookAhead)
+	pol.SetHashWorkers(cfg.hashWorkers)
 
 	// make a new CSN struct and load the pollard into it
 	c := Csn{
@@ -89,12 +93,14 @@ func RunIBD(cfg *Config, sig chan bool) error {
 			if height%1000 == 0 {
 				fmt.Printf("got to height %d\n", height)
 			}
+		case err := <-c.ErrChan:
+			return err
 		}
 	}
 }
 
 // Start starts up a compact state node, and returns channels for txs and
-// block heights.
+// block heights.  If IBD stops on an error, it's sent on c.ErrChan.
 func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig chan bool) (
 	chan wire.MsgTx, chan int32, error) {
 
@@ -109,10 +115,32 @@ func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig ch
 	// initialize channels
 	c.TxChan = make(chan wire.MsgTx, 10)
 	c.HeightChan = make(chan int32, 10)
+	c.ErrChan = make(chan error, 1)
+	c.checkFailed = make(chan error, 1)
 
 	c.CurrentHeight = height
 	c.Params = cfg.params
 	c.remoteHost = cfg.remoteHost
+	c.p2pHost = cfg.p2pHost
+
+	// get the headers first so we know which blocks to accept
+	c.headers = uwire.NewHeaderChain(&c.Params)
+	err := c.syncHeaders()
+	if err != nil {
+		return nil, nil, fmt.Errorf("header sync: %w", err)
+	}
+	c.blockHashes, err = c.initBlockHashes(cfg.blockHashHeight)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.checkAssumed {
+		go func() {
+			err := c.checkAssumedRoots(*cfg, cfg.assumeRoots)
+			if err != nil {
+				c.checkFailed <- err
+			}
+		}()
+	}
 
 	// start client & connect
 	go c.IBDThread(*cfg, haltSig)
@@ -121,22 +149,69 @@ func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig ch
 }
 
 // initCSNState attempts to load and initialize the CSN state from the disk.
-// If a CSN state is not present, chain is initialized to the genesis
-func initCSNState() (
-	p accumulator.Pollard, height int32, utxos map[wire.OutPoint]btcacc.LeafData, err error) {
+// If a CSN state is not present, chain is initialized to the genesis with
+// a pollard using the given hash scheme, or to the assumed roots if there
+// are any.  It gives the block hash switch-over height to use, which for a
+// pollard on disk is the one it was built with.
+func initCSNState(scheme accumulator.HashScheme, blockHashHeight int32,
+	assumed *assumedRoots) (p accumulator.Pollard, height, switchHeight int32,
+	utxos map[wire.OutPoint]btcacc.LeafData, err error) {
 
 	// bool to check if the pollarddata is present
 	pollardInitialized := util.HasAccess(PollardFilePath)
 
 	if pollardInitialized {
 		fmt.Println("Has access to forestdata, resuming")
-		height, p, utxos, err = restorePollard()
+		var saved int32
+		height, saved, p, utxos, err = restorePollard()
 		if err != nil {
 			err = fmt.Errorf("restorePollard error: %s", err.Error())
 			return
 		}
+		if p.HashScheme() != scheme {
+			err = fmt.Errorf("pollard on disk uses hash scheme %s but "+
+				"-hashscheme=%s", p.HashScheme(), scheme)
+			return
+		}
+		switchHeight, err = btcacc.ResumeSwitchHeight(saved, blockHashHeight)
+		if err != nil {
+			err = fmt.Errorf("pollard on disk: %s", err.Error())
+			return
+		}
+		if assumed != nil {
+			fmt.Printf("resuming from pollard on disk at height %d, "+
+				"not from -assumeroots\n", height)
+		}
+		return
+	}
+
+	// a new pollard; leaves commit to block hashes from genesis unless
+	// told otherwise
+	switchHeight = blockHashHeight
+	if switchHeight == btcacc.NoSwitchHeight {
+		switchHeight = 0
+	}
+	if assumed != nil {
+		fmt.Printf("Creating pollarddata from roots assumed at height %d\n",
+			assumed.height)
+		p, err = accumulator.NewPollardFromRoots(assumed.numLeaves,
+			assumed.roots, scheme, accumulator.DefaultHasher)
+		if err != nil {
+			err = fmt.Errorf("-assumeroots: %s", err.Error())
+			return
+		}
+		// the next block is the one after the assumed height
+		height = assumed.height + 1
+		utxos = make(map[wire.OutPoint]btcacc.LeafData)
+		_, err = os.OpenFile(PollardFilePath, os.O_CREATE, 0600)
+		if err != nil {
+			err = fmt.Errorf("Open pollard file %s error: %s",
+				PollardFilePath, err.Error())
+			return
+		}
 	} else {
 		fmt.Println("Creating new pollarddata")
+		p = accumulator.NewPollard(scheme, accumulator.DefaultHasher)
 		// start at height 1
 		height = 1
 		utxos = make(map[wire.OutPoint]btcacc.LeafData)
@@ -11,22 +11,54 @@ import (
 	"github.com/mit-dci/utreexo/btcacc"
 )
 
-// restorePollard restores the pollard from disk to memory.
-// If starting anew, it just returns a empty pollard.
-func restorePollard() (height int32, p accumulator.Pollard,
+// pollardFileMarker starts pollard files that have a version.  Older files
+// start with their utxo count there, which is never this.
+const pollardFileMarker uint32 = 0xffffffff
+
+// pollardFileVersion 1 has the block hash switch-over height after the
+// version, then what older files have
+const pollardFileVersion uint8 = 1
+
+// restorePollard restores the pollard from disk to memory, along with the
+// block hash switch-over height it was built with.  That's
+// btcacc.NoSwitchHeight for pollards saved before it was.
+func restorePollard() (height, switchHeight int32, p accumulator.Pollard,
 	utxos map[wire.OutPoint]btcacc.LeafData, err error) {
 	// Restore Pollard
 	pollardFile, err := os.OpenFile(PollardFilePath, os.O_RDWR, 0600)
 	if err != nil {
 		return
 	}
+	defer pollardFile.Close()
 
-	// restore utxos
 	var numUtxos uint32
 	err = binary.Read(pollardFile, binary.BigEndian, &numUtxos)
 	if err != nil {
 		return
 	}
+	switchHeight = btcacc.NoSwitchHeight
+	if numUtxos == pollardFileMarker {
+		var version uint8
+		err = binary.Read(pollardFile, binary.BigEndian, &version)
+		if err != nil {
+			return
+		}
+		if version != pollardFileVersion {
+			err = fmt.Errorf("pollard file version %d, only know %d",
+				version, pollardFileVersion)
+			return
+		}
+		err = binary.Read(pollardFile, binary.BigEndian, &switchHeight)
+		if err != nil {
+			return
+		}
+		err = binary.Read(pollardFile, binary.BigEndian, &numUtxos)
+		if err != nil {
+			return
+		}
+	}
+
+	// restore utxos
 
 	utxos = make(map[wire.OutPoint]btcacc.LeafData)
 	for ; numUtxos > 0; numUtxos-- {
@@ -62,7 +94,20 @@ func restorePollard() (height int32, p accumulator.Pollard,
 // user restarts, they'll be able to resume.
 // Saves height for ibdsim and pollard itself
 func saveIBDsimData(csn *Csn) error {
-	polFile, err := os.OpenFile(PollardFilePath, os.O_WRONLY, 0600)
+	polFile, err := os.OpenFile(PollardFilePath, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = binary.Write(polFile, binary.BigEndian, pollardFileMarker)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(polFile, binary.BigEndian, pollardFileVersion)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(polFile, binary.BigEndian, csn.blockHashes.SwitchHeight)
 	if err != nil {
 		return err
 	}
@@ -5,6 +5,7 @@ go 1.12
 require (
 	github.com/adiabat/bech32 v0.0.0-20170505011816-6289d404861d
 	github.com/btcsuite/btcd v0.21.0-beta.0.20201124191514-610bb55ae85c
+	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f
 	github.com/btcsuite/btcutil v1.0.3-0.20201208143702-a53e38424cce
 	github.com/dvyukov/go-fuzz v0.0.0-20210914135545-4980593459a1 // indirect
 	github.com/syndtr/goleveldb v1.0.1-0.20200815110645-5c35d600f0ca
@@ -0,0 +1,131 @@
+package wire
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+)
+
+// RuleError is what CheckBlock returns when a block breaks a consensus rule.
+// Rule names the rule using the btcd blockchain error codes, so callers can
+// switch on it instead of parsing strings.
+type RuleError struct {
+	Height      int32
+	Rule        blockchain.ErrorCode
+	Description string
+}
+
+// Error prints the height, the rule violated, and why.
+func (e RuleError) Error() string {
+	return fmt.Sprintf("height %d block fails %s: %s",
+		e.Height, e.Rule.String(), e.Description)
+}
+
+// ruleError makes a RuleError for the given height
+func ruleError(height int32, rule blockchain.ErrorCode, desc string) RuleError {
+	return RuleError{Height: height, Rule: rule, Description: desc}
+}
+
+// toRuleError turns an error from the btcd blockchain package into a
+// RuleError.  Errors which aren't btcd rule errors are passed through.
+func toRuleError(height int32, err error) error {
+	e, ok := err.(blockchain.RuleError)
+	if !ok {
+		return err
+	}
+	return ruleError(height, e.ErrorCode, e.Description)
+}
+
+// txError is toRuleError for an error from checking tx, with its txid in
+// the description
+func txError(height int32, tx *btcutil.Tx, err error) error {
+	e, ok := toRuleError(height, err).(RuleError)
+	if !ok {
+		return fmt.Errorf("height %d tx %s: %w", height, tx.Hash().String(), err)
+	}
+	e.Description = fmt.Sprintf("tx %s: %s", tx.Hash().String(), e.Description)
+	return e
+}
+
+// checkBlockSanity does the context-free block checks: proof of work against
+// the network limit, timestamp, coinbase position, transaction sanity, merkle
+// root, duplicate txs, legacy sigops, block size and weight, and the witness
+// commitment if there's any witness data in the block.
+func checkBlockSanity(blk *btcutil.Block, height int32, p *chaincfg.Params) error {
+	err := blockchain.CheckBlockSanity(
+		blk, p.PowLimit, blockchain.NewMedianTime())
+	if err != nil {
+		return toRuleError(height, err)
+	}
+
+	weight := blockchain.GetBlockWeight(blk)
+	if weight > blockchain.MaxBlockWeight {
+		return ruleError(height, blockchain.ErrBlockWeightTooHigh,
+			fmt.Sprintf("weight %d exceeds max %d",
+				weight, blockchain.MaxBlockWeight))
+	}
+
+	// blocks without witness data have nothing for the commitment to cover,
+	// so only check it when there's witness data
+	if blockHasWitness(blk) {
+		err = blockchain.ValidateWitnessCommitment(blk)
+		if err != nil {
+			return toRuleError(height, err)
+		}
+	}
+	return nil
+}
+
+// checkBlockContext does the checks that need to know the block height but
+// not the utxo set: the version soft-forks (BIP34/65/66) and the BIP34
+// height in the coinbase.
+func checkBlockContext(blk *btcutil.Block, height int32, p *chaincfg.Params) error {
+	header := &blk.MsgBlock().Header
+	err := checkHeaderVersion(header, height, p)
+	if err != nil {
+		return err
+	}
+
+	if blockchain.ShouldHaveSerializedBlockHeight(header) &&
+		height >= p.BIP0034Height {
+		cbHeight, err := blockchain.ExtractCoinbaseHeight(blk.Transactions()[0])
+		if err != nil {
+			return toRuleError(height, err)
+		}
+		if cbHeight != height {
+			return ruleError(height, blockchain.ErrBadCoinbaseHeight,
+				fmt.Sprintf("coinbase says height %d", cbHeight))
+		}
+	}
+	return nil
+}
+
+// checkCoinbaseValue makes sure the coinbase doesn't pay out more than the
+// subsidy plus the fees from all the other transactions in the block.
+func checkCoinbaseValue(
+	blk *btcutil.Block, height int32, fees int64, p *chaincfg.Params) error {
+
+	var cbOut int64
+	for _, out := range blk.Transactions()[0].MsgTx().TxOut {
+		cbOut += out.Value
+	}
+	maxOut := blockchain.CalcBlockSubsidy(height, p) + fees
+	if cbOut > maxOut {
+		return ruleError(height, blockchain.ErrBadCoinbaseValue,
+			fmt.Sprintf("coinbase pays %d but subsidy + fees is %d",
+				cbOut, maxOut))
+	}
+	return nil
+}
+
+// blockHasWitness says if any tx in the block carries witness data
+func blockHasWitness(blk *btcutil.Block) bool {
+	for _, tx := range blk.MsgBlock().Transactions {
+		if tx.HasWitness() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package wire
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// makeCoinbaseBlock makes a regtest block at the given height with only
+// a coinbase paying out amt, and grinds the nonce to meet the regtest target.
+func makeCoinbaseBlock(
+	t *testing.T, height int32, amt int64, p *chaincfg.Params) *wire.MsgBlock {
+
+	sigScript, err := txscript.NewScriptBuilder().
+		AddInt64(int64(height)).AddInt64(0).Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := wire.NewMsgTx(1)
+	cb.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: *wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex),
+		SignatureScript:  sigScript,
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	cb.AddTxOut(wire.NewTxOut(amt, []byte{txscript.OP_TRUE}))
+
+	blk := wire.NewMsgBlock(&wire.BlockHeader{
+		Version:   4,
+		PrevBlock: *p.GenesisHash,
+		Timestamp: time.Unix(p.GenesisBlock.Header.Timestamp.Unix()+600, 0),
+		Bits:      p.PowLimitBits,
+	})
+	blk.AddTransaction(cb)
+	merkles := blockchain.BuildMerkleTreeStore(
+		btcutil.NewBlock(blk).Transactions(), false)
+	blk.Header.MerkleRoot = *merkles[len(merkles)-1]
+	solveHeader(t, &blk.Header)
+	return blk
+}
+
+// solveHeader increments the nonce until the hash is under the header's bits
+func solveHeader(t *testing.T, hdr *wire.BlockHeader) {
+	target := blockchain.CompactToBig(hdr.Bits)
+	for ; hdr.Nonce < 1<<20; hdr.Nonce++ {
+		hash := hdr.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			return
+		}
+	}
+	t.Fatal("couldn't solve regtest header")
+}
+
+// checkRule runs CheckBlock and makes sure it fails with the given rule,
+// or passes if want is nil
+func checkRule(t *testing.T, ub *UBlock, p *chaincfg.Params,
+	want *blockchain.ErrorCode) {
+
+	err := ub.CheckBlock(nil, p, true)
+	if want == nil {
+		if err != nil {
+			t.Fatalf("valid block failed: %s", err.Error())
+		}
+		return
+	}
+	var rerr RuleError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected RuleError %s, got %v", want.String(), err)
+	}
+	if rerr.Rule != *want {
+		t.Fatalf("expected %s, got %s", want.String(), rerr.Error())
+	}
+}
+
+func TestCheckBlockRules(t *testing.T) {
+	// turn on BIP34 from height 1 so the coinbase height is checked
+	p := chaincfg.RegressionNetParams
+	p.BIP0034Height = 1
+	subsidy := blockchain.CalcBlockSubsidy(1, &p)
+
+	// a coinbase-only block claiming exactly the subsidy is fine
+	ub := UBlock{Block: btcutil.NewBlock(makeCoinbaseBlock(t, 1, subsidy, &p))}
+	ub.UtreexoData.Height = 1
+	checkRule(t, &ub, &p, nil)
+
+	// claiming 1 more satoshi than subsidy + fees is not
+	ub.Block = btcutil.NewBlock(makeCoinbaseBlock(t, 1, subsidy+1, &p))
+	code := blockchain.ErrBadCoinbaseValue
+	checkRule(t, &ub, &p, &code)
+
+	// right block, wrong height in the coinbase
+	ub.Block = btcutil.NewBlock(makeCoinbaseBlock(t, 2, subsidy, &p))
+	code = blockchain.ErrBadCoinbaseHeight
+	checkRule(t, &ub, &p, &code)
+
+	// header that doesn't commit to the transactions
+	msgBlock := makeCoinbaseBlock(t, 1, subsidy, &p)
+	msgBlock.Header.MerkleRoot[0] ^= 1
+	solveHeader(t, &msgBlock.Header)
+	ub.Block = btcutil.NewBlock(msgBlock)
+	code = blockchain.ErrBadMerkleRoot
+	checkRule(t, &ub, &p, &code)
+}
+
+// TestTxError makes sure a failing tx's id ends up in the error, and rule
+// errors stay RuleErrors
+func TestTxError(t *testing.T) {
+	tx := btcutil.NewTx(wire.NewMsgTx(1))
+	txid := tx.Hash().String()
+
+	err := txError(5, tx, blockchain.RuleError{
+		ErrorCode: blockchain.ErrSpendTooHigh, Description: "too much"})
+	var rerr RuleError
+	if !errors.As(err, &rerr) || rerr.Rule != blockchain.ErrSpendTooHigh ||
+		rerr.Height != 5 {
+		t.Fatalf("expected ErrSpendTooHigh at 5, got %v", err)
+	}
+	if !strings.Contains(err.Error(), txid) {
+		t.Fatalf("%q doesn't have txid %s", err.Error(), txid)
+	}
+
+	other := errors.New("script broke")
+	err = txError(5, tx, other)
+	if !errors.Is(err, other) || !strings.Contains(err.Error(), txid) {
+		t.Fatalf("expected %q wrapped with txid %s, got %v", other, txid, err)
+	}
+}
@@ -0,0 +1,204 @@
+package wire
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// handshakeTimeout is how long a bridge gets to finish the version / verack
+// handshake
+const handshakeTimeout = 10 * time.Second
+
+// BridgePeer is a connection to a bridge over the bitcoin p2p protocol.  It
+// does one request at a time.
+type BridgePeer struct {
+	peer *peer.Peer
+
+	mu sync.Mutex
+	// the utreexo messages and notfounds from the bridge
+	msgs chan wire.Message
+	// closed once the bridge is disconnected
+	quit chan struct{}
+}
+
+// ConnectBridge connects to the bridge at remoteServer and does the
+// handshake
+func ConnectBridge(remoteServer string, params *chaincfg.Params) (
+	*BridgePeer, error) {
+
+	d := net.Dialer{Timeout: 2 * time.Second}
+	c, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return nil, err
+	}
+	return NewBridgePeer(c, remoteServer, BridgePeerConfig(params))
+}
+
+// BridgePeerConfig is the peer config CSNs connect to bridges with
+func BridgePeerConfig(params *chaincfg.Params) peer.Config {
+	return peer.Config{
+		UserAgentName:    "utreexo-csn",
+		UserAgentVersion: "0.1",
+		ChainParams:      params,
+	}
+}
+
+// NewBridgePeer does the handshake with the bridge at addr over c, and
+// makes sure it's a bridge.  cfg's listeners are replaced.
+func NewBridgePeer(c net.Conn, addr string, cfg peer.Config) (
+	*BridgePeer, error) {
+
+	bp := &BridgePeer{
+		msgs: make(chan wire.Message, 16),
+		quit: make(chan struct{}),
+	}
+	verack := make(chan struct{})
+	cfg.Listeners = peer.MessageListeners{
+		OnVerAck: func(p *peer.Peer, msg *wire.MsgVerAck) {
+			close(verack)
+		},
+		OnNotFound: func(p *peer.Peer, msg *wire.MsgNotFound) {
+			bp.received(msg)
+		},
+	}
+	p, err := peer.NewOutboundPeer(&cfg, addr)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	bp.peer = p
+	p.AssociateConnection(NewMsgConn(c, cfg.ChainParams.Net, bp.received))
+	go func() {
+		p.WaitForDisconnect()
+		close(bp.quit)
+	}()
+
+	select {
+	case <-verack:
+	case <-bp.quit:
+		return nil, fmt.Errorf("%s hung up during the handshake", addr)
+	case <-time.After(handshakeTimeout):
+		bp.Close()
+		return nil, fmt.Errorf("%s didn't finish the handshake", addr)
+	}
+	if p.Services()&SFNodeUtreexo == 0 {
+		bp.Close()
+		return nil, fmt.Errorf("%s isn't a utreexo bridge, services %s",
+			addr, p.Services().String())
+	}
+	return bp, nil
+}
+
+// received is called by the peer with every utreexo message and notfound
+func (bp *BridgePeer) received(msg wire.Message) {
+	select {
+	case bp.msgs <- msg:
+	case <-bp.quit:
+	}
+}
+
+// next waits for the bridge's next message
+func (bp *BridgePeer) next() (wire.Message, error) {
+	select {
+	case msg := <-bp.msgs:
+		return msg, nil
+	case <-bp.quit:
+		return nil, fmt.Errorf("%s hung up", bp.peer.Addr())
+	}
+}
+
+// GetUBlocks asks for the ublocks from fromHeight up to and including
+// toHeight, and puts them in blockChan in order.  It gives an error if the
+// bridge doesn't have them all.
+func (bp *BridgePeer) GetUBlocks(
+	blockChan chan UBlock, fromHeight, toHeight int32) error {
+
+	if toHeight < fromHeight {
+		return fmt.Errorf("GetUBlocks: %d to %d is backwards",
+			fromHeight, toHeight)
+	}
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.peer.QueueMessage(
+		&MsgGetUData{FromHeight: fromHeight, ToHeight: toHeight}, nil)
+
+	for h := fromHeight; h <= toHeight; h++ {
+		msg, err := bp.next()
+		if err != nil {
+			return fmt.Errorf("GetUBlocks at %d: %s", h, err.Error())
+		}
+		switch m := msg.(type) {
+		case *MsgUBlock:
+			if m.UtreexoData.Height != h {
+				return fmt.Errorf("GetUBlocks: asked for %d, got %d",
+					h, m.UtreexoData.Height)
+			}
+			blockChan <- m.UBlock
+		case *wire.MsgNotFound:
+			return fmt.Errorf("GetUBlocks: %s has nothing from %d on",
+				bp.peer.Addr(), h)
+		default:
+			return fmt.Errorf("GetUBlocks: asked for %d, got %s",
+				h, msg.Command())
+		}
+	}
+	return nil
+}
+
+// GetRoots asks for the numLeaves and roots after the block at height
+func (bp *BridgePeer) GetRoots(height int32) (
+	numLeaves uint64, roots []accumulator.Hash, err error) {
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.peer.QueueMessage(&MsgGetUtreexoRoots{Height: height}, nil)
+
+	msg, err := bp.next()
+	if err != nil {
+		return 0, nil, fmt.Errorf("GetRoots: %s", err.Error())
+	}
+	switch m := msg.(type) {
+	case *MsgUtreexoRoots:
+		if m.Height != height {
+			return 0, nil, fmt.Errorf("GetRoots: asked for %d, got %d",
+				height, m.Height)
+		}
+		return m.NumLeaves, m.Roots, nil
+	case *wire.MsgNotFound:
+		return 0, nil, fmt.Errorf("GetRoots: %s has no roots for height %d",
+			bp.peer.Addr(), height)
+	}
+	return 0, nil, fmt.Errorf("GetRoots: asked for %d, got %s",
+		height, msg.Command())
+}
+
+// Close hangs up on the bridge
+func (bp *BridgePeer) Close() {
+	bp.peer.Disconnect()
+	bp.peer.WaitForDisconnect()
+}
+
+// UblockPeerReader is UblockNetworkReader over p2p.  It gets the ublocks
+// from curHeight up to and including endHeight from the bridge at
+// remoteServer, and closes blockChan when it's done or the bridge stops.
+func UblockPeerReader(blockChan chan UBlock, remoteServer string,
+	params *chaincfg.Params, curHeight, endHeight int32) {
+
+	defer close(blockChan)
+	bp, err := ConnectBridge(remoteServer, params)
+	if err != nil {
+		panic(err)
+	}
+	defer bp.Close()
+	err = bp.GetUBlocks(blockChan, curHeight, endHeight)
+	if err != nil {
+		fmt.Printf("UblockPeerReader: %s\n", err.Error())
+	}
+}
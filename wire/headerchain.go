@@ -0,0 +1,334 @@
+package wire
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// medianTimeBlocks is how many previous headers the median time past
+// is taken over
+const medianTimeBlocks = 11
+
+// headerNode is a header that's passed validation, along with where it is
+// in the header tree and how much work is behind it.
+type headerNode struct {
+	header  wire.BlockHeader
+	hash    chainhash.Hash
+	height  int32
+	workSum *big.Int
+	parent  *headerNode
+}
+
+// HeaderChain is a tree of validated block headers, starting at genesis.
+// Every header added has had its proof of work, difficulty, timestamp,
+// version and checkpoints checked.  The branch with the most work is the
+// best chain, and blocks are only accepted if they match it.
+type HeaderChain struct {
+	params     *chaincfg.Params
+	timeSource blockchain.MedianTimeSource
+
+	// every valid header we know about, including ones off the best chain
+	index map[chainhash.Hash]*headerNode
+
+	// the most-work chain, indexed by height
+	bestChain []*headerNode
+
+	// checkpoint heights to hashes from the params
+	checkpoints map[int32]chainhash.Hash
+
+	// retargeting params, in seconds / blocks like bitcoind
+	blocksPerRetarget   int32
+	minRetargetTimespan int64
+	maxRetargetTimespan int64
+	targetTimespan      int64
+
+	// regtest never retargets in bitcoind.  The btcd we build against has
+	// no PoWNoRetargeting in its params, so this goes by the network magic.
+	noRetarget bool
+}
+
+// NewHeaderChain makes a header chain for the given network with only the
+// genesis header in it.
+func NewHeaderChain(p *chaincfg.Params) *HeaderChain {
+	hc := HeaderChain{
+		params:      p,
+		timeSource:  blockchain.NewMedianTime(),
+		index:       make(map[chainhash.Hash]*headerNode),
+		checkpoints: make(map[int32]chainhash.Hash),
+		noRetarget:  p.Net == chaincfg.RegressionNetParams.Net,
+	}
+	hc.targetTimespan = int64(p.TargetTimespan / time.Second)
+	hc.blocksPerRetarget = int32(p.TargetTimespan / p.TargetTimePerBlock)
+	hc.minRetargetTimespan = hc.targetTimespan / p.RetargetAdjustmentFactor
+	hc.maxRetargetTimespan = hc.targetTimespan * p.RetargetAdjustmentFactor
+
+	for _, cp := range p.Checkpoints {
+		hc.checkpoints[cp.Height] = *cp.Hash
+	}
+
+	genesis := &headerNode{
+		header:  p.GenesisBlock.Header,
+		hash:    *p.GenesisHash,
+		workSum: blockchain.CalcWork(p.GenesisBlock.Header.Bits),
+	}
+	hc.index[genesis.hash] = genesis
+	hc.bestChain = []*headerNode{genesis}
+	return &hc
+}
+
+// BestHeight is the height of the tip of the most-work chain
+func (hc *HeaderChain) BestHeight() int32 {
+	return int32(len(hc.bestChain) - 1)
+}
+
+// HashAt gives the hash of the best chain header at the given height.
+// Returns false if the best chain doesn't go that high.
+func (hc *HeaderChain) HashAt(height int32) (chainhash.Hash, bool) {
+	if height < 0 || height > hc.BestHeight() {
+		return chainhash.Hash{}, false
+	}
+	return hc.bestChain[height].hash, true
+}
+
+// HeaderAt gives the best chain header at the given height.  Returns false
+// if the best chain doesn't go that high.
+func (hc *HeaderChain) HeaderAt(height int32) (wire.BlockHeader, bool) {
+	if height < 0 || height > hc.BestHeight() {
+		return wire.BlockHeader{}, false
+	}
+	return hc.bestChain[height].header, true
+}
+
+// CheckUBlock makes sure a ublock is the block the best header chain has at
+// the given height.  Since the block hash is the header hash, and the header
+// commits to the merkle root, this ties the block contents to the header's
+// proof of work.
+func (hc *HeaderChain) CheckUBlock(ub *UBlock, height int32) error {
+	if ub.UtreexoData.Height != height {
+		return fmt.Errorf("expected height %d but udata says %d",
+			height, ub.UtreexoData.Height)
+	}
+	want, ok := hc.HashAt(height)
+	if !ok {
+		return fmt.Errorf("no validated header at height %d (header tip %d)",
+			height, hc.BestHeight())
+	}
+	if *ub.Block.Hash() != want {
+		return fmt.Errorf("height %d block %s but header chain has %s",
+			height, ub.Block.Hash().String(), want.String())
+	}
+	return nil
+}
+
+// AddHeader validates a header and adds it to the header tree.  If it gives
+// a branch with more work than the current best chain, that branch becomes
+// the best chain.  Headers already known are ignored.  A header which breaks
+// a consensus rule gives a RuleError.
+func (hc *HeaderChain) AddHeader(header *wire.BlockHeader) error {
+	hash := header.BlockHash()
+	if _, known := hc.index[hash]; known {
+		return nil
+	}
+	parent, ok := hc.index[header.PrevBlock]
+	if !ok {
+		return ruleError(-1, blockchain.ErrPreviousBlockUnknown,
+			fmt.Sprintf("header %s builds on unknown %s",
+				hash.String(), header.PrevBlock.String()))
+	}
+	height := parent.height + 1
+
+	err := hc.checkHeader(header, &hash, parent)
+	if err != nil {
+		return err
+	}
+
+	node := &headerNode{
+		header: *header,
+		hash:   hash,
+		height: height,
+		parent: parent,
+	}
+	node.workSum = new(big.Int).Add(
+		parent.workSum, blockchain.CalcWork(header.Bits))
+	hc.index[hash] = node
+
+	if node.workSum.Cmp(hc.bestChain[hc.BestHeight()].workSum) > 0 {
+		hc.setBest(node)
+	}
+	return nil
+}
+
+// setBest makes the branch ending at tip the best chain.  Usually tip just
+// extends the current best chain, but it may be a reorg.
+func (hc *HeaderChain) setBest(tip *headerNode) {
+	// walk back from the tip until we hit the current best chain
+	var branch []*headerNode
+	n := tip
+	for n.height > hc.BestHeight() || hc.bestChain[n.height] != n {
+		branch = append(branch, n)
+		n = n.parent
+	}
+	if len(branch) > 1 || tip.parent != hc.bestChain[hc.BestHeight()] {
+		fmt.Printf("header reorg from height %d to %d, fork at %d\n",
+			hc.BestHeight(), tip.height, n.height)
+	}
+	hc.bestChain = hc.bestChain[:n.height+1]
+	for i := len(branch) - 1; i >= 0; i-- {
+		hc.bestChain = append(hc.bestChain, branch[i])
+	}
+}
+
+// checkHeader does all the checks for a header building on parent:
+// proof of work, expected difficulty, median time past, future time,
+// version soft-forks, and checkpoints.
+func (hc *HeaderChain) checkHeader(
+	header *wire.BlockHeader, hash *chainhash.Hash, parent *headerNode) error {
+
+	height := parent.height + 1
+
+	// the bits must be in range and the hash must be under them
+	target := blockchain.CompactToBig(header.Bits)
+	if target.Sign() <= 0 || target.Cmp(hc.params.PowLimit) > 0 {
+		return ruleError(height, blockchain.ErrUnexpectedDifficulty,
+			fmt.Sprintf("target bits %08x out of range", header.Bits))
+	}
+	if blockchain.HashToBig(hash).Cmp(target) > 0 {
+		return ruleError(height, blockchain.ErrHighHash,
+			fmt.Sprintf("hash %s above target %08x", hash.String(), header.Bits))
+	}
+
+	// the bits must be what the retarget rules say
+	expectBits := hc.nextBits(parent, header.Timestamp)
+	if header.Bits != expectBits {
+		return ruleError(height, blockchain.ErrUnexpectedDifficulty,
+			fmt.Sprintf("bits %08x but expected %08x", header.Bits, expectBits))
+	}
+
+	// timestamp after the median of the last 11, and not too far ahead
+	mtp := parent.medianTimePast()
+	if !header.Timestamp.After(mtp) {
+		return ruleError(height, blockchain.ErrTimeTooOld,
+			fmt.Sprintf("time %v not after median %v", header.Timestamp, mtp))
+	}
+	maxTime := hc.timeSource.AdjustedTime().Add(
+		time.Second * blockchain.MaxTimeOffsetSeconds)
+	if header.Timestamp.After(maxTime) {
+		return ruleError(height, blockchain.ErrTimeTooNew,
+			fmt.Sprintf("time %v too far in the future", header.Timestamp))
+	}
+
+	err := checkHeaderVersion(header, height, hc.params)
+	if err != nil {
+		return err
+	}
+
+	// must match any checkpoint at this height, and can't fork off the
+	// best chain below the last checkpoint it's passed
+	cpHash, isCheckpoint := hc.checkpoints[height]
+	if isCheckpoint && cpHash != *hash {
+		return ruleError(height, blockchain.ErrBadCheckpoint,
+			fmt.Sprintf("hash %s but checkpoint is %s",
+				hash.String(), cpHash.String()))
+	}
+	lastCp := hc.lastCheckpointHeight()
+	if height <= lastCp {
+		return ruleError(height, blockchain.ErrForkTooOld,
+			fmt.Sprintf("forks before checkpoint at %d", lastCp))
+	}
+
+	return nil
+}
+
+// lastCheckpointHeight is the height of the highest checkpoint the best
+// chain has reached, or 0 if none
+func (hc *HeaderChain) lastCheckpointHeight() int32 {
+	var last int32
+	for h := range hc.checkpoints {
+		if h <= hc.BestHeight() && h > last {
+			last = h
+		}
+	}
+	return last
+}
+
+// nextBits gives the bits the header after parent must have, the same way
+// as btcd's calcNextRequiredDifficulty.
+func (hc *HeaderChain) nextBits(
+	parent *headerNode, newTime time.Time) uint32 {
+
+	p := hc.params
+	if hc.noRetarget {
+		return parent.header.Bits
+	}
+
+	if (parent.height+1)%hc.blocksPerRetarget != 0 {
+		if !p.ReduceMinDifficulty {
+			return parent.header.Bits
+		}
+		// testnet: min difficulty allowed if it's been a while since the
+		// last block, otherwise the last non-min difficulty
+		allowMin := parent.header.Timestamp.Unix() +
+			int64(p.MinDiffReductionTime/time.Second)
+		if newTime.Unix() > allowMin {
+			return p.PowLimitBits
+		}
+		n := parent
+		for n.parent != nil && n.height%hc.blocksPerRetarget != 0 &&
+			n.header.Bits == p.PowLimitBits {
+			n = n.parent
+		}
+		return n.header.Bits
+	}
+
+	// retarget based on how long the last period took
+	first := parent
+	for i := int32(0); i < hc.blocksPerRetarget-1 && first.parent != nil; i++ {
+		first = first.parent
+	}
+	timespan := parent.header.Timestamp.Unix() - first.header.Timestamp.Unix()
+	if timespan < hc.minRetargetTimespan {
+		timespan = hc.minRetargetTimespan
+	} else if timespan > hc.maxRetargetTimespan {
+		timespan = hc.maxRetargetTimespan
+	}
+
+	newTarget := new(big.Int).Mul(
+		blockchain.CompactToBig(parent.header.Bits), big.NewInt(timespan))
+	newTarget.Div(newTarget, big.NewInt(hc.targetTimespan))
+	if newTarget.Cmp(p.PowLimit) > 0 {
+		newTarget.Set(p.PowLimit)
+	}
+	return blockchain.BigToCompact(newTarget)
+}
+
+// medianTimePast is the median timestamp of this header and the 10
+// before it
+func (n *headerNode) medianTimePast() time.Time {
+	times := make([]int64, 0, medianTimeBlocks)
+	for i := 0; i < medianTimeBlocks && n != nil; i++ {
+		times = append(times, n.header.Timestamp.Unix())
+		n = n.parent
+	}
+	sort.Slice(times, func(a, b int) bool { return times[a] < times[b] })
+	return time.Unix(times[len(times)/2], 0)
+}
+
+// checkHeaderVersion rejects header versions that have been obsoleted by
+// the BIP34, BIP66 and BIP65 soft-forks.
+func checkHeaderVersion(
+	header *wire.BlockHeader, height int32, p *chaincfg.Params) error {
+	if header.Version < 2 && height >= p.BIP0034Height ||
+		header.Version < 3 && height >= p.BIP0066Height ||
+		header.Version < 4 && height >= p.BIP0065Height {
+		return ruleError(height, blockchain.ErrBlockVersionTooOld,
+			fmt.Sprintf("version %d too old", header.Version))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package wire
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// nextHeader makes a solved regtest header on top of prev.  tag goes in the
+// merkle root so that different branches get different hashes.
+func nextHeader(t *testing.T, prev *wire.BlockHeader, tag byte,
+	p *chaincfg.Params) wire.BlockHeader {
+
+	hdr := wire.BlockHeader{
+		Version:   4,
+		PrevBlock: prev.BlockHash(),
+		Timestamp: prev.Timestamp.Add(10 * time.Minute),
+		Bits:      p.PowLimitBits,
+	}
+	hdr.MerkleRoot[0] = tag
+	solveHeader(t, &hdr)
+	return hdr
+}
+
+// makeHeaderChain makes n synthetic headers building on start
+func makeHeaderChain(t *testing.T, start *wire.BlockHeader, n int, tag byte,
+	p *chaincfg.Params) []wire.BlockHeader {
+
+	headers := make([]wire.BlockHeader, n)
+	prev := start
+	for i := range headers {
+		headers[i] = nextHeader(t, prev, tag, p)
+		prev = &headers[i]
+	}
+	return headers
+}
+
+// expectRule makes sure err is a RuleError for the given rule
+func expectRule(t *testing.T, err error, want blockchain.ErrorCode) {
+	var rerr RuleError
+	if !errors.As(err, &rerr) || rerr.Rule != want {
+		t.Fatalf("expected %s, got %v", want.String(), err)
+	}
+}
+
+func TestHeaderChainBuild(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	hc := NewHeaderChain(&p)
+	headers := makeHeaderChain(t, &p.GenesisBlock.Header, 20, 0, &p)
+	for i := range headers {
+		err := hc.AddHeader(&headers[i])
+		if err != nil {
+			t.Fatalf("header %d: %s", i+1, err.Error())
+		}
+	}
+	if hc.BestHeight() != 20 {
+		t.Fatalf("expected height 20, got %d", hc.BestHeight())
+	}
+	hash, ok := hc.HashAt(20)
+	if !ok || hash != headers[19].BlockHash() {
+		t.Fatalf("tip hash wrong")
+	}
+	// adding the same header again changes nothing
+	err := hc.AddHeader(&headers[5])
+	if err != nil || hc.BestHeight() != 20 {
+		t.Fatalf("re-adding header: %v height %d", err, hc.BestHeight())
+	}
+}
+
+func TestHeaderChainReject(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	hc := NewHeaderChain(&p)
+	headers := makeHeaderChain(t, &p.GenesisBlock.Header, 12, 0, &p)
+	for i := range headers {
+		err := hc.AddHeader(&headers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := &headers[len(headers)-1]
+
+	// hash above target
+	bad := nextHeader(t, tip, 1, &p)
+	for {
+		bad.Nonce++
+		hash := bad.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(
+			blockchain.CompactToBig(bad.Bits)) > 0 {
+			break
+		}
+	}
+	expectRule(t, hc.AddHeader(&bad), blockchain.ErrHighHash)
+
+	// valid PoW but not the difficulty the chain calls for
+	bad = nextHeader(t, tip, 2, &p)
+	bad.Bits = 0x207ffffe
+	solveHeader(t, &bad)
+	expectRule(t, hc.AddHeader(&bad), blockchain.ErrUnexpectedDifficulty)
+
+	// timestamp not after the median of the last 11
+	bad = nextHeader(t, tip, 3, &p)
+	bad.Timestamp = headers[len(headers)-7].Timestamp
+	solveHeader(t, &bad)
+	expectRule(t, hc.AddHeader(&bad), blockchain.ErrTimeTooOld)
+
+	// way in the future
+	bad = nextHeader(t, tip, 4, &p)
+	bad.Timestamp = time.Unix(time.Now().Add(24*time.Hour).Unix(), 0)
+	solveHeader(t, &bad)
+	expectRule(t, hc.AddHeader(&bad), blockchain.ErrTimeTooNew)
+
+	// parent we've never seen
+	bad = nextHeader(t, tip, 5, &p)
+	bad.PrevBlock = chainhash.Hash{1}
+	solveHeader(t, &bad)
+	expectRule(t, hc.AddHeader(&bad), blockchain.ErrPreviousBlockUnknown)
+
+	if hc.BestHeight() != 12 {
+		t.Fatalf("bad headers changed height to %d", hc.BestHeight())
+	}
+}
+
+func TestHeaderChainMostWork(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	hc := NewHeaderChain(&p)
+	main := makeHeaderChain(t, &p.GenesisBlock.Header, 15, 0, &p)
+	for i := range main {
+		err := hc.AddHeader(&main[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a fork off height 10 that's shorter doesn't take over
+	fork := makeHeaderChain(t, &main[9], 7, 1, &p)
+	for i := range fork[:4] {
+		err := hc.AddHeader(&fork[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, _ := hc.HashAt(15)
+	if hc.BestHeight() != 15 || hash != main[14].BlockHash() {
+		t.Fatalf("shorter fork became best")
+	}
+
+	// but once it has more work it does
+	for i := range fork[4:] {
+		err := hc.AddHeader(&fork[4+i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hc.BestHeight() != 17 {
+		t.Fatalf("expected fork height 17, got %d", hc.BestHeight())
+	}
+	for h := int32(11); h <= 17; h++ {
+		hash, _ := hc.HashAt(h)
+		if hash != fork[h-11].BlockHash() {
+			t.Fatalf("height %d not on fork", h)
+		}
+	}
+	hash, _ = hc.HashAt(10)
+	if hash != main[9].BlockHash() {
+		t.Fatalf("fork point changed")
+	}
+}
+
+func TestHeaderChainCheckpoint(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	headers := makeHeaderChain(t, &p.GenesisBlock.Header, 10, 0, &p)
+	cpHash := headers[4].BlockHash()
+	p.Checkpoints = []chaincfg.Checkpoint{{Height: 5, Hash: &cpHash}}
+	hc := NewHeaderChain(&p)
+
+	// a branch that doesn't match the checkpoint is rejected at height 5
+	other := makeHeaderChain(t, &p.GenesisBlock.Header, 5, 1, &p)
+	for i := range other[:4] {
+		err := hc.AddHeader(&other[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectRule(t, hc.AddHeader(&other[4]), blockchain.ErrBadCheckpoint)
+
+	for i := range headers {
+		err := hc.AddHeader(&headers[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// once past the checkpoint, can't fork below it
+	late := nextHeader(t, &headers[2], 2, &p)
+	expectRule(t, hc.AddHeader(&late), blockchain.ErrForkTooOld)
+}
+
+func TestHeaderChainCheckUBlock(t *testing.T) {
+	p := chaincfg.RegressionNetParams
+	subsidy := blockchain.CalcBlockSubsidy(1, &p)
+	blk := makeCoinbaseBlock(t, 1, subsidy, &p)
+
+	hc := NewHeaderChain(&p)
+	var ub UBlock
+	ub.UtreexoData.Height = 1
+	ub.Block = btcutil.NewBlock(blk)
+	if hc.CheckUBlock(&ub, 1) == nil {
+		t.Fatal("accepted block above header tip")
+	}
+	err := hc.AddHeader(&blk.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hc.CheckUBlock(&ub, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different block at the same height doesn't match
+	other := makeCoinbaseBlock(t, 1, subsidy-1, &p)
+	ub.Block = btcutil.NewBlock(other)
+	if hc.CheckUBlock(&ub, 1) == nil {
+		t.Fatal("accepted block not in header chain")
+	}
+}
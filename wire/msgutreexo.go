@@ -0,0 +1,309 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+/*
+Utreexo messages for the bitcoin p2p protocol.  They satisfy btcd's
+wire.Message, so a peer.Peer can send them like any other message, and the
+rest of the connection is a normal bitcoin one with the usual version /
+verack handshake, pings and so on.
+
+getudata   FromHeight, ToHeight  ask a bridge for the ublocks in that range
+ublock     a ublock, one per height asked for, in order
+geturoots  Height                ask a bridge for the roots after a block
+uroots     Height, NumLeaves, the roots
+
+A bridge that runs out of ublocks, or has no roots for the height, sends a
+notfound with an InvTypeUBlock or InvTypeUtreexoRoots inv instead.  Bridges
+set SFNodeUtreexo in their version message.
+
+btcd's wire package can't read messages it doesn't know, and a peer hangs
+up on them, so the peer's connection is wrapped with NewMsgConn, which
+takes the utreexo messages out of the stream before the peer sees it.
+*/
+
+const (
+	CmdUBlock          = "ublock"
+	CmdGetUData        = "getudata"
+	CmdUtreexoRoots    = "uroots"
+	CmdGetUtreexoRoots = "geturoots"
+)
+
+// SFNodeUtreexo is the service flag of a bridge that serves ublocks
+const SFNodeUtreexo wire.ServiceFlag = 1 << 24
+
+const (
+	// InvUtreexoFlag is set on inventory types for utreexo data
+	InvUtreexoFlag wire.InvType = 1 << 24
+
+	// InvTypeUBlock is a ublock.  Ublocks always have their witnesses.
+	InvTypeUBlock = wire.InvTypeWitnessBlock | InvUtreexoFlag
+
+	// InvTypeUtreexoRoots is the roots after a block.  They aren't a block
+	// or a tx, so it's just the flag.
+	InvTypeUtreexoRoots = InvUtreexoFlag
+)
+
+// MsgUBlock is a ublock sent over p2p
+type MsgUBlock struct {
+	UBlock
+}
+
+// BtcDecode reads the block then the udata
+func (msg *MsgUBlock) BtcDecode(
+	r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+
+	var msgBlock wire.MsgBlock
+	err := msgBlock.BtcDecode(r, pver, enc)
+	if err != nil {
+		return err
+	}
+	msg.Block = btcutil.NewBlock(&msgBlock)
+	return msg.UtreexoData.Deserialize(r)
+}
+
+// BtcEncode writes the block then the udata
+func (msg *MsgUBlock) BtcEncode(
+	w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+
+	err := msg.Block.MsgBlock().BtcEncode(w, pver, enc)
+	if err != nil {
+		return err
+	}
+	return msg.UtreexoData.Serialize(w)
+}
+
+func (msg *MsgUBlock) Command() string {
+	return CmdUBlock
+}
+
+func (msg *MsgUBlock) MaxPayloadLength(pver uint32) uint32 {
+	return wire.MaxMessagePayload
+}
+
+// MsgGetUData asks for the ublocks from FromHeight up to and including
+// ToHeight
+type MsgGetUData struct {
+	FromHeight, ToHeight int32
+}
+
+func (msg *MsgGetUData) BtcDecode(
+	r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+
+	return binary.Read(r, binary.LittleEndian, msg)
+}
+
+func (msg *MsgGetUData) BtcEncode(
+	w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+
+	return binary.Write(w, binary.LittleEndian, msg)
+}
+
+func (msg *MsgGetUData) Command() string {
+	return CmdGetUData
+}
+
+func (msg *MsgGetUData) MaxPayloadLength(pver uint32) uint32 {
+	return 8
+}
+
+// MsgGetUtreexoRoots asks for the roots after the block at Height
+type MsgGetUtreexoRoots struct {
+	Height int32
+}
+
+func (msg *MsgGetUtreexoRoots) BtcDecode(
+	r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+
+	return binary.Read(r, binary.LittleEndian, &msg.Height)
+}
+
+func (msg *MsgGetUtreexoRoots) BtcEncode(
+	w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+
+	return binary.Write(w, binary.LittleEndian, msg.Height)
+}
+
+func (msg *MsgGetUtreexoRoots) Command() string {
+	return CmdGetUtreexoRoots
+}
+
+func (msg *MsgGetUtreexoRoots) MaxPayloadLength(pver uint32) uint32 {
+	return 4
+}
+
+// MsgUtreexoRoots is the numLeaves and roots after the block at Height.
+// How many roots there are comes from NumLeaves.
+type MsgUtreexoRoots struct {
+	Height    int32
+	NumLeaves uint64
+	Roots     []accumulator.Hash
+}
+
+func (msg *MsgUtreexoRoots) BtcDecode(
+	r io.Reader, pver uint32, enc wire.MessageEncoding) error {
+
+	err := binary.Read(r, binary.LittleEndian, &msg.Height)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(r, binary.LittleEndian, &msg.NumLeaves)
+	if err != nil {
+		return err
+	}
+	msg.Roots = make([]accumulator.Hash, bits.OnesCount64(msg.NumLeaves))
+	for i := range msg.Roots {
+		_, err = io.ReadFull(r, msg.Roots[i][:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (msg *MsgUtreexoRoots) BtcEncode(
+	w io.Writer, pver uint32, enc wire.MessageEncoding) error {
+
+	if len(msg.Roots) != bits.OnesCount64(msg.NumLeaves) {
+		return fmt.Errorf("MsgUtreexoRoots: %d leaves but %d roots",
+			msg.NumLeaves, len(msg.Roots))
+	}
+	err := binary.Write(w, binary.LittleEndian, msg.Height)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, msg.NumLeaves)
+	if err != nil {
+		return err
+	}
+	for _, root := range msg.Roots {
+		_, err = w.Write(root[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (msg *MsgUtreexoRoots) Command() string {
+	return CmdUtreexoRoots
+}
+
+func (msg *MsgUtreexoRoots) MaxPayloadLength(pver uint32) uint32 {
+	return 4 + 8 + (64 * 32)
+}
+
+// makeUtreexoMessage gives an empty message for command, or nil if it isn't
+// a utreexo one
+func makeUtreexoMessage(command string) wire.Message {
+	switch command {
+	case CmdUBlock:
+		return &MsgUBlock{}
+	case CmdGetUData:
+		return &MsgGetUData{}
+	case CmdUtreexoRoots:
+		return &MsgUtreexoRoots{}
+	case CmdGetUtreexoRoots:
+		return &MsgGetUtreexoRoots{}
+	}
+	return nil
+}
+
+// msgConn is a peer's connection with the utreexo messages taken out
+type msgConn struct {
+	net.Conn
+	btcnet wire.BitcoinNet
+	handle func(wire.Message)
+
+	// the header of a message going through to the peer that it hasn't
+	// read yet, then how much of the payload is left
+	header      []byte
+	payloadLeft uint32
+}
+
+// NewMsgConn wraps c, the connection for a btcd peer.Peer on network
+// btcnet.  Utreexo messages read from it go to handle, in order, instead of
+// to the peer; everything else goes through untouched.  handle is called
+// from the peer's reading goroutine, so the peer doesn't read anything more
+// until it returns.
+func NewMsgConn(c net.Conn, btcnet wire.BitcoinNet,
+	handle func(msg wire.Message)) net.Conn {
+
+	return &msgConn{Conn: c, btcnet: btcnet, handle: handle}
+}
+
+func (mc *msgConn) Read(b []byte) (int, error) {
+	for len(mc.header) == 0 && mc.payloadLeft == 0 {
+		err := mc.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(mc.header) != 0 {
+		n := copy(b, mc.header)
+		mc.header = mc.header[n:]
+		return n, nil
+	}
+	if uint32(len(b)) > mc.payloadLeft {
+		b = b[:mc.payloadLeft]
+	}
+	n, err := mc.Conn.Read(b)
+	mc.payloadLeft -= uint32(n)
+	return n, err
+}
+
+// next reads the next message header.  If it's a utreexo message, it reads
+// and handles the whole message.  Otherwise the message is left for the
+// peer, which checks everything about it.
+func (mc *msgConn) next() error {
+	hdr := make([]byte, wire.MessageHeaderSize)
+	_, err := io.ReadFull(mc.Conn, hdr)
+	if err != nil {
+		return err
+	}
+	magic := wire.BitcoinNet(binary.LittleEndian.Uint32(hdr[0:4]))
+	command := string(bytes.TrimRight(hdr[4:16], "\x00"))
+	length := binary.LittleEndian.Uint32(hdr[16:20])
+
+	msg := makeUtreexoMessage(command)
+	if msg == nil || magic != mc.btcnet {
+		mc.header, mc.payloadLeft = hdr, length
+		return nil
+	}
+
+	if length > msg.MaxPayloadLength(wire.ProtocolVersion) {
+		return fmt.Errorf("%s message is %d bytes, max %d", command, length,
+			msg.MaxPayloadLength(wire.ProtocolVersion))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(mc.Conn, payload)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(chainhash.DoubleHashB(payload)[:4], hdr[20:24]) {
+		return fmt.Errorf("%s message checksum %x doesn't match", command,
+			hdr[20:24])
+	}
+	r := bytes.NewReader(payload)
+	err = msg.BtcDecode(r, wire.ProtocolVersion, wire.WitnessEncoding)
+	if err != nil {
+		return fmt.Errorf("%s message: %s", command, err.Error())
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%s message has %d bytes left over", command, r.Len())
+	}
+	mc.handle(msg)
+	return nil
+}
@@ -0,0 +1,98 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// TestMsgConn writes utreexo messages mixed in with standard ones, and checks
+// the standard ones read back through the conn like it isn't there while the
+// utreexo ones go to the handler, the same as they were sent
+func TestMsgConn(t *testing.T) {
+	p := &chaincfg.RegressionNetParams
+	blk := makeCoinbaseBlock(t, 1, 50*1e8, p)
+	// a witness, to check it isn't dropped
+	blk.Transactions[0].TxIn[0].Witness = wire.TxWitness{make([]byte, 32)}
+	ublock := &MsgUBlock{UBlock{
+		Block: btcutil.NewBlock(blk),
+		UtreexoData: btcacc.UData{
+			Height: 1,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{3}, Proof: []accumulator.Hash{{1}, {2}}},
+			Stxos: []btcacc.LeafData{{TxHash: btcacc.Hash{3}, Amt: 7,
+				PkScript: []byte{0x51}}},
+			TxoTTLs: []int32{0},
+		},
+	}}
+	utreexoMsgs := []wire.Message{
+		&MsgGetUData{FromHeight: 1, ToHeight: 1000},
+		ublock,
+		&MsgGetUtreexoRoots{Height: 12},
+		&MsgUtreexoRoots{Height: 12, NumLeaves: 5,
+			Roots: []accumulator.Hash{{4}, {5}}},
+	}
+	sent := []wire.Message{
+		wire.NewMsgPing(1), utreexoMsgs[0], utreexoMsgs[1], wire.NewMsgVerAck(),
+		utreexoMsgs[2], utreexoMsgs[3], wire.NewMsgPong(2),
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		for _, msg := range sent {
+			_, err := wire.WriteMessageWithEncodingN(client, msg,
+				wire.ProtocolVersion, p.Net, wire.WitnessEncoding)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		client.Close()
+	}()
+
+	var handled []wire.Message
+	conn := NewMsgConn(server, p.Net, func(msg wire.Message) {
+		handled = append(handled, msg)
+	})
+	var read []wire.Message
+	for {
+		_, msg, _, err := wire.ReadMessageWithEncodingN(conn,
+			wire.ProtocolVersion, p.Net, wire.WitnessEncoding)
+		if err != nil {
+			break
+		}
+		read = append(read, msg)
+	}
+
+	want := []wire.Message{sent[0], sent[3], sent[6]}
+	if !reflect.DeepEqual(read, want) {
+		t.Fatalf("read %v, expect %v", read, want)
+	}
+	if len(handled) != len(utreexoMsgs) {
+		t.Fatalf("handled %d messages, expect %d",
+			len(handled), len(utreexoMsgs))
+	}
+	for i, msg := range handled {
+		var got, expect bytes.Buffer
+		msg.BtcEncode(&got, wire.ProtocolVersion, wire.WitnessEncoding)
+		utreexoMsgs[i].BtcEncode(&expect, wire.ProtocolVersion,
+			wire.WitnessEncoding)
+		if msg.Command() != utreexoMsgs[i].Command() ||
+			!bytes.Equal(got.Bytes(), expect.Bytes()) {
+			t.Fatalf("handled %s %x, expect %s %x", msg.Command(), got.Bytes(),
+				utreexoMsgs[i].Command(), expect.Bytes())
+		}
+	}
+	got := handled[1].(*MsgUBlock)
+	if *got.Block.Hash() != blk.BlockHash() ||
+		!got.Block.MsgBlock().Transactions[0].HasWitness() {
+		t.Fatal("ublock came back different")
+	}
+}
@@ -1,10 +1,12 @@
 package wire
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
+	"math/bits"
 	"net"
 	"sync"
 	"time"
@@ -20,11 +22,266 @@ import (
 	"github.com/mit-dci/utreexo/util"
 )
 
+// HeaderRequest is sent instead of a start height to ask the bridge for
+// block headers rather than ublocks.  The start and end heights follow it
+// the same way as in a ublock request.
+const HeaderRequest int32 = math.MinInt32
+
+// RootsRequest is sent instead of a start height to ask the bridge for the
+// accumulator roots after a block.  The height of the block follows it.
+const RootsRequest int32 = math.MinInt32 + 1
+
+// ProofRequest is sent instead of a start height to ask the bridge to prove
+// utxos at its tip.  A 4 byte count follows, then that many outpoints as a
+// 32 byte txid and 4 byte index.
+const ProofRequest int32 = math.MinInt32 + 2
+
+// RangeProofRequest is sent instead of a start height to ask the bridge for
+// the range proof of the blocks from a start height to an end height, which
+// follow it.
+const RangeProofRequest int32 = math.MinInt32 + 3
+
+// BareUBlockRequest is sent instead of a start height to ask the bridge for
+// ublocks without the hashes in their accumulator proofs, for use with a
+// range proof.  The start and end heights follow it the same way as in a
+// ublock request.
+const BareUBlockRequest int32 = math.MinInt32 + 4
+
+// GetRootsAtHeight asks the remote host for the numLeaves and roots of the
+// accumulator after the block at height.
+func GetRootsAtHeight(remoteServer string, height int32) (
+	numLeaves uint64, roots []accumulator.Hash, err error) {
+
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return
+	}
+	defer con.Close()
+
+	for _, i := range []int32{RootsRequest, height} {
+		err = binary.Write(con, binary.BigEndian, i)
+		if err != nil {
+			err = fmt.Errorf("GetRootsAtHeight: write error to %s %s",
+				con.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+
+	// the bridge hangs up without sending anything if it doesn't have them
+	err = binary.Read(con, binary.BigEndian, &numLeaves)
+	if err == io.EOF {
+		err = fmt.Errorf("GetRootsAtHeight: %s has no roots for height %d",
+			con.RemoteAddr().String(), height)
+		return
+	}
+	if err != nil {
+		return
+	}
+	roots = make([]accumulator.Hash, bits.OnesCount64(numLeaves))
+	for i := range roots {
+		_, err = io.ReadFull(con, roots[i][:])
+		if err != nil {
+			err = fmt.Errorf("GetRootsAtHeight: read error from %s %s",
+				con.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+	return
+}
+
+// GetRangeProof asks the remote host for the RangeProof for the blocks from
+// start to end.  It comes without the adds, which have to be filled in from
+// the blocks before it can be used.
+func GetRangeProof(remoteServer string, start, end int32) (
+	rp accumulator.RangeProof, err error) {
+
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return
+	}
+	defer con.Close()
+
+	for _, i := range []int32{RangeProofRequest, start, end} {
+		err = binary.Write(con, binary.BigEndian, i)
+		if err != nil {
+			err = fmt.Errorf("GetRangeProof: write error to %s %s",
+				con.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+
+	// the bridge hangs up without sending anything if it doesn't have it
+	err = rp.Deserialize(bufio.NewReader(con))
+	if err == io.EOF {
+		err = fmt.Errorf("GetRangeProof: %s has no range proof from %d to %d",
+			con.RemoteAddr().String(), start, end)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("GetRangeProof: read error from %s %s",
+			con.RemoteAddr().String(), err.Error())
+		return
+	}
+	if len(rp.Blocks) != int(end-start+1) {
+		err = fmt.Errorf("GetRangeProof: asked for %d blocks, got %d",
+			end-start+1, len(rp.Blocks))
+	}
+	return
+}
+
+// GetBareUBlocks asks the remote host for the ublocks from start to end
+// without the hashes in their AccProofs.  The range proof for those blocks
+// has them instead.
+func GetBareUBlocks(remoteServer string, start, end int32) (
+	[]UBlock, error) {
+
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	for _, i := range []int32{BareUBlockRequest, start, end} {
+		err = binary.Write(con, binary.BigEndian, i)
+		if err != nil {
+			return nil, fmt.Errorf("GetBareUBlocks: write error to %s %s",
+				con.RemoteAddr().String(), err.Error())
+		}
+	}
+
+	r := bufio.NewReader(con)
+	ubs := make([]UBlock, end-start+1)
+	for i := range ubs {
+		err = ubs[i].Deserialize(r)
+		if err != nil {
+			return nil, fmt.Errorf("GetBareUBlocks: read error from %s "+
+				"after %d blocks %s",
+				con.RemoteAddr().String(), i, err.Error())
+		}
+		if len(ubs[i].UtreexoData.AccProof.Proof) != 0 {
+			return nil, fmt.Errorf("GetBareUBlocks: %s sent a proof at %d",
+				con.RemoteAddr().String(), start+int32(i))
+		}
+	}
+	return ubs, nil
+}
+
+// GetOutpointProofs asks the remote host to prove outpoints at its tip.
+// It gives the height and numLeaves they're proven at, the LeafData of the
+// outpoints that are utxos there, and a BatchProof whose targets are in the
+// same order as the LeafData.  Outpoints that aren't utxos are left out.
+func GetOutpointProofs(remoteServer string, ops []wire.OutPoint) (
+	height int32, numLeaves uint64, leaves []btcacc.LeafData,
+	bp accumulator.BatchProof, err error) {
+
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return
+	}
+	defer con.Close()
+
+	req := make([]byte, 8, 8+(36*len(ops)))
+	request := ProofRequest
+	binary.BigEndian.PutUint32(req, uint32(request))
+	binary.BigEndian.PutUint32(req[4:], uint32(len(ops)))
+	for _, op := range ops {
+		req = append(req, op.Hash[:]...)
+		req = append(req, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(req[len(req)-4:], op.Index)
+	}
+	_, err = con.Write(req)
+	if err != nil {
+		err = fmt.Errorf("GetOutpointProofs: write error to %s %s",
+			con.RemoteAddr().String(), err.Error())
+		return
+	}
+
+	// the bridge hangs up without sending anything if it can't prove them
+	err = binary.Read(con, binary.BigEndian, &height)
+	if err == io.EOF {
+		err = fmt.Errorf("GetOutpointProofs: %s can't prove outpoints",
+			con.RemoteAddr().String())
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = binary.Read(con, binary.BigEndian, &numLeaves)
+	if err != nil {
+		return
+	}
+	var numFound uint32
+	err = binary.Read(con, binary.BigEndian, &numFound)
+	if err != nil {
+		return
+	}
+	if numFound > uint32(len(ops)) {
+		err = fmt.Errorf("GetOutpointProofs: asked for %d outpoints, got %d",
+			len(ops), numFound)
+		return
+	}
+	leaves = make([]btcacc.LeafData, numFound)
+	for i := range leaves {
+		err = leaves[i].Deserialize(con)
+		if err != nil {
+			err = fmt.Errorf("GetOutpointProofs: read error from %s %s",
+				con.RemoteAddr().String(), err.Error())
+			return
+		}
+	}
+	err = bp.Deserialize(con)
+	if err != nil {
+		err = fmt.Errorf("GetOutpointProofs: read error from %s %s",
+			con.RemoteAddr().String(), err.Error())
+	}
+	return
+}
+
+// GetHeaders asks the remote host for the 80 byte block headers from
+// fromHeight to toHeight, and reads them until the host hangs up.
+func GetHeaders(remoteServer string, fromHeight, toHeight int32) (
+	[]wire.BlockHeader, error) {
+
+	d := net.Dialer{Timeout: 2 * time.Second}
+	con, err := d.Dial("tcp", remoteServer)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+
+	for _, i := range []int32{HeaderRequest, fromHeight, toHeight} {
+		err = binary.Write(con, binary.BigEndian, i)
+		if err != nil {
+			return nil, fmt.Errorf("GetHeaders: write error to %s %s",
+				con.RemoteAddr().String(), err.Error())
+		}
+	}
+
+	var headers []wire.BlockHeader
+	for {
+		var hdr wire.BlockHeader
+		err = hdr.Deserialize(con)
+		if err == io.EOF {
+			return headers, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("GetHeaders: read error from %s after %d "+
+				"headers %s", con.RemoteAddr().String(), len(headers), err.Error())
+		}
+		headers = append(headers, hdr)
+	}
+}
+
 // UblockNetworkReader gets Ublocks from the remote host and puts em in the
-// channel.  It'll try to fill the channel buffer.
+// channel.  It'll try to fill the channel buffer.  It asks for everything
+// from curHeight up to and including endHeight.
 func UblockNetworkReader(
 	blockChan chan UBlock, remoteServer string,
-	curHeight, lookahead int32) {
+	curHeight, endHeight, lookahead int32) {
 
 	d := net.Dialer{Timeout: 2 * time.Second}
 	con, err := d.Dial("tcp", remoteServer)
@@ -36,14 +293,14 @@ func UblockNetworkReader(
 
 	var ub UBlock
 	// var ublen uint32
-	// request range from curHeight to latest block
+	// request range from curHeight to endHeight
 	err = binary.Write(con, binary.BigEndian, curHeight)
 	if err != nil {
 		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
 			con.RemoteAddr().String(), err.Error())
 		panic(e)
 	}
-	err = binary.Write(con, binary.BigEndian, int32(math.MaxInt32))
+	err = binary.Write(con, binary.BigEndian, endHeight)
 	if err != nil {
 		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
 			con.RemoteAddr().String(), err.Error())
@@ -67,17 +324,63 @@ func UblockNetworkReader(
 // BlockToAdds turns all the new utxos in a msgblock into leafTxos
 // uses remember slice up to number of txos, but doesn't check that it's the
 // right length.  Similar with skiplist, doesn't check it.
+// The leaves commit to the block hash if blockHashes says they should at
+// this height, and are hashed with scheme and hasher.
 func BlockToAddLeaves(
 	blk *btcutil.Block,
 	remember []bool,
 	skiplist []uint32,
 	height int32,
-	outCount uint32) (leaves []accumulator.Leaf) {
+	outCount uint32,
+	blockHashes *btcacc.BlockHashIndex,
+	scheme accumulator.HashScheme,
+	hasher accumulator.Hasher) (leaves []accumulator.Leaf) {
 
 	// We're overallocating a little bit since all the unspendables
 	// won't be appended. It's ok though for the pre-allocation savings.
 	leaves = make([]accumulator.Leaf, 0, outCount-uint32(len(skiplist)))
 
+	forEachAddLeaf(blk, skiplist, height, blockHashes,
+		func(txonum uint32, l *btcacc.LeafData) {
+			uleaf := accumulator.Leaf{Hash: l.LeafHashWith(scheme, hasher)}
+			if uint32(len(remember)) > txonum {
+				uleaf.Remember = remember[txonum]
+			}
+			leaves = append(leaves, uleaf)
+		})
+	return
+}
+
+// BlockToAddLeafData gives the LeafData for the same utxos BlockToAddLeaves
+// makes leaves for, in the same order.
+func BlockToAddLeafData(
+	blk *btcutil.Block,
+	skiplist []uint32,
+	height int32,
+	blockHashes *btcacc.BlockHashIndex) (lds []btcacc.LeafData) {
+
+	forEachAddLeaf(blk, skiplist, height, blockHashes,
+		func(_ uint32, l *btcacc.LeafData) {
+			lds = append(lds, *l)
+		})
+	return
+}
+
+// forEachAddLeaf calls f with the txo number in the block and LeafData of
+// every new utxo in blk that goes in the accumulator, skipping unspendables
+// and whatever's on the skiplist.
+func forEachAddLeaf(
+	blk *btcutil.Block,
+	skiplist []uint32,
+	height int32,
+	blockHashes *btcacc.BlockHashIndex,
+	f func(txonum uint32, l *btcacc.LeafData)) {
+
+	var bh [32]byte
+	if blockHashes.Commits(height) {
+		bh = *blk.Hash()
+	}
+
 	var txonum uint32
 	for coinbaseif0, tx := range blk.Transactions() {
 		// cache txid aka txhash
@@ -96,8 +399,7 @@ func BlockToAddLeaves(
 			}
 
 			var l btcacc.LeafData
-			// TODO put blockhash back in -- leaving empty for now!
-			// l.BlockHash = bh
+			l.BlockHash = bh
 			l.TxHash = btcacc.Hash(*txid)
 			l.Index = uint32(i)
 			l.Height = height
@@ -106,15 +408,10 @@ func BlockToAddLeaves(
 			}
 			l.Amt = out.Value
 			l.PkScript = out.PkScript
-			uleaf := accumulator.Leaf{Hash: l.LeafHash()}
-			if uint32(len(remember)) > txonum {
-				uleaf.Remember = remember[txonum]
-			}
-			leaves = append(leaves, uleaf)
+			f(txonum, &l)
 			txonum++
 		}
 	}
-	return
 }
 
 // UBlock is a regular block, with Udata stuck on
@@ -151,6 +448,23 @@ func (ub *UBlock) ProofSanity(nl uint64, h uint8) error {
 	return nil
 }
 
+// CheckLeafBlockHashes makes sure every leaf in the udata commits to the
+// hash of the block that created it, or to nothing if it was created before
+// the switch-over height.
+func (ub *UBlock) CheckLeafBlockHashes(blockHashes *btcacc.BlockHashIndex) error {
+	for _, ld := range ub.UtreexoData.Stxos {
+		bh, err := blockHashes.LeafBlockHash(ld.Height)
+		if err != nil {
+			return err
+		}
+		if bh != ld.BlockHash {
+			return fmt.Errorf("height %d leaf %s has block hash %x, expected %x",
+				ub.UtreexoData.Height, ld.OPString(), ld.BlockHash, bh)
+		}
+	}
+	return nil
+}
+
 // ToUtxoView converts a UData into a btcd blockchain.UtxoViewpoint
 // all the data is there, just a bit different format.
 // Note that this needs blockchain.NewUtxoEntry() in btcd
@@ -172,11 +486,26 @@ func (ub *UBlock) ToUtxoView() *blockchain.UtxoViewpoint {
 	return v
 }
 
-// CheckBlock does all internal block checks for a UBlock
-// right now checks the signatures
-func (ub *UBlock) CheckBlock(outskip []uint32, p *chaincfg.Params) bool {
+// CheckBlock does all internal block checks for a UBlock: the context-free
+// block checks, the checks that depend on height (BIP34 etc), the inputs of
+// every transaction, and that the coinbase doesn't claim more than the subsidy
+// plus fees.  If checkSigs is set, it also validates all the scripts.
+// Any consensus failure comes back as a RuleError.
+func (ub *UBlock) CheckBlock(
+	outskip []uint32, p *chaincfg.Params, checkSigs bool) error {
 	// NOTE Whatever happens here is done a million times
 	// be efficient here
+	height := ub.UtreexoData.Height
+
+	err := checkBlockSanity(ub.Block, height, p)
+	if err != nil {
+		return err
+	}
+	err = checkBlockContext(ub.Block, height, p)
+	if err != nil {
+		return err
+	}
+
 	view := ub.ToUtxoView()
 	viewMap := view.Entries()
 	var txonum uint32
@@ -188,7 +517,7 @@ func (ub *UBlock) CheckBlock(outskip []uint32, p *chaincfg.Params) bool {
 		outputsInTx := uint32(len(tx.MsgTx().TxOut))
 		if txnum == 0 {
 			txonum += outputsInTx
-			continue // skip checks for coinbase TX for now.  Or maybe it'll work?
+			continue // coinbase outputs can't be spent in the same block
 		}
 		/* add txos to the UtxoView if they're also consumed in this block
 		(will be on the output skiplist from DedupeBlock)
@@ -208,36 +537,48 @@ func (ub *UBlock) CheckBlock(outskip []uint32, p *chaincfg.Params) bool {
 		txonum += outputsInTx
 	}
 
+	// each tx writes its fee and error to its own slot, so no locking
+	txs := ub.Block.Transactions()
+	fees := make([]int64, len(txs))
+	errs := make([]error, len(txs))
+
 	var wg sync.WaitGroup
-	wg.Add(len(ub.Block.Transactions()) - 1) // subtract coinbase
-	for txnum, tx := range ub.Block.Transactions() {
+	wg.Add(len(txs) - 1) // subtract coinbase
+	for txnum, tx := range txs {
 		if txnum == 0 {
-			continue // skip checks for coinbase TX for now.  Or maybe it'll work?
+			continue // coinbase has no inputs; checked with the fees below
 		}
-		go func(w *sync.WaitGroup, tx *btcutil.Tx) {
-			// hardcoded testnet3 for now
-			_, err := blockchain.CheckTransactionInputs(
-				tx, ub.UtreexoData.Height, view, p)
-			if err != nil {
-				fmt.Printf("Tx %s fails CheckTransactionInputs: %s\n",
-					tx.Hash().String(), err.Error())
-				panic(err)
+		go func(w *sync.WaitGroup, txnum int, tx *btcutil.Tx) {
+			defer w.Done()
+			fees[txnum], errs[txnum] = blockchain.CheckTransactionInputs(
+				tx, height, view, p)
+			if errs[txnum] != nil || !checkSigs {
+				return
 			}
 
 			// no scriptflags for now
-			err = blockchain.ValidateTransactionScripts(
+			errs[txnum] = blockchain.ValidateTransactionScripts(
 				tx, view, 0, sigCache, hashCache)
-			if err != nil {
-				fmt.Printf("Tx %s fails ValidateTransactionScripts: %s\n",
-					tx.Hash().String(), err.Error())
-				panic(err)
-			}
-			w.Done()
-		}(&wg, tx)
+		}(&wg, txnum, tx)
 	}
 	wg.Wait()
 
-	return true
+	var totalFees int64
+	for txnum, tx := range txs {
+		if errs[txnum] != nil {
+			return txError(height, tx, errs[txnum])
+		}
+		// CheckTransactionInputs caps each fee at MaxSatoshi, so this
+		// only overflows if something's very wrong
+		lastTotal := totalFees
+		totalFees += fees[txnum]
+		if totalFees < lastTotal {
+			return ruleError(height, blockchain.ErrBadFees,
+				"total fees overflow")
+		}
+	}
+
+	return checkCoinbaseValue(ub.Block, height, totalFees, p)
 }
 
 /*